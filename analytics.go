@@ -0,0 +1,477 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// analyticsDefaultDays は利用状況の分析の既定の集計日数です
+	analyticsDefaultDays = 90
+	// analyticsMaxDays は一度に集計できる最大の日数です
+	analyticsMaxDays = 731
+	// analyticsStudentLimit は分析ページに表示する寮生の人数です (CSV・API は全員)
+	analyticsStudentLimit = 20
+)
+
+// analyticsIntervals は推移の集計単位です
+var analyticsIntervals = []struct {
+	Name  string
+	Label string
+}{
+	{"day", "日"},
+	{"week", "週"},
+	{"month", "月"},
+}
+
+// analyticsStudentSorts は寮生ごとの集計の並べ替えに使う列です
+var analyticsStudentSorts = []struct {
+	Name  string
+	Label string
+	Order string
+}{
+	{"overnight", "外泊が多い順", "overnights DESC, skipped DESC"},
+	{"skipped", "欠食が多い順", "skipped DESC, overnights DESC"},
+	{"late", "門限後の帰寮が多い順", "late_returns DESC, overnights DESC"},
+	{"unregistered", "記録のない日が多い順", "unregistered DESC, overnights DESC"},
+}
+
+// AnalyticsQuery は利用状況の分析の条件です
+type AnalyticsQuery struct {
+	From     time.Time
+	To       time.Time
+	Interval string // day / week / month
+	Filter   LocationFilter
+	Sort     string // 寮生ごとの集計の並べ替え
+}
+
+// parseAnalyticsQuery はクエリパラメータから分析の条件を読み込みます (既定は今日までの90日間・週ごと)
+func parseAnalyticsQuery(c echo.Context) AnalyticsQuery {
+	q := AnalyticsQuery{
+		To:       time.Now(),
+		Interval: "week",
+		Filter:   parseLocationFilter(c),
+		Sort:     analyticsStudentSorts[0].Name,
+	}
+	if d, err := time.ParseInLocation("2006-01-02", c.QueryParam("to"), time.Local); err == nil {
+		q.To = d
+	}
+	q.From = q.To.AddDate(0, 0, -(analyticsDefaultDays - 1))
+	if d, err := time.ParseInLocation("2006-01-02", c.QueryParam("from"), time.Local); err == nil {
+		q.From = d
+	}
+	if q.From.After(q.To) {
+		q.From, q.To = q.To, q.From
+	}
+	if q.To.Sub(q.From) > analyticsMaxDays*24*time.Hour {
+		q.From = q.To.AddDate(0, 0, -(analyticsMaxDays - 1))
+	}
+	for _, i := range analyticsIntervals {
+		if c.QueryParam("interval") == i.Name {
+			q.Interval = i.Name
+		}
+	}
+	for _, s := range analyticsStudentSorts {
+		if c.QueryParam("sort") == s.Name {
+			q.Sort = s.Name
+		}
+	}
+	return q
+}
+
+// CSVURL は同じ条件で集計 report を CSV で書き出すURLです
+func (q AnalyticsQuery) CSVURL(report string) string {
+	v := url.Values{}
+	v.Set("report", report)
+	v.Set("from", q.From.Format("2006-01-02"))
+	v.Set("to", q.To.Format("2006-01-02"))
+	v.Set("interval", q.Interval)
+	v.Set("sort", q.Sort)
+	if q.Filter.BuildingID > 0 {
+		v.Set("building", strconv.Itoa(q.Filter.BuildingID))
+	}
+	if q.Filter.FloorID > 0 {
+		v.Set("floor", strconv.Itoa(q.Filter.FloorID))
+	}
+	return "/admin/analytics.csv?" + v.Encode()
+}
+
+// AnalyticsBucket は期間・曜日・フロア・学年などでまとめた利用状況です
+// 寮生日数は閉寮日を除いた「寮生 × 日」の数で、外泊率の分母にします
+// 食事ごとの提供数は提供される日の寮生日数で、喫食率の分母にします
+type AnalyticsBucket struct {
+	Key             string `json:"key"`
+	Label           string `json:"label"`
+	ResidentDays    int    `json:"resident_days"`
+	Overnights      int    `json:"overnights"`
+	BreakfastServed int    `json:"breakfast_served"`
+	BreakfastEaten  int    `json:"breakfast_eaten"`
+	LunchServed     int    `json:"lunch_served"`
+	LunchEaten      int    `json:"lunch_eaten"`
+	DinnerServed    int    `json:"dinner_served"`
+	DinnerEaten     int    `json:"dinner_eaten"`
+}
+
+// percent は割合を百分率で返します (分母が0のときは0)
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+// OvernightRate と BreakfastRate などは外泊率・食事ごとの喫食率 (%) を返します
+func (b AnalyticsBucket) OvernightRate() float64 { return percent(b.Overnights, b.ResidentDays) }
+func (b AnalyticsBucket) BreakfastRate() float64 { return percent(b.BreakfastEaten, b.BreakfastServed) }
+func (b AnalyticsBucket) LunchRate() float64     { return percent(b.LunchEaten, b.LunchServed) }
+func (b AnalyticsBucket) DinnerRate() float64    { return percent(b.DinnerEaten, b.DinnerServed) }
+
+// MealRate は3食を合わせた喫食率 (%) を返します
+func (b AnalyticsBucket) MealRate() float64 {
+	return percent(b.BreakfastEaten+b.LunchEaten+b.DinnerEaten, b.BreakfastServed+b.LunchServed+b.DinnerServed)
+}
+
+// StudentAnalytics は寮生ごとの利用状況です
+type StudentAnalytics struct {
+	StudentID    string `json:"student_id"`
+	Name         string `json:"name"`
+	Grade        int    `json:"grade"`
+	Overnights   int    `json:"overnights"`
+	MealsServed  int    `json:"meals_served"`
+	MealsEaten   int    `json:"meals_eaten"`
+	Skipped      int    `json:"skipped"` // 提供される食事のうち欠食した数
+	LateReturns  int    `json:"late_returns"`
+	Unregistered int    `json:"unregistered"` // 記録のない日の数
+}
+
+// MealRate は喫食率 (%) を返します
+func (s StudentAnalytics) MealRate() float64 { return percent(s.MealsEaten, s.MealsServed) }
+
+// AnalyticsReport は利用状況の分析の結果です (API でもこの形で返します)
+type AnalyticsReport struct {
+	From     string             `json:"from"`
+	To       string             `json:"to"`
+	Interval string             `json:"interval"`
+	Total    AnalyticsBucket    `json:"total"`
+	Series   []AnalyticsBucket  `json:"series"`
+	Weekdays []AnalyticsBucket  `json:"weekdays"`
+	Floors   []AnalyticsBucket  `json:"floors"`
+	Grades   []AnalyticsBucket  `json:"grades"`
+	Students []StudentAnalytics `json:"students"`
+}
+
+// analyticsDimension は利用状況をまとめる単位です
+type analyticsDimension struct {
+	group string              // GROUP BY の式
+	key   string              // 結果の見出しにする式 (text)
+	order string              // ORDER BY の式
+	label func(string) string // 見出しの表示名
+}
+
+// seriesDimension は期間の推移を集計単位 interval (day / week / month) でまとめます
+func seriesDimension(interval string) analyticsDimension {
+	trunc := "date_trunc('" + interval + "', d)::date"
+	return analyticsDimension{
+		group: trunc,
+		key:   "to_char(" + trunc + ", 'YYYY-MM-DD')",
+		order: trunc,
+		label: func(key string) string {
+			t, err := time.ParseInLocation("2006-01-02", key, time.Local)
+			if err != nil {
+				return key
+			}
+			switch interval {
+			case "month":
+				return t.Format("2006/01")
+			case "week":
+				return t.Format("01/02") + "〜"
+			}
+			return t.Format("01/02") + " (" + japaneseWeekday(t) + ")"
+		},
+	}
+}
+
+var (
+	// totalDimension は期間全体を1つにまとめます
+	totalDimension = analyticsDimension{group: "()", key: "''", order: "1", label: func(string) string { return "合計" }}
+
+	// weekdayDimension は曜日 (月曜始まり) ごとにまとめます
+	weekdayDimension = analyticsDimension{
+		group: "EXTRACT(ISODOW FROM d)",
+		key:   "EXTRACT(ISODOW FROM d)::int::text",
+		order: "EXTRACT(ISODOW FROM d)",
+		label: func(key string) string {
+			n, err := strconv.Atoi(key)
+			if err != nil {
+				return key
+			}
+			return [...]string{"日", "月", "火", "水", "木", "金", "土"}[n%7]
+		},
+	}
+
+	// floorDimension はその日の部屋の棟・フロアごとにまとめます
+	floorDimension = analyticsDimension{
+		group: "b.name, f.sort_order, f.name",
+		key:   "COALESCE(b.name || ' ' || f.name, '')",
+		order: "b.name ASC NULLS LAST, f.sort_order ASC, f.name ASC",
+		label: func(key string) string {
+			if key == "" {
+				return "部屋未割り当て"
+			}
+			return key
+		},
+	}
+
+	// gradeDimension は学年ごとにまとめます
+	gradeDimension = analyticsDimension{
+		group: "u.grade",
+		key:   "u.grade::text",
+		order: "NULLIF(u.grade, 0) ASC NULLS LAST",
+		label: func(key string) string {
+			if key == "0" {
+				return "未登録"
+			}
+			return key + "年"
+		},
+	}
+)
+
+// analyticsFromSQL は期間内の「日 × その日に在寮していた寮生」に、その日の部屋・記録・行事予定を結合します ($1, $2 が期間)
+// 在寮していたかは食数・食費と同じ residentOnDaySQL で判断するため、卒業・退寮して無効にした寮生も在寮していた期間は含みます
+// 記録のない日は、全ての食事を食べ外泊しないものとして数えます (食数の集計と同じ扱い)
+// WHERE 句で終わるため、条件は AND で続けます
+func analyticsFromSQL() string {
+	return `
+	FROM generate_series($1::date, $2::date, INTERVAL '1 day') AS d
+	JOIN users u ON ` + residentRolesSQL + locationJoinSQL("d::date") + `
+	LEFT JOIN gaihaku_kesshoku_records r ON r.student_id = u.username AND r.record_date = d::date` + dormCalendarJoinSQL("d::date") + `
+	WHERE ` + residentOnDaySQL("d::date")
+}
+
+// analyticsOpenSQL は閉寮日でないことを表す条件です
+const analyticsOpenSQL = "COALESCE(dc.kind, '') <> '" + DayClosed + "'"
+
+// getAnalyticsBuckets は期間内の利用状況を dim の単位でまとめて集計します
+// 対象は各日に在寮していた寮生で、フロアは各日の部屋割りで数えます
+func getAnalyticsBuckets(db *sql.DB, q AnalyticsQuery, dim analyticsDimension) ([]AnalyticsBucket, error) {
+	args := []interface{}{q.From.Format("2006-01-02"), q.To.Format("2006-01-02")}
+	where := q.Filter.where(&args)
+	rows, err := db.Query(`
+	SELECT `+dim.key+`,
+		COUNT(*) FILTER (WHERE `+analyticsOpenSQL+`),
+		COUNT(*) FILTER (WHERE `+analyticsOpenSQL+` AND `+countedOvernightSQL+`),
+		COUNT(*) FILTER (WHERE `+mealServedSQL("breakfast")+`),
+		COUNT(*) FILTER (WHERE `+mealEatenSQL("breakfast")+`),
+		COUNT(*) FILTER (WHERE `+mealServedSQL("lunch")+`),
+		COUNT(*) FILTER (WHERE `+mealEatenSQL("lunch")+`),
+		COUNT(*) FILTER (WHERE `+mealServedSQL("dinner")+`),
+		COUNT(*) FILTER (WHERE `+mealEatenSQL("dinner")+`)`+
+		analyticsFromSQL()+where+`
+	GROUP BY `+dim.group+`
+	ORDER BY `+dim.order, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query analytics: %w", err)
+	}
+	defer rows.Close()
+
+	var buckets []AnalyticsBucket
+	for rows.Next() {
+		var b AnalyticsBucket
+		if err := rows.Scan(&b.Key, &b.ResidentDays, &b.Overnights, &b.BreakfastServed, &b.BreakfastEaten,
+			&b.LunchServed, &b.LunchEaten, &b.DinnerServed, &b.DinnerEaten); err != nil {
+			log.Printf("Failed to scan analytics: %v", err)
+			continue
+		}
+		b.Label = dim.label(b.Key)
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
+
+// getStudentAnalytics は期間内の利用状況を寮生ごとに集計し、sort の順に limit 人分返します (0 は全員)
+func getStudentAnalytics(db *sql.DB, q AnalyticsQuery, limit int) ([]StudentAnalytics, error) {
+	order := analyticsStudentSorts[0].Order
+	for _, s := range analyticsStudentSorts {
+		if s.Name == q.Sort {
+			order = s.Order
+		}
+	}
+	args := []interface{}{q.From.Format("2006-01-02"), q.To.Format("2006-01-02")}
+	where := q.Filter.where(&args)
+	query := `
+	SELECT u.username, ` + userNameSQL + `, u.grade,
+		COUNT(*) FILTER (WHERE ` + analyticsOpenSQL + ` AND ` + countedOvernightSQL + `) AS overnights,
+		COUNT(*) FILTER (WHERE ` + mealServedSQL("breakfast") + `) + COUNT(*) FILTER (WHERE ` + mealServedSQL("lunch") + `)
+			+ COUNT(*) FILTER (WHERE ` + mealServedSQL("dinner") + `) AS served,
+		COUNT(*) FILTER (WHERE ` + mealEatenSQL("breakfast") + `) + COUNT(*) FILTER (WHERE ` + mealEatenSQL("lunch") + `)
+			+ COUNT(*) FILTER (WHERE ` + mealEatenSQL("dinner") + `) AS eaten,
+		COUNT(*) FILTER (WHERE ` + mealServedSQL("breakfast") + ` AND NOT ` + mealEatenSQL("breakfast") + `)
+			+ COUNT(*) FILTER (WHERE ` + mealServedSQL("lunch") + ` AND NOT ` + mealEatenSQL("lunch") + `)
+			+ COUNT(*) FILTER (WHERE ` + mealServedSQL("dinner") + ` AND NOT ` + mealEatenSQL("dinner") + `) AS skipped,
+		COUNT(*) FILTER (WHERE COALESCE(r.late_return, FALSE)) AS late_returns,
+		COUNT(*) FILTER (WHERE ` + analyticsOpenSQL + ` AND r.student_id IS NULL) AS unregistered` +
+		analyticsFromSQL() + where + `
+	GROUP BY u.id
+	ORDER BY ` + order + `, u.username ASC`
+	if limit > 0 {
+		args = append(args, limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query student analytics: %w", err)
+	}
+	defer rows.Close()
+
+	var students []StudentAnalytics
+	for rows.Next() {
+		var s StudentAnalytics
+		if err := rows.Scan(&s.StudentID, &s.Name, &s.Grade, &s.Overnights, &s.MealsServed, &s.MealsEaten,
+			&s.Skipped, &s.LateReturns, &s.Unregistered); err != nil {
+			log.Printf("Failed to scan student analytics: %v", err)
+			continue
+		}
+		students = append(students, s)
+	}
+	return students, nil
+}
+
+// getAnalyticsReport は期間全体・推移・曜日・フロア・学年・寮生ごとの利用状況をまとめて集計します
+func getAnalyticsReport(db *sql.DB, q AnalyticsQuery, studentLimit int) (AnalyticsReport, error) {
+	report := AnalyticsReport{
+		From:     q.From.Format("2006-01-02"),
+		To:       q.To.Format("2006-01-02"),
+		Interval: q.Interval,
+	}
+	total, err := getAnalyticsBuckets(db, q, totalDimension)
+	if err != nil {
+		return report, err
+	}
+	if len(total) > 0 {
+		report.Total = total[0]
+	}
+	for _, part := range []struct {
+		dest *[]AnalyticsBucket
+		dim  analyticsDimension
+	}{
+		{&report.Series, seriesDimension(q.Interval)},
+		{&report.Weekdays, weekdayDimension},
+		{&report.Floors, floorDimension},
+		{&report.Grades, gradeDimension},
+	} {
+		if *part.dest, err = getAnalyticsBuckets(db, q, part.dim); err != nil {
+			return report, err
+		}
+	}
+	report.Students, err = getStudentAnalytics(db, q, studentLimit)
+	return report, err
+}
+
+// adminAnalyticsHandler は食事・外泊の利用状況の分析ページを表示します
+func adminAnalyticsHandler(c echo.Context) error {
+	q := parseAnalyticsQuery(c)
+	report, err := getAnalyticsReport(db, q, analyticsStudentLimit)
+	if err != nil {
+		log.Printf("Failed to get analytics: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to retrieve analytics.")
+	}
+	floors, err := getFloors(db)
+	if err != nil {
+		log.Printf("Failed to get floors: %v", err)
+	}
+
+	return c.Render(http.StatusOK, "admin_analytics.html", map[string]interface{}{
+		"query":     q,
+		"report":    report,
+		"intervals": analyticsIntervals,
+		"sorts":     analyticsStudentSorts,
+		"floors":    floors,
+		"filter":    q.Filter,
+	})
+}
+
+// adminAnalyticsAPIHandler は利用状況の分析結果を JSON で返します (寮生ごとの集計は全員分)
+func adminAnalyticsAPIHandler(c echo.Context) error {
+	report, err := getAnalyticsReport(db, parseAnalyticsQuery(c), 0)
+	if err != nil {
+		log.Printf("Failed to get analytics: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "集計できませんでした。"})
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+// adminAnalyticsCSVHandler は利用状況の集計 (report: series / weekday / floor / grade / students) を CSV で書き出します
+func adminAnalyticsCSVHandler(c echo.Context) error {
+	q := parseAnalyticsQuery(c)
+	report := c.QueryParam("report")
+
+	var header []string
+	var records [][]string
+	if report == "students" {
+		students, err := getStudentAnalytics(db, q, 0)
+		if err != nil {
+			log.Printf("Failed to get student analytics: %v", err)
+			return c.String(http.StatusInternalServerError, "Failed to retrieve analytics.")
+		}
+		header = []string{"学籍番号", "氏名", "学年", "外泊", "提供された食事", "喫食", "欠食", "喫食率(%)", "門限後の帰寮", "記録のない日"}
+		for _, s := range students {
+			records = append(records, []string{s.StudentID, s.Name, strconv.Itoa(s.Grade), strconv.Itoa(s.Overnights),
+				strconv.Itoa(s.MealsServed), strconv.Itoa(s.MealsEaten), strconv.Itoa(s.Skipped), formatPercent(s.MealRate()),
+				strconv.Itoa(s.LateReturns), strconv.Itoa(s.Unregistered)})
+		}
+	} else {
+		dims := map[string]analyticsDimension{
+			"series":  seriesDimension(q.Interval),
+			"weekday": weekdayDimension,
+			"floor":   floorDimension,
+			"grade":   gradeDimension,
+		}
+		dim, ok := dims[report]
+		if !ok {
+			return c.String(http.StatusBadRequest, "Invalid report.")
+		}
+		buckets, err := getAnalyticsBuckets(db, q, dim)
+		if err != nil {
+			log.Printf("Failed to get analytics: %v", err)
+			return c.String(http.StatusInternalServerError, "Failed to retrieve analytics.")
+		}
+		header = []string{"区分", "寮生日数", "外泊", "外泊率(%)", "朝食提供", "朝食喫食", "朝食喫食率(%)",
+			"昼食提供", "昼食喫食", "昼食喫食率(%)", "夕食提供", "夕食喫食", "夕食喫食率(%)"}
+		for _, b := range buckets {
+			key := b.Label
+			if report == "series" {
+				key = b.Key
+			}
+			records = append(records, []string{key, strconv.Itoa(b.ResidentDays), strconv.Itoa(b.Overnights), formatPercent(b.OvernightRate()),
+				strconv.Itoa(b.BreakfastServed), strconv.Itoa(b.BreakfastEaten), formatPercent(b.BreakfastRate()),
+				strconv.Itoa(b.LunchServed), strconv.Itoa(b.LunchEaten), formatPercent(b.LunchRate()),
+				strconv.Itoa(b.DinnerServed), strconv.Itoa(b.DinnerEaten), formatPercent(b.DinnerRate())})
+		}
+	}
+
+	filename := fmt.Sprintf("analytics_%s_%s_%s.csv", report, q.From.Format("20060102"), q.To.Format("20060102"))
+	c.Response().Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="`+filename+`"`)
+	c.Response().WriteHeader(http.StatusOK)
+	// Excel で文字化けしないよう BOM を付けます
+	if _, err := c.Response().Write([]byte("\ufeff")); err != nil {
+		return err
+	}
+	w := csv.NewWriter(c.Response())
+	w.Write(header)
+	w.WriteAll(records)
+	return w.Error()
+}
+
+// formatPercent は百分率を小数点以下1桁の文字列にします
+func formatPercent(p float64) string {
+	return strconv.FormatFloat(p, 'f', 1, 64)
+}
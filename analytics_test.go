@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// 利用状況の分析は、食数と同じ寮生を在寮していたものとして数える
+func TestAnalyticsCountsTheSameResidentsAsMealCounts(t *testing.T) {
+	db := openTestDB(t)
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	mustExec(t, db, `INSERT INTO users (username, password, role, active, grade) VALUES
+		('unassigned', 'x', 'user', TRUE, 1),
+		('assigned', 'x', 'user', TRUE, 2),
+		('moved_out', 'x', 'user', TRUE, 2),
+		('graduated', 'x', 'user', FALSE, 4)`)
+	mustExec(t, db, `INSERT INTO buildings (id, name) VALUES (1, '北')`)
+	mustExec(t, db, `INSERT INTO floors (id, building_id, name) VALUES (1, 1, '1F')`)
+	mustExec(t, db, `INSERT INTO rooms (id, floor_id, number, capacity) VALUES (1, 1, '101', 4)`)
+	mustExec(t, db, `INSERT INTO room_assignments (student_id, room_id, start_date, end_date) VALUES
+		('assigned', 1, CURRENT_DATE - 10, NULL),
+		('moved_out', 1, CURRENT_DATE - 10, CURRENT_DATE - 3),
+		('graduated', 1, CURRENT_DATE - 10, NULL)`)
+	mustExec(t, db, `INSERT INTO gaihaku_kesshoku_records (student_id, record_date, breakfast, lunch, dinner) VALUES
+		('assigned', CURRENT_DATE - 1, FALSE, TRUE, TRUE)`)
+
+	from := today.AddDate(0, 0, -5)
+	counts, err := getMealCounts(db, from, 6, LocationFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var residentDays, breakfasts int
+	for _, m := range counts {
+		residentDays += m.Residents
+		breakfasts += m.Breakfast
+	}
+
+	buckets, err := getAnalyticsBuckets(db, AnalyticsQuery{From: from, To: today}, totalDimension)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 1 {
+		t.Fatalf("got %d total buckets, want 1", len(buckets))
+	}
+	if b := buckets[0]; b.ResidentDays != residentDays || b.BreakfastEaten != breakfasts {
+		t.Errorf("analytics: %d resident days, %d breakfasts; meal counts: %d and %d", b.ResidentDays, b.BreakfastEaten, residentDays, breakfasts)
+	}
+	// unassigned と assigned は6日、moved_out は2日 (終了日を含まない)、graduated は今日を除く5日
+	if residentDays != 6+6+2+5 {
+		t.Errorf("resident days = %d, want %d", residentDays, 6+6+2+5)
+	}
+}
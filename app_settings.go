@@ -0,0 +1,149 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 設定項目のキー
+const (
+	settingStaffApproval     = "overnight.staff_approval" // 外泊に寮監督者の承認を必要とするか ("true" / "false")
+	settingCurfew            = "dorm.curfew"              // 門限の時刻 ("HH:MM")
+	settingPriceBreakfast    = "billing.price.breakfast"  // 朝食の単価 (円)
+	settingPriceLunch        = "billing.price.lunch"      // 昼食の単価 (円)
+	settingPriceDinner       = "billing.price.dinner"     // 夕食の単価 (円)
+	settingGuestMaxPerOrder  = "guest.max_per_order"      // 寮生1人が1回の食事に申し込める来客の人数
+	settingGuestMaxPerMeal   = "guest.max_per_meal"       // 1回の食事の来客の合計人数 (0 は上限なし)
+	settingGuestDeadlineDays = "guest.deadline_days"      // 来客の食事の申し込みの締め切り (何日前)
+	settingGuestDeadlineTime = "guest.deadline_time"      // 来客の食事の申し込みの締め切り (時刻 "HH:MM")
+)
+
+// createAppSettingsTable は管理者が変更できる設定のテーブルを作成します
+func createAppSettingsTable(db *sql.DB) error {
+	const createTableSQL = `
+	CREATE TABLE IF NOT EXISTS app_settings (
+		key VARCHAR(100) PRIMARY KEY,
+		value TEXT NOT NULL,
+		updated_by VARCHAR(50),
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	_, err := db.Exec(createTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to execute SQL: %w", err)
+	}
+
+	return nil
+}
+
+// getSetting は設定値を取得します。未設定の場合や取得に失敗した場合は def を返します
+func getSetting(db *sql.DB, key, def string) string {
+	var value string
+	err := db.QueryRow("SELECT value FROM app_settings WHERE key = $1", key).Scan(&value)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to get setting %s: %v", key, err)
+		}
+		return def
+	}
+	return value
+}
+
+// getBoolSetting は真偽値の設定を取得します
+func getBoolSetting(db *sql.DB, key string, def bool) bool {
+	b, err := strconv.ParseBool(getSetting(db, key, strconv.FormatBool(def)))
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+// getIntSetting は整数の設定を取得します
+func getIntSetting(db *sql.DB, key string, def int) int {
+	n, err := strconv.Atoi(getSetting(db, key, strconv.Itoa(def)))
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// setSetting は設定値を保存します
+func setSetting(db *sql.DB, key, value, updatedBy string) error {
+	_, err := db.Exec(`INSERT INTO app_settings (key, value, updated_by) VALUES ($1, $2, $3)
+	ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, updated_by = EXCLUDED.updated_by, updated_at = CURRENT_TIMESTAMP`,
+		key, value, updatedBy)
+	if err != nil {
+		return fmt.Errorf("failed to save setting %s: %w", key, err)
+	}
+	return nil
+}
+
+// adminSettingsHandler は寮の運用に関する設定ページを表示します
+func adminSettingsHandler(c echo.Context) error {
+	return c.Render(http.StatusOK, "admin_settings.html", map[string]interface{}{
+		"staffApproval":  getBoolSetting(db, settingStaffApproval, false),
+		"curfew":         getCurfew(db),
+		"prices":         getMealPrices(db),
+		"guestRules":     getGuestRules(db),
+		"successMessage": popFlash(c, "app_settings_success"),
+	})
+}
+
+// adminUpdateSettingsHandler は寮の運用に関する設定を保存します
+func adminUpdateSettingsHandler(c echo.Context) error {
+	user := currentUser(c)
+	staffApproval := c.FormValue("staff_approval") == "on"
+	curfew := c.FormValue("curfew")
+	if _, err := time.Parse(clockLayout, curfew); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid curfew time.")
+	}
+	settings := map[string]string{
+		settingStaffApproval: strconv.FormatBool(staffApproval),
+		settingCurfew:        curfew,
+	}
+	for _, field := range []struct{ name, key string }{
+		{"price_breakfast", settingPriceBreakfast},
+		{"price_lunch", settingPriceLunch},
+		{"price_dinner", settingPriceDinner},
+	} {
+		price, err := strconv.Atoi(c.FormValue(field.name))
+		if err != nil || price < 0 || price > maxMealPrice {
+			return c.String(http.StatusBadRequest, "Invalid meal price.")
+		}
+		settings[field.key] = strconv.Itoa(price)
+	}
+	for _, field := range []struct {
+		name, key string
+		min, max  int
+	}{
+		{"guest_max_per_order", settingGuestMaxPerOrder, 1, 20},
+		{"guest_max_per_meal", settingGuestMaxPerMeal, 0, 1000},
+		{"guest_deadline_days", settingGuestDeadlineDays, 0, 14},
+	} {
+		n, err := strconv.Atoi(c.FormValue(field.name))
+		if err != nil || n < field.min || n > field.max {
+			return c.String(http.StatusBadRequest, "Invalid guest meal setting.")
+		}
+		settings[field.key] = strconv.Itoa(n)
+	}
+	guestDeadlineTime := c.FormValue("guest_deadline_time")
+	if _, err := time.Parse(clockLayout, guestDeadlineTime); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid guest meal deadline.")
+	}
+	settings[settingGuestDeadlineTime] = guestDeadlineTime
+	for key, value := range settings {
+		if err := setSetting(db, key, value, user.Username); err != nil {
+			log.Printf("Failed to update settings: %v", err)
+			return c.String(http.StatusInternalServerError, "Failed to save settings.")
+		}
+	}
+	log.Printf("Settings updated by %s", user.Username)
+
+	return redirectWithFlash(c, "/admin/settings", "設定を保存しました。", true, "app_settings_success", "app_settings_error")
+}
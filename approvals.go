@@ -0,0 +1,212 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// getPreviousOvernight は保存する前の外泊の内容と承認状況をトランザクションの中で読み込み、行をロックします
+// 記録がない場合は nil を返します
+func getPreviousOvernight(q queryRower, r *GaihakuKesshokuRecord) (*GaihakuKesshokuRecord, error) {
+	var prev GaihakuKesshokuRecord
+	var expectedReturn sql.NullTime
+	err := q.QueryRow(`SELECT overnight, destination, stay_phone, expected_return, guardian_status, staff_status
+	FROM gaihaku_kesshoku_records WHERE student_id = $1 AND record_date = $2 FOR UPDATE`,
+		r.StudentID, r.RecordDate.Format("2006-01-02")).Scan(&prev.Overnight, &prev.Destination, &prev.StayPhone, &expectedReturn, &prev.GuardianStatus, &prev.StaffStatus)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get previous overnight for %s: %w", r.RecordDate.Format("2006-01-02"), err)
+	}
+	if expectedReturn.Valid {
+		prev.ExpectedReturn = &expectedReturn.Time
+	}
+	return &prev, nil
+}
+
+// needsStaffApproval は保存する外泊 r を寮監督者の承認待ちにする必要があるかを返します
+// prev は保存する前の記録 (getPreviousOvernight) で、内容が変わっていない外泊は承認状況をそのまま引き継ぎます
+func needsStaffApproval(prev, r *GaihakuKesshokuRecord) bool {
+	return r.Overnight && !(prev != nil && prev.Overnight && prev.StaffStatus != "" && sameOvernight(prev, r))
+}
+
+// errApprovalNotPending は承認待ちでない外泊 (外泊の登録がない・取り消された・既に判断済み) を承認・却下しようとした場合のエラーです
+var errApprovalNotPending = errors.New("overnight is not pending staff approval")
+
+// markStaffPending は外泊を寮監督者の承認待ちにし、以前の判断を消去します
+func markStaffPending(ex execer, studentID string, date time.Time) error {
+	_, err := ex.Exec(`UPDATE gaihaku_kesshoku_records SET staff_status = $3, staff_comment = '',
+		staff_decided_by = NULL, staff_decided_at = NULL
+	WHERE student_id = $1 AND record_date = $2 AND overnight`, studentID, date.Format("2006-01-02"), ApprovalPending)
+	if err != nil {
+		return fmt.Errorf("failed to update staff status: %w", err)
+	}
+	return nil
+}
+
+// decideStaffApproval は承認待ちの外泊を承認・却下します。外泊として数えるかが変わるため、厨房の画面に食数の変更を通知します
+// 承認待ちの外泊がない場合 (古い画面からの送信などで既に判断済みの場合を含む) は errApprovalNotPending を返し、何も変更しません
+func decideStaffApproval(db *sql.DB, studentID string, date time.Time, decision, comment, decidedBy string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE gaihaku_kesshoku_records SET staff_status = $3, staff_comment = $4,
+		staff_decided_by = $5, staff_decided_at = CURRENT_TIMESTAMP
+	WHERE student_id = $1 AND record_date = $2 AND overnight AND staff_status = $6`,
+		studentID, date.Format("2006-01-02"), decision, comment, decidedBy, ApprovalPending)
+	if err != nil {
+		return fmt.Errorf("failed to update staff status: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to update staff status: %w", err)
+	}
+	if n == 0 {
+		return errApprovalNotPending
+	}
+	if err := notifyCountChange(tx, date, date); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// getOvernightRequests は from 以降の外泊のうち、寮監督者の承認の対象になったものを取得します
+// status を指定すると、その承認状況のもののみを取得します
+func getOvernightRequests(db *sql.DB, from time.Time, status string) ([]OvernightRequest, error) {
+	rows, err := db.Query(`
+	SELECT r.student_id, `+userNameSQL+`, r.record_date, r.destination, r.stay_phone, r.expected_return,
+		r.guardian_status, r.staff_status, r.staff_comment, COALESCE(r.staff_decided_by, ''), r.staff_decided_at
+	FROM gaihaku_kesshoku_records r
+	JOIN users u ON u.username = r.student_id
+	WHERE r.overnight AND r.staff_status <> '' AND r.record_date >= $1 AND ($2 = '' OR r.staff_status = $2)
+	ORDER BY r.record_date ASC, r.student_id ASC`, from.Format("2006-01-02"), status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query overnight requests: %w", err)
+	}
+	defer rows.Close()
+
+	var requests []OvernightRequest
+	for rows.Next() {
+		var o OvernightRequest
+		var expectedReturn, decidedAt sql.NullTime
+		if err := rows.Scan(&o.StudentID, &o.StudentName, &o.RecordDate, &o.Destination, &o.StayPhone, &expectedReturn,
+			&o.GuardianStatus, &o.StaffStatus, &o.StaffComment, &o.DecidedBy, &decidedAt); err != nil {
+			log.Printf("Failed to scan overnight request: %v", err)
+			continue
+		}
+		if expectedReturn.Valid {
+			o.ExpectedReturn = &expectedReturn.Time
+		}
+		if decidedAt.Valid {
+			o.DecidedAt = &decidedAt.Time
+		}
+		requests = append(requests, o)
+	}
+	return requests, nil
+}
+
+// adminApprovalsHandler は寮監督者の承認待ちの外泊と、判断済みの今後の外泊を表示します
+func adminApprovalsHandler(c echo.Context) error {
+	requests, err := getOvernightRequests(db, time.Now(), "")
+	if err != nil {
+		log.Printf("Failed to get overnight requests: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to retrieve overnight requests.")
+	}
+	var pending, decided []OvernightRequest
+	for _, o := range requests {
+		if o.StaffStatus == ApprovalPending {
+			pending = append(pending, o)
+		} else {
+			decided = append(decided, o)
+		}
+	}
+
+	return c.Render(http.StatusOK, "admin_approvals.html", map[string]interface{}{
+		"pending":        pending,
+		"decided":        decided,
+		"enabled":        getBoolSetting(db, settingStaffApproval, false),
+		"successMessage": popFlash(c, "approvals_success"),
+		"errorMessage":   popFlash(c, "approvals_error"),
+	})
+}
+
+// adminDecideApprovalHandler は外泊を承認・却下し、結果を寮生に通知します
+func adminDecideApprovalHandler(c echo.Context) error {
+	studentID := c.FormValue("student_id")
+	date, err := time.ParseInLocation("2006-01-02", c.FormValue("record_date"), time.Local)
+	decision := c.FormValue("decision")
+	comment := strings.TrimSpace(c.FormValue("comment"))
+	if studentID == "" || err != nil || (decision != ApprovalApproved && decision != ApprovalRejected) {
+		return c.String(http.StatusBadRequest, "Invalid approval.")
+	}
+	if utf8.RuneCountInString(comment) > 500 {
+		return c.String(http.StatusBadRequest, "Comment is too long.")
+	}
+
+	staff := currentUser(c)
+	err = decideStaffApproval(db, studentID, date, decision, comment, staff.Username)
+	if errors.Is(err, errApprovalNotPending) {
+		// 判断済み・取り消し済みの外泊は変更せず、寮生にも通知しない
+		return redirectWithFlash(c, "/admin/approvals",
+			fmt.Sprintf("%s の %s の外泊は承認待ちではないため、変更しませんでした (既に判断済みか、取り消された可能性があります)。", studentID, date.Format("01/02")),
+			false, "approvals_success", "approvals_error")
+	}
+	if err != nil {
+		log.Printf("Failed to decide overnight of %s: %v", studentID, err)
+		return c.String(http.StatusInternalServerError, "Failed to save approval.")
+	}
+	log.Printf("Overnight of %s on %s %s by %s", studentID, date.Format("2006-01-02"), decision, staff.Username)
+
+	name := studentID
+	if student, err := getUserByUsername(db, studentID); err != nil {
+		log.Printf("Failed to get user %s: %v", studentID, err)
+	} else {
+		name = student.Name()
+		notifyStaffDecision(student, date, decision, comment)
+	}
+
+	return redirectWithFlash(c, "/admin/approvals",
+		fmt.Sprintf("%s さんの %s の外泊を%sしました。", name, date.Format("01/02"), staffStatusLabel(decision)),
+		true, "approvals_success", "approvals_error")
+}
+
+// notifyStaffDecision は外泊の承認結果を寮生のメールアドレスに通知します (未登録の場合は画面でのみ確認できます)
+func notifyStaffDecision(student *User, date time.Time, decision, comment string) {
+	if student.Email == "" {
+		return
+	}
+	subject := fmt.Sprintf("【外泊届】%s の外泊が%sされました", date.Format("01/02"), staffStatusLabel(decision))
+	body := fmt.Sprintf("%s さん\n\n%s (%s) の外泊届が%sされました。\n", student.Name(), date.Format("2006/01/02"), japaneseWeekday(date), staffStatusLabel(decision))
+	if comment != "" {
+		body += "\nコメント: " + comment + "\n"
+	}
+	body += "\n詳細は " + appBaseURL() + "/main で確認できます。\n"
+	if err := notifier.Send(student.Email, subject, body); err != nil {
+		log.Printf("Failed to notify %s of staff decision: %v", student.Username, err)
+	}
+}
+
+// staffStatusLabel は寮監督者の承認状況の表示名を返します
+func staffStatusLabel(status string) string {
+	switch status {
+	case ApprovalPending:
+		return "承認待ち"
+	case ApprovalApproved:
+		return "承認"
+	case ApprovalRejected:
+		return "却下"
+	}
+	return ""
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDecideStaffApprovalOnlyChangesPendingOvernights(t *testing.T) {
+	db := openTestDB(t)
+	date := time.Date(2024, 1, 10, 0, 0, 0, 0, time.Local)
+	mustExec(t, db, `INSERT INTO gaihaku_kesshoku_records (student_id, record_date, overnight, staff_status) VALUES
+		('s1', '2024-01-10', TRUE, 'pending'),
+		('s2', '2024-01-10', FALSE, '')`)
+
+	if err := decideStaffApproval(db, "s1", date, ApprovalApproved, "", "admin"); err != nil {
+		t.Fatalf("decide pending overnight: %v", err)
+	}
+	var status, decidedBy string
+	if err := db.QueryRow(`SELECT staff_status, staff_decided_by FROM gaihaku_kesshoku_records WHERE student_id = 's1'`).Scan(&status, &decidedBy); err != nil {
+		t.Fatal(err)
+	}
+	if status != ApprovalApproved || decidedBy != "admin" {
+		t.Fatalf("after approval: status=%q decided_by=%q", status, decidedBy)
+	}
+
+	// 古い画面から送られた判断で、判断済みの外泊を上書きしない
+	err := decideStaffApproval(db, "s1", date, ApprovalRejected, "stale", "staff2")
+	if !errors.Is(err, errApprovalNotPending) {
+		t.Errorf("deciding an approved overnight: err = %v, want errApprovalNotPending", err)
+	}
+	if err := db.QueryRow(`SELECT staff_status, staff_decided_by FROM gaihaku_kesshoku_records WHERE student_id = 's1'`).Scan(&status, &decidedBy); err != nil {
+		t.Fatal(err)
+	}
+	if status != ApprovalApproved || decidedBy != "admin" {
+		t.Errorf("stale decision overwrote the approval: status=%q decided_by=%q", status, decidedBy)
+	}
+
+	// 外泊の登録がない・記録がない日
+	if err := decideStaffApproval(db, "s2", date, ApprovalApproved, "", "admin"); !errors.Is(err, errApprovalNotPending) {
+		t.Errorf("deciding a day without overnight: err = %v, want errApprovalNotPending", err)
+	}
+	if err := decideStaffApproval(db, "s1", date.AddDate(0, 0, 1), ApprovalApproved, "", "admin"); !errors.Is(err, errApprovalNotPending) {
+		t.Errorf("deciding a wrong date: err = %v, want errApprovalNotPending", err)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// maxMealPrice は食費の単価として設定できる上限 (円) です
+const maxMealPrice = 100000
+
+// monthLayout は請求月の指定 (month) の形式です
+const monthLayout = "2006-01"
+
+// getMealPrices は食事ごとの単価を取得します
+func getMealPrices(db *sql.DB) MealPrices {
+	return MealPrices{
+		Breakfast: getIntSetting(db, settingPriceBreakfast, 0),
+		Lunch:     getIntSetting(db, settingPriceLunch, 0),
+		Dinner:    getIntSetting(db, settingPriceDinner, 0),
+	}
+}
+
+// BreakfastAmount は朝食の請求額 (円) を返します
+func (s BillingStatement) BreakfastAmount() int { return s.Breakfast * s.Prices.Breakfast }
+
+// LunchAmount は昼食の請求額 (円) を返します
+func (s BillingStatement) LunchAmount() int { return s.Lunch * s.Prices.Lunch }
+
+// DinnerAmount は夕食の請求額 (円) を返します
+func (s BillingStatement) DinnerAmount() int { return s.Dinner * s.Prices.Dinner }
+
+// Total は請求額の合計 (円) を返します
+func (s BillingStatement) Total() int {
+	return s.BreakfastAmount() + s.LunchAmount() + s.DinnerAmount() + s.GuestAmount
+}
+
+// addGuests は寮生の食費に加算する来客の食事の数と金額を加えます
+func (s *BillingStatement) addGuests(breakfast, lunch, dinner int) {
+	s.Guests += breakfast + lunch + dinner
+	s.GuestAmount += breakfast*s.Prices.Breakfast + lunch*s.Prices.Lunch + dinner*s.Prices.Dinner
+}
+
+// guestBillingSQL は期間 $1〜$2 に寮生の食費に加算する来客の食事の人数を、寮生ごと・食事ごとに gb として結合するSQLです
+// 食数と同じく、行事予定で提供しない食事と、申し込んだ寮生が在寮していない日の食事は数えません
+func guestBillingSQL() string {
+	return `
+	LEFT JOIN (
+		SELECT g.student_id,
+			COALESCE(SUM(g.guests) FILTER (WHERE g.meal = 'breakfast' AND ` + mealServedSQL("breakfast") + `), 0) AS breakfast,
+			COALESCE(SUM(g.guests) FILTER (WHERE g.meal = 'lunch' AND ` + mealServedSQL("lunch") + `), 0) AS lunch,
+			COALESCE(SUM(g.guests) FILTER (WHERE g.meal = 'dinner' AND ` + mealServedSQL("dinner") + `), 0) AS dinner
+		FROM guest_meals g
+		JOIN users u ON u.username = g.student_id` + locationJoinSQL("g.meal_date") + dormCalendarJoinSQL("g.meal_date") + `
+		WHERE g.payer = '` + GuestPayerStudent + `' AND g.meal_date BETWEEN $1::date AND $2::date AND ` + residentOnDaySQL("g.meal_date") + `
+		GROUP BY g.student_id
+	) gb ON gb.student_id = u.username`
+}
+
+// billedMealsSQL は日付 d に在寮していたかと、請求する朝食・昼食・夕食を表すSQLの列です
+var billedMealsSQL = residentOnDaySQL("d::date") + `,
+		` + residentOnDaySQL("d::date") + ` AND ` + mealEatenSQL("breakfast") + `,
+		` + residentOnDaySQL("d::date") + ` AND ` + mealEatenSQL("lunch") + `,
+		` + residentOnDaySQL("d::date") + ` AND ` + mealEatenSQL("dinner")
+
+// parseBillingMonth はクエリの month (YYYY-MM) を月初の日付に変換します。指定がなければ今月です
+func parseBillingMonth(c echo.Context) time.Time {
+	if m, err := time.ParseInLocation(monthLayout, c.QueryParam("month"), time.Local); err == nil {
+		return m
+	}
+	y, m, _ := time.Now().Date()
+	return time.Date(y, m, 1, 0, 0, 0, 0, time.Local)
+}
+
+// monthRange は月の初日と末日を返します
+func monthRange(month time.Time) (time.Time, time.Time) {
+	return month, month.AddDate(0, 1, -1)
+}
+
+// getBillingStatement は寮生の月の食費を日ごとの内訳とともに取得します
+// 在寮していた日 (residentOnDaySQL) のみ請求します。登録がない日は食べるものとし、行事予定で提供しない食事は請求しません
+func getBillingStatement(db *sql.DB, studentID string, month time.Time) (BillingStatement, error) {
+	from, to := monthRange(month)
+	s := BillingStatement{StudentID: studentID, Month: month, Prices: getMealPrices(db)}
+	rows, err := db.Query(`
+	SELECT d::date, `+billedMealsSQL+`, COALESCE(dc.kind, ''), COALESCE(dc.note, '')
+	FROM generate_series($1::date, $2::date, INTERVAL '1 day') AS d
+	JOIN users u ON u.username = $3`+locationJoinSQL("d::date")+`
+	LEFT JOIN gaihaku_kesshoku_records r ON r.student_id = u.username AND r.record_date = d::date`+dormCalendarJoinSQL("d::date")+`
+	ORDER BY d ASC`, from.Format("2006-01-02"), to.Format("2006-01-02"), studentID)
+	if err != nil {
+		return s, fmt.Errorf("failed to query billing: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d BillingDay
+		if err := rows.Scan(&d.Date, &d.Resident, &d.Breakfast, &d.Lunch, &d.Dinner, &d.Day.Kind, &d.Day.Note); err != nil {
+			log.Printf("Failed to scan billing day: %v", err)
+			continue
+		}
+		d.Day.Date = d.Date
+		if d.Breakfast {
+			s.Breakfast++
+		}
+		if d.Lunch {
+			s.Lunch++
+		}
+		if d.Dinner {
+			s.Dinner++
+		}
+		s.Days = append(s.Days, d)
+	}
+
+	guestMeals, err := getGuestMeals(db, studentID, from, to)
+	if err != nil {
+		return s, err
+	}
+	days := make(map[string]BillingDay, len(s.Days))
+	for _, d := range s.Days {
+		days[d.Date.Format("2006-01-02")] = d
+	}
+	for _, g := range guestMeals {
+		// 食数と同じく、在寮していない日と提供しない食事の来客は請求しない
+		d := days[g.Date.Format("2006-01-02")]
+		if g.Payer != GuestPayerStudent || !d.Resident || (g.Meal == "breakfast" && !d.Day.BreakfastServed()) || (g.Meal != "breakfast" && !d.Day.MealsServed()) {
+			continue
+		}
+		switch g.Meal {
+		case "breakfast":
+			s.addGuests(g.Guests, 0, 0)
+		case "lunch":
+			s.addGuests(0, g.Guests, 0)
+		case "dinner":
+			s.addGuests(0, 0, g.Guests)
+		}
+		s.GuestMeals = append(s.GuestMeals, g)
+	}
+	return s, nil
+}
+
+// getMonthlyBilling は月のうちに在寮していた全寮生の月の食費を取得します
+// 月の途中で退寮して無効にした寮生も、在寮していた日の分を請求します
+func getMonthlyBilling(db *sql.DB, month time.Time) ([]BillingStatement, error) {
+	from, to := monthRange(month)
+	prices := getMealPrices(db)
+	rows, err := db.Query(`
+	SELECT u.username, `+userNameSQL+`,
+		COUNT(*) FILTER (WHERE `+residentOnDaySQL("d::date")+` AND `+mealEatenSQL("breakfast")+`),
+		COUNT(*) FILTER (WHERE `+residentOnDaySQL("d::date")+` AND `+mealEatenSQL("lunch")+`),
+		COUNT(*) FILTER (WHERE `+residentOnDaySQL("d::date")+` AND `+mealEatenSQL("dinner")+`),
+		COALESCE(gb.breakfast, 0), COALESCE(gb.lunch, 0), COALESCE(gb.dinner, 0)
+	FROM users u`+guestBillingSQL()+`
+	CROSS JOIN generate_series($1::date, $2::date, INTERVAL '1 day') AS d`+locationJoinSQL("d::date")+`
+	LEFT JOIN gaihaku_kesshoku_records r ON r.student_id = u.username AND r.record_date = d::date`+dormCalendarJoinSQL("d::date")+`
+	WHERE `+residentRolesSQL+`
+	GROUP BY u.username, u.display_name, gb.breakfast, gb.lunch, gb.dinner
+	HAVING COUNT(*) FILTER (WHERE `+residentOnDaySQL("d::date")+`) > 0
+		OR COALESCE(gb.breakfast, 0) + COALESCE(gb.lunch, 0) + COALESCE(gb.dinner, 0) > 0
+	ORDER BY u.username ASC`, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query monthly billing: %w", err)
+	}
+	defer rows.Close()
+
+	var statements []BillingStatement
+	for rows.Next() {
+		s := BillingStatement{Month: month, Prices: prices}
+		var guestBreakfast, guestLunch, guestDinner int
+		if err := rows.Scan(&s.StudentID, &s.StudentName, &s.Breakfast, &s.Lunch, &s.Dinner, &guestBreakfast, &guestLunch, &guestDinner); err != nil {
+			log.Printf("Failed to scan billing: %v", err)
+			continue
+		}
+		s.addGuests(guestBreakfast, guestLunch, guestDinner)
+		statements = append(statements, s)
+	}
+	return statements, nil
+}
+
+// billingHandler はログイン中の寮生の月の食費を表示します
+func billingHandler(c echo.Context) error {
+	month := parseBillingMonth(c)
+	statement, err := getBillingStatement(db, currentUser(c).Username, month)
+	if err != nil {
+		log.Printf("Failed to get billing for %s: %v", currentUser(c).Username, err)
+		return c.String(http.StatusInternalServerError, "Failed to retrieve billing.")
+	}
+
+	return c.Render(http.StatusOK, "billing.html", map[string]interface{}{
+		"statement": statement,
+		"month":     month,
+		"prevMonth": month.AddDate(0, -1, 0),
+		"nextMonth": month.AddDate(0, 1, 0),
+	})
+}
+
+// adminBillingHandler は全寮生の月の食費の一覧を表示します
+func adminBillingHandler(c echo.Context) error {
+	month := parseBillingMonth(c)
+	statements, err := getMonthlyBilling(db, month)
+	if err != nil {
+		log.Printf("Failed to get monthly billing: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to retrieve billing.")
+	}
+
+	total := 0
+	for _, s := range statements {
+		total += s.Total()
+	}
+
+	return c.Render(http.StatusOK, "admin_billing.html", map[string]interface{}{
+		"statements": statements,
+		"prices":     getMealPrices(db),
+		"total":      total,
+		"month":      month,
+		"prevMonth":  month.AddDate(0, -1, 0),
+		"nextMonth":  month.AddDate(0, 1, 0),
+	})
+}
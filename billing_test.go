@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// 食数と食費は同じ条件で在寮していた寮生を数える
+func TestMealCountsAndBillingShareResidency(t *testing.T) {
+	db := openTestDB(t)
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	mustExec(t, db, `INSERT INTO users (username, password, role, active) VALUES
+		('unassigned', 'x', 'user', TRUE),
+		('assigned', 'x', 'user', TRUE),
+		('moved_out', 'x', 'floor_leader', TRUE),
+		('graduated', 'x', 'user', FALSE),
+		('cook', 'x', 'kitchen', TRUE)`)
+	mustExec(t, db, `INSERT INTO buildings (id, name) VALUES (1, '北')`)
+	mustExec(t, db, `INSERT INTO floors (id, building_id, name) VALUES (1, 1, '1F')`)
+	mustExec(t, db, `INSERT INTO rooms (id, floor_id, number, capacity) VALUES (1, 1, '101', 4)`)
+	mustExec(t, db, `INSERT INTO room_assignments (student_id, room_id, start_date, end_date) VALUES
+		('assigned', 1, CURRENT_DATE - 10, NULL),
+		('moved_out', 1, CURRENT_DATE - 10, CURRENT_DATE),
+		('graduated', 1, CURRENT_DATE - 10, NULL)`)
+
+	want := map[string]bool{"unassigned": true, "assigned": true, "moved_out": false, "graduated": false, "cook": false}
+
+	counts, err := getMealCounts(db, today, 1, LocationFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := counts[0].Residents; got != 2 {
+		t.Errorf("meal counts: %d residents today, want 2", got)
+	}
+
+	for studentID, resident := range want {
+		s, err := getBillingStatement(db, studentID, time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, time.Local))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range s.Days {
+			if d.Date.Day() == today.Day() && d.Resident != resident {
+				t.Errorf("billing for %s: resident today = %v, want %v", studentID, d.Resident, resident)
+			}
+		}
+	}
+}
+
+// 来客の食事は、申し込んだ寮生が在寮している日だけ食数に含め、食費に加算する
+func TestGuestMealsCountedAndBilledForResidentHostsOnly(t *testing.T) {
+	db := openTestDB(t)
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	mustExec(t, db, `INSERT INTO users (username, password, role, active) VALUES
+		('host', 'x', 'user', TRUE), ('left', 'x', 'user', TRUE)`)
+	mustExec(t, db, `INSERT INTO buildings (id, name) VALUES (1, '北')`)
+	mustExec(t, db, `INSERT INTO floors (id, building_id, name) VALUES (1, 1, '1F')`)
+	mustExec(t, db, `INSERT INTO rooms (id, floor_id, number, capacity) VALUES (1, 1, '101', 4)`)
+	mustExec(t, db, `INSERT INTO room_assignments (student_id, room_id, start_date, end_date) VALUES
+		('left', 1, CURRENT_DATE - 10, CURRENT_DATE)`)
+	mustExec(t, db, `INSERT INTO guest_meals (student_id, meal_date, meal, guests, payer) VALUES
+		('host', CURRENT_DATE, 'dinner', 2, 'student'),
+		('left', CURRENT_DATE, 'dinner', 3, 'student')`)
+
+	counts, err := getMealCounts(db, today, 1, LocationFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := counts[0].GuestDinner; got != 2 {
+		t.Errorf("guest dinners counted = %d, want 2", got)
+	}
+
+	month := time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, time.Local)
+	statements, err := getMonthlyBilling(db, month)
+	if err != nil {
+		t.Fatal(err)
+	}
+	billed := make(map[string]int)
+	for _, s := range statements {
+		billed[s.StudentID] = s.Guests
+	}
+	if billed["host"] != 2 || billed["left"] != 0 {
+		t.Errorf("monthly billing guests = %v, want host 2 and left 0", billed)
+	}
+	for _, studentID := range []string{"host", "left"} {
+		s, err := getBillingStatement(db, studentID, month)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Guests != billed[studentID] {
+			t.Errorf("statement for %s: %d guests, monthly billing has %d", studentID, s.Guests, billed[studentID])
+		}
+	}
+}
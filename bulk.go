@@ -0,0 +1,357 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+// maxBulkDays は一括編集で一度に変更できる日数です
+const maxBulkDays = 31
+
+// maxBulkCSVSize は一括編集で読み込む学籍番号のCSVファイルの上限 (バイト) です
+const maxBulkCSVSize = 1 << 20
+
+// 一括編集で食事・外泊をどう変更するか (空文字は変更しない)
+const (
+	bulkSet   = "set"   // 食べる・外泊する
+	bulkUnset = "unset" // 欠食する・外泊しない
+)
+
+// bulkEdit は一括編集の内容です
+type bulkEdit struct {
+	StudentIDs     []string
+	From, To       time.Time
+	Breakfast      string // "" / bulkSet / bulkUnset
+	Lunch          string
+	Dinner         string
+	Overnight      string
+	Destination    string
+	StayPhone      string
+	ExpectedReturn *time.Time
+	Note           string // 空文字の場合は備考を変更しない
+}
+
+// splitStudentIDs は改行・カンマ・空白などで区切られた学籍番号の一覧を、重複を除いて返します
+func splitStudentIDs(s string) []string {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == '、' || r == ';' || r == ' ' || r == '　' || r == '\t' || r == '\n' || r == '\r'
+	})
+	seen := make(map[string]bool)
+	var ids []string
+	for _, f := range fields {
+		if f != "" && !seen[f] {
+			seen[f] = true
+			ids = append(ids, f)
+		}
+	}
+	return ids
+}
+
+// readStudentIDsCSV はCSVファイルの1列目から学籍番号を読み込みます。見出し行 (student_id / 学籍番号) は読み飛ばします
+func readStudentIDsCSV(r io.Reader) ([]string, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	var ids []string
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CSV: %w", err)
+		}
+		id := strings.TrimSpace(strings.TrimPrefix(rec[0], "\ufeff"))
+		if id == "" || id == "student_id" || id == "学籍番号" {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// resolveBulkStudents は学籍番号・部屋・フロアで選んだ寮生の学籍番号を返します (date 時点の部屋で選びます)
+// 寮生として見つからない学籍番号は unknown に返します
+func resolveBulkStudents(db *sql.DB, ids []string, roomID, floorID int, date time.Time) (students, unknown []string, err error) {
+	rows, err := db.Query(`
+	SELECT u.username
+	FROM users u `+locationJoinSQL("$1::date")+`
+	WHERE `+residentRoleCondition+` AND (u.username = ANY($2) OR rm.id = $3 OR f.id = $4)
+	ORDER BY u.username ASC`, date.Format("2006-01-02"), pq.Array(ids), roomID, floorID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query bulk students: %w", err)
+	}
+	defer rows.Close()
+
+	found := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("Failed to scan bulk student: %v", err)
+			continue
+		}
+		found[id] = true
+		students = append(students, id)
+	}
+	for _, id := range ids {
+		if !found[id] {
+			unknown = append(unknown, id)
+		}
+	}
+	return students, unknown, nil
+}
+
+// readBulkEditForm はフォームから一括編集の内容を読み込み、入力エラーがあればその内容を返します
+func readBulkEditForm(c echo.Context, form url.Values) (bulkEdit, string) {
+	e := bulkEdit{
+		Breakfast:   form.Get("breakfast"),
+		Lunch:       form.Get("lunch"),
+		Dinner:      form.Get("dinner"),
+		Overnight:   form.Get("overnight"),
+		Destination: strings.TrimSpace(form.Get("destination")),
+		StayPhone:   strings.TrimSpace(form.Get("stay_phone")),
+		Note:        strings.TrimSpace(form.Get("note")),
+	}
+	from, err := time.ParseInLocation("2006-01-02", form.Get("from"), time.Local)
+	if err != nil {
+		return e, "開始日を入力してください。"
+	}
+	e.From, e.To = from, from
+	if form.Get("to") != "" {
+		if e.To, err = time.ParseInLocation("2006-01-02", form.Get("to"), time.Local); err != nil || e.To.Before(e.From) {
+			return e, "終了日は開始日以降の日付を入力してください。"
+		}
+	}
+	if e.To.After(e.From.AddDate(0, 0, maxBulkDays-1)) {
+		return e, fmt.Sprintf("一度に変更できるのは%d日分までです。", maxBulkDays)
+	}
+	for _, v := range []string{e.Breakfast, e.Lunch, e.Dinner, e.Overnight} {
+		if v != "" && v != bulkSet && v != bulkUnset {
+			return e, "変更内容を選択してください。"
+		}
+	}
+	if e.Breakfast == "" && e.Lunch == "" && e.Dinner == "" && e.Overnight == "" && e.Note == "" {
+		return e, "変更する項目を1つ以上選択してください。"
+	}
+	if utf8.RuneCountInString(e.Note) > 200 {
+		return e, "備考は200文字以内で入力してください。"
+	}
+	if t, err := time.ParseInLocation(expectedReturnLayout, form.Get("expected_return"), time.Local); err == nil {
+		e.ExpectedReturn = &t
+	}
+
+	ids := splitStudentIDs(form.Get("student_ids"))
+	ids = append(ids, form["student"]...)
+	if file, err := c.FormFile("csv"); err == nil {
+		if file.Size > maxBulkCSVSize {
+			return e, "CSVファイルが大きすぎます。"
+		}
+		f, err := file.Open()
+		if err != nil {
+			return e, "CSVファイルを読み込めませんでした。"
+		}
+		defer f.Close()
+		csvIDs, err := readStudentIDsCSV(f)
+		if err != nil {
+			log.Printf("Failed to read bulk CSV: %v", err)
+			return e, "CSVファイルを読み込めませんでした。"
+		}
+		ids = append(ids, csvIDs...)
+	}
+	ids = splitStudentIDs(strings.Join(ids, ","))
+	roomID, _ := strconv.Atoi(form.Get("room"))
+	floorID, _ := strconv.Atoi(form.Get("floor"))
+	if len(ids) == 0 && roomID == 0 && floorID == 0 {
+		return e, "対象の寮生を選択してください。"
+	}
+
+	students, unknown, err := resolveBulkStudents(db, ids, roomID, floorID, e.From)
+	if err != nil {
+		log.Printf("Failed to resolve bulk students: %v", err)
+		return e, "対象の寮生を取得できませんでした。"
+	}
+	if len(unknown) > 0 {
+		return e, "寮生が見つからない学籍番号があります: " + strings.Join(unknown, ", ")
+	}
+	if len(students) == 0 {
+		return e, "選択した部屋・フロアに寮生がいません。"
+	}
+	e.StudentIDs = students
+	return e, ""
+}
+
+// apply は記録に一括編集の内容を反映します
+func (e bulkEdit) apply(r *GaihakuKesshokuRecord) {
+	for _, m := range []struct {
+		change string
+		meal   *bool
+	}{{e.Breakfast, &r.Breakfast}, {e.Lunch, &r.Lunch}, {e.Dinner, &r.Dinner}} {
+		if m.change != "" {
+			*m.meal = m.change == bulkSet
+		}
+	}
+	switch e.Overnight {
+	case bulkSet:
+		r.Overnight, r.Destination, r.StayPhone, r.ExpectedReturn = true, e.Destination, e.StayPhone, e.ExpectedReturn
+		r.LateReturn, r.ExpectedArrival = false, nil
+	case bulkUnset:
+		r.Overnight, r.Destination, r.StayPhone, r.ExpectedReturn = false, "", "", nil
+	}
+	if e.Note != "" {
+		r.Note = e.Note
+	}
+}
+
+// getRecordForUpdate は寮生の指定日の記録を、トランザクション内で更新のためにロックして取得します
+// 記録がない日は、全ての食事を食べ外泊しない記録を返します
+func getRecordForUpdate(q queryRower, studentID string, date time.Time) (GaihakuKesshokuRecord, error) {
+	r := GaihakuKesshokuRecord{StudentID: studentID, RecordDate: date, Breakfast: true, Lunch: true, Dinner: true}
+	var expectedReturn, expectedArrival sql.NullTime
+	err := q.QueryRow(`
+	SELECT breakfast, lunch, dinner, overnight, COALESCE(note, ''), destination, stay_phone, expected_return, late_return, expected_arrival
+	FROM gaihaku_kesshoku_records
+	WHERE student_id = $1 AND record_date = $2
+	FOR UPDATE`, studentID, date.Format("2006-01-02")).Scan(&r.Breakfast, &r.Lunch, &r.Dinner, &r.Overnight, &r.Note,
+		&r.Destination, &r.StayPhone, &expectedReturn, &r.LateReturn, &expectedArrival)
+	if err == sql.ErrNoRows {
+		return r, nil
+	}
+	if err != nil {
+		return r, fmt.Errorf("failed to query record for update: %w", err)
+	}
+	if expectedReturn.Valid {
+		r.ExpectedReturn = &expectedReturn.Time
+	}
+	if expectedArrival.Valid {
+		r.ExpectedArrival = &expectedArrival.Time
+	}
+	return r, nil
+}
+
+// saveBulkEdit は一括編集を1つのトランザクションで保存し、変更を履歴に残して厨房の画面に通知します
+// 入力エラーのある記録があれば何も保存せず、そのメッセージを返します
+func saveBulkEdit(db *sql.DB, e bulkEdit, changedBy string) (int, string, error) {
+	var dates []time.Time
+	for d := e.From; !d.After(e.To); d = d.AddDate(0, 0, 1) {
+		dates = append(dates, d)
+	}
+	rules := loadRecordRules(db, e.From, len(dates))
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	saved := 0
+	for _, studentID := range e.StudentIDs {
+		for _, date := range dates {
+			r, err := getRecordForUpdate(tx, studentID, date)
+			if err != nil {
+				return 0, "", err
+			}
+			e.apply(&r)
+			rules.Calendar[date.Format("2006-01-02")].apply(&r)
+			if message := validateRecord(&r, rules.Curfew); message != "" {
+				return 0, studentID + ": " + message, nil
+			}
+			changed, err := logRecordChange(tx, &r, HistoryAdminBulk, changedBy)
+			if err != nil {
+				return 0, "", err
+			}
+			if err := upsertRecord(tx, &r); err != nil {
+				return 0, "", err
+			}
+			if changed {
+				if err := notifyRecordChange(tx, &r, HistoryAdminBulk); err != nil {
+					return 0, "", err
+				}
+			}
+			saved++
+		}
+	}
+	return saved, "", tx.Commit()
+}
+
+// renderAdminBulk は一括編集ページを表示します。入力エラーの場合は、送信された内容をそのまま表示し直します
+func renderAdminBulk(c echo.Context, status int, form url.Values, successMessage, errorMessage string) error {
+	users, err := getAllUsers(db, LocationFilter{})
+	if err != nil {
+		log.Printf("Failed to get all users: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to retrieve user data.")
+	}
+	var residents []User
+	for _, u := range users {
+		if u.IsResident() && u.Active {
+			residents = append(residents, u)
+		}
+	}
+	selected := make(map[string]bool)
+	for _, id := range form["student"] {
+		selected[id] = true
+	}
+	floors, err := getFloors(db)
+	if err != nil {
+		log.Printf("Failed to get floors: %v", err)
+	}
+	buildings, err := getBuildings(db)
+	if err != nil {
+		log.Printf("Failed to get buildings: %v", err)
+	}
+
+	return c.Render(status, "admin_bulk.html", map[string]interface{}{
+		"residentGroups": groupByFloor(residents, func(u User) RoomLocation { return u.Location }),
+		"selected":       selected,
+		"floors":         floors,
+		"buildings":      buildings,
+		"form":           form,
+		"meals":          menuMeals,
+		"today":          time.Now(),
+		"maxDays":        maxBulkDays,
+		"successMessage": successMessage,
+		"errorMessage":   errorMessage,
+	})
+}
+
+// adminBulkHandler は複数の寮生の外泊・欠食をまとめて変更するページを表示します
+func adminBulkHandler(c echo.Context) error {
+	return renderAdminBulk(c, http.StatusOK, url.Values{}, popFlash(c, "bulk_success"), "")
+}
+
+// adminSaveBulkHandler は複数の寮生・複数日の外泊・欠食をまとめて変更します
+func adminSaveBulkHandler(c echo.Context) error {
+	form, err := c.FormParams()
+	if err != nil {
+		log.Printf("Failed to parse form data for bulk edit: %v", err)
+		return c.String(http.StatusBadRequest, "Invalid form data.")
+	}
+	e, message := readBulkEditForm(c, form)
+	if message != "" {
+		return renderAdminBulk(c, http.StatusUnprocessableEntity, form, "", message)
+	}
+	user := currentUser(c)
+	saved, message, err := saveBulkEdit(db, e, user.Username)
+	if err != nil {
+		log.Printf("Failed to save bulk edit by %s: %v", user.Username, err)
+		return c.String(http.StatusInternalServerError, "Failed to save records.")
+	}
+	if message != "" {
+		return renderAdminBulk(c, http.StatusUnprocessableEntity, form, "", message)
+	}
+	log.Printf("Bulk edit of %d records (%d students, %s - %s) by %s", saved, len(e.StudentIDs),
+		e.From.Format("2006-01-02"), e.To.Format("2006-01-02"), user.Username)
+	message = fmt.Sprintf("%d人の%s〜%sの記録 (%d件) を変更しました。", len(e.StudentIDs), e.From.Format("01/02"), e.To.Format("01/02"), saved)
+	return redirectWithFlash(c, "/admin/bulk", message, true, "bulk_success", "bulk_error")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitStudentIDs(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"2401, 2402、2403;2404", []string{"2401", "2402", "2403", "2404"}},
+		{"2401\r\n2402\t2403　2404", []string{"2401", "2402", "2403", "2404"}},
+		{"2401,,2402, 2401", []string{"2401", "2402"}},
+	}
+	for _, tt := range tests {
+		if got := splitStudentIDs(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitStudentIDs(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestReadStudentIDsCSV(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []string
+	}{
+		{"header", "student_id,name\n2401,山田\n2402,佐藤\n", []string{"2401", "2402"}},
+		{"japanese header with BOM", "\ufeff学籍番号\n2401\n", []string{"2401"}},
+		{"no header and blank rows", "2401\n\n 2402 ,x\n,\n", []string{"2401", "2402"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readStudentIDsCSV(strings.NewReader(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := readStudentIDsCSV(strings.NewReader("\"2401\n")); err == nil {
+		t.Error("unterminated quote: want an error")
+	}
+}
+
+func TestBulkEditApply(t *testing.T) {
+	back := time.Date(2024, 5, 6, 18, 0, 0, 0, time.Local)
+	arrival := time.Date(2024, 5, 4, 23, 0, 0, 0, time.Local)
+	r := GaihakuKesshokuRecord{Breakfast: true, Lunch: true, Dinner: true, Note: "部活", LateReturn: true, ExpectedArrival: &arrival}
+
+	e := bulkEdit{Breakfast: bulkUnset, Overnight: bulkSet, Destination: "実家", StayPhone: "0312345678", ExpectedReturn: &back}
+	e.apply(&r)
+	if r.Breakfast || !r.Lunch || !r.Dinner {
+		t.Errorf("meals = %v %v %v, want only breakfast skipped", r.Breakfast, r.Lunch, r.Dinner)
+	}
+	if !r.Overnight || r.Destination != "実家" || r.ExpectedReturn != &back {
+		t.Errorf("overnight not applied: %+v", r)
+	}
+	// 外泊にすると門限後の帰寮の届出は取り消す。備考は入力がなければ変えない
+	if r.LateReturn || r.ExpectedArrival != nil || r.Note != "部活" {
+		t.Errorf("late return %v / arrival %v / note %q after setting overnight", r.LateReturn, r.ExpectedArrival, r.Note)
+	}
+
+	bulkEdit{Overnight: bulkUnset, Note: "帰省取りやめ"}.apply(&r)
+	if r.Overnight || r.Destination != "" || r.StayPhone != "" || r.ExpectedReturn != nil || r.Note != "帰省取りやめ" {
+		t.Errorf("after unsetting overnight: %+v", r)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 特別な日の種類
+const (
+	DayNoBreakfast = "no_breakfast" // 朝食なし
+	DayNoMeals     = "no_meals"     // 食事なし
+	DayClosed      = "closed"       // 閉寮日
+)
+
+// dormDayKinds は画面に表示する特別な日の種類の一覧です
+var dormDayKinds = []struct {
+	Name  string
+	Label string
+}{
+	{DayNoBreakfast, "朝食なし"},
+	{DayNoMeals, "食事なし"},
+	{DayClosed, "閉寮"},
+}
+
+// maxCalendarRangeDays は一度に登録できる特別な日の日数です
+const maxCalendarRangeDays = 62
+
+// createDormCalendarTable は寮の行事予定 (祝日・試験期間・閉寮日など) のテーブルを作成します
+func createDormCalendarTable(db *sql.DB) error {
+	const createTableSQL = `
+	CREATE TABLE IF NOT EXISTS dorm_calendar (
+		date DATE PRIMARY KEY,
+		kind VARCHAR(20) NOT NULL,
+		note TEXT NOT NULL DEFAULT '',
+		created_by VARCHAR(50),
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	_, err := db.Exec(createTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to execute SQL: %w", err)
+	}
+
+	return nil
+}
+
+// dormCalendarJoinSQL は日付 dateExpr の特別な日を dc として結合するSQLです
+func dormCalendarJoinSQL(dateExpr string) string {
+	return `
+	LEFT JOIN dorm_calendar dc ON dc.date = ` + dateExpr
+}
+
+// mealServedSQL は食事 meal (breakfast / lunch / dinner) が提供される日かを表すSQLの式です (dormCalendarJoinSQL と組み合わせて使います)
+func mealServedSQL(meal string) string {
+	if meal == "breakfast" {
+		return "COALESCE(dc.kind, '') NOT IN ('" + DayNoBreakfast + "', '" + DayNoMeals + "', '" + DayClosed + "')"
+	}
+	return "COALESCE(dc.kind, '') NOT IN ('" + DayNoMeals + "', '" + DayClosed + "')"
+}
+
+// mealEatenSQL は寮生が食事 meal を食べるかを表すSQLの式です。登録がなければ食べるものとし、提供されない日は食べないものとします
+func mealEatenSQL(meal string) string {
+	return "(COALESCE(r." + meal + ", TRUE) AND " + mealServedSQL(meal) + ")"
+}
+
+// BreakfastServed は朝食が提供される日かを返します
+func (d DormDay) BreakfastServed() bool {
+	return d.Kind != DayNoBreakfast && d.MealsServed()
+}
+
+// MealsServed は昼食・夕食が提供される日かを返します
+func (d DormDay) MealsServed() bool {
+	return d.Kind != DayNoMeals && !d.Closed()
+}
+
+// Closed は閉寮日かを返します
+func (d DormDay) Closed() bool {
+	return d.Kind == DayClosed
+}
+
+// Label は特別な日の表示名を返します (通常の日は空文字)
+func (d DormDay) Label() string {
+	for _, k := range dormDayKinds {
+		if k.Name == d.Kind {
+			return k.Label
+		}
+	}
+	return d.Kind
+}
+
+// apply は特別な日に合わせて記録を直します。提供されない食事は欠食とし、閉寮日は外泊・門限後の帰寮を登録しません
+func (d DormDay) apply(r *GaihakuKesshokuRecord) {
+	if !d.BreakfastServed() {
+		r.Breakfast = false
+	}
+	if !d.MealsServed() {
+		r.Lunch, r.Dinner = false, false
+	}
+	if d.Closed() {
+		r.Overnight, r.Destination, r.StayPhone, r.ExpectedReturn = false, "", "", nil
+		r.LateReturn, r.ExpectedArrival = false, nil
+	}
+}
+
+// isValidDormDayKind は特別な日の種類が定義済みのものかを確認します
+func isValidDormDayKind(kind string) bool {
+	for _, k := range dormDayKinds {
+		if k.Name == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// getDormDays は期間内の特別な日を日付順に取得します
+func getDormDays(db *sql.DB, from, to time.Time) ([]DormDay, error) {
+	rows, err := db.Query(`SELECT date, kind, note, COALESCE(created_by, '') FROM dorm_calendar
+	WHERE date BETWEEN $1 AND $2 ORDER BY date ASC`, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query dorm calendar: %w", err)
+	}
+	defer rows.Close()
+
+	var days []DormDay
+	for rows.Next() {
+		var d DormDay
+		if err := rows.Scan(&d.Date, &d.Kind, &d.Note, &d.CreatedBy); err != nil {
+			log.Printf("Failed to scan dorm day: %v", err)
+			continue
+		}
+		days = append(days, d)
+	}
+	return days, nil
+}
+
+// getDormCalendar は期間内の特別な日を日付 ("2006-01-02") ごとに取得します
+// 通常の日は含まれないため、存在しない日付を引くと通常の日 (DormDay のゼロ値) になります
+func getDormCalendar(db *sql.DB, from, to time.Time) (map[string]DormDay, error) {
+	days, err := getDormDays(db, from, to)
+	if err != nil {
+		return nil, err
+	}
+	calendar := make(map[string]DormDay, len(days))
+	for _, d := range days {
+		calendar[d.Date.Format("2006-01-02")] = d
+	}
+	return calendar, nil
+}
+
+// setDormDays は期間内の各日を特別な日として登録します。既に登録されている日は上書きします
+// 提供する食事が変わるため、厨房の画面に食数の変更を通知します
+func setDormDays(db *sql.DB, from, to time.Time, kind, note, createdBy string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO dorm_calendar (date, kind, note, created_by)
+	SELECT d::date, $3, $4, $5 FROM generate_series($1::date, $2::date, INTERVAL '1 day') AS d
+	ON CONFLICT (date) DO UPDATE SET kind = EXCLUDED.kind, note = EXCLUDED.note, created_by = EXCLUDED.created_by, created_at = CURRENT_TIMESTAMP`,
+		from.Format("2006-01-02"), to.Format("2006-01-02"), kind, note, createdBy)
+	if err != nil {
+		return fmt.Errorf("failed to save dorm calendar: %w", err)
+	}
+	if err := notifyCountChange(tx, from, to); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteDormDay は特別な日の登録を削除し、厨房の画面に食数の変更を通知します
+func deleteDormDay(db *sql.DB, date time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM dorm_calendar WHERE date = $1", date.Format("2006-01-02")); err != nil {
+		return fmt.Errorf("failed to delete dorm calendar: %w", err)
+	}
+	if err := notifyCountChange(tx, date, date); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// adminCalendarHandler は寮の行事予定 (特別な日) の一覧と登録フォームを表示します
+func adminCalendarHandler(c echo.Context) error {
+	today := time.Now()
+	days, err := getDormDays(db, today.AddDate(0, 0, -31), today.AddDate(1, 0, 0))
+	if err != nil {
+		log.Printf("Failed to get dorm calendar: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to retrieve calendar.")
+	}
+
+	return c.Render(http.StatusOK, "admin_calendar.html", map[string]interface{}{
+		"days":           days,
+		"kinds":          dormDayKinds,
+		"today":          today,
+		"successMessage": popFlash(c, "calendar_success"),
+		"errorMessage":   popFlash(c, "calendar_error"),
+	})
+}
+
+// adminAddCalendarHandler は期間を指定して特別な日を登録します
+func adminAddCalendarHandler(c echo.Context) error {
+	from, err := time.ParseInLocation("2006-01-02", c.FormValue("from"), time.Local)
+	if err != nil {
+		return redirectWithFlash(c, "/admin/calendar", "日付を入力してください。", false, "calendar_success", "calendar_error")
+	}
+	to := from
+	if v := c.FormValue("to"); v != "" {
+		if to, err = time.ParseInLocation("2006-01-02", v, time.Local); err != nil {
+			return redirectWithFlash(c, "/admin/calendar", "終了日が正しくありません。", false, "calendar_success", "calendar_error")
+		}
+	}
+	kind := c.FormValue("kind")
+	note := strings.TrimSpace(c.FormValue("note"))
+	switch {
+	case to.Before(from):
+		return redirectWithFlash(c, "/admin/calendar", "終了日は開始日以降にしてください。", false, "calendar_success", "calendar_error")
+	case to.Sub(from) >= maxCalendarRangeDays*24*time.Hour:
+		return redirectWithFlash(c, "/admin/calendar", fmt.Sprintf("一度に登録できるのは%d日までです。", maxCalendarRangeDays), false, "calendar_success", "calendar_error")
+	case !isValidDormDayKind(kind):
+		return redirectWithFlash(c, "/admin/calendar", "種類を選択してください。", false, "calendar_success", "calendar_error")
+	case utf8.RuneCountInString(note) > 200:
+		return redirectWithFlash(c, "/admin/calendar", "内容は200文字以内で入力してください。", false, "calendar_success", "calendar_error")
+	}
+
+	user := currentUser(c)
+	if err := setDormDays(db, from, to, kind, note, user.Username); err != nil {
+		log.Printf("Failed to add dorm calendar: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to save calendar.")
+	}
+	log.Printf("Dorm calendar %s - %s set to %s by %s", from.Format("2006-01-02"), to.Format("2006-01-02"), kind, user.Username)
+	return redirectWithFlash(c, "/admin/calendar", "行事予定を登録しました。", true, "calendar_success", "calendar_error")
+}
+
+// adminDeleteCalendarHandler は特別な日の登録を取り消し、通常の日に戻します
+func adminDeleteCalendarHandler(c echo.Context) error {
+	date, err := time.ParseInLocation("2006-01-02", c.FormValue("date"), time.Local)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid date.")
+	}
+	if err := deleteDormDay(db, date); err != nil {
+		log.Printf("Failed to delete dorm calendar: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to delete calendar.")
+	}
+	log.Printf("Dorm calendar %s deleted by %s", date.Format("2006-01-02"), currentUser(c).Username)
+	return redirectWithFlash(c, "/admin/calendar", "行事予定を削除しました。", true, "calendar_success", "calendar_error")
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// createEmergencyContactsTable は保護者・緊急連絡先のテーブルを作成します
+func createEmergencyContactsTable(db *sql.DB) error {
+	const createTableSQL = `
+	CREATE TABLE IF NOT EXISTS emergency_contacts (
+		id SERIAL PRIMARY KEY,
+		student_id VARCHAR(50) NOT NULL,
+		name VARCHAR(100) NOT NULL,
+		relationship VARCHAR(50) NOT NULL DEFAULT '',
+		phone VARCHAR(20) NOT NULL,
+		email VARCHAR(255) NOT NULL DEFAULT '',
+		is_guardian BOOLEAN NOT NULL DEFAULT FALSE,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS emergency_contacts_student_idx ON emergency_contacts (student_id);`
+
+	_, err := db.Exec(createTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to execute SQL: %w", err)
+	}
+
+	return nil
+}
+
+// primaryContactJoinSQL は users u に、最優先の緊急連絡先 (保護者を優先し、登録順) を ec として結合するSQLです
+const primaryContactJoinSQL = `
+	LEFT JOIN LATERAL (
+		SELECT name, phone FROM emergency_contacts
+		WHERE student_id = u.username
+		ORDER BY is_guardian DESC, id ASC LIMIT 1
+	) ec ON TRUE`
+
+// getEmergencyContacts は学生の緊急連絡先を、保護者を先頭にして取得します
+func getEmergencyContacts(db *sql.DB, studentID string) ([]EmergencyContact, error) {
+	rows, err := db.Query(`
+	SELECT id, student_id, name, relationship, phone, email, is_guardian
+	FROM emergency_contacts WHERE student_id = $1
+	ORDER BY is_guardian DESC, id ASC`, studentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query emergency contacts: %w", err)
+	}
+	defer rows.Close()
+
+	var contacts []EmergencyContact
+	for rows.Next() {
+		var ec EmergencyContact
+		if err := rows.Scan(&ec.ID, &ec.StudentID, &ec.Name, &ec.Relationship, &ec.Phone, &ec.Email, &ec.IsGuardian); err != nil {
+			log.Printf("Failed to scan emergency contact: %v", err)
+			continue
+		}
+		contacts = append(contacts, ec)
+	}
+	return contacts, nil
+}
+
+// addEmergencyContact は緊急連絡先を追加します
+func addEmergencyContact(db *sql.DB, ec *EmergencyContact) error {
+	_, err := db.Exec(`INSERT INTO emergency_contacts (student_id, name, relationship, phone, email, is_guardian)
+	VALUES ($1, $2, $3, $4, $5, $6)`, ec.StudentID, ec.Name, ec.Relationship, ec.Phone, ec.Email, ec.IsGuardian)
+	if err != nil {
+		return fmt.Errorf("failed to insert emergency contact: %w", err)
+	}
+	return nil
+}
+
+// deleteEmergencyContact は学生の緊急連絡先を削除し、削除したかを返します
+// 保護者は外泊を承認する立場のため、allowGuardian が false (本人による削除) の場合は保護者を削除しません
+func deleteEmergencyContact(db *sql.DB, studentID string, id int, allowGuardian bool) (bool, error) {
+	res, err := db.Exec("DELETE FROM emergency_contacts WHERE id = $1 AND student_id = $2 AND ($3 OR NOT is_guardian)", id, studentID, allowGuardian)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete emergency contact: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete emergency contact: %w", err)
+	}
+	return n > 0, nil
+}
+
+// addContactFromForm はフォームの内容を確認して緊急連絡先を追加し、表示するメッセージと成否を返します
+// 保護者は外泊を承認する立場のため、allowGuardian が false (本人による登録) の場合は保護者の指定を無視します
+func addContactFromForm(c echo.Context, studentID string, allowGuardian bool) (string, bool) {
+	ec := EmergencyContact{
+		StudentID:    studentID,
+		Name:         strings.TrimSpace(c.FormValue("name")),
+		Relationship: strings.TrimSpace(c.FormValue("relationship")),
+		Phone:        strings.TrimSpace(c.FormValue("phone")),
+		Email:        strings.TrimSpace(c.FormValue("email")),
+		IsGuardian:   allowGuardian && c.FormValue("is_guardian") == "on",
+	}
+	if ec.Name == "" || ec.Phone == "" {
+		return "緊急連絡先の氏名と電話番号は必須です。", false
+	}
+	if utf8.RuneCountInString(ec.Name) > 100 || utf8.RuneCountInString(ec.Relationship) > 50 {
+		return "氏名は100文字以内、続柄は50文字以内で入力してください。", false
+	}
+	if message := validateContactInfo(ec.Phone, ec.Email); message != "" {
+		return message, false
+	}
+	if err := addEmergencyContact(db, &ec); err != nil {
+		log.Printf("Failed to add emergency contact for %s: %v", studentID, err)
+		return "緊急連絡先の追加に失敗しました。", false
+	}
+	return "緊急連絡先を追加しました。", true
+}
+
+// addOwnContactHandler はログイン中のユーザーが自分の緊急連絡先を追加します
+func addOwnContactHandler(c echo.Context) error {
+	message, ok := addContactFromForm(c, currentUser(c).Username, false)
+	return redirectWithFlash(c, "/settings", message, ok, "settings_success", "settings_error")
+}
+
+// deleteOwnContactHandler はログイン中のユーザーが自分の緊急連絡先を削除します
+func deleteOwnContactHandler(c echo.Context) error {
+	id, _ := strconv.Atoi(c.FormValue("id"))
+	deleted, err := deleteEmergencyContact(db, currentUser(c).Username, id, false)
+	if err != nil {
+		log.Printf("Failed to delete emergency contact: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to delete emergency contact.")
+	}
+	if !deleted {
+		return redirectWithFlash(c, "/settings", "保護者の緊急連絡先の削除は、寮の管理者に依頼してください。", false, "settings_success", "settings_error")
+	}
+	return redirectWithFlash(c, "/settings", "緊急連絡先を削除しました。", true, "settings_success", "settings_error")
+}
+
+// adminAddContactHandler は管理者が学生の緊急連絡先を追加します
+func adminAddContactHandler(c echo.Context) error {
+	studentID := c.Param("student_id")
+	message, ok := addContactFromForm(c, studentID, true)
+	return redirectWithFlash(c, "/admin/user/"+studentID, message, ok, "update_success", "update_error")
+}
+
+// adminDeleteContactHandler は管理者が学生の緊急連絡先を削除します
+func adminDeleteContactHandler(c echo.Context) error {
+	studentID := c.Param("student_id")
+	id, _ := strconv.Atoi(c.FormValue("id"))
+	if _, err := deleteEmergencyContact(db, studentID, id, true); err != nil {
+		log.Printf("Failed to delete emergency contact: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to delete emergency contact.")
+	}
+	return redirectWithFlash(c, "/admin/user/"+studentID, "緊急連絡先を削除しました。", true, "update_success", "update_error")
+}
+
+// redirectWithFlash はメッセージをフラッシュに保存してリダイレクトします
+// ok に応じて successKey と errorKey のどちらに保存するかを決めます
+func redirectWithFlash(c echo.Context, path, message string, ok bool, successKey, errorKey string) error {
+	key := errorKey
+	if ok {
+		key = successKey
+	}
+	addFlash(c, message, key)
+	sess, _ := session.Get("session", c)
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		log.Printf("Failed to save session with flash message: %v", err)
+	}
+	return c.Redirect(http.StatusSeeOther, path)
+}
+
+// addFlash はフラッシュメッセージを追加します。保存は続けて呼ぶ redirectWithFlash などで行います
+func addFlash(c echo.Context, message, key string) {
+	sess, _ := session.Get("session", c)
+	sess.AddFlash(message, key)
+}
+
+// popFlash はフラッシュメッセージを1件取り出します (なければ空文字)
+func popFlash(c echo.Context, key string) string {
+	sess, _ := session.Get("session", c)
+	message := ""
+	if flashes := sess.Flashes(key); len(flashes) > 0 {
+		message, _ = flashes[0].(string)
+	}
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		log.Printf("Failed to save session: %v", err)
+	}
+	return message
+}
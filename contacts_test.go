@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// ログイン中のセッションに保存したフラッシュメッセージは、リダイレクト先で1回だけ読み出せる
+func TestRedirectWithFlashRoutesMessagesByResult(t *testing.T) {
+	prev := sessionStore
+	sessionStore = NewServerSessionStore(newMemorySessionBackend(), []byte("test-secret"), time.Hour, 24*time.Hour)
+	t.Cleanup(func() { sessionStore = prev })
+
+	var cookies []*http.Cookie
+	serve := func(h echo.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		if err := session.Middleware(sessionStore)(h)(c); err != nil {
+			t.Fatal(err)
+		}
+		if got := rec.Result().Cookies(); len(got) > 0 {
+			cookies = got
+		}
+		return rec
+	}
+
+	serve(func(c echo.Context) error {
+		sess, _ := session.Get("session", c)
+		sess.Values["authenticated"] = true
+		sess.Values["studentID"] = "admin"
+		return sess.Save(c.Request(), c.Response())
+	})
+
+	rec := serve(func(c echo.Context) error {
+		addFlash(c, "注意があります。", "update_error")
+		return redirectWithFlash(c, "/admin/user/s1", "保存しました。", true, "update_success", "update_error")
+	})
+	if rec.Code != http.StatusSeeOther || rec.Header().Get(echo.HeaderLocation) != "/admin/user/s1" {
+		t.Fatalf("redirect: %d to %q", rec.Code, rec.Header().Get(echo.HeaderLocation))
+	}
+	serve(func(c echo.Context) error {
+		return redirectWithFlash(c, "/admin/user/s1", "失敗しました。", false, "settings_success", "settings_error")
+	})
+
+	var success, updateError, settingsError, again string
+	serve(func(c echo.Context) error {
+		success = popFlash(c, "update_success")
+		updateError = popFlash(c, "update_error")
+		settingsError = popFlash(c, "settings_error")
+		return nil
+	})
+	serve(func(c echo.Context) error {
+		again = popFlash(c, "update_success")
+		return nil
+	})
+	if success != "保存しました。" || updateError != "注意があります。" || settingsError != "失敗しました。" {
+		t.Errorf("flashes = %q, %q, %q", success, updateError, settingsError)
+	}
+	if again != "" {
+		t.Errorf("flash read twice: %q", again)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultCurfew = "22:00"
+	// clockLayout は門限や帰寮時刻の入力欄 (time) の形式です
+	clockLayout = "15:04"
+	// curfewRepeatThreshold は無届の門限超えが指導対象となる回数です
+	curfewRepeatThreshold = 3
+	// curfewReportDays は門限超えレポートの既定の集計日数です
+	curfewReportDays = 30
+)
+
+// clockOn は指定日の時刻 (HH:MM) を日時に変換します
+// 正午より前の時刻は、その日の夜から続く翌日の深夜・早朝として扱います
+func clockOn(date time.Time, clock string) (time.Time, error) {
+	t, err := time.Parse(clockLayout, clock)
+	if err != nil {
+		return time.Time{}, err
+	}
+	y, m, d := date.Date()
+	if t.Hour() < 12 {
+		d++
+	}
+	return time.Date(y, m, d, t.Hour(), t.Minute(), 0, 0, time.Local), nil
+}
+
+// getCurfew は門限の時刻 (HH:MM) を取得します
+func getCurfew(db *sql.DB) string {
+	curfew := getSetting(db, settingCurfew, defaultCurfew)
+	if _, err := time.Parse(clockLayout, curfew); err != nil {
+		log.Printf("Invalid curfew setting %q: %v", curfew, err)
+		return defaultCurfew
+	}
+	return curfew
+}
+
+// curfewOn は指定日の門限の日時を返します
+func curfewOn(date time.Time, curfew string) time.Time {
+	t, err := clockOn(date, curfew)
+	if err != nil {
+		t, _ = clockOn(date, defaultCurfew)
+	}
+	return t
+}
+
+// isCurfewViolation は帰寮時刻が門限違反かどうかを返します
+// 門限後の帰寮を届け出ていない場合と、届け出た予定時刻より遅れた場合が違反です
+func isCurfewViolation(lateReturn bool, expectedArrival, actualArrival *time.Time, curfewAt time.Time) bool {
+	if actualArrival == nil || !actualArrival.After(curfewAt) {
+		return false
+	}
+	return !lateReturn || expectedArrival == nil || actualArrival.After(*expectedArrival)
+}
+
+// ViolatesCurfew は点呼リストの寮生が門限に違反して帰寮したかどうかを返します
+func (e RollCallEntry) ViolatesCurfew(curfewAt time.Time) bool {
+	return isCurfewViolation(e.LateReturn, e.ExpectedArrival, e.ActualArrival, curfewAt)
+}
+
+// getCurfewViolations は期間内の門限違反を寮生ごとに集計し、無届の門限超えが多い順に返します
+func getCurfewViolations(db *sql.DB, from, to time.Time, curfew string) ([]CurfewViolationSummary, error) {
+	rows, err := db.Query(`
+	SELECT rc.student_id, `+userNameSQL+`, rc.roll_date, COALESCE(r.late_return, FALSE), r.expected_arrival, rc.actual_arrival
+	FROM roll_calls rc
+	JOIN users u ON u.username = rc.student_id
+	LEFT JOIN gaihaku_kesshoku_records r ON r.student_id = rc.student_id AND r.record_date = rc.roll_date
+	WHERE rc.roll_date BETWEEN $1 AND $2 AND rc.actual_arrival IS NOT NULL
+	ORDER BY rc.roll_date ASC`, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query arrivals: %w", err)
+	}
+	defer rows.Close()
+
+	summaries := make(map[string]*CurfewViolationSummary)
+	for rows.Next() {
+		var v CurfewViolation
+		var expectedArrival sql.NullTime
+		if err := rows.Scan(&v.StudentID, &v.StudentName, &v.RecordDate, &v.LateReturn, &expectedArrival, &v.ActualArrival); err != nil {
+			log.Printf("Failed to scan arrival: %v", err)
+			continue
+		}
+		if expectedArrival.Valid {
+			v.ExpectedArrival = &expectedArrival.Time
+		}
+		if !isCurfewViolation(v.LateReturn, v.ExpectedArrival, &v.ActualArrival, curfewOn(v.RecordDate, curfew)) {
+			continue
+		}
+
+		s, ok := summaries[v.StudentID]
+		if !ok {
+			s = &CurfewViolationSummary{StudentID: v.StudentID, StudentName: v.StudentName}
+			summaries[v.StudentID] = s
+		}
+		if v.LateReturn {
+			s.LaterThanExpected++
+		} else {
+			s.Unregistered++
+		}
+		s.Violations = append(s.Violations, v)
+	}
+
+	result := make([]CurfewViolationSummary, 0, len(summaries))
+	for _, s := range summaries {
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Unregistered != result[j].Unregistered {
+			return result[i].Unregistered > result[j].Unregistered
+		}
+		if len(result[i].Violations) != len(result[j].Violations) {
+			return len(result[i].Violations) > len(result[j].Violations)
+		}
+		return result[i].StudentID < result[j].StudentID
+	})
+
+	return result, nil
+}
+
+// adminCurfewHandler は門限違反の集計レポートを表示します (既定は直近30日間)
+func adminCurfewHandler(c echo.Context) error {
+	to := time.Now()
+	if d, err := time.ParseInLocation("2006-01-02", c.QueryParam("to"), time.Local); err == nil {
+		to = d
+	}
+	from := to.AddDate(0, 0, -(curfewReportDays - 1))
+	if d, err := time.ParseInLocation("2006-01-02", c.QueryParam("from"), time.Local); err == nil {
+		from = d
+	}
+	if from.After(to) {
+		from, to = to, from
+	}
+
+	curfew := getCurfew(db)
+	summaries, err := getCurfewViolations(db, from, to, curfew)
+	if err != nil {
+		log.Printf("Failed to get curfew violations: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to retrieve curfew report.")
+	}
+
+	return c.Render(http.StatusOK, "admin_curfew.html", map[string]interface{}{
+		"from":      from,
+		"to":        to,
+		"curfew":    curfew,
+		"threshold": curfewRepeatThreshold,
+		"summaries": summaries,
+	})
+}
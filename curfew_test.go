@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClockOnMovesEarlyMorningToNextDay(t *testing.T) {
+	// 月末の夜
+	date := time.Date(2024, 1, 31, 0, 0, 0, 0, time.Local)
+
+	got, err := clockOn(date, "22:30")
+	if err != nil || !got.Equal(time.Date(2024, 1, 31, 22, 30, 0, 0, time.Local)) {
+		t.Errorf("clockOn(22:30) = %v, %v; want the same evening", got, err)
+	}
+	got, err = clockOn(date, "12:00")
+	if err != nil || !got.Equal(time.Date(2024, 1, 31, 12, 0, 0, 0, time.Local)) {
+		t.Errorf("clockOn(12:00) = %v, %v; want noon of the same day", got, err)
+	}
+	got, err = clockOn(date, "00:30")
+	if err != nil || !got.Equal(time.Date(2024, 2, 1, 0, 30, 0, 0, time.Local)) {
+		t.Errorf("clockOn(00:30) = %v, %v; want after midnight into February", got, err)
+	}
+
+	for _, invalid := range []string{"", "25:00", "9pm"} {
+		if _, err := clockOn(date, invalid); err == nil {
+			t.Errorf("clockOn(%q) accepted an invalid time", invalid)
+		}
+	}
+}
+
+func TestCurfewOnFallsBackToDefault(t *testing.T) {
+	date := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	if got := curfewOn(date, "invalid"); !got.Equal(time.Date(2024, 1, 1, 22, 0, 0, 0, time.Local)) {
+		t.Errorf("curfewOn(invalid) = %v, want the default %s", got, defaultCurfew)
+	}
+	if got := curfewOn(date, "01:00"); !got.Equal(time.Date(2024, 1, 2, 1, 0, 0, 0, time.Local)) {
+		t.Errorf("curfewOn(01:00) = %v, want 01:00 of the next day", got)
+	}
+}
+
+func TestIsCurfewViolation(t *testing.T) {
+	curfewAt := time.Date(2024, 1, 1, 22, 0, 0, 0, time.Local)
+	at := func(hour, min int) *time.Time {
+		t := time.Date(2024, 1, 1, hour, min, 0, 0, time.Local)
+		return &t
+	}
+
+	if isCurfewViolation(false, nil, nil, curfewAt) {
+		t.Error("no arrival recorded counted as a violation")
+	}
+	if isCurfewViolation(false, nil, at(22, 0), curfewAt) {
+		t.Error("arrival exactly at curfew counted as a violation")
+	}
+	if !isCurfewViolation(false, nil, at(22, 1), curfewAt) {
+		t.Error("arrival after curfew without notice not counted")
+	}
+
+	// 届け出た予定時刻までの帰寮は違反にならない
+	if isCurfewViolation(true, at(23, 0), at(23, 0), curfewAt) {
+		t.Error("arrival at the notified time counted as a violation")
+	}
+	if !isCurfewViolation(true, at(23, 0), at(23, 10), curfewAt) {
+		t.Error("arrival later than the notified time not counted")
+	}
+	if !isCurfewViolation(true, nil, at(22, 30), curfewAt) {
+		t.Error("notice without a time excused a late arrival")
+	}
+}
@@ -13,10 +13,12 @@ import (
 // グローバル変数としてデータベース接続を保持
 var db *sql.DB
 
+// dbConnStr はデータベースの接続文字列です (記録の変更の通知を受け取る接続でも使います)
+const dbConnStr = "user=user password=password dbname=mydatabase host=db sslmode=disable"
+
 // connectDB はデータベースに接続します
 func connectDB() (*sql.DB, error) {
-	connStr := "user=user password=password dbname=mydatabase host=db sslmode=disable"
-	db, err := sql.Open("postgres", connStr)
+	db, err := sql.Open("postgres", dbConnStr)
 	if err != nil {
 		return nil, err
 	}
@@ -41,12 +43,94 @@ func initDBSchema(db *sql.DB) error {
 	}
 	log.Println("Gaihaku records table created or already exists!")
 
+	if err := createRollCallsTable(db); err != nil {
+		return err
+	}
+	log.Println("Roll calls table created or already exists!")
+
+	if err := createLoginThrottlesTable(db); err != nil {
+		return err
+	}
+	log.Println("Login throttles table created or already exists!")
+
+	if err := createSessionsTable(db); err != nil {
+		return err
+	}
+	log.Println("Sessions table created or already exists!")
+
+	if err := createLocationTables(db); err != nil {
+		return err
+	}
+	log.Println("Location tables created or already exist!")
+
+	if err := createEmergencyContactsTable(db); err != nil {
+		return err
+	}
+	log.Println("Emergency contacts table created or already exists!")
+
+	if err := createAppSettingsTable(db); err != nil {
+		return err
+	}
+	log.Println("App settings table created or already exists!")
+
+	if err := createGuardianApprovalsTable(db); err != nil {
+		return err
+	}
+	log.Println("Guardian approvals table created or already exists!")
+
+	if err := createPresenceLogsTable(db); err != nil {
+		return err
+	}
+	log.Println("Presence logs table created or already exists!")
+
+	if err := createSafetyTables(db); err != nil {
+		return err
+	}
+	log.Println("Safety tables created or already exists!")
+
+	if err := createDormCalendarTable(db); err != nil {
+		return err
+	}
+	log.Println("Dorm calendar table created or already exists!")
+
+	if err := createMenuItemsTable(db); err != nil {
+		return err
+	}
+	log.Println("Menu items table created or already exists!")
+
+	if err := createDietaryRequirementsTable(db); err != nil {
+		return err
+	}
+	log.Println("Dietary requirements table created or already exists!")
+
+	if err := createGuestMealsTable(db); err != nil {
+		return err
+	}
+	log.Println("Guest meals table created or already exists!")
+
+	if err := createRecordHistoryTable(db); err != nil {
+		return err
+	}
+	log.Println("Record history table created or already exists!")
+
+	if err := createUserSearchIndexes(db); err != nil {
+		return err
+	}
+	log.Println("User search indexes created or already exist!")
+
 	return nil
 }
 
-// getAllUsers は全てのユーザー情報を取得します（パスワードを除く）
-func getAllUsers(db *sql.DB) ([]User, error) {
-	rows, err := db.Query("SELECT id, username, role FROM users ORDER BY id ASC")
+// getAllUsers は全てのユーザー情報を現在の部屋とともに取得します（パスワードを除く）
+// 棟・フロア・部屋の順に並べ、filter で棟・フロアを絞り込めます
+func getAllUsers(db *sql.DB, filter LocationFilter) ([]User, error) {
+	args := []interface{}{time.Now().Format("2006-01-02")}
+	query := `
+	SELECT u.id, u.username, u.role, u.active, ` + profileColumnsSQL + `, ` + locationColumnsSQL + `
+	FROM users u ` + locationJoinSQL("$1::date") + `
+	WHERE TRUE` + filter.where(&args) + `
+	ORDER BY ` + locationOrderSQL + `, u.id ASC`
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query users: %w", err)
 	}
@@ -55,7 +139,9 @@ func getAllUsers(db *sql.DB) ([]User, error) {
 	var users []User
 	for rows.Next() {
 		var u User
-		if err := rows.Scan(&u.ID, &u.Username, &u.Role); err != nil {
+		dest := append([]interface{}{&u.ID, &u.Username, &u.Role, &u.Active}, profileScanDest(&u)...)
+		dest = append(dest, locationScanDest(&u.Location)...)
+		if err := rows.Scan(dest...); err != nil {
 			log.Printf("Failed to scan user: %v", err)
 			continue
 		}
@@ -72,13 +158,32 @@ func createUsersTable(db *sql.DB) error {
 		id SERIAL PRIMARY KEY,
 		username VARCHAR(50) UNIQUE NOT NULL,
 		password VARCHAR(255) NOT NULL,
-		role VARCHAR(10) NOT NULL DEFAULT 'user'
-	);`
+		role VARCHAR(20) NOT NULL DEFAULT 'user',
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		display_name VARCHAR(100) NOT NULL DEFAULT '',
+		furigana VARCHAR(100) NOT NULL DEFAULT '',
+		grade SMALLINT NOT NULL DEFAULT 0,
+		department VARCHAR(100) NOT NULL DEFAULT '',
+		phone VARCHAR(20) NOT NULL DEFAULT '',
+		email VARCHAR(255) NOT NULL DEFAULT '',
+		birth_date DATE,
+		qr_token VARCHAR(64) UNIQUE
+	);
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS active BOOLEAN NOT NULL DEFAULT TRUE;
+	ALTER TABLE users ALTER COLUMN role TYPE VARCHAR(20);
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS display_name VARCHAR(100) NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS furigana VARCHAR(100) NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS grade SMALLINT NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS department VARCHAR(100) NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS phone VARCHAR(20) NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS email VARCHAR(255) NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS birth_date DATE;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS qr_token VARCHAR(64) UNIQUE;`
 	_, err := db.Exec(createTableSQL)
 	return err
 }
 
-// createGaihakuKesshokuRecordsTable は欠食・外泊・点呼記録テーブルを作成します
+// createGaihakuKesshokuRecordsTable は欠食・外泊記録テーブルを作成します
 func createGaihakuKesshokuRecordsTable(db *sql.DB) error {
 	const createTableSQL = `
 	CREATE TABLE IF NOT EXISTS gaihaku_kesshoku_records (
@@ -89,11 +194,32 @@ func createGaihakuKesshokuRecordsTable(db *sql.DB) error {
 		lunch BOOLEAN NOT NULL DEFAULT TRUE,
 		dinner BOOLEAN NOT NULL DEFAULT TRUE,
 		overnight BOOLEAN NOT NULL DEFAULT FALSE,
-		roll_call BOOLEAN NOT NULL DEFAULT FALSE,
 		note TEXT,
+		destination TEXT NOT NULL DEFAULT '',
+		stay_phone VARCHAR(20) NOT NULL DEFAULT '',
+		expected_return TIMESTAMP WITH TIME ZONE,
+		guardian_status VARCHAR(20) NOT NULL DEFAULT '',
+		guardian_decided_at TIMESTAMP WITH TIME ZONE,
+		staff_status VARCHAR(20) NOT NULL DEFAULT '',
+		staff_comment TEXT NOT NULL DEFAULT '',
+		staff_decided_by VARCHAR(50),
+		staff_decided_at TIMESTAMP WITH TIME ZONE,
+		late_return BOOLEAN NOT NULL DEFAULT FALSE,
+		expected_arrival TIMESTAMP WITH TIME ZONE,
 		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
 		UNIQUE (student_id, record_date)
-	);`
+	);
+	ALTER TABLE gaihaku_kesshoku_records ADD COLUMN IF NOT EXISTS destination TEXT NOT NULL DEFAULT '';
+	ALTER TABLE gaihaku_kesshoku_records ADD COLUMN IF NOT EXISTS stay_phone VARCHAR(20) NOT NULL DEFAULT '';
+	ALTER TABLE gaihaku_kesshoku_records ADD COLUMN IF NOT EXISTS expected_return TIMESTAMP WITH TIME ZONE;
+	ALTER TABLE gaihaku_kesshoku_records ADD COLUMN IF NOT EXISTS guardian_status VARCHAR(20) NOT NULL DEFAULT '';
+	ALTER TABLE gaihaku_kesshoku_records ADD COLUMN IF NOT EXISTS guardian_decided_at TIMESTAMP WITH TIME ZONE;
+	ALTER TABLE gaihaku_kesshoku_records ADD COLUMN IF NOT EXISTS staff_status VARCHAR(20) NOT NULL DEFAULT '';
+	ALTER TABLE gaihaku_kesshoku_records ADD COLUMN IF NOT EXISTS staff_comment TEXT NOT NULL DEFAULT '';
+	ALTER TABLE gaihaku_kesshoku_records ADD COLUMN IF NOT EXISTS staff_decided_by VARCHAR(50);
+	ALTER TABLE gaihaku_kesshoku_records ADD COLUMN IF NOT EXISTS staff_decided_at TIMESTAMP WITH TIME ZONE;
+	ALTER TABLE gaihaku_kesshoku_records ADD COLUMN IF NOT EXISTS late_return BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE gaihaku_kesshoku_records ADD COLUMN IF NOT EXISTS expected_arrival TIMESTAMP WITH TIME ZONE;`
 
 	_, err := db.Exec(createTableSQL)
 	if err != nil {
@@ -121,12 +247,12 @@ func RegisterUser(db *sql.DB, studentID, password string) error {
 // AuthenticateUser はユーザーのログイン認証を行います
 func AuthenticateUser(db *sql.DB, studentID, password string) (bool, string) {
 	var hashedPassword, role string
-	query := "SELECT password, role FROM users WHERE username = $1"
+	query := "SELECT password, role FROM users WHERE username = $1 AND active"
 	err := db.QueryRow(query, studentID).Scan(&hashedPassword, &role)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return false, "" // ユーザーが存在しない
+			return false, "" // ユーザーが存在しない、または無効化されている
 		}
 		log.Printf("Error during authentication query: %v", err)
 		return false, ""
@@ -144,7 +270,8 @@ func getGaihakuKesshokuRecords(db *sql.DB, studentID string) ([]GaihakuKesshokuR
 	records := []GaihakuKesshokuRecord{}
 	// 現在の日付から1週間後までを取得
 	rows, err := db.Query(`
-	SELECT record_date, breakfast, lunch, dinner, overnight, note 
+	SELECT record_date, breakfast, lunch, dinner, overnight, COALESCE(note, ''), destination, stay_phone, expected_return, guardian_status, staff_status, staff_comment,
+		late_return, expected_arrival
 	FROM gaihaku_kesshoku_records 
 	WHERE student_id = $1 AND record_date >= CURRENT_DATE AND record_date <= CURRENT_DATE + INTERVAL '7 days' 
 	ORDER BY record_date ASC`, studentID)
@@ -156,13 +283,26 @@ func getGaihakuKesshokuRecords(db *sql.DB, studentID string) ([]GaihakuKesshokuR
 
 	existingRecords := make(map[string]GaihakuKesshokuRecord)
 	now := time.Now()
+	calendar, err := getDormCalendar(db, now, now.AddDate(0, 0, 6))
+	if err != nil {
+		log.Printf("Failed to get dorm calendar: %v", err)
+	}
 
 	for rows.Next() {
 		var r GaihakuKesshokuRecord
-		if err := rows.Scan(&r.RecordDate, &r.Breakfast, &r.Lunch, &r.Dinner, &r.Overnight, &r.Note); err != nil {
+		var expectedReturn, expectedArrival sql.NullTime
+		if err := rows.Scan(&r.RecordDate, &r.Breakfast, &r.Lunch, &r.Dinner, &r.Overnight, &r.Note,
+			&r.Destination, &r.StayPhone, &expectedReturn, &r.GuardianStatus, &r.StaffStatus, &r.StaffComment,
+			&r.LateReturn, &expectedArrival); err != nil {
 			log.Printf("Failed to scan gaihaku record: %v", err)
 			continue
 		}
+		if expectedReturn.Valid {
+			r.ExpectedReturn = &expectedReturn.Time
+		}
+		if expectedArrival.Valid {
+			r.ExpectedArrival = &expectedArrival.Time
+		}
 		existingRecords[r.RecordDate.Format("2006-01-02")] = r
 	}
 
@@ -175,13 +315,14 @@ func getGaihakuKesshokuRecords(db *sql.DB, studentID string) ([]GaihakuKesshokuR
 			// 既存のデータがあればそれを使用
 			records = append(records, r)
 		} else {
-			// なければデフォルト値を使用
+			// なければデフォルト値を使用 (特別な日に提供されない食事は欠食とする)
+			day := calendar[dateStr]
 			records = append(records, GaihakuKesshokuRecord{
 				StudentID:  studentID,
 				RecordDate: recordDate,
-				Breakfast:  true,
-				Lunch:      true,
-				Dinner:     true,
+				Breakfast:  day.BreakfastServed(),
+				Lunch:      day.MealsServed(),
+				Dinner:     day.MealsServed(),
 				Overnight:  false,
 			})
 		}
@@ -217,3 +358,46 @@ func createAdminUserIfNotExists(db *sql.DB) error {
 
 	return nil
 }
+
+// getUserByUsername は学籍番号からユーザー情報を取得します（パスワードを除く）
+func getUserByUsername(db *sql.DB, studentID string) (*User, error) {
+	var u User
+	dest := append([]interface{}{&u.ID, &u.Username, &u.Role, &u.Active}, profileScanDest(&u)...)
+	err := db.QueryRow("SELECT u.id, u.username, u.role, u.active, "+profileColumnsSQL+" FROM users u WHERE u.username = $1", studentID).Scan(dest...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query user: %w", err)
+	}
+	return &u, nil
+}
+
+// updateUserPassword はユーザーのパスワードを変更します
+func updateUserPassword(db *sql.DB, studentID, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	_, err = db.Exec("UPDATE users SET password = $1 WHERE username = $2", string(hashedPassword), studentID)
+	if err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	return nil
+}
+
+// updateUserRole はユーザーの役割を変更します
+func updateUserRole(db *sql.DB, studentID, role string) error {
+	_, err := db.Exec("UPDATE users SET role = $1 WHERE username = $2", role, studentID)
+	if err != nil {
+		return fmt.Errorf("failed to update role: %w", err)
+	}
+	return nil
+}
+
+// updateUserActive はユーザーを有効化・無効化します
+func updateUserActive(db *sql.DB, studentID string, active bool) error {
+	_, err := db.Exec("UPDATE users SET active = $1 WHERE username = $2", active, studentID)
+	if err != nil {
+		return fmt.Errorf("failed to update active status: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestDB は TEST_DATABASE_URL のデータベースにテスト専用のスキーマを作成し、スキーマを初期化して接続を返します
+// 接続はグローバル変数 db にも設定し、テストの終了時にスキーマごと削除します
+// TEST_DATABASE_URL が設定されていない場合はテストをスキップします
+// (例: docker compose で起動したデータベースに対して TEST_DATABASE_URL="host=localhost user=user password=password dbname=mydatabase sslmode=disable")
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	connStr := os.Getenv("TEST_DATABASE_URL")
+	if connStr == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	admin, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatalf("failed to open test database: %v", err)
+	}
+	schema := fmt.Sprintf("gaihaku_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		admin.Close()
+		t.Fatalf("failed to create test schema: %v", err)
+	}
+
+	conn, err := sql.Open("postgres", withSearchPath(connStr, schema+",public"))
+	if err != nil {
+		t.Fatalf("failed to open test schema: %v", err)
+	}
+	prev := db
+	db = conn
+	t.Cleanup(func() {
+		db = prev
+		conn.Close()
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Logf("failed to drop test schema %s: %v", schema, err)
+		}
+		admin.Close()
+	})
+
+	if err := initDBSchema(conn); err != nil {
+		t.Fatalf("failed to initialize schema: %v", err)
+	}
+	return conn
+}
+
+// withSearchPath は接続文字列 (URL 形式または key=value 形式) に search_path を追加します
+func withSearchPath(connStr, searchPath string) string {
+	if strings.Contains(connStr, "://") {
+		u, err := url.Parse(connStr)
+		if err == nil {
+			q := u.Query()
+			q.Set("search_path", searchPath)
+			u.RawQuery = q.Encode()
+			return u.String()
+		}
+	}
+	return connStr + " search_path=" + searchPath
+}
+
+// mustExec はテスト用のデータを準備する SQL を実行します
+func mustExec(t *testing.T, db *sql.DB, query string, args ...interface{}) {
+	t.Helper()
+	if _, err := db.Exec(query, args...); err != nil {
+		t.Fatalf("failed to execute %q: %v", query, err)
+	}
+}
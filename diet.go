@@ -0,0 +1,240 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+// 食事制限の種類
+const (
+	DietHalal      = "halal"      // ハラール
+	DietVegetarian = "vegetarian" // ベジタリアン
+	DietVegan      = "vegan"      // ヴィーガン
+	DietOther      = "other"      // その他 (備考に内容を記入)
+)
+
+// dietKinds は画面に表示する食事制限の種類の一覧です
+var dietKinds = []struct {
+	Name  string
+	Label string
+}{
+	{DietHalal, "ハラール"},
+	{DietVegetarian, "ベジタリアン"},
+	{DietVegan, "ヴィーガン"},
+	{DietOther, "その他"},
+}
+
+// 食事制限の種類別の集計で、種類に当てはまらない区分の表示名
+const (
+	regularDietLabel = "通常食"
+	allergyLabel     = "アレルギー対応"
+)
+
+// createDietaryRequirementsTable は寮生のアレルギー・食事制限のテーブルを作成します
+func createDietaryRequirementsTable(db *sql.DB) error {
+	const createTableSQL = `
+	CREATE TABLE IF NOT EXISTS dietary_requirements (
+		student_id VARCHAR(50) PRIMARY KEY,
+		diet VARCHAR(20) NOT NULL DEFAULT '',
+		allergens TEXT[] NOT NULL DEFAULT '{}',
+		note TEXT NOT NULL DEFAULT '',
+		updated_by VARCHAR(50),
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+	-- 以前はアレルゲンを「,」区切りの文字列で保存していたため、献立と同じく配列に変換する
+	DO $$ BEGIN
+		IF EXISTS (SELECT 1 FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = 'dietary_requirements' AND column_name = 'allergens' AND data_type = 'text') THEN
+			ALTER TABLE dietary_requirements ALTER COLUMN allergens DROP DEFAULT;
+			ALTER TABLE dietary_requirements ALTER COLUMN allergens TYPE TEXT[]
+				USING CASE WHEN allergens = '' THEN '{}'::text[] ELSE string_to_array(allergens, ',') END;
+			ALTER TABLE dietary_requirements ALTER COLUMN allergens SET DEFAULT '{}';
+		END IF;
+	END $$;`
+
+	_, err := db.Exec(createTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to execute SQL: %w", err)
+	}
+
+	return nil
+}
+
+// dietLabel は食事制限の種類の表示名を返します
+func dietLabel(diet string) string {
+	for _, d := range dietKinds {
+		if d.Name == diet {
+			return d.Label
+		}
+	}
+	return diet
+}
+
+// isValidDiet は食事制限の種類が定義済みのもの (または制限なしの空文字) かを確認します
+func isValidDiet(diet string) bool {
+	return diet == "" || dietLabel(diet) != diet
+}
+
+// IsEmpty はアレルギー・食事制限が登録されていないかを返します
+func (d DietaryRequirement) IsEmpty() bool {
+	return d.Diet == "" && len(d.Allergens) == 0 && d.Note == ""
+}
+
+// AllergenLabel はアレルゲンを「・」区切りで返します
+func (d DietaryRequirement) AllergenLabel() string {
+	return strings.Join(d.Allergens, "・")
+}
+
+// getDietaryRequirement は寮生のアレルギー・食事制限を取得します。未登録の場合は空の内容を返します
+func getDietaryRequirement(db *sql.DB, studentID string) (DietaryRequirement, error) {
+	d := DietaryRequirement{StudentID: studentID}
+	err := db.QueryRow("SELECT diet, allergens, note FROM dietary_requirements WHERE student_id = $1", studentID).
+		Scan(&d.Diet, pq.Array(&d.Allergens), &d.Note)
+	if err == sql.ErrNoRows {
+		return d, nil
+	}
+	if err != nil {
+		return d, fmt.Errorf("failed to query dietary requirement: %w", err)
+	}
+	return d, nil
+}
+
+// saveDietaryRequirement はアレルギー・食事制限を保存します。内容が空の場合は登録を削除します
+func saveDietaryRequirement(db *sql.DB, d DietaryRequirement, updatedBy string) error {
+	if d.IsEmpty() {
+		if _, err := db.Exec("DELETE FROM dietary_requirements WHERE student_id = $1", d.StudentID); err != nil {
+			return fmt.Errorf("failed to delete dietary requirement: %w", err)
+		}
+		return nil
+	}
+	_, err := db.Exec(`INSERT INTO dietary_requirements (student_id, diet, allergens, note, updated_by) VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (student_id) DO UPDATE SET diet = EXCLUDED.diet, allergens = EXCLUDED.allergens, note = EXCLUDED.note,
+		updated_by = EXCLUDED.updated_by, updated_at = CURRENT_TIMESTAMP`,
+		d.StudentID, d.Diet, pq.Array(d.Allergens), d.Note, updatedBy)
+	if err != nil {
+		return fmt.Errorf("failed to save dietary requirement: %w", err)
+	}
+	return nil
+}
+
+// saveDietFromForm はフォームの内容を確認してアレルギー・食事制限を保存し、表示するメッセージと成否を返します
+func saveDietFromForm(c echo.Context, studentID string) (string, bool) {
+	d := DietaryRequirement{
+		StudentID: studentID,
+		Diet:      c.FormValue("diet"),
+		Allergens: splitAllergens(c.FormValue("allergens")),
+		Note:      strings.TrimSpace(c.FormValue("diet_note")),
+	}
+	if !isValidDiet(d.Diet) {
+		return "食事制限の種類を選択してください。", false
+	}
+	if utf8.RuneCountInString(d.AllergenLabel()) > 200 || utf8.RuneCountInString(d.Note) > 200 {
+		return "アレルゲン・備考は200文字以内で入力してください。", false
+	}
+	if d.Diet == DietOther && d.Note == "" {
+		return "食事制限が「その他」の場合は、備考に内容を入力してください。", false
+	}
+	if err := saveDietaryRequirement(db, d, currentUser(c).Username); err != nil {
+		log.Printf("Failed to save dietary requirement for %s: %v", studentID, err)
+		return "アレルギー・食事制限の保存に失敗しました。", false
+	}
+	return "アレルギー・食事制限を保存しました。", true
+}
+
+// updateOwnDietHandler はログイン中の寮生が自分のアレルギー・食事制限を保存します
+func updateOwnDietHandler(c echo.Context) error {
+	if !currentUser(c).IsResident() {
+		return c.String(http.StatusForbidden, "Permission denied.")
+	}
+	message, ok := saveDietFromForm(c, currentUser(c).Username)
+	return redirectWithFlash(c, "/settings", message, ok, "settings_success", "settings_error")
+}
+
+// adminUpdateDietHandler は管理者が寮生のアレルギー・食事制限を保存します
+func adminUpdateDietHandler(c echo.Context) error {
+	studentID := c.Param("student_id")
+	message, ok := saveDietFromForm(c, studentID)
+	return redirectWithFlash(c, "/admin/user/"+studentID, message, ok, "update_success", "update_error")
+}
+
+// getDietaryEaters は指定日に食事をとる寮生のうち、アレルギー・食事制限のある寮生を部屋順に取得します
+// 登録がなければ食べるものとし、行事予定で提供しない食事は食べないものとします
+func getDietaryEaters(db *sql.DB, date time.Time) ([]DietaryEater, error) {
+	rows, err := db.Query(`
+	SELECT u.username, `+userNameSQL+`, dr.diet, dr.allergens, dr.note,
+		`+mealEatenSQL("breakfast")+`, `+mealEatenSQL("lunch")+`, `+mealEatenSQL("dinner")+`, `+locationColumnsSQL+`
+	FROM users u
+	JOIN dietary_requirements dr ON dr.student_id = u.username`+locationJoinSQL("$1::date")+`
+	LEFT JOIN gaihaku_kesshoku_records r ON r.student_id = u.username AND r.record_date = $1::date`+dormCalendarJoinSQL("$1::date")+`
+	WHERE `+residentOnDaySQL("$1::date")+`
+	ORDER BY `+locationOrderSQL+`, u.username ASC`, date.Format("2006-01-02"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query dietary requirements: %w", err)
+	}
+	defer rows.Close()
+
+	var eaters []DietaryEater
+	for rows.Next() {
+		var e DietaryEater
+		dest := append([]interface{}{&e.StudentID, &e.StudentName, &e.Diet, pq.Array(&e.Allergens), &e.Note, &e.Breakfast, &e.Lunch, &e.Dinner}, locationScanDest(&e.Location)...)
+		if err := rows.Scan(dest...); err != nil {
+			log.Printf("Failed to scan dietary requirement: %v", err)
+			continue
+		}
+		if !e.Breakfast && !e.Lunch && !e.Dinner {
+			continue
+		}
+		eaters = append(eaters, e)
+	}
+	return eaters, nil
+}
+
+// countDiets は食事ごとに、通常食・食事制限の種類別・アレルギー対応の人数を集計します
+// 通常食は total (その日の食数) から食事制限のある寮生を除いた人数です
+// アレルギー対応は食事制限のない寮生も含めるため、ほかの区分と重複することがあります
+func countDiets(total MealCount, eaters []DietaryEater) []DietCount {
+	counts := make([]DietCount, 0, len(dietKinds)+2)
+	for _, k := range dietKinds {
+		counts = append(counts, DietCount{Diet: k.Name, Label: k.Label})
+	}
+	counts = append(counts, DietCount{Label: allergyLabel, Allergy: true})
+	allergy := &counts[len(counts)-1]
+
+	add := func(c *DietCount, e DietaryEater) {
+		if e.Breakfast {
+			c.Breakfast++
+		}
+		if e.Lunch {
+			c.Lunch++
+		}
+		if e.Dinner {
+			c.Dinner++
+		}
+	}
+	for _, e := range eaters {
+		for i := range counts[:len(dietKinds)] {
+			if counts[i].Diet == e.Diet {
+				add(&counts[i], e)
+			}
+		}
+		if len(e.Allergens) > 0 {
+			add(allergy, e)
+		}
+	}
+
+	regular := DietCount{Label: regularDietLabel, Breakfast: total.Breakfast, Lunch: total.Lunch, Dinner: total.Dinner}
+	for _, c := range counts[:len(dietKinds)] {
+		regular.Breakfast -= c.Breakfast
+		regular.Lunch -= c.Lunch
+		regular.Dinner -= c.Dinner
+	}
+	return append([]DietCount{regular}, counts...)
+}
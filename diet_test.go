@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCountDiets(t *testing.T) {
+	total := MealCount{Breakfast: 10, Lunch: 12, Dinner: 11}
+	eaters := []DietaryEater{
+		{DietaryRequirement: DietaryRequirement{Diet: DietHalal}, Breakfast: true, Lunch: true, Dinner: true},
+		{DietaryRequirement: DietaryRequirement{Diet: DietHalal, Allergens: []string{"卵"}}, Lunch: true},
+		{DietaryRequirement: DietaryRequirement{Diet: DietVegan}, Dinner: true},
+		// アレルギーのみの寮生は通常食にも数える
+		{DietaryRequirement: DietaryRequirement{Allergens: []string{"そば"}}, Breakfast: true, Dinner: true},
+	}
+
+	got := make(map[string][3]int)
+	for _, c := range countDiets(total, eaters) {
+		got[c.Label] = [3]int{c.Breakfast, c.Lunch, c.Dinner}
+	}
+	want := map[string][3]int{
+		regularDietLabel: {9, 10, 9},
+		"ハラール":           {1, 2, 1},
+		"ベジタリアン":         {0, 0, 0},
+		"ヴィーガン":          {0, 0, 1},
+		"その他":            {0, 0, 0},
+		allergyLabel:     {1, 1, 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("countDiets = %v, want %v", got, want)
+	}
+}
+
+func TestIsValidDiet(t *testing.T) {
+	for _, d := range []string{"", DietHalal, DietVegetarian, DietVegan, DietOther} {
+		if !isValidDiet(d) {
+			t.Errorf("isValidDiet(%q) = false", d)
+		}
+	}
+	for _, d := range []string{"kosher", "ハラール"} {
+		if isValidDiet(d) {
+			t.Errorf("isValidDiet(%q) = true", d)
+		}
+	}
+}
+
+func TestSaveDietaryRequirementDeletesEmpty(t *testing.T) {
+	db := openTestDB(t)
+	d := DietaryRequirement{StudentID: "s1", Diet: DietOther, Allergens: []string{"えび", "かに"}, Note: "豚肉不可"}
+	if err := saveDietaryRequirement(db, d, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := getDietaryRequirement(db, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, d) {
+		t.Errorf("saved requirement = %+v, want %+v", got, d)
+	}
+
+	if err := saveDietaryRequirement(db, DietaryRequirement{StudentID: "s1"}, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM dietary_requirements`).Scan(&n)
+	if n != 0 {
+		t.Errorf("empty requirement kept %d rows, want 0", n)
+	}
+}
+
+func TestCreateDietaryRequirementsTableConvertsTextAllergens(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, `DROP TABLE dietary_requirements`)
+	mustExec(t, db, `CREATE TABLE dietary_requirements (
+		student_id VARCHAR(50) PRIMARY KEY,
+		diet VARCHAR(20) NOT NULL DEFAULT '',
+		allergens TEXT NOT NULL DEFAULT '',
+		note TEXT NOT NULL DEFAULT '',
+		updated_by VARCHAR(50),
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	)`)
+	mustExec(t, db, `INSERT INTO dietary_requirements (student_id, diet, allergens) VALUES
+		('s1', '', 'えび,かに'),
+		('s2', 'halal', '')`)
+
+	// 2回実行しても変換済みの列はそのまま
+	for i := 0; i < 2; i++ {
+		if err := createDietaryRequirementsTable(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s1, err := getDietaryRequirement(db, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := getDietaryRequirement(db, "s2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s1.Allergens, []string{"えび", "かに"}) || len(s2.Allergens) != 0 {
+		t.Errorf("converted allergens = %v and %v", s1.Allergens, s2.Allergens)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	// forecastDays は厨房に表示する食数の予測の日数です
+	forecastDays = 14
+	// forecastHistoryDays は予測に使う過去の記録の日数です (12週間)
+	forecastHistoryDays = 84
+	// forecastPriorWeight は寮生ごとの喫食率を寮全体の喫食率に寄せる強さ (日数換算) です
+	// 記録の少ない寮生や、初めての種類の日でも極端な予測にならないようにします
+	forecastPriorWeight = 2.0
+	// forecastZ は予測の範囲 (90%) の幅を決める係数です
+	forecastZ = 1.645
+)
+
+// forecastMeals は予測する食事の順番です
+var forecastMeals = [3]string{"breakfast", "lunch", "dinner"}
+
+// forecastRate は過去の記録から数えた、食事が提供された回数と食べた回数です
+type forecastRate struct {
+	served int
+	eaten  int
+}
+
+// rate は喫食率を返します。prior に向けて forecastPriorWeight 日分だけ寄せます
+func (r forecastRate) rate(prior float64) float64 {
+	return (float64(r.eaten) + forecastPriorWeight*prior) / (float64(r.served) + forecastPriorWeight)
+}
+
+// forecastPatternSQL は日付 d の傾向を分ける区分を表すSQLの式です (dormCalendarJoinSQL と組み合わせて使います)
+// 行事予定に登録された日 (祝日の朝食なしなど) はその種類ごとに、それ以外の日は曜日ごとにまとめます
+const forecastPatternSQL = `COALESCE(dc.kind, EXTRACT(ISODOW FROM d)::int::text)`
+
+// forecastPattern は forecastPatternSQL と同じ日付の区分を返します
+func forecastPattern(date time.Time, day DormDay) string {
+	if day.Kind != "" {
+		return day.Kind
+	}
+	return isoWeekday(date)
+}
+
+// isoWeekday は曜日を ISO 8601 の番号 (月曜 1 〜 日曜 7) の文字列で返します
+func isoWeekday(date time.Time) string {
+	wd := int(date.Weekday())
+	if wd == 0 {
+		wd = 7
+	}
+	return strconv.Itoa(wd)
+}
+
+// forecastHistory は過去の記録から数えた、寮生ごと・日の区分ごとの食事の利用状況です
+type forecastHistory struct {
+	students map[string]map[string][3]forecastRate // 学籍番号 → 日の区分 → 食事
+	overall  map[string][3]forecastRate            // 日の区分 → 食事 (寮全体)
+}
+
+// getForecastHistory は from より前の forecastHistoryDays 日分の記録から、食事の利用状況を集計します
+// 記録のない日は、食数の集計と同じく食べたものとして数えます
+func getForecastHistory(db *sql.DB, from time.Time) (forecastHistory, error) {
+	h := forecastHistory{
+		students: make(map[string]map[string][3]forecastRate),
+		overall:  make(map[string][3]forecastRate),
+	}
+	rows, err := db.Query(`
+	SELECT u.username, `+forecastPatternSQL+`,
+		COUNT(*) FILTER (WHERE `+mealServedSQL("breakfast")+`), COUNT(*) FILTER (WHERE `+mealEatenSQL("breakfast")+`),
+		COUNT(*) FILTER (WHERE `+mealServedSQL("lunch")+`), COUNT(*) FILTER (WHERE `+mealEatenSQL("lunch")+`),
+		COUNT(*) FILTER (WHERE `+mealServedSQL("dinner")+`), COUNT(*) FILTER (WHERE `+mealEatenSQL("dinner")+`)
+	FROM generate_series($1::date, $2::date, INTERVAL '1 day') AS d
+	JOIN users u ON `+residentRolesSQL+locationJoinSQL("d::date")+`
+	LEFT JOIN gaihaku_kesshoku_records r ON r.student_id = u.username AND r.record_date = d::date`+dormCalendarJoinSQL("d::date")+`
+	WHERE `+residentOnDaySQL("d::date")+`
+	GROUP BY u.username, `+forecastPatternSQL, from.AddDate(0, 0, -forecastHistoryDays).Format("2006-01-02"), from.AddDate(0, 0, -1).Format("2006-01-02"))
+	if err != nil {
+		return h, fmt.Errorf("failed to query meal history: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var studentID, pattern string
+		var rates [3]forecastRate
+		if err := rows.Scan(&studentID, &pattern, &rates[0].served, &rates[0].eaten,
+			&rates[1].served, &rates[1].eaten, &rates[2].served, &rates[2].eaten); err != nil {
+			log.Printf("Failed to scan meal history: %v", err)
+			continue
+		}
+		if h.students[studentID] == nil {
+			h.students[studentID] = make(map[string][3]forecastRate)
+		}
+		h.students[studentID][pattern] = rates
+		overall := h.overall[pattern]
+		for i := range rates {
+			overall[i].served += rates[i].served
+			overall[i].eaten += rates[i].eaten
+		}
+		h.overall[pattern] = overall
+	}
+	return h, nil
+}
+
+// probability は記録のない寮生が、日の区分 pattern の日に食事 meal (forecastMeals の番号) を食べる見込みを返します
+// 寮全体の喫食率を事前の見込みとし、寮生本人の記録が多いほど本人の傾向に近づけます
+// 特別な日の記録が過去にない場合は、その日の曜日の傾向を使います
+func (h forecastHistory) probability(studentID, pattern, weekday string, meal int) float64 {
+	prior := 1.0 // 過去の記録がなければ、食数の集計と同じく食べるものとする
+	if o := h.overall[pattern][meal]; o.served > 0 {
+		prior = o.rate(prior)
+	} else if o := h.overall[weekday][meal]; o.served > 0 {
+		pattern = weekday
+		prior = o.rate(prior)
+	}
+	return h.students[studentID][pattern][meal].rate(prior)
+}
+
+// mealEstimateAccumulator は1回の食事の予測を寮生ごとに積み上げます
+type mealEstimateAccumulator struct {
+	MealEstimate
+	expected float64 // 記録のない寮生が食べる見込みの合計
+	variance float64
+}
+
+// add は寮生1人分を加えます。記録があれば登録どおりに、なければ食べる見込み p で数えます
+func (a *mealEstimateAccumulator) add(registered, eats bool, p float64) {
+	if !a.Served {
+		return
+	}
+	if registered {
+		if eats {
+			a.Registered++
+		}
+		return
+	}
+	a.Unregistered++
+	a.expected += p
+	a.variance += p * (1 - p)
+}
+
+// estimate は予測食数と範囲を確定します
+// 各寮生が独立に食べるかどうかを決めるものとして、正規分布で近似した範囲を返します
+func (a *mealEstimateAccumulator) estimate() MealEstimate {
+	e := a.MealEstimate
+	if !e.Served {
+		return MealEstimate{}
+	}
+	margin := forecastZ * math.Sqrt(a.variance)
+	base := e.Registered + e.Guests
+	e.Expected = base + int(math.Round(a.expected))
+	e.Low = base + max(0, int(math.Floor(a.expected-margin)))
+	e.High = base + min(e.Unregistered, int(math.Ceil(a.expected+margin)))
+	return e
+}
+
+// getMealForecast は from から days 日分の食事ごとの食数を予測します
+// 記録のある寮生は登録どおりに数え、記録のない寮生は過去の同じ曜日 (祝日などは同じ種類の日) の傾向から見込みを数えます
+// filter を指定すると、各日時点でその棟・フロアに住む寮生のみを数えます
+func getMealForecast(db *sql.DB, from time.Time, days int, filter LocationFilter) ([]MealForecast, error) {
+	to := from.AddDate(0, 0, days-1)
+	counts, err := getMealCounts(db, from, days, filter)
+	if err != nil {
+		return nil, err
+	}
+	calendar, err := getDormCalendar(db, from, to)
+	if err != nil {
+		log.Printf("Failed to get dorm calendar: %v", err)
+	}
+	history, err := getForecastHistory(db, from)
+	if err != nil {
+		return nil, err
+	}
+
+	byDate := make(map[string]*[3]mealEstimateAccumulator, days)
+	for _, m := range counts {
+		key := m.Date.Format("2006-01-02")
+		day := calendar[key]
+		byDate[key] = &[3]mealEstimateAccumulator{
+			{MealEstimate: MealEstimate{Served: day.BreakfastServed(), Current: m.Breakfast, Guests: m.GuestBreakfast}},
+			{MealEstimate: MealEstimate{Served: day.MealsServed(), Current: m.Lunch, Guests: m.GuestLunch}},
+			{MealEstimate: MealEstimate{Served: day.MealsServed(), Current: m.Dinner, Guests: m.GuestDinner}},
+		}
+	}
+
+	args := []interface{}{from.Format("2006-01-02"), to.Format("2006-01-02")}
+	rows, err := db.Query(`
+	SELECT d::date, u.username, r.student_id IS NOT NULL,
+		COALESCE(r.breakfast, TRUE), COALESCE(r.lunch, TRUE), COALESCE(r.dinner, TRUE)
+	FROM generate_series($1::date, $2::date, INTERVAL '1 day') AS d
+	JOIN users u ON `+residentRolesSQL+locationJoinSQL("d::date")+`
+	LEFT JOIN gaihaku_kesshoku_records r ON r.student_id = u.username AND r.record_date = d::date
+	WHERE `+residentOnDaySQL("d::date")+filter.where(&args), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query registrations for forecast: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var date time.Time
+		var studentID string
+		var registered bool
+		var eats [3]bool
+		if err := rows.Scan(&date, &studentID, &registered, &eats[0], &eats[1], &eats[2]); err != nil {
+			log.Printf("Failed to scan registration for forecast: %v", err)
+			continue
+		}
+		key := date.Format("2006-01-02")
+		acc, ok := byDate[key]
+		if !ok {
+			continue
+		}
+		pattern, weekday := forecastPattern(date, calendar[key]), isoWeekday(date)
+		for i := range forecastMeals {
+			p := 0.0
+			if !registered {
+				p = history.probability(studentID, pattern, weekday, i)
+			}
+			acc[i].add(registered, eats[i], p)
+		}
+	}
+
+	forecasts := make([]MealForecast, 0, days)
+	for _, m := range counts {
+		key := m.Date.Format("2006-01-02")
+		acc := byDate[key]
+		forecasts = append(forecasts, MealForecast{
+			Date:      m.Date,
+			Day:       calendar[key],
+			Breakfast: acc[0].estimate(),
+			Lunch:     acc[1].estimate(),
+			Dinner:    acc[2].estimate(),
+		})
+	}
+	return forecasts, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestForecastRate(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  forecastRate
+		prior float64
+		want  float64
+	}{
+		{"no history uses prior", forecastRate{}, 0.5, 0.5},
+		{"always eaten", forecastRate{served: 10, eaten: 10}, 0.5, 11.0 / 12},
+		{"rarely eaten", forecastRate{served: 8, eaten: 2}, 1, 0.4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rate.rate(tt.prior); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("rate(%v) = %v, want %v", tt.prior, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForecastPattern(t *testing.T) {
+	monday := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	sunday := time.Date(2024, 1, 7, 0, 0, 0, 0, time.Local)
+	tests := []struct {
+		name string
+		date time.Time
+		day  DormDay
+		want string
+	}{
+		{"monday", monday, DormDay{}, "1"},
+		{"sunday", sunday, DormDay{}, "7"},
+		{"calendar kind wins", sunday, DormDay{Kind: DayNoBreakfast}, DayNoBreakfast},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := forecastPattern(tt.date, tt.day); got != tt.want {
+				t.Errorf("forecastPattern() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForecastHistoryProbability(t *testing.T) {
+	h := forecastHistory{
+		students: map[string]map[string][3]forecastRate{
+			"s1": {"1": {{served: 4, eaten: 0}}},
+		},
+		overall: map[string][3]forecastRate{
+			"1": {{served: 10, eaten: 5}},
+		},
+	}
+	overallMonday := 7.0 / 12 // (5 + 2*1) / (10 + 2)
+	tests := []struct {
+		name      string
+		studentID string
+		pattern   string
+		meal      int
+		want      float64
+	}{
+		{"student history", "s1", "1", 0, (2 * overallMonday) / 6},
+		{"no student history uses overall", "s2", "1", 0, overallMonday},
+		{"unknown pattern falls back to weekday", "s1", DayNoBreakfast, 0, (2 * overallMonday) / 6},
+		{"no history at all", "s1", "1", 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := h.probability(tt.studentID, tt.pattern, "1", tt.meal)
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("probability() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMealEstimateAccumulator(t *testing.T) {
+	type student struct {
+		registered, eats bool
+		p                float64
+	}
+	tests := []struct {
+		name     string
+		served   bool
+		guests   int
+		students []student
+		want     MealEstimate
+	}{
+		{
+			name:     "not served",
+			students: []student{{true, true, 0}, {false, false, 0.5}},
+			want:     MealEstimate{},
+		},
+		{
+			name:     "registered only",
+			served:   true,
+			students: []student{{true, true, 0}, {true, false, 0}, {true, true, 0}},
+			want:     MealEstimate{Served: true, Registered: 2, Expected: 2, Low: 2, High: 2},
+		},
+		{
+			name:     "certain unregistered",
+			served:   true,
+			students: []student{{false, false, 1}, {false, false, 1}, {false, false, 1}},
+			want:     MealEstimate{Served: true, Unregistered: 3, Expected: 3, Low: 3, High: 3},
+		},
+		{
+			name:     "uncertain unregistered with guests",
+			served:   true,
+			guests:   1,
+			students: []student{{true, true, 0}, {false, false, 0.5}, {false, false, 0.5}, {false, false, 0.5}, {false, false, 0.5}},
+			// 見込み 2、標準偏差 1 → 範囲は floor(2-1.645)=0 〜 ceil(2+1.645)=4
+			want: MealEstimate{Served: true, Registered: 1, Guests: 1, Unregistered: 4, Expected: 4, Low: 2, High: 6},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := mealEstimateAccumulator{MealEstimate: MealEstimate{Served: tt.served, Guests: tt.guests}}
+			for _, s := range tt.students {
+				a.add(s.registered, s.eats, s.p)
+			}
+			if got := a.estimate(); got != tt.want {
+				t.Errorf("estimate() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 承認状況 (保護者・寮監督者の承認で共通)
+const (
+	ApprovalPending  = "pending"
+	ApprovalApproved = "approved"
+	ApprovalRejected = "rejected"
+)
+
+// adultAge は保護者の承認が不要になる年齢です
+const adultAge = 18
+
+// approvalKey は承認リンクのトークンを署名する鍵です (SESSION_SECRET_KEY から設定します)
+var approvalKey []byte
+
+// errApprovalInvalid は承認リンクが存在しない・使用済み・期限切れの場合のエラーです
+var errApprovalInvalid = errors.New("approval link is invalid or expired")
+
+// createGuardianApprovalsTable は保護者への承認依頼のテーブルを作成します
+// トークンそのものは保存せず、署名 (HMAC) のみを保存します
+func createGuardianApprovalsTable(db *sql.DB) error {
+	const createTableSQL = `
+	CREATE TABLE IF NOT EXISTS guardian_approvals (
+		id SERIAL PRIMARY KEY,
+		student_id VARCHAR(50) NOT NULL,
+		record_date DATE NOT NULL,
+		contact_id INTEGER REFERENCES emergency_contacts(id) ON DELETE SET NULL,
+		token_hash CHAR(64) UNIQUE NOT NULL,
+		expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+		used_at TIMESTAMP WITH TIME ZONE,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS guardian_approvals_record_idx ON guardian_approvals (student_id, record_date);`
+
+	_, err := db.Exec(createTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to execute SQL: %w", err)
+	}
+
+	return nil
+}
+
+// NeedsGuardianConsent は指定日の外泊に保護者の承認が必要か (未成年か) を返します
+// 生年月日が未登録の場合は、承認が必要なものとして扱います
+func (u User) NeedsGuardianConsent(date time.Time) bool {
+	if u.BirthDate == nil {
+		return true
+	}
+	return u.BirthDate.AddDate(adultAge, 0, 0).After(date)
+}
+
+// approvalTokenHash はトークンの署名を返します
+func approvalTokenHash(token string) string {
+	mac := hmac.New(sha256.New, approvalKey)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newApprovalToken は承認リンク用のランダムなトークンを生成します
+func newApprovalToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// sameOvernight は外泊の内容 (外泊先・連絡先・帰寮予定) が変わっていないかを返します
+func sameOvernight(a, b *GaihakuKesshokuRecord) bool {
+	if a.Destination != b.Destination || a.StayPhone != b.StayPhone {
+		return false
+	}
+	if a.ExpectedReturn == nil || b.ExpectedReturn == nil {
+		return a.ExpectedReturn == b.ExpectedReturn
+	}
+	return a.ExpectedReturn.Equal(*b.ExpectedReturn)
+}
+
+// needsGuardianApproval は保存する外泊 r を保護者の承認待ちにする必要があるかを返します
+// 承認が必要か (未成年か) は呼び出し側で確認します。内容が変わっていない外泊は承認状況をそのまま引き継ぎます
+func needsGuardianApproval(prev, r *GaihakuKesshokuRecord) bool {
+	return r.Overnight && !(prev != nil && prev.Overnight && prev.GuardianStatus != "" && sameOvernight(prev, r))
+}
+
+// sendGuardianApprovals は保存時に保護者の承認待ちにした外泊 (saveRecords の戻り値) について、保護者に承認を依頼します
+// 承認依頼を送れなかった場合は、寮生に表示するメッセージを返します
+func sendGuardianApprovals(db *sql.DB, user *User, pending []GaihakuKesshokuRecord) string {
+	if len(pending) == 0 {
+		return ""
+	}
+
+	var guardian *EmergencyContact
+	contacts, err := getEmergencyContacts(db, user.Username)
+	if err != nil {
+		log.Printf("Failed to get emergency contacts for %s: %v", user.Username, err)
+	}
+	for i := range contacts {
+		if contacts[i].IsGuardian && contacts[i].Email != "" {
+			guardian = &contacts[i]
+			break
+		}
+	}
+	// 保護者は外泊を承認する立場のため、寮生本人は登録できない
+	if guardian == nil {
+		return "保護者のメールアドレスが登録されていないため、外泊の承認依頼を送信できませんでした。管理者に連絡して保護者を登録してもらってください。"
+	}
+
+	warning := ""
+	for i := range pending {
+		r := &pending[i]
+		if err := sendGuardianApproval(db, user, r, guardian); err != nil {
+			log.Printf("Failed to send guardian approval for %s on %s: %v", user.Username, r.RecordDate.Format("2006-01-02"), err)
+			warning = "保護者への承認依頼の送信に失敗しました。時間をおいて再度登録するか、管理者に連絡してください。"
+		}
+	}
+	return warning
+}
+
+// setGuardianStatus は外泊の承認状況を変更します
+func setGuardianStatus(ex execer, studentID string, date time.Time, status string) error {
+	_, err := ex.Exec(`UPDATE gaihaku_kesshoku_records SET guardian_status = $3,
+		guardian_decided_at = CASE WHEN $3 IN ('approved', 'rejected') THEN CURRENT_TIMESTAMP END
+	WHERE student_id = $1 AND record_date = $2 AND overnight`, studentID, date.Format("2006-01-02"), status)
+	if err != nil {
+		return fmt.Errorf("failed to update guardian status: %w", err)
+	}
+	return nil
+}
+
+// sendGuardianApproval は承認リンクを発行して保護者に送信します
+// 同じ日の未使用のリンクは無効になります
+func sendGuardianApproval(db *sql.DB, user *User, r *GaihakuKesshokuRecord, guardian *EmergencyContact) error {
+	token, err := newApprovalToken()
+	if err != nil {
+		return err
+	}
+	date := r.RecordDate.Format("2006-01-02")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM guardian_approvals WHERE student_id = $1 AND record_date = $2 AND used_at IS NULL`, user.Username, date); err != nil {
+		return fmt.Errorf("failed to revoke old approvals: %w", err)
+	}
+	// 外泊日の翌日が終わるまで有効
+	if _, err := tx.Exec(`INSERT INTO guardian_approvals (student_id, record_date, contact_id, token_hash, expires_at)
+	VALUES ($1, $2::date, $3, $4, $2::date + INTERVAL '2 days')`,
+		user.Username, date, guardian.ID, approvalTokenHash(token)); err != nil {
+		return fmt.Errorf("failed to insert approval: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit approval: %w", err)
+	}
+
+	link := appBaseURL() + "/guardian/approval?token=" + url.QueryEscape(token)
+	subject := fmt.Sprintf("【外泊承認のお願い】%s さん %s", user.Name(), r.RecordDate.Format("01/02"))
+	body := fmt.Sprintf(`%s 様
+
+%s さんから、以下の外泊の届け出がありました。
+内容をご確認のうえ、下記のリンクから承認または却下をお願いいたします。
+
+外泊日: %s (%s)
+外泊先: %s
+滞在中の連絡先: %s
+帰寮予定: %s
+
+%s
+
+このリンクは一度のみ有効です。お心当たりのない場合は、寮までご連絡ください。
+`, guardian.Name, user.Name(), r.RecordDate.Format("2006/01/02"), japaneseWeekday(r.RecordDate),
+		r.Destination, r.StayPhone, r.ExpectedReturn.Format("2006/01/02 15:04"), link)
+
+	return notifier.Send(guardian.Email, subject, body)
+}
+
+// getGuardianApproval はトークンに対応する未使用・期限内の承認依頼と、外泊の内容を取得します
+func getGuardianApproval(q interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, token string, forUpdate bool) (*GuardianApproval, error) {
+	query := `
+	SELECT ga.id, ga.student_id, ` + userNameSQL + `, ga.record_date, COALESCE(ec.name, ''),
+		r.destination, r.stay_phone, r.expected_return, r.guardian_status
+	FROM guardian_approvals ga
+	JOIN users u ON u.username = ga.student_id
+	JOIN gaihaku_kesshoku_records r ON r.student_id = ga.student_id AND r.record_date = ga.record_date AND r.overnight
+	LEFT JOIN emergency_contacts ec ON ec.id = ga.contact_id
+	WHERE ga.token_hash = $1 AND ga.used_at IS NULL AND ga.expires_at > CURRENT_TIMESTAMP`
+	if forUpdate {
+		query += " FOR UPDATE OF ga"
+	}
+
+	var a GuardianApproval
+	var expectedReturn sql.NullTime
+	err := q.QueryRow(query, approvalTokenHash(token)).Scan(&a.ID, &a.StudentID, &a.StudentName, &a.RecordDate, &a.GuardianName,
+		&a.Destination, &a.StayPhone, &expectedReturn, &a.Status)
+	if err == sql.ErrNoRows {
+		return nil, errApprovalInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query approval: %w", err)
+	}
+	if expectedReturn.Valid {
+		a.ExpectedReturn = &expectedReturn.Time
+	}
+	return &a, nil
+}
+
+// decideGuardianApproval は保護者の回答を保存し、リンクを使用済みにします
+func decideGuardianApproval(db *sql.DB, token string, approve bool) (*GuardianApproval, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	a, err := getGuardianApproval(tx, token, true)
+	if err != nil {
+		return nil, err
+	}
+	a.Status = ApprovalRejected
+	if approve {
+		a.Status = ApprovalApproved
+	}
+	if _, err := tx.Exec("UPDATE guardian_approvals SET used_at = CURRENT_TIMESTAMP WHERE id = $1", a.ID); err != nil {
+		return nil, fmt.Errorf("failed to mark approval as used: %w", err)
+	}
+	if err := setGuardianStatus(tx, a.StudentID, a.RecordDate, a.Status); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit approval: %w", err)
+	}
+	return a, nil
+}
+
+// getGuardianApprovalOverview は from 以降の、保護者の承認が必要な外泊を日付順に取得します
+func getGuardianApprovalOverview(db *sql.DB, from time.Time) ([]GuardianApproval, error) {
+	rows, err := db.Query(`
+	SELECT r.student_id, `+userNameSQL+`, r.record_date, r.destination, r.expected_return, r.guardian_status
+	FROM gaihaku_kesshoku_records r
+	JOIN users u ON u.username = r.student_id
+	WHERE r.overnight AND r.guardian_status <> '' AND r.record_date >= $1
+	ORDER BY r.record_date ASC, r.student_id ASC`, from.Format("2006-01-02"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query guardian approvals: %w", err)
+	}
+	defer rows.Close()
+
+	var approvals []GuardianApproval
+	for rows.Next() {
+		var a GuardianApproval
+		var expectedReturn sql.NullTime
+		if err := rows.Scan(&a.StudentID, &a.StudentName, &a.RecordDate, &a.Destination, &expectedReturn, &a.Status); err != nil {
+			log.Printf("Failed to scan guardian approval: %v", err)
+			continue
+		}
+		if expectedReturn.Valid {
+			a.ExpectedReturn = &expectedReturn.Time
+		}
+		approvals = append(approvals, a)
+	}
+	return approvals, nil
+}
+
+// guardianApprovalPageHandler は保護者向けの承認ページを表示します (ログイン不要)
+func guardianApprovalPageHandler(c echo.Context) error {
+	token := c.QueryParam("token")
+	approval, err := getGuardianApproval(db, token, false)
+	if err != nil && !errors.Is(err, errApprovalInvalid) {
+		log.Printf("Failed to get guardian approval: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to retrieve approval.")
+	}
+
+	return c.Render(http.StatusOK, "guardian_approval.html", map[string]interface{}{
+		"token":    token,
+		"approval": approval,
+	})
+}
+
+// guardianApprovalHandler は保護者の承認・却下を保存します (ログイン不要)
+func guardianApprovalHandler(c echo.Context) error {
+	token := c.FormValue("token")
+	decision := c.FormValue("decision")
+	if decision != ApprovalApproved && decision != ApprovalRejected {
+		return c.String(http.StatusBadRequest, "Invalid decision.")
+	}
+	approval, err := decideGuardianApproval(db, token, decision == ApprovalApproved)
+	if err != nil && !errors.Is(err, errApprovalInvalid) {
+		log.Printf("Failed to save guardian approval: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to save approval.")
+	}
+	if approval != nil {
+		log.Printf("Guardian %s overnight of %s on %s", approval.Status, approval.StudentID, approval.RecordDate.Format("2006-01-02"))
+	}
+
+	return c.Render(http.StatusOK, "guardian_approval.html", map[string]interface{}{
+		"approval": approval,
+		"decided":  true,
+	})
+}
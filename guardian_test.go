@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNeedsGuardianConsent(t *testing.T) {
+	birth := time.Date(2006, 4, 2, 0, 0, 0, 0, time.Local)
+	u := User{BirthDate: &birth}
+	if !u.NeedsGuardianConsent(time.Date(2024, 4, 1, 0, 0, 0, 0, time.Local)) {
+		t.Error("the day before turning 18 should need guardian consent")
+	}
+	if u.NeedsGuardianConsent(time.Date(2024, 4, 2, 0, 0, 0, 0, time.Local)) {
+		t.Error("the 18th birthday should not need guardian consent")
+	}
+	if !(User{}).NeedsGuardianConsent(time.Now()) {
+		t.Error("a user without birth date should need guardian consent")
+	}
+}
+
+func TestApprovalTokenHash(t *testing.T) {
+	prev := approvalKey
+	t.Cleanup(func() { approvalKey = prev })
+
+	approvalKey = []byte("key1")
+	token, err := newApprovalToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := newApprovalToken()
+	if token == other {
+		t.Fatal("tokens should be random")
+	}
+	hash := approvalTokenHash(token)
+	if len(hash) != 64 || hash != approvalTokenHash(token) || hash == approvalTokenHash(other) {
+		t.Errorf("hash %q is not a stable per-token HMAC", hash)
+	}
+	// 鍵を知らなければトークンから署名を作れない
+	approvalKey = []byte("key2")
+	if approvalTokenHash(token) == hash {
+		t.Error("hash should depend on the approval key")
+	}
+}
+
+// approvalTokenPattern は承認依頼のメールからトークンを取り出します
+var approvalTokenPattern = regexp.MustCompile(`/guardian/approval\?token=(\S+)`)
+
+func TestGuardianApprovalFlow(t *testing.T) {
+	db := openTestDB(t)
+	n := &recordingNotifier{sent: make(map[string]string)}
+	prev := notifier
+	notifier = n
+	t.Cleanup(func() { notifier = prev })
+
+	mustExec(t, db, `INSERT INTO users (username, password, role, active) VALUES ('s1', 'x', 'user', TRUE)`)
+	student := &User{Username: "s1", Role: RoleUser, Active: true}
+	tomorrow := time.Now().AddDate(0, 0, 1)
+	date := time.Date(tomorrow.Year(), tomorrow.Month(), tomorrow.Day(), 0, 0, 0, 0, time.Local)
+	expectedReturn := date.Add(34 * time.Hour)
+	overnight := GaihakuKesshokuRecord{StudentID: "s1", RecordDate: date, Overnight: true,
+		Destination: "実家", StayPhone: "090-1234-5678", ExpectedReturn: &expectedReturn}
+	guardianStatus := func() string {
+		t.Helper()
+		var status string
+		if err := db.QueryRow(`SELECT guardian_status FROM gaihaku_kesshoku_records WHERE student_id = 's1' AND record_date = $1`,
+			date.Format("2006-01-02")).Scan(&status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	// 保護者が未登録でも、外泊は保存と同時に承認待ちになり、管理者への連絡を促す
+	pending, err := saveRecords(db, []GaihakuKesshokuRecord{overnight}, HistorySelf, "s1", false, student)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || guardianStatus() != ApprovalPending {
+		t.Fatalf("pending = %d, status = %q; want the overnight pending", len(pending), guardianStatus())
+	}
+	if warning := sendGuardianApprovals(db, student, pending); !strings.Contains(warning, "管理者") {
+		t.Errorf("warning without guardian = %q, want it to point to an administrator", warning)
+	}
+
+	// 内容が変わっていない外泊は、承認状況を引き継いで改めて依頼しない
+	mustExec(t, db, `INSERT INTO emergency_contacts (student_id, name, phone, email, is_guardian) VALUES ('s1', '母', '090-0000-0000', 'mother@example.com', TRUE)`)
+	if pending, err = saveRecords(db, []GaihakuKesshokuRecord{overnight}, HistorySelf, "s1", false, student); err != nil || len(pending) != 0 {
+		t.Fatalf("resaving the same overnight: pending = %d, err = %v", len(pending), err)
+	}
+
+	// 内容を変えると改めて承認待ちにし、保護者にリンクを送る
+	overnight.Destination = "祖父母の家"
+	if pending, err = saveRecords(db, []GaihakuKesshokuRecord{overnight}, HistorySelf, "s1", false, student); err != nil || len(pending) != 1 {
+		t.Fatalf("changing the overnight: pending = %d, err = %v", len(pending), err)
+	}
+	if warning := sendGuardianApprovals(db, student, pending); warning != "" {
+		t.Fatalf("send approval: %s", warning)
+	}
+	m := approvalTokenPattern.FindStringSubmatch(n.sent["mother@example.com"])
+	if m == nil {
+		t.Fatalf("approval mail has no link: %q", n.sent["mother@example.com"])
+	}
+	token, _ := url.QueryUnescape(m[1])
+
+	if _, err := decideGuardianApproval(db, "wrong-token", true); !errors.Is(err, errApprovalInvalid) {
+		t.Errorf("wrong token: err = %v, want errApprovalInvalid", err)
+	}
+	a, err := decideGuardianApproval(db, token, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Destination != "祖父母の家" || guardianStatus() != ApprovalApproved {
+		t.Errorf("after approval: destination = %q, status = %q", a.Destination, guardianStatus())
+	}
+	// リンクは一度のみ有効
+	if _, err := decideGuardianApproval(db, token, false); !errors.Is(err, errApprovalInvalid) {
+		t.Errorf("reusing token: err = %v, want errApprovalInvalid", err)
+	}
+	if guardianStatus() != ApprovalApproved {
+		t.Errorf("reused token changed the status to %q", guardianStatus())
+	}
+
+	// 成人の外泊や管理者による保存は承認待ちにしない
+	adult := time.Date(2000, 1, 1, 0, 0, 0, 0, time.Local)
+	overnight.Destination = "友人宅"
+	if pending, err = saveRecords(db, []GaihakuKesshokuRecord{overnight}, HistorySelf, "s1", false, &User{Username: "s1", BirthDate: &adult}); err != nil || len(pending) != 0 {
+		t.Errorf("adult overnight: pending = %d, err = %v", len(pending), err)
+	}
+	if pending, err = saveRecords(db, []GaihakuKesshokuRecord{overnight}, HistoryAdmin, "admin", false, nil); err != nil || len(pending) != 0 {
+		t.Errorf("admin save: pending = %d, err = %v", len(pending), err)
+	}
+}
+
+func TestStudentsCannotDeleteGuardianContacts(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, `INSERT INTO emergency_contacts (id, student_id, name, phone, is_guardian) VALUES
+		(1, 's1', '母', '090-0000-0000', TRUE),
+		(2, 's1', '叔父', '090-1111-1111', FALSE)`)
+	student := &User{Username: "s1", Role: RoleUser, Active: true}
+	exists := func(id int) bool {
+		var n int
+		db.QueryRow(`SELECT COUNT(*) FROM emergency_contacts WHERE id = $1`, id).Scan(&n)
+		return n > 0
+	}
+
+	serveAs(t, deleteOwnContactHandler, student, http.MethodPost, "/settings/contacts/delete", url.Values{"id": {"1"}})
+	if !exists(1) {
+		t.Error("student deleted the guardian contact")
+	}
+	serveAs(t, deleteOwnContactHandler, student, http.MethodPost, "/settings/contacts/delete", url.Values{"id": {"2"}})
+	if exists(2) {
+		t.Error("student could not delete their own non-guardian contact")
+	}
+
+	if deleted, err := deleteEmergencyContact(db, "s1", 1, true); err != nil || !deleted || exists(1) {
+		t.Errorf("admin delete of guardian contact: deleted = %v, err = %v", deleted, err)
+	}
+}
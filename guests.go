@@ -0,0 +1,400 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 来客の食事の支払い方法
+const (
+	GuestPayerStudent = "student" // 寮生の月の食費に加算
+	GuestPayerGuest   = "guest"   // 来客が当日支払う
+)
+
+// guestPayers は画面に表示する支払い方法の一覧です
+var guestPayers = []struct {
+	Name  string
+	Label string
+}{
+	{GuestPayerStudent, "寮生の食費に加算"},
+	{GuestPayerGuest, "来客が当日支払い"},
+}
+
+const (
+	// defaultGuestMaxPerOrder は寮生1人が1回の食事に申し込める来客の人数の既定値です
+	defaultGuestMaxPerOrder = 3
+	// defaultGuestMaxPerMeal は1回の食事の来客の合計人数の既定値です (0 は上限なし)
+	defaultGuestMaxPerMeal = 20
+	// defaultGuestDeadlineDays と defaultGuestDeadlineTime は申し込みの締め切り (何日前の何時) の既定値です
+	defaultGuestDeadlineDays = 1
+	defaultGuestDeadlineTime = "17:00"
+	// maxGuestDays は何日先まで来客の食事を申し込めるかです
+	maxGuestDays = 62
+)
+
+// createGuestMealsTable は来客の食事の申し込みテーブルを作成します
+func createGuestMealsTable(db *sql.DB) error {
+	const createTableSQL = `
+	CREATE TABLE IF NOT EXISTS guest_meals (
+		id SERIAL PRIMARY KEY,
+		student_id VARCHAR(50) NOT NULL,
+		meal_date DATE NOT NULL,
+		meal VARCHAR(10) NOT NULL,
+		guests INTEGER NOT NULL,
+		guest_name VARCHAR(100) NOT NULL DEFAULT '',
+		payer VARCHAR(10) NOT NULL,
+		created_by VARCHAR(50),
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS guest_meals_date_idx ON guest_meals (meal_date, meal);
+	CREATE INDEX IF NOT EXISTS guest_meals_student_idx ON guest_meals (student_id, meal_date);`
+
+	_, err := db.Exec(createTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to execute SQL: %w", err)
+	}
+
+	return nil
+}
+
+// guestMealsJoinSQL は users u に、日付 dateExpr の来客の人数を食事ごとに gm として結合するSQLです
+func guestMealsJoinSQL(dateExpr string) string {
+	return `
+	LEFT JOIN LATERAL (
+		SELECT COALESCE(SUM(guests) FILTER (WHERE meal = 'breakfast'), 0) AS breakfast,
+			COALESCE(SUM(guests) FILTER (WHERE meal = 'lunch'), 0) AS lunch,
+			COALESCE(SUM(guests) FILTER (WHERE meal = 'dinner'), 0) AS dinner
+		FROM guest_meals WHERE student_id = u.username AND meal_date = ` + dateExpr + `
+	) gm ON TRUE`
+}
+
+// guestCountSQL は guestMealsJoinSQL で結合した来客の人数の合計です。提供されない食事は数えません
+func guestCountSQL(meal string) string {
+	return "COALESCE(SUM(gm." + meal + ") FILTER (WHERE " + mealServedSQL(meal) + "), 0)"
+}
+
+// addGuests は寮生の食数に来客の食数を加えます
+func (m *MealCount) addGuests() {
+	m.Breakfast += m.GuestBreakfast
+	m.Lunch += m.GuestLunch
+	m.Dinner += m.GuestDinner
+}
+
+// GuestRules は来客の食事の申し込みの決まりです (運用設定で変更できます)
+type GuestRules struct {
+	MaxPerOrder  int
+	MaxPerMeal   int // 0 は上限なし
+	DeadlineDays int
+	DeadlineTime string // "HH:MM"
+}
+
+// getGuestRules は来客の食事の申し込みの決まりを取得します
+func getGuestRules(db *sql.DB) GuestRules {
+	rules := GuestRules{
+		MaxPerOrder:  getIntSetting(db, settingGuestMaxPerOrder, defaultGuestMaxPerOrder),
+		MaxPerMeal:   getIntSetting(db, settingGuestMaxPerMeal, defaultGuestMaxPerMeal),
+		DeadlineDays: getIntSetting(db, settingGuestDeadlineDays, defaultGuestDeadlineDays),
+		DeadlineTime: getSetting(db, settingGuestDeadlineTime, defaultGuestDeadlineTime),
+	}
+	if _, err := time.Parse(clockLayout, rules.DeadlineTime); err != nil {
+		rules.DeadlineTime = defaultGuestDeadlineTime
+	}
+	return rules
+}
+
+// Deadline は指定日の来客の食事の申し込み・取り消しの締め切りを返します
+func (g GuestRules) Deadline(date time.Time) time.Time {
+	t, _ := time.Parse(clockLayout, g.DeadlineTime)
+	y, m, d := date.Date()
+	return time.Date(y, m, d-g.DeadlineDays, t.Hour(), t.Minute(), 0, 0, time.Local)
+}
+
+// guestPayerLabel は支払い方法の表示名を返します
+func guestPayerLabel(payer string) string {
+	for _, p := range guestPayers {
+		if p.Name == payer {
+			return p.Label
+		}
+	}
+	return payer
+}
+
+// mealLabel は食事の表示名を返します
+func mealLabel(meal string) string {
+	for _, m := range menuMeals {
+		if m.Name == meal {
+			return m.Label
+		}
+	}
+	return meal
+}
+
+// getGuestMeals は期間内の来客の食事の申し込みを取得します。studentID が空の場合は全寮生の申し込みです
+func getGuestMeals(db *sql.DB, studentID string, from, to time.Time) ([]GuestMeal, error) {
+	args := []interface{}{from.Format("2006-01-02"), to.Format("2006-01-02")}
+	query := `
+	SELECT g.id, g.student_id, ` + userNameSQL + `, g.meal_date, g.meal, g.guests, g.guest_name, g.payer, COALESCE(g.created_by, '')
+	FROM guest_meals g
+	JOIN users u ON u.username = g.student_id
+	WHERE g.meal_date BETWEEN $1 AND $2`
+	if studentID != "" {
+		args = append(args, studentID)
+		query += ` AND g.student_id = $3`
+	}
+	query += `
+	ORDER BY g.meal_date ASC, CASE g.meal WHEN 'breakfast' THEN 0 WHEN 'lunch' THEN 1 ELSE 2 END, g.id ASC`
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query guest meals: %w", err)
+	}
+	defer rows.Close()
+
+	var meals []GuestMeal
+	for rows.Next() {
+		var g GuestMeal
+		if err := rows.Scan(&g.ID, &g.StudentID, &g.StudentName, &g.Date, &g.Meal, &g.Guests, &g.GuestName, &g.Payer, &g.CreatedBy); err != nil {
+			log.Printf("Failed to scan guest meal: %v", err)
+			continue
+		}
+		meals = append(meals, g)
+	}
+	return meals, nil
+}
+
+// addGuestMeal は来客の食事の申し込みを追加します
+// 1回の食事の来客の合計人数の上限を超える場合は、表示するメッセージを返します
+func addGuestMeal(db *sql.DB, g GuestMeal, rules GuestRules) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// 同じ食事への申し込みが同時に来ても上限を超えないよう、申し込みを順に処理する
+	if _, err := tx.Exec("LOCK TABLE guest_meals IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		return "", fmt.Errorf("failed to lock guest meals: %w", err)
+	}
+	var ordered, total int
+	err = tx.QueryRow(`SELECT COALESCE(SUM(guests) FILTER (WHERE student_id = $3), 0), COALESCE(SUM(guests), 0)
+	FROM guest_meals WHERE meal_date = $1 AND meal = $2`, g.Date.Format("2006-01-02"), g.Meal, g.StudentID).Scan(&ordered, &total)
+	if err != nil {
+		return "", fmt.Errorf("failed to count guest meals: %w", err)
+	}
+	if ordered+g.Guests > rules.MaxPerOrder {
+		return fmt.Sprintf("1回の食事に申し込める来客は%d人までです (申し込み済み %d人)。", rules.MaxPerOrder, ordered), nil
+	}
+	if rules.MaxPerMeal > 0 && total+g.Guests > rules.MaxPerMeal {
+		return fmt.Sprintf("この食事の来客の受け付けは残り%d人です。", max(rules.MaxPerMeal-total, 0)), nil
+	}
+
+	_, err = tx.Exec(`INSERT INTO guest_meals (student_id, meal_date, meal, guests, guest_name, payer, created_by)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		g.StudentID, g.Date.Format("2006-01-02"), g.Meal, g.Guests, g.GuestName, g.Payer, g.CreatedBy)
+	if err != nil {
+		return "", fmt.Errorf("failed to insert guest meal: %w", err)
+	}
+	if err := notifyCountChange(tx, g.Date, g.Date); err != nil {
+		return "", err
+	}
+	return "", tx.Commit()
+}
+
+// readGuestMealForm はフォームから来客の食事の申し込みを読み込み、入力エラーがあればその内容を返します
+// staff が true の場合 (管理者による代理の申し込み) は締め切りを確認しません
+func readGuestMealForm(c echo.Context, studentID string, rules GuestRules, staff bool) (GuestMeal, string) {
+	g := GuestMeal{
+		StudentID: studentID,
+		Meal:      c.FormValue("meal"),
+		GuestName: strings.TrimSpace(c.FormValue("guest_name")),
+		Payer:     c.FormValue("payer"),
+		CreatedBy: currentUser(c).Username,
+	}
+	date, err := time.ParseInLocation("2006-01-02", c.FormValue("date"), time.Local)
+	if err != nil {
+		return g, "日付を入力してください。"
+	}
+	g.Date = date
+	g.Guests, _ = strconv.Atoi(c.FormValue("guests"))
+
+	now := time.Now()
+	switch {
+	case mealLabel(g.Meal) == g.Meal:
+		return g, "食事を選択してください。"
+	case g.Guests < 1 || g.Guests > rules.MaxPerOrder:
+		return g, fmt.Sprintf("人数は1〜%d人で入力してください。", rules.MaxPerOrder)
+	case guestPayerLabel(g.Payer) == g.Payer:
+		return g, "支払い方法を選択してください。"
+	case utf8.RuneCountInString(g.GuestName) > 100:
+		return g, "来客の氏名は100文字以内で入力してください。"
+	case date.After(now.AddDate(0, 0, maxGuestDays)):
+		return g, fmt.Sprintf("来客の食事は%d日先まで申し込めます。", maxGuestDays)
+	case !staff && now.After(rules.Deadline(date)):
+		return g, fmt.Sprintf("%s の申し込みは %s で締め切りました。", date.Format("01/02"), rules.Deadline(date).Format("01/02 15:04"))
+	}
+
+	calendar, err := getDormCalendar(db, date, date)
+	if err != nil {
+		log.Printf("Failed to get dorm calendar: %v", err)
+	}
+	day := calendar[date.Format("2006-01-02")]
+	if (g.Meal == "breakfast" && !day.BreakfastServed()) || (g.Meal != "breakfast" && !day.MealsServed()) {
+		return g, fmt.Sprintf("%s の%sは提供されません。", date.Format("01/02"), mealLabel(g.Meal))
+	}
+	return g, ""
+}
+
+// cancelGuestMeal は来客の食事の申し込みを取り消します。studentID が空でなければ、その寮生の申し込みに限ります
+// 取り消した申し込みを返します (該当する申し込みがなければ sql.ErrNoRows)
+func cancelGuestMeal(db *sql.DB, id int, studentID string) (GuestMeal, error) {
+	var g GuestMeal
+	tx, err := db.Begin()
+	if err != nil {
+		return g, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`DELETE FROM guest_meals WHERE id = $1 AND ($2 = '' OR student_id = $2)
+	RETURNING id, student_id, meal_date, meal, guests`, id, studentID).Scan(&g.ID, &g.StudentID, &g.Date, &g.Meal, &g.Guests)
+	if err != nil {
+		return g, fmt.Errorf("failed to delete guest meal: %w", err)
+	}
+	if err := notifyCountChange(tx, g.Date, g.Date); err != nil {
+		return g, err
+	}
+	return g, tx.Commit()
+}
+
+// guestsPageHandler はログイン中の寮生の来客の食事の申し込みページを表示します
+func guestsPageHandler(c echo.Context) error {
+	user := currentUser(c)
+	if !user.IsResident() {
+		return c.String(http.StatusForbidden, "Permission denied.")
+	}
+	today := time.Now()
+	meals, err := getGuestMeals(db, user.Username, today, today.AddDate(0, 0, maxGuestDays))
+	if err != nil {
+		log.Printf("Failed to get guest meals for %s: %v", user.Username, err)
+		return c.String(http.StatusInternalServerError, "Failed to retrieve guest meals.")
+	}
+
+	return c.Render(http.StatusOK, "guests.html", map[string]interface{}{
+		"guestMeals":     meals,
+		"rules":          getGuestRules(db),
+		"meals":          menuMeals,
+		"payers":         guestPayers,
+		"now":            today,
+		"successMessage": popFlash(c, "guests_success"),
+		"errorMessage":   popFlash(c, "guests_error"),
+	})
+}
+
+// addOwnGuestMealHandler はログイン中の寮生が来客の食事を申し込みます
+func addOwnGuestMealHandler(c echo.Context) error {
+	user := currentUser(c)
+	if !user.IsResident() {
+		return c.String(http.StatusForbidden, "Permission denied.")
+	}
+	rules := getGuestRules(db)
+	g, message := readGuestMealForm(c, user.Username, rules, false)
+	if message != "" {
+		return redirectWithFlash(c, "/guests", message, false, "guests_success", "guests_error")
+	}
+	message, err := addGuestMeal(db, g, rules)
+	if err != nil {
+		log.Printf("Failed to add guest meal for %s: %v", user.Username, err)
+		return c.String(http.StatusInternalServerError, "Failed to save guest meal.")
+	}
+	if message != "" {
+		return redirectWithFlash(c, "/guests", message, false, "guests_success", "guests_error")
+	}
+	log.Printf("Guest meal %s %s x%d ordered by %s", g.Date.Format("2006-01-02"), g.Meal, g.Guests, user.Username)
+	return redirectWithFlash(c, "/guests", "来客の食事を申し込みました。", true, "guests_success", "guests_error")
+}
+
+// cancelOwnGuestMealHandler はログイン中の寮生が締め切り前の来客の食事の申し込みを取り消します
+func cancelOwnGuestMealHandler(c echo.Context) error {
+	user := currentUser(c)
+	id, _ := strconv.Atoi(c.FormValue("id"))
+
+	var date time.Time
+	err := db.QueryRow("SELECT meal_date FROM guest_meals WHERE id = $1 AND student_id = $2", id, user.Username).Scan(&date)
+	if err != nil {
+		return redirectWithFlash(c, "/guests", "申し込みが見つかりません。", false, "guests_success", "guests_error")
+	}
+	if time.Now().After(getGuestRules(db).Deadline(date)) {
+		return redirectWithFlash(c, "/guests", "締め切りを過ぎた申し込みは取り消せません。寮務担当に連絡してください。", false, "guests_success", "guests_error")
+	}
+	if _, err := cancelGuestMeal(db, id, user.Username); err != nil {
+		log.Printf("Failed to cancel guest meal: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to cancel guest meal.")
+	}
+	return redirectWithFlash(c, "/guests", "来客の食事の申し込みを取り消しました。", true, "guests_success", "guests_error")
+}
+
+// adminGuestsHandler は全寮生の来客の食事の申し込みを表示します (既定は今日から2週間)
+func adminGuestsHandler(c echo.Context) error {
+	from := time.Now()
+	if d, err := time.ParseInLocation("2006-01-02", c.QueryParam("from"), time.Local); err == nil {
+		from = d
+	}
+	to := from.AddDate(0, 0, 13)
+	meals, err := getGuestMeals(db, "", from, to)
+	if err != nil {
+		log.Printf("Failed to get guest meals: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to retrieve guest meals.")
+	}
+
+	return c.Render(http.StatusOK, "admin_guests.html", map[string]interface{}{
+		"guestMeals":     meals,
+		"from":           from,
+		"to":             to,
+		"rules":          getGuestRules(db),
+		"meals":          menuMeals,
+		"payers":         guestPayers,
+		"successMessage": popFlash(c, "guests_success"),
+		"errorMessage":   popFlash(c, "guests_error"),
+	})
+}
+
+// adminAddGuestMealHandler は管理者が寮生の来客の食事を代理で申し込みます (締め切り後も申し込めます)
+func adminAddGuestMealHandler(c echo.Context) error {
+	studentID := strings.TrimSpace(c.FormValue("student_id"))
+	student, err := getUserByUsername(db, studentID)
+	if err != nil || !student.IsResident() {
+		return redirectWithFlash(c, "/admin/guests", "寮生が見つかりません。", false, "guests_success", "guests_error")
+	}
+	rules := getGuestRules(db)
+	g, message := readGuestMealForm(c, studentID, rules, true)
+	if message == "" {
+		message, err = addGuestMeal(db, g, rules)
+		if err != nil {
+			log.Printf("Failed to add guest meal for %s: %v", studentID, err)
+			return c.String(http.StatusInternalServerError, "Failed to save guest meal.")
+		}
+	}
+	if message != "" {
+		return redirectWithFlash(c, "/admin/guests", message, false, "guests_success", "guests_error")
+	}
+	log.Printf("Guest meal %s %s x%d for %s ordered by %s", g.Date.Format("2006-01-02"), g.Meal, g.Guests, studentID, currentUser(c).Username)
+	return redirectWithFlash(c, "/admin/guests", "来客の食事を申し込みました。", true, "guests_success", "guests_error")
+}
+
+// adminCancelGuestMealHandler は管理者が来客の食事の申し込みを取り消します (締め切り後も取り消せます)
+func adminCancelGuestMealHandler(c echo.Context) error {
+	id, _ := strconv.Atoi(c.FormValue("id"))
+	g, err := cancelGuestMeal(db, id, "")
+	if err != nil {
+		log.Printf("Failed to cancel guest meal: %v", err)
+		return redirectWithFlash(c, "/admin/guests", "申し込みが見つかりません。", false, "guests_success", "guests_error")
+	}
+	log.Printf("Guest meal %d for %s cancelled by %s", g.ID, g.StudentID, currentUser(c).Username)
+	return redirectWithFlash(c, "/admin/guests", "来客の食事の申し込みを取り消しました。", true, "guests_success", "guests_error")
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -11,68 +13,139 @@ import (
 	"github.com/labstack/echo/v4"
 )
 
-// AdminMiddleware は管理ユーザーであるかを確認するミドルウェアです
-func AdminMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+// contextUserKey は認証済みユーザーを echo.Context に保存するキーです
+const contextUserKey = "user"
+
+// AuthMiddleware はログイン中のユーザーをリクエストごとにデータベースから読み込み、
+// echo.Context に設定するミドルウェアです
+// ユーザーが存在しない、または無効化されている場合はセッションを破棄してログインページへリダイレクトします
+func AuthMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		sess, err := session.Get("session", c)
 		if err != nil {
-			return c.Redirect(http.StatusTemporaryRedirect, "/") // セッション取得失敗
+			return c.Redirect(http.StatusSeeOther, "/") // セッション取得失敗
 		}
 
 		auth, ok := sess.Values["authenticated"].(bool)
-		if !ok || !auth {
-			return c.Redirect(http.StatusTemporaryRedirect, "/") // 未認証
+		studentID, idOK := sess.Values["studentID"].(string)
+		if !ok || !auth || !idOK || studentID == "" {
+			return c.Redirect(http.StatusSeeOther, "/") // 未認証
 		}
 
-		role, ok := sess.Values["role"].(string)
-		if !ok || role != "admin" {
-			// ここでは管理者でない場合の明確なエラーページへリダイレクトするか、
-			// もしくは単にメインページへリダイレクトするなど、仕様に応じた対応を検討
-			return c.Redirect(http.StatusTemporaryRedirect, "/main") // 管理者ではないのでメインページへ
+		user, err := getUserByUsername(db, studentID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Failed to load user %s: %v", studentID, err)
+			return c.String(http.StatusInternalServerError, "Failed to load user.")
+		}
+		if user == nil || !user.Active {
+			log.Printf("Session of %s rejected: user deleted or deactivated", studentID)
+			sess.Options.MaxAge = -1
+			if err := sess.Save(c.Request(), c.Response()); err != nil {
+				log.Printf("Failed to delete session: %v", err)
+			}
+			return c.Redirect(http.StatusSeeOther, "/")
 		}
 
+		c.Set(contextUserKey, user)
 		return next(c)
 	}
 }
 
-// adminDashboardHandler は管理者ダッシュボードを表示します
+// currentUser は AuthMiddleware が設定したログイン中のユーザーを返します
+func currentUser(c echo.Context) *User {
+	user, _ := c.Get(contextUserKey).(*User)
+	return user
+}
+
+// adminDashboardHandler は管理者ダッシュボード (今日・明日の概況とユーザー一覧) を表示します
 func adminDashboardHandler(c echo.Context) error {
-	users, err := getAllUsers(db)
+	query := parseUserQuery(c)
+	page, err := searchUsers(db, query, time.Now())
 	if err != nil {
-		log.Printf("Failed to get all users: %v", err)
+		log.Printf("Failed to search users: %v", err)
 		return c.String(http.StatusInternalServerError, "Failed to retrieve user data.")
 	}
+	userGroups := []LocationGroup[User]{{Items: page.Users}}
+	if query.Grouped() {
+		userGroups = groupByFloor(page.Users, func(u User) RoomLocation { return u.Location })
+	}
 
-	// セッションからフラッシュメッセージを取得
-	sess, _ := session.Get("session", c)
-	flashes := sess.Flashes("success_message")
-	successMessage := ""
-	if len(flashes) > 0 {
-		successMessage = flashes[0].(string)
+	floors, err := getFloors(db)
+	if err != nil {
+		log.Printf("Failed to get floors: %v", err)
 	}
-	if err := sess.Save(c.Request(), c.Response()); err != nil {
-		log.Printf("Failed to save session after reading flash: %v", err)
+
+	approvals, err := getGuardianApprovalOverview(db, time.Now())
+	if err != nil {
+		log.Printf("Failed to get guardian approvals: %v", err)
+	}
+	guardianPending := 0
+	for _, a := range approvals {
+		if a.Status == "pending" {
+			guardianPending++
+		}
+	}
+	staffPending, err := getOvernightRequests(db, time.Now(), "pending")
+	if err != nil {
+		log.Printf("Failed to get overnight requests: %v", err)
+	}
+	overviews, err := getDayOverviews(db, time.Now(), overviewDays)
+	if err != nil {
+		log.Printf("Failed to get day overviews: %v", err)
+	}
+	recentChanges, err := getRecentRecordHistory(db, recentChangesLimit)
+	if err != nil {
+		log.Printf("Failed to get recent record changes: %v", err)
+	}
+
+	var loginLocks []LoginLock
+	if currentUser(c).Can(PermUsersManage) {
+		loginLocks, err = getLockedLogins(db)
+		if err != nil {
+			log.Printf("Failed to get login locks: %v", err)
+		}
 	}
 
 	return c.Render(http.StatusOK, "admin.html", map[string]interface{}{
-		"users":          users,
-		"successMessage": successMessage,
+		"userGroups":      userGroups,
+		"userPage":        page,
+		"query":           query,
+		"roles":           Roles,
+		"floors":          floors,
+		"filter":          query.Filter,
+		"approvals":       approvals,
+		"overviews":       overviews,
+		"guardianPending": guardianPending,
+		"staffPending":    len(staffPending),
+		"recentChanges":   recentChanges,
+		"loginLocks":      loginLocks,
+		"successMessage":  popFlash(c, "success_message"),
 	})
 }
 
-// adminAddUserFormHandler は新規ユーザー追加フォームを表示します
-func adminAddUserFormHandler(c echo.Context) error {
-	// エラーメッセージをセッションから取得
-	sess, _ := session.Get("session", c)
-	flashes := sess.Flashes("error_message")
-	errorMessage := ""
-	if len(flashes) > 0 {
-		errorMessage = flashes[0].(string)
+// adminUnlockLoginHandler はロック中の学籍番号・IPアドレスのロックを解除します
+func adminUnlockLoginHandler(c echo.Context) error {
+	scope := c.FormValue("scope")
+	subject := c.FormValue("subject")
+	if (scope != loginScopeAccount && scope != loginScopeIP) || subject == "" {
+		return c.String(http.StatusBadRequest, "Invalid unlock request.")
+	}
+
+	if err := clearLoginFailures(db, scope, subject); err != nil {
+		log.Printf("Failed to unlock login %s %q: %v", scope, subject, err)
+		return c.String(http.StatusInternalServerError, "Failed to unlock.")
 	}
-	sess.Save(c.Request(), c.Response())
 
+	log.Printf("Login unlocked by %s: %s %q", currentUser(c).Username, scope, subject)
+
+	return redirectWithFlash(c, "/admin", fmt.Sprintf("'%s' のロックを解除しました。", subject), true, "success_message", "error_message")
+}
+
+// adminAddUserFormHandler は新規ユーザー追加フォームを表示します
+func adminAddUserFormHandler(c echo.Context) error {
 	return c.Render(http.StatusOK, "admin_add_user.html", map[string]interface{}{
-		"errorMessage": errorMessage,
+		"profile":      User{},
+		"errorMessage": popFlash(c, "error_message"),
 	})
 }
 
@@ -82,32 +155,26 @@ func adminAddUserHandler(c echo.Context) error {
 	password := c.FormValue("password")
 
 	if studentID == "" || password == "" {
-		sess, _ := session.Get("session", c)
-		sess.AddFlash("学籍番号とパスワードは必須です。", "error_message")
-		sess.Save(c.Request(), c.Response())
-		return c.Redirect(http.StatusSeeOther, "/admin/add_user")
+		return redirectWithFlash(c, "/admin/add_user", "学籍番号とパスワードは必須です。", false, "success_message", "error_message")
+	}
+
+	profile := &User{Username: studentID}
+	readProfileForm(c, profile, false)
+	if message := validateProfile(profile); message != "" {
+		return redirectWithFlash(c, "/admin/add_user", message, false, "success_message", "error_message")
 	}
 
 	err := RegisterUser(db, studentID, password)
 	if err != nil {
 		log.Printf("Failed to register new user by admin: %v", err)
-		sess, _ := session.Get("session", c)
-		// A more specific error message would be better.
-		// For now, a generic one.
-		sess.AddFlash("ユーザーの追加に失敗しました。ユーザーが既に存在する可能性があります。", "error_message")
-		sess.Save(c.Request(), c.Response())
-		return c.Redirect(http.StatusSeeOther, "/admin/add_user")
+		return redirectWithFlash(c, "/admin/add_user", "ユーザーの追加に失敗しました。ユーザーが既に存在する可能性があります。", false, "success_message", "error_message")
 	}
 
-	// Add a success flash message
-	sess, _ := session.Get("session", c)
-	message := fmt.Sprintf("ユーザー '%s' を追加しました。", studentID)
-	sess.AddFlash(message, "success_message")
-	if err := sess.Save(c.Request(), c.Response()); err != nil {
-		log.Printf("Failed to save session with flash message: %v", err)
+	if err := updateUserProfile(db, profile); err != nil {
+		log.Printf("Failed to save profile of new user %s: %v", studentID, err)
 	}
 
-	return c.Redirect(http.StatusSeeOther, "/admin")
+	return redirectWithFlash(c, "/admin", fmt.Sprintf("ユーザー '%s' を追加しました。", profile.Name()), true, "success_message", "error_message")
 }
 
 // adminUpdateUserRecordsHandler は管理者によるユーザーの外泊・欠食記録の更新を処理します
@@ -123,39 +190,17 @@ func adminUpdateUserRecordsHandler(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid form data.")
 	}
 
-	now := time.Now()
-	for i := 0; i < 7; i++ {
-		recordDate := now.AddDate(0, 0, i)
-		dateStr := recordDate.Format("2006-01-02")
-
-		// HTMLのフォーム値からbool値を決定するロジック
-		// 食事: 'on' は「欠食」を意味するので、DBでは false
-		// 外泊: 'on' は「外泊」を意味するので、DBでは true
-		breakfast := formValues.Get("breakfast-"+dateStr) != "on"
-		lunch := formValues.Get("lunch-"+dateStr) != "on"
-		dinner := formValues.Get("dinner-"+dateStr) != "on"
-		overnight := formValues.Get("overnight-"+dateStr) == "on"
-		note := formValues.Get("note-" + dateStr)
-
-		query := `INSERT INTO gaihaku_kesshoku_records (student_id, record_date, breakfast, lunch, dinner, overnight, note) VALUES ($1, $2, $3, $4, $5, $6, $7)
-        ON CONFLICT (student_id, record_date) DO UPDATE SET breakfast = EXCLUDED.breakfast, lunch = EXCLUDED.lunch, dinner = EXCLUDED.dinner, overnight = EXCLUDED.overnight, note = EXCLUDED.note;`
-
-		_, err = db.Exec(query, studentID, recordDate, breakfast, lunch, dinner, overnight, note)
-		if err != nil {
-			log.Printf("Failed to insert or update record for %s by admin: %v", dateStr, err)
-			return c.String(http.StatusInternalServerError, "Failed to submit record.")
-		}
+	// 管理者ページの食事ボタンは、"on" が欠食を表す
+	records, errorMessage := readWeekRecordForm(formValues, studentID, false, loadRecordRules(db, time.Now(), 7))
+	if errorMessage != "" {
+		return renderAdminUserRecords(c, http.StatusUnprocessableEntity, studentID, records, "", errorMessage)
 	}
-
-	// 成功のフラッシュメッセージを追加
-	sess, _ := session.Get("session", c)
-	sess.AddFlash("ユーザーの記録を更新しました。", "update_success")
-	if err := sess.Save(c.Request(), c.Response()); err != nil {
-		log.Printf("Failed to save session with flash message: %v", err)
+	if _, err := saveRecords(db, records, HistoryAdmin, currentUser(c).Username, false, nil); err != nil {
+		log.Printf("Failed to save records for %s by admin: %v", studentID, err)
+		return c.String(http.StatusInternalServerError, "Failed to submit record.")
 	}
 
-	// 編集ページにリダイレクト
-	return c.Redirect(http.StatusSeeOther, "/admin/user/"+studentID)
+	return redirectWithFlash(c, "/admin/user/"+studentID, "ユーザーの記録を更新しました。", true, "update_success", "update_error")
 }
 
 // adminViewUserRecordsHandler は特定のユーザーの外泊・欠食記録を表示・編集するページです
@@ -171,49 +216,81 @@ func adminViewUserRecordsHandler(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, "Failed to retrieve records.")
 	}
 
-	// 成功メッセージをセッションから取得
-	sess, _ := session.Get("session", c)
-	flashes := sess.Flashes("update_success")
-	successMessage := ""
-	if len(flashes) > 0 {
-		successMessage = flashes[0].(string)
-	}
-	sess.Save(c.Request(), c.Response())
-
-	return c.Render(http.StatusOK, "admin_user_records.html", map[string]interface{}{
-		"studentID":      studentID,
-		"records":        records,
-		"successMessage": successMessage,
-	})
+	return renderAdminUserRecords(c, http.StatusOK, studentID, records, popFlash(c, "update_success"), popFlash(c, "update_error"))
 }
 
-// mainPageHandlerは認証後のメインページを表示します
-func mainPageHandler(c echo.Context) error {
-	// セッションを取得
-	sess, err := session.Get("session", c)
+// renderAdminUserRecords はユーザー記録の編集ページを表示します
+// 入力エラーの場合は、送信された記録をそのまま表示し直します
+func renderAdminUserRecords(c echo.Context, status int, studentID string, records []GaihakuKesshokuRecord, successMessage, errorMessage string) error {
+	user, err := getUserByUsername(db, studentID)
 	if err != nil {
-		// セッションの取得に失敗したら、ログインページへリダイレクト
-		return c.Redirect(http.StatusTemporaryRedirect, "/")
+		log.Printf("Failed to get user %s by admin: %v", studentID, err)
+		return c.String(http.StatusNotFound, "User not found.")
 	}
 
-	// セッションに "authenticated" の値がない、または false の場合はログインページへリダイレクト
-	if auth, ok := sess.Values["authenticated"].(bool); !ok || !auth {
-		return c.Redirect(http.StatusTemporaryRedirect, "/")
+	activeSessions, err := sessionStore.ListUserSessions(studentID, nil)
+	if err != nil {
+		log.Printf("Failed to list sessions for %s: %v", studentID, err)
+	}
+
+	if user.Location, err = getCurrentLocation(db, studentID, time.Now()); err != nil {
+		log.Printf("Failed to get location of %s: %v", studentID, err)
+	}
+	assignments, err := getRoomAssignments(db, studentID)
+	if err != nil {
+		log.Printf("Failed to get room assignments for %s: %v", studentID, err)
+	}
+	buildings, err := getBuildings(db)
+	if err != nil {
+		log.Printf("Failed to get buildings: %v", err)
+	}
+	contacts, err := getEmergencyContacts(db, studentID)
+	if err != nil {
+		log.Printf("Failed to get emergency contacts for %s: %v", studentID, err)
 	}
+	diet, err := getDietaryRequirement(db, studentID)
+	if err != nil {
+		log.Printf("Failed to get dietary requirement for %s: %v", studentID, err)
+	}
+	history, err := getRecordHistory(db, studentID, recordHistoryLimit)
+	if err != nil {
+		log.Printf("Failed to get record history for %s: %v", studentID, err)
+	}
+	rules := loadRecordRules(db, time.Now(), 7)
+
+	return c.Render(status, "admin_user_records.html", map[string]interface{}{
+		"studentID":        studentID,
+		"user":             user,
+		"records":          records,
+		"sessions":         activeSessions,
+		"roles":            Roles,
+		"assignments":      assignments,
+		"buildings":        buildings,
+		"contacts":         contacts,
+		"contactsPath":     "/admin/user/" + studentID + "/contacts",
+		"contactsEditable": currentUser(c).Can(PermUsersManage),
+		"guardianEditable": true,
+		"diet":             diet,
+		"dietKinds":        dietKinds,
+		"dietPath":         "/admin/user/" + studentID + "/diet",
+		"dietEditable":     currentUser(c).Can(PermUsersManage),
+		"history":          history,
+		"today":            time.Now(),
+		"curfew":           rules.Curfew,
+		"calendar":         rules.Calendar,
+		"successMessage":   successMessage,
+		"errorMessage":     errorMessage,
+	})
+}
 
-	studentID := sess.Values["studentID"].(string)
+// mainPageHandlerは認証後のメインページを表示します
+func mainPageHandler(c echo.Context) error {
+	studentID := currentUser(c).Username
 
 	log.Printf("User %s accessed the main page", studentID)
 
-	flashes := sess.Flashes("success_message")
-	successMessage := ""
-	if len(flashes) > 0 {
-		successMessage = flashes[0].(string)
-	}
-
-	if err := sess.Save(c.Request(), c.Response()); err != nil {
-		log.Printf("Failed to save session: %v", err)
-	}
+	successMessage := popFlash(c, "success_message")
+	errorMessage := popFlash(c, "error_message")
 
 	// データベースから欠食・外泊記録を取得
 	records, err := getGaihakuKesshokuRecords(db, studentID)
@@ -222,26 +299,48 @@ func mainPageHandler(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, "Failed to retrieve records.")
 	}
 
-	return c.Render(http.StatusOK, "main.html", map[string]interface{}{
+	return renderMainPage(c, http.StatusOK, records, successMessage, errorMessage)
+}
+
+// renderMainPage はメインページを表示します
+// 入力エラーの場合は、送信された内容をそのまま表示し直します
+func renderMainPage(c echo.Context, status int, records []GaihakuKesshokuRecord, successMessage, errorMessage string) error {
+	studentID := currentUser(c).Username
+	rules := loadRecordRules(db, time.Now(), 7)
+	menus, err := getMenus(db, time.Now(), time.Now().AddDate(0, 0, 6))
+	if err != nil {
+		log.Printf("Failed to get menus: %v", err)
+	}
+	data := map[string]interface{}{
 		"studentID":      studentID,
 		"records":        records,
+		"curfew":         rules.Curfew,
+		"calendar":       rules.Calendar,
+		"menus":          menus,
 		"successMessage": successMessage,
-	})
-}
+		"errorMessage":   errorMessage,
+	}
 
-func gaihakuHandler(c echo.Context) error {
-	// セッションを取得
-	sess, err := session.Get("session", c)
+	// 安否確認の実施中は回答を促す
+	safetyEvent, err := getActiveSafetyEvent(db)
 	if err != nil {
-		return c.Redirect(http.StatusTemporaryRedirect, "/")
+		log.Printf("Failed to get active safety event: %v", err)
 	}
-
-	// 認証されていない場合はログインページへリダイレクト
-	if auth, ok := sess.Values["authenticated"].(bool); !ok || !auth {
-		return c.Redirect(http.StatusTemporaryRedirect, "/")
+	if safetyEvent != nil {
+		response, _, err := getOwnSafetyResponse(db, safetyEvent.ID, studentID)
+		if err != nil {
+			log.Printf("Failed to get safety response of %s: %v", studentID, err)
+		}
+		data["safetyEvent"] = safetyEvent
+		data["safetyResponse"] = response
 	}
 
-	studentID := sess.Values["studentID"].(string)
+	return c.Render(status, "main.html", data)
+}
+
+// gaihakuHandler はログイン中の学生の外泊・欠食登録を処理します
+func gaihakuHandler(c echo.Context) error {
+	studentID := currentUser(c).Username
 
 	formValues, err := c.FormParams()
 	if err != nil {
@@ -249,65 +348,51 @@ func gaihakuHandler(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid form data.")
 	}
 
-	now := time.Now()
-	for i := 0; i < 7; i++ {
-		recordDate := now.AddDate(0, 0, i)
-		dateStr := recordDate.Format("2006-01-02")
-
-		// フォームデータから各項目を取得
-		// HTMLのaria-pressed="true"に対応
-		breakfast := formValues.Get("breakfast-"+dateStr) == "on"
-		lunch := formValues.Get("lunch-"+dateStr) == "on"
-		dinner := formValues.Get("dinner-"+dateStr) == "on"
-		overnight := formValues.Get("overnight-"+dateStr) == "on"
-		note := formValues.Get("note-" + dateStr)
-
-		query := `INSERT INTO gaihaku_kesshoku_records (student_id, record_date, breakfast, lunch, dinner, overnight, note) VALUES ($1, $2, $3, $4, $5, $6, $7)
-        ON CONFLICT (student_id, record_date) DO UPDATE SET breakfast = EXCLUDED.breakfast, lunch = EXCLUDED.lunch, dinner = EXCLUDED.dinner, overnight = EXCLUDED.overnight, note = EXCLUDED.note;`
-
-		_, err = db.Exec(query, studentID, recordDate, breakfast, lunch, dinner, overnight, note)
-		if err != nil {
-			log.Printf("Failed to insert or update record for %s: %v", dateStr, err)
-			return c.String(http.StatusInternalServerError, "Failed to submit record.")
-		}
+	// メインページの食事ボタンは、"on" が喫食を表す
+	records, errorMessage := readWeekRecordForm(formValues, studentID, true, loadRecordRules(db, time.Now(), 7))
+	if errorMessage != "" {
+		return renderMainPage(c, http.StatusUnprocessableEntity, records, "", errorMessage)
 	}
-
-	// 成功したらセッションにフラッシュメッセージを保存
-	timestamp := time.Now().Format("[15:04]")
-	message := fmt.Sprintf("%s 登録を受け付けました。", timestamp)
-
-	sess.AddFlash(message, "success_message")
-	if err := sess.Save(c.Request(), c.Response()); err != nil {
-		log.Printf("Failed to save session: %v", err)
+	// 寮監督者の承認が必要な設定の場合は、外泊を保存と同時に承認待ちにする
+	// 未成年の外泊も保存と同時に保護者の承認待ちにし、コミットした後に保護者に承認を依頼する
+	guardianPending, err := saveRecords(db, records, HistorySelf, studentID, getBoolSetting(db, settingStaffApproval, false), currentUser(c))
+	if err != nil {
+		log.Printf("Failed to save records for %s: %v", studentID, err)
+		return c.String(http.StatusInternalServerError, "Failed to submit record.")
 	}
+	warning := sendGuardianApprovals(db, currentUser(c), guardianPending)
 
-	// 成功したらメインページにリダイレクト
-	return c.Redirect(http.StatusSeeOther, "/main")
+	// 受け付けたメッセージと、保護者への依頼についての注意を表示する
+	if warning != "" {
+		addFlash(c, warning, "error_message")
+	}
+	message := fmt.Sprintf("%s 登録を受け付けました。", time.Now().Format("[15:04]"))
+	return redirectWithFlash(c, "/main", message, true, "success_message", "error_message")
 }
 
 // loginFormHandlerはログインフォームを表示します
 func loginFormHandler(c echo.Context) error {
 	sess, _ := session.Get("session", c)
 
-	// セッションに "authenticated" の値があり、trueの場合は /main にリダイレクト
+	// セッションに "authenticated" の値があり、trueの場合は役割に応じたページにリダイレクト
 	if auth, ok := sess.Values["authenticated"].(bool); ok && auth {
 		// リダイレクトする前に、セッションを保存
 		if err := sess.Save(c.Request(), c.Response()); err != nil {
 			log.Printf("Failed to save session before redirect: %v", err)
 		}
-		return c.Redirect(http.StatusSeeOther, "/main")
+		redirect := "/main"
+		if studentID, ok := sess.Values["studentID"].(string); ok {
+			if user, err := getUserByUsername(db, studentID); err == nil {
+				redirect = homePath(user.Role)
+			}
+		}
+		return c.Redirect(http.StatusSeeOther, redirect)
 	}
 
-	// セッションからフラッシュメッセージを取得
-	flashes := sess.Flashes("login_error")
+	// 認証に失敗した場合はクエリパラメータで通知される (ログイン前のセッションはサーバー側に保存しないため)
 	errorMessage := ""
-	if len(flashes) > 0 {
-		errorMessage = flashes[0].(string)
-	}
-
-	// セッションを保存して、メッセージを削除
-	if err := sess.Save(c.Request(), c.Response()); err != nil {
-		log.Printf("Failed to save session after flashing: %v", err)
+	if c.QueryParam("error") == loginErrorParam {
+		errorMessage = loginErrorMessage
 	}
 
 	// テンプレートにエラーメッセージを渡してレンダリング
@@ -320,19 +405,35 @@ func loginFormHandler(c echo.Context) error {
 func loginHandler(c echo.Context) error {
 	studentID := c.FormValue("student_id")
 	password := c.FormValue("password")
+	ip := c.RealIP()
+
+	// ロック中は認証を行わず、通常の認証失敗と同じ応答を返す
+	if isLoginAttemptLocked(studentID, ip) {
+		log.Printf("Rejected login attempt for %q from %s: locked out", studentID, ip)
+		return loginFailed(c)
+	}
 
 	authenticated, role := AuthenticateUser(db, studentID, password)
 	if authenticated {
-		// 認証成功
+		if err := clearLoginFailures(db, loginScopeAccount, studentID); err != nil {
+			log.Printf("Failed to clear login failures for %q: %v", studentID, err)
+		}
+
+		// 認証成功: セッション固定化を防ぐため、ログイン前のセッションIDは破棄する
 		sess, _ := session.Get("session", c)
+		if err := sessionStore.Renew(sess); err != nil {
+			log.Printf("Failed to renew session: %v", err)
+			return c.String(http.StatusInternalServerError, "Failed to login.")
+		}
 		sess.Options = &sessions.Options{
 			Path:     "/",
-			MaxAge:   86400 * 7, // 7 days
+			MaxAge:   int(sessionStore.AbsoluteTimeout.Seconds()),
 			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
 		}
 		sess.Values["authenticated"] = true
 		sess.Values["studentID"] = studentID
-		sess.Values["role"] = role // ロールをセッションに保存
+		// ロールはセッションに保存せず、リクエストごとに AuthMiddleware でデータベースから読み込む
 
 		if err := sess.Save(c.Request(), c.Response()); err != nil {
 			log.Printf("Failed to save session: %v", err)
@@ -340,27 +441,61 @@ func loginHandler(c echo.Context) error {
 		}
 
 		// 役割に基づいてリダイレクト先を変更
-		if role == "admin" {
-			return c.Redirect(http.StatusSeeOther, "/admin")
-		}
-		return c.Redirect(http.StatusSeeOther, "/main")
+		return c.Redirect(http.StatusSeeOther, homePath(role))
 	}
 
-	// 認証失敗
-	sess, _ := session.Get("session", c)
-	sess.AddFlash("認証に失敗しました。学籍番号またはパスワードが間違っています。", "login_error")
-	if err := sess.Save(c.Request(), c.Response()); err != nil {
-		log.Printf("Failed to save session with flash message: %v", err)
+	// 認証失敗: 学籍番号とIPアドレスの両方で失敗を記録する
+	accountFailures, _, err := recordLoginFailure(db, loginScopeAccount, studentID, loginAccountMaxFailures)
+	if err != nil {
+		log.Printf("Failed to record login failure for %q: %v", studentID, err)
+	}
+	ipFailures, _, err := recordLoginFailure(db, loginScopeIP, ip, loginIPMaxFailures)
+	if err != nil {
+		log.Printf("Failed to record login failure for %s: %v", ip, err)
 	}
 
-	return c.Redirect(http.StatusSeeOther, "/")
+	// 失敗が続くほど応答を遅らせる
+	time.Sleep(loginFailureDelay(max(accountFailures, ipFailures)))
+
+	return loginFailed(c)
+}
+
+// isLoginAttemptLocked は学籍番号またはIPアドレスがロック中かを確認します
+func isLoginAttemptLocked(studentID, ip string) bool {
+	for _, s := range []struct{ scope, subject string }{
+		{loginScopeAccount, studentID},
+		{loginScopeIP, ip},
+	} {
+		locked, err := isLoginLocked(db, s.scope, s.subject)
+		if err != nil {
+			log.Printf("Failed to check login lock: %v", err)
+			continue
+		}
+		if locked {
+			return true
+		}
+	}
+	return false
+}
+
+// ログイン失敗の通知に使うクエリパラメータの値とメッセージ
+// アカウントの存在やロック状態が分からないよう、メッセージは常に同じにする
+const (
+	loginErrorParam   = "auth"
+	loginErrorMessage = "認証に失敗しました。学籍番号またはパスワードが間違っています。"
+)
+
+// loginFailed は認証失敗を通知するクエリパラメータを付けてログインページへリダイレクトします
+// 匿名のセッションにフラッシュメッセージを保存すると、失敗のたびにセッションの行が増えるため使わない
+func loginFailed(c echo.Context) error {
+	return c.Redirect(http.StatusSeeOther, "/?error="+loginErrorParam)
 }
 
 func logoutHandler(c echo.Context) error {
 	sess, err := session.Get("session", c)
 	if err != nil {
 		// セッションが取得できない場合は、既にログアウト状態とみなす
-		return c.Redirect(http.StatusTemporaryRedirect, "/")
+		return c.Redirect(http.StatusSeeOther, "/")
 	}
 
 	// セッションの値をクリアして、有効期限を過去にする
@@ -373,3 +508,178 @@ func logoutHandler(c echo.Context) error {
 	// ログインページにリダイレクト
 	return c.Redirect(http.StatusSeeOther, "/")
 }
+
+// minPasswordLength はパスワード変更時に求める最小の長さです
+const minPasswordLength = 8
+
+// settingsPageHandler はユーザー設定ページ（パスワード変更・ログイン中の端末一覧）を表示します
+func settingsPageHandler(c echo.Context) error {
+	studentID := currentUser(c).Username
+	sess, _ := session.Get("session", c)
+
+	activeSessions, err := sessionStore.ListUserSessions(studentID, sess)
+	if err != nil {
+		log.Printf("Failed to list sessions for %s: %v", studentID, err)
+		return c.String(http.StatusInternalServerError, "Failed to retrieve sessions.")
+	}
+
+	contacts, err := getEmergencyContacts(db, studentID)
+	if err != nil {
+		log.Printf("Failed to get emergency contacts for %s: %v", studentID, err)
+	}
+	diet, err := getDietaryRequirement(db, studentID)
+	if err != nil {
+		log.Printf("Failed to get dietary requirement for %s: %v", studentID, err)
+	}
+
+	return c.Render(http.StatusOK, "settings.html", map[string]interface{}{
+		"studentID":        studentID,
+		"user":             currentUser(c),
+		"contacts":         contacts,
+		"contactsPath":     "/settings/contacts",
+		"contactsEditable": true,
+		"guardianEditable": false,
+		"diet":             diet,
+		"dietKinds":        dietKinds,
+		"dietPath":         "/settings/diet",
+		"dietEditable":     true,
+		"sessions":         activeSessions,
+		"successMessage":   popFlash(c, "settings_success"),
+		"errorMessage":     popFlash(c, "settings_error"),
+	})
+}
+
+// changePasswordHandler はログイン中のユーザーのパスワードを変更します
+// 変更後は、この端末以外のセッションを全て無効化します
+func changePasswordHandler(c echo.Context) error {
+	studentID := currentUser(c).Username
+	sess, _ := session.Get("session", c)
+
+	currentPassword := c.FormValue("current_password")
+	newPassword := c.FormValue("new_password")
+	confirmPassword := c.FormValue("confirm_password")
+
+	message, key := "パスワードを変更しました。他の端末からはログアウトされました。", "settings_success"
+	switch {
+	case newPassword != confirmPassword:
+		message, key = "新しいパスワードが一致しません。", "settings_error"
+	case len(newPassword) < minPasswordLength:
+		message, key = fmt.Sprintf("パスワードは%d文字以上にしてください。", minPasswordLength), "settings_error"
+	default:
+		if ok, _ := AuthenticateUser(db, studentID, currentPassword); !ok {
+			message, key = "現在のパスワードが間違っています。", "settings_error"
+			break
+		}
+		if err := updateUserPassword(db, studentID, newPassword); err != nil {
+			log.Printf("Failed to change password for %s: %v", studentID, err)
+			return c.String(http.StatusInternalServerError, "Failed to change password.")
+		}
+		if err := sessionStore.RevokeUserSessions(studentID, sess); err != nil {
+			log.Printf("Failed to revoke sessions for %s: %v", studentID, err)
+		}
+		log.Printf("User %s changed password", studentID)
+	}
+
+	return redirectWithFlash(c, "/settings", message, key == "settings_success", "settings_success", "settings_error")
+}
+
+// revokeSessionHandler はログイン中の端末を1つ選んでログアウトさせます
+func revokeSessionHandler(c echo.Context) error {
+	studentID := currentUser(c).Username
+
+	if err := sessionStore.RevokeSession(studentID, c.FormValue("session_id")); err != nil {
+		log.Printf("Failed to revoke session for %s: %v", studentID, err)
+		return c.String(http.StatusInternalServerError, "Failed to revoke session.")
+	}
+
+	return redirectWithFlash(c, "/settings", "選択した端末をログアウトさせました。", true, "settings_success", "settings_error")
+}
+
+// revokeAllSessionsHandler はこの端末を含む全ての端末からログアウトします
+func revokeAllSessionsHandler(c echo.Context) error {
+	studentID := currentUser(c).Username
+	sess, _ := session.Get("session", c)
+
+	if err := sessionStore.RevokeUserSessions(studentID, nil); err != nil {
+		log.Printf("Failed to revoke sessions for %s: %v", studentID, err)
+		return c.String(http.StatusInternalServerError, "Failed to revoke sessions.")
+	}
+	log.Printf("User %s logged out everywhere", studentID)
+
+	sess.Options.MaxAge = -1
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		log.Printf("Failed to save session: %v", err)
+	}
+
+	return c.Redirect(http.StatusSeeOther, "/")
+}
+
+// adminUpdateUserRoleHandler はユーザーの役割を変更し、そのユーザーのセッションを全て無効化します
+func adminUpdateUserRoleHandler(c echo.Context) error {
+	studentID := c.Param("student_id")
+	role := c.FormValue("role")
+	if studentID == "" || !isValidRole(role) {
+		return c.String(http.StatusBadRequest, "Invalid role.")
+	}
+
+	if currentUser(c).Username == studentID {
+		return redirectWithFlash(c, "/admin/user/"+studentID, "自分自身の役割は変更できません。", false, "update_success", "update_error")
+	}
+
+	if err := updateUserRole(db, studentID, role); err != nil {
+		log.Printf("Failed to update role for %s: %v", studentID, err)
+		return c.String(http.StatusInternalServerError, "Failed to update role.")
+	}
+	if err := sessionStore.RevokeUserSessions(studentID, nil); err != nil {
+		log.Printf("Failed to revoke sessions for %s: %v", studentID, err)
+	}
+	log.Printf("Role of %s changed to %s", studentID, role)
+
+	return redirectWithFlash(c, "/admin/user/"+studentID, "役割を変更しました。対象ユーザーは再ログインが必要です。", true, "update_success", "update_error")
+}
+
+// adminRevokeUserSessionsHandler はユーザーを全ての端末からログアウトさせます
+func adminRevokeUserSessionsHandler(c echo.Context) error {
+	studentID := c.Param("student_id")
+	if studentID == "" {
+		return c.String(http.StatusBadRequest, "Student ID is required.")
+	}
+
+	if err := sessionStore.RevokeUserSessions(studentID, nil); err != nil {
+		log.Printf("Failed to revoke sessions for %s: %v", studentID, err)
+		return c.String(http.StatusInternalServerError, "Failed to revoke sessions.")
+	}
+	log.Printf("All sessions of %s revoked by admin", studentID)
+
+	return redirectWithFlash(c, "/admin/user/"+studentID, "全ての端末からログアウトさせました。", true, "update_success", "update_error")
+}
+
+// adminUpdateUserActiveHandler はユーザーを有効化・無効化します
+// 無効化したユーザーは全ての端末からログアウトされ、ログインもできなくなります
+func adminUpdateUserActiveHandler(c echo.Context) error {
+	studentID := c.Param("student_id")
+	if studentID == "" {
+		return c.String(http.StatusBadRequest, "Student ID is required.")
+	}
+	active := c.FormValue("active") == "true"
+
+	if currentUser(c).Username == studentID {
+		return redirectWithFlash(c, "/admin/user/"+studentID, "自分自身を無効化することはできません。", false, "update_success", "update_error")
+	}
+
+	if err := updateUserActive(db, studentID, active); err != nil {
+		log.Printf("Failed to update active status for %s: %v", studentID, err)
+		return c.String(http.StatusInternalServerError, "Failed to update user.")
+	}
+
+	message := "アカウントを有効化しました。"
+	if !active {
+		if err := sessionStore.RevokeUserSessions(studentID, nil); err != nil {
+			log.Printf("Failed to revoke sessions for %s: %v", studentID, err)
+		}
+		message = "アカウントを無効化しました。"
+	}
+	log.Printf("Active status of %s changed to %t by %s", studentID, active, currentUser(c).Username)
+
+	return redirectWithFlash(c, "/admin/user/"+studentID, message, true, "update_success", "update_error")
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// 外泊・欠食記録の変更の種類
+const (
+	HistorySelf      = "self"       // 寮生本人の登録
+	HistoryAdmin     = "admin"      // 管理者による寮生ごとの編集
+	HistoryAdminBulk = "admin_bulk" // 管理者による一括編集
+	HistoryAdminPast = "admin_past" // 管理者による過去の日の記録の修正 (編集のロックを解除して変更)
+)
+
+// historyActions は変更の種類の表示名です
+var historyActions = []struct {
+	Name  string
+	Label string
+}{
+	{HistorySelf, "本人"},
+	{HistoryAdmin, "管理者"},
+	{HistoryAdminBulk, "管理者 (一括編集)"},
+	{HistoryAdminPast, "管理者 (過去の記録の修正)"},
+}
+
+// recordHistoryLimit は寮生のページに表示する変更履歴の件数です
+const recordHistoryLimit = 30
+
+// createRecordHistoryTable は外泊・欠食記録の変更履歴のテーブルを作成します
+func createRecordHistoryTable(db *sql.DB) error {
+	const createTableSQL = `
+	CREATE TABLE IF NOT EXISTS record_history (
+		id SERIAL PRIMARY KEY,
+		student_id VARCHAR(50) NOT NULL,
+		record_date DATE NOT NULL,
+		action VARCHAR(20) NOT NULL,
+		breakfast BOOLEAN NOT NULL,
+		lunch BOOLEAN NOT NULL,
+		dinner BOOLEAN NOT NULL,
+		overnight BOOLEAN NOT NULL,
+		destination VARCHAR(200) NOT NULL DEFAULT '',
+		late_return BOOLEAN NOT NULL,
+		note TEXT NOT NULL DEFAULT '',
+		changed_by VARCHAR(50),
+		changed_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS record_history_student_idx ON record_history (student_id, changed_at);
+	CREATE INDEX IF NOT EXISTS record_history_changed_at_idx ON record_history (changed_at);`
+
+	_, err := db.Exec(createTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to execute SQL: %w", err)
+	}
+
+	return nil
+}
+
+// historyActionLabel は変更の種類の表示名を返します
+func historyActionLabel(action string) string {
+	for _, a := range historyActions {
+		if a.Name == action {
+			return a.Label
+		}
+	}
+	return action
+}
+
+// logRecordChange は保存する記録が現在の記録と異なる場合に、変更履歴に残します (upsertRecord の前に呼び出します)
+// 記録がない日は、全ての食事を食べ外泊しないものとして比べます。変更があったかどうかを返します
+func logRecordChange(ex execer, r *GaihakuKesshokuRecord, action, changedBy string) (bool, error) {
+	res, err := ex.Exec(`
+	INSERT INTO record_history (student_id, record_date, action, breakfast, lunch, dinner, overnight, destination, late_return, note, changed_by)
+	SELECT $1::text, $2::date, $3::text, $4::boolean, $5::boolean, $6::boolean, $7::boolean, $8::text, $9::boolean, $10::text, $11::text
+	FROM (SELECT 1) AS one
+	LEFT JOIN gaihaku_kesshoku_records r ON r.student_id = $1::text AND r.record_date = $2::date
+	WHERE (COALESCE(r.breakfast, TRUE), COALESCE(r.lunch, TRUE), COALESCE(r.dinner, TRUE), COALESCE(r.overnight, FALSE),
+		COALESCE(r.destination, ''), COALESCE(r.late_return, FALSE), COALESCE(r.note, ''))
+		IS DISTINCT FROM ($4::boolean, $5::boolean, $6::boolean, $7::boolean, $8::text, $9::boolean, $10::text)`,
+		r.StudentID, r.RecordDate.Format("2006-01-02"), action, r.Breakfast, r.Lunch, r.Dinner, r.Overnight,
+		r.Destination, r.LateReturn, r.Note, changedBy)
+	if err != nil {
+		return false, fmt.Errorf("failed to log record change for %s: %w", r.RecordDate.Format("2006-01-02"), err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to log record change for %s: %w", r.RecordDate.Format("2006-01-02"), err)
+	}
+	return n > 0, nil
+}
+
+// getRecentRecordHistory は全寮生の最近の外泊・欠食記録の変更を新しい順に取得します
+func getRecentRecordHistory(db *sql.DB, limit int) ([]RecordHistory, error) {
+	rows, err := db.Query(`
+	SELECT h.student_id, `+userNameSQL+`, h.record_date, h.action, h.breakfast, h.lunch, h.dinner, h.overnight,
+		h.destination, h.late_return, h.note, COALESCE(h.changed_by, ''), h.changed_at
+	FROM record_history h
+	JOIN users u ON u.username = h.student_id
+	ORDER BY h.changed_at DESC, h.id DESC
+	LIMIT $1`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query recent record history: %w", err)
+	}
+	defer rows.Close()
+
+	var history []RecordHistory
+	for rows.Next() {
+		var h RecordHistory
+		if err := rows.Scan(&h.StudentID, &h.StudentName, &h.RecordDate, &h.Action, &h.Breakfast, &h.Lunch, &h.Dinner, &h.Overnight,
+			&h.Destination, &h.LateReturn, &h.Note, &h.ChangedBy, &h.ChangedAt); err != nil {
+			log.Printf("Failed to scan record history: %v", err)
+			continue
+		}
+		history = append(history, h)
+	}
+	return history, nil
+}
+
+// getRecordHistoryByDate は寮生の期間内の日の変更履歴を、対象日ごとに新しい順にまとめて取得します
+func getRecordHistoryByDate(db *sql.DB, studentID string, from, to time.Time) (map[string][]RecordHistory, error) {
+	rows, err := db.Query(`
+	SELECT record_date, action, breakfast, lunch, dinner, overnight, destination, late_return, note, COALESCE(changed_by, ''), changed_at
+	FROM record_history
+	WHERE student_id = $1 AND record_date BETWEEN $2 AND $3
+	ORDER BY changed_at DESC, id DESC`, studentID, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query record history: %w", err)
+	}
+	defer rows.Close()
+
+	history := make(map[string][]RecordHistory)
+	for rows.Next() {
+		h := RecordHistory{StudentID: studentID}
+		if err := rows.Scan(&h.RecordDate, &h.Action, &h.Breakfast, &h.Lunch, &h.Dinner, &h.Overnight,
+			&h.Destination, &h.LateReturn, &h.Note, &h.ChangedBy, &h.ChangedAt); err != nil {
+			log.Printf("Failed to scan record history: %v", err)
+			continue
+		}
+		key := h.RecordDate.Format("2006-01-02")
+		history[key] = append(history[key], h)
+	}
+	return history, nil
+}
+
+// getRecordHistory は寮生の外泊・欠食記録の変更履歴を新しい順に取得します
+func getRecordHistory(db *sql.DB, studentID string, limit int) ([]RecordHistory, error) {
+	rows, err := db.Query(`
+	SELECT record_date, action, breakfast, lunch, dinner, overnight, destination, late_return, note, COALESCE(changed_by, ''), changed_at
+	FROM record_history
+	WHERE student_id = $1
+	ORDER BY changed_at DESC, id DESC
+	LIMIT $2`, studentID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query record history: %w", err)
+	}
+	defer rows.Close()
+
+	var history []RecordHistory
+	for rows.Next() {
+		h := RecordHistory{StudentID: studentID}
+		if err := rows.Scan(&h.RecordDate, &h.Action, &h.Breakfast, &h.Lunch, &h.Dinner, &h.Overnight,
+			&h.Destination, &h.LateReturn, &h.Note, &h.ChangedBy, &h.ChangedAt); err != nil {
+			log.Printf("Failed to scan record history: %v", err)
+			continue
+		}
+		history = append(history, h)
+	}
+	return history, nil
+}
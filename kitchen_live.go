@@ -0,0 +1,409 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+const (
+	// recordChangesChannel は記録の変更を通知する PostgreSQL の LISTEN/NOTIFY のチャンネルです
+	// 複数のアプリのインスタンスがあっても、どのインスタンスで保存した変更も全てのインスタンスに届きます
+	recordChangesChannel = "record_changes"
+	// countChangesChannel は記録以外の、食数のみが変わる変更 (来客の食事・外泊の承認・行事予定) を通知するチャンネルです
+	countChangesChannel = "count_changes"
+	// liveDays は厨房のライブ表示で食数を表示する日数 (今日・明日) です
+	liveDays = 2
+	// liveDebounce は続けて届いた変更をまとめて食数を数え直すまでの待ち時間です (一括編集などで何度も数え直さないため)
+	liveDebounce = time.Second
+	// liveHeartbeat は接続を保つためにコメントを送る間隔です
+	liveHeartbeat = 30 * time.Second
+	// liveSubscriberBuffer は表示中の画面ごとに溜めておくイベントの数です (溢れた分は捨て、次の食数で追いつきます)
+	liveSubscriberBuffer = 32
+)
+
+// RecordChangeEvent は記録の変更の通知です。pg_notify で送り、SSE の change イベントとして画面に届けます
+// 厨房の画面に送るため、寮生を特定する情報は含めません
+type RecordChangeEvent struct {
+	Date        string `json:"date"`
+	Action      string `json:"action"`
+	ActionLabel string `json:"action_label"`
+	Breakfast   bool   `json:"breakfast"`
+	Lunch       bool   `json:"lunch"`
+	Dinner      bool   `json:"dinner"`
+	Overnight   bool   `json:"overnight"`
+	ChangedAt   string `json:"changed_at"` // HH:MM:SS
+}
+
+// notifyRecordChange は記録の変更を通知します。トランザクションの中で呼び出すと、コミットしたときに届きます
+func notifyRecordChange(ex execer, r *GaihakuKesshokuRecord, action string) error {
+	payload, err := json.Marshal(RecordChangeEvent{
+		Date:        r.RecordDate.Format("2006-01-02"),
+		Action:      action,
+		ActionLabel: historyActionLabel(action),
+		Breakfast:   r.Breakfast,
+		Lunch:       r.Lunch,
+		Dinner:      r.Dinner,
+		Overnight:   r.Overnight,
+		ChangedAt:   time.Now().Format("15:04:05"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode record change: %w", err)
+	}
+	if _, err := ex.Exec("SELECT pg_notify($1, $2)", recordChangesChannel, string(payload)); err != nil {
+		return fmt.Errorf("failed to notify record change for %s: %w", r.RecordDate.Format("2006-01-02"), err)
+	}
+	return nil
+}
+
+// CountChangeEvent は食数のみが変わる変更の通知で、変わった期間 (From〜To) のみを持ちます
+// 画面に変更の内容は表示せず、表示中の日が期間に含まれれば食数を数え直します
+type CountChangeEvent struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// notifyCountChange は from〜to の食数が変わったことを通知します。トランザクションの中で呼び出すと、コミットしたときに届きます
+func notifyCountChange(ex execer, from, to time.Time) error {
+	payload, err := json.Marshal(CountChangeEvent{From: from.Format("2006-01-02"), To: to.Format("2006-01-02")})
+	if err != nil {
+		return fmt.Errorf("failed to encode count change: %w", err)
+	}
+	if _, err := ex.Exec("SELECT pg_notify($1, $2)", countChangesChannel, string(payload)); err != nil {
+		return fmt.Errorf("failed to notify count change for %s - %s: %w", from.Format("2006-01-02"), to.Format("2006-01-02"), err)
+	}
+	return nil
+}
+
+// liveMealCount は厨房のライブ表示の1日分の食数です (SSE の counts イベントでも送ります)
+type liveMealCount struct {
+	Date             string `json:"date"`
+	Label            string `json:"label"`
+	DayLabel         string `json:"day_label"` // 特別な日の表示名
+	BreakfastServed  bool   `json:"breakfast_served"`
+	MealsServed      bool   `json:"meals_served"`
+	Breakfast        int    `json:"breakfast"`
+	Lunch            int    `json:"lunch"`
+	Dinner           int    `json:"dinner"`
+	GuestBreakfast   int    `json:"guest_breakfast"`
+	GuestLunch       int    `json:"guest_lunch"`
+	GuestDinner      int    `json:"guest_dinner"`
+	Overnight        int    `json:"overnight"`
+	OvernightPending int    `json:"overnight_pending"`
+	Residents        int    `json:"residents"`
+}
+
+// getLiveMealCounts は now から liveDays 日分の食数を取得します
+func getLiveMealCounts(now time.Time) ([]liveMealCount, error) {
+	counts, err := getMealCounts(db, now, liveDays, LocationFilter{})
+	if err != nil {
+		return nil, err
+	}
+	calendar, err := getDormCalendar(db, now, now.AddDate(0, 0, liveDays-1))
+	if err != nil {
+		log.Printf("Failed to get dorm calendar: %v", err)
+	}
+
+	live := make([]liveMealCount, 0, len(counts))
+	for _, m := range counts {
+		day := calendar[m.Date.Format("2006-01-02")]
+		live = append(live, liveMealCount{
+			Date:             m.Date.Format("2006-01-02"),
+			Label:            m.Date.Format("01/02") + " (" + japaneseWeekday(m.Date) + ")",
+			DayLabel:         day.Label(),
+			BreakfastServed:  day.BreakfastServed(),
+			MealsServed:      day.MealsServed(),
+			Breakfast:        m.Breakfast,
+			Lunch:            m.Lunch,
+			Dinner:           m.Dinner,
+			GuestBreakfast:   m.GuestBreakfast,
+			GuestLunch:       m.GuestLunch,
+			GuestDinner:      m.GuestDinner,
+			Overnight:        m.Overnight,
+			OvernightPending: m.OvernightPending,
+			Residents:        m.Residents,
+		})
+	}
+	return live, nil
+}
+
+// liveMessage は SSE で送る1件のイベントです
+type liveMessage struct {
+	event string
+	data  []byte
+}
+
+// newLiveMessage は v を JSON にしたイベントを作成します
+func newLiveMessage(event string, v interface{}) (liveMessage, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return liveMessage{}, fmt.Errorf("failed to encode %s event: %w", event, err)
+	}
+	return liveMessage{event: event, data: data}, nil
+}
+
+// kitchenBroker は記録の変更の通知を、このインスタンスで表示中の厨房の画面に配信します
+type kitchenBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan liveMessage]struct{}
+	done        chan struct{} // サーバーの停止処理で閉じ、表示中の画面との接続を終了させます
+	closeOnce   sync.Once
+}
+
+// kitchenLive は厨房のライブ表示への配信です
+var kitchenLive = &kitchenBroker{subscribers: make(map[chan liveMessage]struct{}), done: make(chan struct{})}
+
+// subscribe は配信を受け取るチャンネルを登録します
+func (b *kitchenBroker) subscribe() chan liveMessage {
+	ch := make(chan liveMessage, liveSubscriberBuffer)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+// unsubscribe は配信を受け取るチャンネルの登録を解除します
+func (b *kitchenBroker) unsubscribe(ch chan liveMessage) {
+	b.mu.Lock()
+	delete(b.subscribers, ch)
+	b.mu.Unlock()
+}
+
+// close は表示中の全ての画面との接続を終了させます
+// SSE の接続は終わらないため、サーバーの停止処理で呼び出さないと停止が待ち時間いっぱいまで終わりません
+// 画面は EventSource の再接続で、別のインスタンスまたは再起動後のサーバーにつなぎ直します
+func (b *kitchenBroker) close() {
+	b.closeOnce.Do(func() { close(b.done) })
+}
+
+// subscriberCount は表示中の画面の数を返します
+func (b *kitchenBroker) subscriberCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers)
+}
+
+// broadcast は全ての画面にイベントを送ります。受け取りが追いつかない画面には送りません
+func (b *kitchenBroker) broadcast(m liveMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- m:
+		default:
+		}
+	}
+}
+
+// publish はまとめて届いた変更を配信し、表示中の日の変更があれば食数を数え直して配信します
+// counts は食数のみが変わる変更で、表示中の日を含めば食数を数え直します
+// resync は通知を受け取れなかった可能性がある (再接続した) ことを表し、変更がなくても食数を数え直します
+func (b *kitchenBroker) publish(changes []RecordChangeEvent, counts []CountChangeEvent, resync bool) {
+	if b.subscriberCount() == 0 {
+		return
+	}
+	now := time.Now()
+	shown := make(map[string]bool, liveDays)
+	for i := 0; i < liveDays; i++ {
+		shown[now.AddDate(0, 0, i).Format("2006-01-02")] = true
+	}
+	first, last := now.Format("2006-01-02"), now.AddDate(0, 0, liveDays-1).Format("2006-01-02")
+
+	recount := resync
+	for _, ev := range counts {
+		if ev.From <= last && ev.To >= first {
+			recount = true
+		}
+	}
+	for _, ev := range changes {
+		if !shown[ev.Date] {
+			continue
+		}
+		recount = true
+		m, err := newLiveMessage("change", ev)
+		if err != nil {
+			log.Printf("Failed to publish record change: %v", err)
+			continue
+		}
+		b.broadcast(m)
+	}
+	if !recount {
+		return
+	}
+
+	live, err := getLiveMealCounts(now)
+	if err != nil {
+		log.Printf("Failed to get live meal counts: %v", err)
+		return
+	}
+	m, err := newLiveMessage("counts", live)
+	if err != nil {
+		log.Printf("Failed to publish meal counts: %v", err)
+		return
+	}
+	b.broadcast(m)
+}
+
+// run は記録の変更の通知を受け取り、liveDebounce ごとにまとめて配信します (listener を閉じると終了します)
+func (b *kitchenBroker) run(listener *pq.Listener) {
+	var changes []RecordChangeEvent
+	var counts []CountChangeEvent
+	resync := false
+	var flush <-chan time.Time
+	ping := time.NewTicker(90 * time.Second)
+	defer ping.Stop()
+
+	for {
+		select {
+		case n, ok := <-listener.Notify:
+			if !ok {
+				return
+			}
+			switch {
+			case n == nil:
+				// 再接続するまでの間の通知は届かないため、食数を数え直す
+				resync = true
+			case n.Channel == countChangesChannel:
+				var ev CountChangeEvent
+				if err := json.Unmarshal([]byte(n.Extra), &ev); err != nil {
+					log.Printf("Failed to decode count change: %v", err)
+					continue
+				}
+				counts = append(counts, ev)
+			default:
+				var ev RecordChangeEvent
+				if err := json.Unmarshal([]byte(n.Extra), &ev); err != nil {
+					log.Printf("Failed to decode record change: %v", err)
+					continue
+				}
+				changes = append(changes, ev)
+			}
+			if flush == nil {
+				flush = time.After(liveDebounce)
+			}
+		case <-flush:
+			b.publish(changes, counts, resync)
+			changes, counts, resync, flush = nil, nil, false, nil
+		case <-ping.C:
+			// 接続が切れていれば気付けるよう、定期的に確認する
+			go listener.Ping()
+		}
+	}
+}
+
+// startRecordChangeListener は記録の変更の通知の受け取りを開始します
+// データベースとの接続が切れた場合は自動で再接続します
+func startRecordChangeListener(connStr string) *pq.Listener {
+	listener := pq.NewListener(connStr, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Record change listener: %v", err)
+		}
+	})
+	for _, channel := range []string{recordChangesChannel, countChangesChannel} {
+		if err := listener.Listen(channel); err != nil {
+			log.Printf("Failed to listen on %s: %v", channel, err)
+		}
+	}
+	go kitchenLive.run(listener)
+	return listener
+}
+
+// kitchenLiveHandler は今日・明日の食数が自動で更新される厨房のライブ表示を表示します
+func kitchenLiveHandler(c echo.Context) error {
+	counts, err := getLiveMealCounts(time.Now())
+	if err != nil {
+		log.Printf("Failed to get live meal counts: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to retrieve meal counts.")
+	}
+	return c.Render(http.StatusOK, "kitchen_live.html", map[string]interface{}{
+		"counts": counts,
+	})
+}
+
+// kitchenLiveEventsHandler は食数 (counts) と記録の変更 (change) を Server-Sent Events で送り続けます
+// 接続した直後に現在の食数を送ります
+// 接続中もハートビートごとにセッションとユーザーを確認し、ログアウト・セッションの無効化・ユーザーの無効化や権限の変更があれば接続を閉じます
+func kitchenLiveEventsHandler(c echo.Context) error {
+	ch := kitchenLive.subscribe()
+	defer kitchenLive.unsubscribe(ch)
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(m liveMessage) error {
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", m.event, m.data); err != nil {
+			return err
+		}
+		w.Flush()
+		return nil
+	}
+
+	counts, err := getLiveMealCounts(time.Now())
+	if err != nil {
+		log.Printf("Failed to get live meal counts: %v", err)
+	} else if m, err := newLiveMessage("counts", counts); err == nil {
+		if err := send(m); err != nil {
+			return nil
+		}
+	}
+
+	heartbeat := time.NewTicker(liveHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-kitchenLive.done:
+			return nil
+		case m := <-ch:
+			if err := send(m); err != nil {
+				return nil
+			}
+		case <-heartbeat.C:
+			if !liveSessionValid(c) {
+				// 画面を読み込み直してログインページへ移動させる
+				send(liveMessage{event: "logout", data: []byte("{}")})
+				return nil
+			}
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return nil
+			}
+			w.Flush()
+		}
+	}
+}
+
+// liveSessionValid は接続中のリクエストのセッションとユーザーを読み込み直し、ライブ表示を続けてよいかを返します
+// セッションが無効化・期限切れになった場合や、ユーザーが無効化されたり食数を閲覧できない役割に変わった場合は false を返します
+// 開いたままの画面でセッションが切れなくならないよう、セッションの最終アクセス時刻は更新しません
+func liveSessionValid(c echo.Context) bool {
+	sess, err := sessionStore.Peek(c.Request(), "session")
+	if err != nil {
+		log.Printf("Failed to reload session for live events: %v", err)
+		return false
+	}
+	auth, _ := sess.Values["authenticated"].(bool)
+	studentID, _ := sess.Values["studentID"].(string)
+	if sess.IsNew || !auth || studentID != currentUser(c).Username {
+		return false
+	}
+	user, err := getUserByUsername(db, studentID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Failed to load user %s for live events: %v", studentID, err)
+		}
+		return false
+	}
+	return user != nil && user.Active && user.Can(PermMealsRead)
+}
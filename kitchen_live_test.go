@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestLiveSessionValidFollowsRevocationAndRoleChanges(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, `INSERT INTO users (username, password, role, active) VALUES ('cook', 'x', 'kitchen', TRUE)`)
+	prev := sessionStore
+	sessionStore = NewServerSessionStore(newMemorySessionBackend(), []byte("test-secret"), time.Hour, 24*time.Hour)
+	t.Cleanup(func() { sessionStore = prev })
+
+	// ログインしたときのセッションを保存し、そのクッキーでライブ表示に接続する
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	sess, _ := sessionStore.New(req, "session")
+	sess.Values["authenticated"] = true
+	sess.Values["studentID"] = "cook"
+	if err := sessionStore.Save(req, rec, sess); err != nil {
+		t.Fatal(err)
+	}
+	live := func() bool {
+		req := httptest.NewRequest(http.MethodGet, "/kitchen/live/events", nil)
+		for _, c := range rec.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		c := echo.New().NewContext(req, httptest.NewRecorder())
+		c.Set(contextUserKey, &User{Username: "cook", Role: RoleKitchen, Active: true})
+		return liveSessionValid(c)
+	}
+
+	if !live() {
+		t.Fatal("live display closed for a valid session")
+	}
+	mustExec(t, db, `UPDATE users SET role = 'user' WHERE username = 'cook'`)
+	if live() {
+		t.Error("live display kept open after the role lost meals.read")
+	}
+	mustExec(t, db, `UPDATE users SET role = 'kitchen', active = FALSE WHERE username = 'cook'`)
+	if live() {
+		t.Error("live display kept open for a deactivated user")
+	}
+	mustExec(t, db, `UPDATE users SET active = TRUE WHERE username = 'cook'`)
+	if !live() {
+		t.Fatal("live display closed after restoring the user")
+	}
+	if err := sessionStore.RevokeUserSessions("cook", nil); err != nil {
+		t.Fatal(err)
+	}
+	if live() {
+		t.Error("live display kept open after the sessions were revoked")
+	}
+}
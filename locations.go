@@ -0,0 +1,431 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// createLocationTables は棟・フロア・部屋と部屋割りのテーブルを作成します
+func createLocationTables(db *sql.DB) error {
+	const createTableSQL = `
+	CREATE TABLE IF NOT EXISTS buildings (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(50) UNIQUE NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS floors (
+		id SERIAL PRIMARY KEY,
+		building_id INTEGER NOT NULL REFERENCES buildings(id) ON DELETE CASCADE,
+		name VARCHAR(50) NOT NULL,
+		sort_order INTEGER NOT NULL DEFAULT 0,
+		UNIQUE (building_id, name)
+	);
+	CREATE TABLE IF NOT EXISTS rooms (
+		id SERIAL PRIMARY KEY,
+		floor_id INTEGER NOT NULL REFERENCES floors(id) ON DELETE CASCADE,
+		number VARCHAR(20) NOT NULL,
+		capacity INTEGER NOT NULL DEFAULT 1,
+		UNIQUE (floor_id, number)
+	);
+	CREATE TABLE IF NOT EXISTS room_assignments (
+		id SERIAL PRIMARY KEY,
+		student_id VARCHAR(50) NOT NULL,
+		room_id INTEGER NOT NULL REFERENCES rooms(id) ON DELETE RESTRICT,
+		start_date DATE NOT NULL,
+		end_date DATE,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS room_assignments_current_idx ON room_assignments (student_id) WHERE end_date IS NULL;
+	CREATE INDEX IF NOT EXISTS room_assignments_room_idx ON room_assignments (room_id);`
+
+	_, err := db.Exec(createTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to execute SQL: %w", err)
+	}
+
+	// 同じ学生の部屋割りの期間が重なると、食数などで同じ日に二重に数えるため、排他制約で防ぐ
+	if _, err := db.Exec("CREATE EXTENSION IF NOT EXISTS btree_gist"); err != nil {
+		log.Printf("btree_gist is not available, room assignment overlaps are checked only by the application: %v", err)
+		return nil
+	}
+	_, err = db.Exec(`
+	DO $$ BEGIN
+		IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'room_assignments_no_overlap') THEN
+			ALTER TABLE room_assignments ADD CONSTRAINT room_assignments_no_overlap
+				EXCLUDE USING gist (student_id WITH =, daterange(start_date, end_date) WITH &&);
+		END IF;
+	END $$;`)
+	if err != nil {
+		// 既に期間の重なる履歴がある場合は追加できないため、履歴を直すまでアプリ側の確認のみで動かす
+		log.Printf("Failed to add room assignment overlap constraint, fix overlapping history in room_assignments: %v", err)
+	}
+	return nil
+}
+
+// errRoomAssignmentOverlap は部屋割りの開始日が、終了済みの部屋割りの期間に含まれるか、現在の部屋割りの開始日より前であることを表します
+var errRoomAssignmentOverlap = errors.New("room assignment overlaps an earlier assignment")
+
+// locationJoinSQL は users u に、指定日 (dateExpr) 時点の部屋・フロア・棟を結合するSQLです
+// 部屋割りは start_date <= 日付 < end_date の期間有効です
+func locationJoinSQL(dateExpr string) string {
+	return `
+	LEFT JOIN room_assignments ra ON ra.student_id = u.username AND ra.start_date <= ` + dateExpr + ` AND (ra.end_date IS NULL OR ra.end_date > ` + dateExpr + `)
+	LEFT JOIN rooms rm ON rm.id = ra.room_id
+	LEFT JOIN floors f ON f.id = rm.floor_id
+	LEFT JOIN buildings b ON b.id = f.building_id`
+}
+
+// residentOnDaySQL は users u が日付 dateExpr に在寮していたかを表すSQLの式です (locationJoinSQL と組み合わせて使います)
+// 食数・食費・利用状況の分析は、いずれもこの条件で在寮していた寮生を数えます
+// 部屋割りの履歴がある寮生はその日を含む部屋割りがあること、部屋を一度も割り当てていない寮生は有効であることを条件とします
+// 退寮などで無効にしたユーザーは、今日より前の日のみ在寮していたものとします
+func residentOnDaySQL(dateExpr string) string {
+	return "(" + residentRolesSQL + " AND (u.active OR " + dateExpr + " < CURRENT_DATE)" +
+		" AND (ra.id IS NOT NULL OR (u.active AND NOT EXISTS (SELECT 1 FROM room_assignments ra_any WHERE ra_any.student_id = u.username))))"
+}
+
+// locationColumnsSQL は locationJoinSQL で結合した場所の列です (locationScanDest で読み込みます)
+const locationColumnsSQL = `COALESCE(b.id, 0), COALESCE(b.name, ''), COALESCE(f.id, 0), COALESCE(f.name, ''), COALESCE(rm.id, 0), COALESCE(rm.number, '')`
+
+// locationOrderSQL は棟・フロア・部屋の順に並べるための ORDER BY 句の列です (部屋未割り当ては最後)
+const locationOrderSQL = `b.name ASC NULLS LAST, f.sort_order ASC, f.name ASC, rm.number ASC`
+
+// locationScanDest は locationColumnsSQL の列を読み込む Scan の引数を返します
+func locationScanDest(l *RoomLocation) []interface{} {
+	return []interface{}{&l.BuildingID, &l.BuildingName, &l.FloorID, &l.FloorName, &l.RoomID, &l.RoomNumber}
+}
+
+// LocationFilter は棟・フロアによる絞り込み条件です (0 は指定なし)
+type LocationFilter struct {
+	BuildingID int
+	FloorID    int
+}
+
+// where は絞り込み条件のSQLを返します。args に引数を追加し、プレースホルダの番号を揃えます
+func (lf LocationFilter) where(args *[]interface{}) string {
+	cond := ""
+	if lf.BuildingID > 0 {
+		*args = append(*args, lf.BuildingID)
+		cond += fmt.Sprintf(" AND b.id = $%d", len(*args))
+	}
+	if lf.FloorID > 0 {
+		*args = append(*args, lf.FloorID)
+		cond += fmt.Sprintf(" AND f.id = $%d", len(*args))
+	}
+	return cond
+}
+
+// parseLocationFilter はクエリパラメータ building, floor から絞り込み条件を読み込みます
+func parseLocationFilter(c echo.Context) LocationFilter {
+	buildingID, _ := strconv.Atoi(c.QueryParam("building"))
+	floorID, _ := strconv.Atoi(c.QueryParam("floor"))
+	return LocationFilter{BuildingID: buildingID, FloorID: floorID}
+}
+
+// LocationGroup は棟・フロアごとにまとめた一覧です
+type LocationGroup[T any] struct {
+	Label string
+	Items []T
+}
+
+// groupByFloor は棟・フロア順に並んだ一覧を、棟・フロアごとのグループに分けます
+func groupByFloor[T any](items []T, location func(T) RoomLocation) []LocationGroup[T] {
+	var groups []LocationGroup[T]
+	for _, item := range items {
+		label := location(item).FloorLabel()
+		if len(groups) == 0 || groups[len(groups)-1].Label != label {
+			groups = append(groups, LocationGroup[T]{Label: label})
+		}
+		groups[len(groups)-1].Items = append(groups[len(groups)-1].Items, item)
+	}
+	return groups
+}
+
+// getFloors は全ての棟・フロアを取得します (絞り込みの選択肢に使用)
+func getFloors(db *sql.DB) ([]Floor, error) {
+	rows, err := db.Query(`
+	SELECT f.id, f.name, f.sort_order, b.id, b.name
+	FROM floors f JOIN buildings b ON b.id = f.building_id
+	ORDER BY b.name ASC, f.sort_order ASC, f.name ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query floors: %w", err)
+	}
+	defer rows.Close()
+
+	var floors []Floor
+	for rows.Next() {
+		var f Floor
+		if err := rows.Scan(&f.ID, &f.Name, &f.SortOrder, &f.BuildingID, &f.BuildingName); err != nil {
+			log.Printf("Failed to scan floor: %v", err)
+			continue
+		}
+		floors = append(floors, f)
+	}
+	return floors, nil
+}
+
+// getBuildings は全ての棟を、フロア・部屋と現在の入居者を含めて取得します
+func getBuildings(db *sql.DB) ([]Building, error) {
+	rows, err := db.Query(`
+	SELECT b.id, b.name, COALESCE(f.id, 0), COALESCE(f.name, ''), COALESCE(f.sort_order, 0),
+		COALESCE(rm.id, 0), COALESCE(rm.number, ''), COALESCE(rm.capacity, 0),
+		COALESCE((SELECT string_agg(` + userNameSQL + `, ', ' ORDER BY u.username)
+			FROM room_assignments ra JOIN users u ON u.username = ra.student_id
+			WHERE ra.room_id = rm.id AND ra.end_date IS NULL), '')
+	FROM buildings b
+	LEFT JOIN floors f ON f.building_id = b.id
+	LEFT JOIN rooms rm ON rm.floor_id = f.id
+	ORDER BY b.name ASC, f.sort_order ASC, f.name ASC, rm.number ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query buildings: %w", err)
+	}
+	defer rows.Close()
+
+	var buildings []Building
+	for rows.Next() {
+		var (
+			b Building
+			f Floor
+			r Room
+		)
+		if err := rows.Scan(&b.ID, &b.Name, &f.ID, &f.Name, &f.SortOrder, &r.ID, &r.Number, &r.Capacity, &r.Occupants); err != nil {
+			log.Printf("Failed to scan building: %v", err)
+			continue
+		}
+		if len(buildings) == 0 || buildings[len(buildings)-1].ID != b.ID {
+			buildings = append(buildings, b)
+		}
+		cur := &buildings[len(buildings)-1]
+		if f.ID == 0 {
+			continue
+		}
+		if len(cur.Floors) == 0 || cur.Floors[len(cur.Floors)-1].ID != f.ID {
+			f.BuildingID, f.BuildingName = b.ID, b.Name
+			cur.Floors = append(cur.Floors, f)
+		}
+		if r.ID == 0 {
+			continue
+		}
+		floor := &cur.Floors[len(cur.Floors)-1]
+		floor.Rooms = append(floor.Rooms, r)
+	}
+	return buildings, nil
+}
+
+// getCurrentLocation は学生の指定日時点の部屋を取得します (未割り当ての場合はゼロ値)
+func getCurrentLocation(db *sql.DB, studentID string, date time.Time) (RoomLocation, error) {
+	var l RoomLocation
+	err := db.QueryRow(`
+	SELECT `+locationColumnsSQL+`
+	FROM users u `+locationJoinSQL("$2::date")+`
+	WHERE u.username = $1`, studentID, date.Format("2006-01-02")).Scan(locationScanDest(&l)...)
+	if err != nil && err != sql.ErrNoRows {
+		return l, fmt.Errorf("failed to query location: %w", err)
+	}
+	return l, nil
+}
+
+// getRoomAssignments は学生の部屋割りの履歴を新しい順に取得します
+func getRoomAssignments(db *sql.DB, studentID string) ([]RoomAssignment, error) {
+	rows, err := db.Query(`
+	SELECT ra.id, ra.start_date, ra.end_date, b.id, b.name, f.id, f.name, rm.id, rm.number
+	FROM room_assignments ra
+	JOIN rooms rm ON rm.id = ra.room_id
+	JOIN floors f ON f.id = rm.floor_id
+	JOIN buildings b ON b.id = f.building_id
+	WHERE ra.student_id = $1
+	ORDER BY ra.start_date DESC, ra.id DESC`, studentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query room assignments: %w", err)
+	}
+	defer rows.Close()
+
+	var assignments []RoomAssignment
+	for rows.Next() {
+		var a RoomAssignment
+		var endDate sql.NullTime
+		dest := append([]interface{}{&a.ID, &a.StartDate, &endDate}, locationScanDest(&a.Location)...)
+		if err := rows.Scan(dest...); err != nil {
+			log.Printf("Failed to scan room assignment: %v", err)
+			continue
+		}
+		if endDate.Valid {
+			a.EndDate = &endDate.Time
+		}
+		assignments = append(assignments, a)
+	}
+	return assignments, nil
+}
+
+// assignRoom は学生を部屋に割り当てます。現在の部屋割りは startDate で終了し、履歴として残ります
+// startDate が終了済みの部屋割りの期間に含まれる場合や、現在の部屋割りの開始日より前の場合は、期間が重ならないよう errRoomAssignmentOverlap を返します
+func assignRoom(db *sql.DB, studentID string, roomID int, startDate time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	date := startDate.Format("2006-01-02")
+	// 同時に割り当てを変更されないよう、学生の部屋割りをロックしてから確認する
+	var overlaps bool
+	err = tx.QueryRow(`SELECT COALESCE(bool_or(CASE WHEN end_date IS NULL THEN start_date > $2 ELSE end_date > $2 END), FALSE) FROM (
+		SELECT start_date, end_date FROM room_assignments WHERE student_id = $1 FOR UPDATE
+	) assignments`, studentID, date).Scan(&overlaps)
+	if err != nil {
+		return fmt.Errorf("failed to check room assignment history: %w", err)
+	}
+	if overlaps {
+		return errRoomAssignmentOverlap
+	}
+	// 同じ日に割り当てをやり直した場合は、その日に始まった割り当てを取り消す
+	if _, err := tx.Exec(`DELETE FROM room_assignments WHERE student_id = $1 AND end_date IS NULL AND start_date = $2`, studentID, date); err != nil {
+		return fmt.Errorf("failed to replace room assignment: %w", err)
+	}
+	if _, err := tx.Exec(`UPDATE room_assignments SET end_date = $2 WHERE student_id = $1 AND end_date IS NULL`, studentID, date); err != nil {
+		return fmt.Errorf("failed to end room assignment: %w", err)
+	}
+	if _, err := tx.Exec(`INSERT INTO room_assignments (student_id, room_id, start_date) VALUES ($1, $2, $3)`, studentID, roomID, date); err != nil {
+		return fmt.Errorf("failed to insert room assignment: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// endRoomAssignment は学生の現在の部屋割りを endDate で終了します (退寮など)
+func endRoomAssignment(db *sql.DB, studentID string, endDate time.Time) error {
+	_, err := db.Exec(`UPDATE room_assignments SET end_date = GREATEST(start_date, $2::date) WHERE student_id = $1 AND end_date IS NULL`,
+		studentID, endDate.Format("2006-01-02"))
+	if err != nil {
+		return fmt.Errorf("failed to end room assignment: %w", err)
+	}
+	return nil
+}
+
+// adminRoomsHandler は棟・フロア・部屋の一覧と追加フォームを表示します
+func adminRoomsHandler(c echo.Context) error {
+	buildings, err := getBuildings(db)
+	if err != nil {
+		log.Printf("Failed to get buildings: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to retrieve rooms.")
+	}
+
+	return c.Render(http.StatusOK, "admin_rooms.html", map[string]interface{}{
+		"buildings":      buildings,
+		"successMessage": popFlash(c, "rooms_success"),
+		"errorMessage":   popFlash(c, "rooms_error"),
+	})
+}
+
+// adminAddLocationHandler は棟・フロア・部屋を追加します
+// kind は "building", "floor", "room" のいずれかです
+func adminAddLocationHandler(c echo.Context) error {
+	kind := c.FormValue("kind")
+	name := strings.TrimSpace(c.FormValue("name"))
+	parentID, _ := strconv.Atoi(c.FormValue("parent_id"))
+
+	// 入力を確認してから追加する
+	maxLength := 50
+	switch kind {
+	case "building":
+	case "floor", "room":
+		if parentID <= 0 {
+			return c.String(http.StatusBadRequest, "Parent location is required.")
+		}
+		if kind == "room" {
+			maxLength = 20
+		}
+	default:
+		return c.String(http.StatusBadRequest, "Invalid location kind.")
+	}
+	if name == "" {
+		return redirectWithFlash(c, "/admin/rooms", "名前を入力してください。", false, "rooms_success", "rooms_error")
+	}
+	if utf8.RuneCountInString(name) > maxLength {
+		return redirectWithFlash(c, "/admin/rooms", fmt.Sprintf("名前は%d文字以内で入力してください。", maxLength), false, "rooms_success", "rooms_error")
+	}
+	capacity := 1
+	if kind == "room" && c.FormValue("capacity") != "" {
+		n, err := strconv.Atoi(c.FormValue("capacity"))
+		if err != nil || n <= 0 {
+			return redirectWithFlash(c, "/admin/rooms", "定員は1以上の数値で入力してください。", false, "rooms_success", "rooms_error")
+		}
+		capacity = n
+	}
+
+	var err error
+	switch kind {
+	case "building":
+		_, err = db.Exec("INSERT INTO buildings (name) VALUES ($1)", name)
+	case "floor":
+		sortOrder, _ := strconv.Atoi(c.FormValue("sort_order"))
+		_, err = db.Exec("INSERT INTO floors (building_id, name, sort_order) VALUES ($1, $2, $3)", parentID, name, sortOrder)
+	case "room":
+		_, err = db.Exec("INSERT INTO rooms (floor_id, number, capacity) VALUES ($1, $2, $3)", parentID, name, capacity)
+	}
+	if err != nil {
+		log.Printf("Failed to add location %q: %v", name, err)
+		return redirectWithFlash(c, "/admin/rooms", "追加に失敗しました。同じ名前が既に存在する可能性があります。", false, "rooms_success", "rooms_error")
+	}
+	return redirectWithFlash(c, "/admin/rooms", fmt.Sprintf("'%s' を追加しました。", name), true, "rooms_success", "rooms_error")
+}
+
+// adminDeleteLocationHandler は棟・フロア・部屋を削除します
+// 部屋割りの履歴がある部屋 (を含む棟・フロア) は削除できません
+func adminDeleteLocationHandler(c echo.Context) error {
+	id, _ := strconv.Atoi(c.FormValue("id"))
+
+	var table string
+	switch c.FormValue("kind") {
+	case "building":
+		table = "buildings"
+	case "floor":
+		table = "floors"
+	case "room":
+		table = "rooms"
+	default:
+		return c.String(http.StatusBadRequest, "Invalid location kind.")
+	}
+
+	if _, err := db.Exec("DELETE FROM "+table+" WHERE id = $1", id); err != nil {
+		log.Printf("Failed to delete from %s (id %d): %v", table, id, err)
+		return redirectWithFlash(c, "/admin/rooms", "削除できませんでした。部屋割りの履歴がある部屋は削除できません。", false, "rooms_success", "rooms_error")
+	}
+	return redirectWithFlash(c, "/admin/rooms", "削除しました。", true, "rooms_success", "rooms_error")
+}
+
+// adminAssignRoomHandler は学生を部屋に割り当てます (転室の場合は以前の部屋割りを履歴に残します)
+func adminAssignRoomHandler(c echo.Context) error {
+	studentID := c.Param("student_id")
+	roomID, _ := strconv.Atoi(c.FormValue("room_id"))
+	startDate, err := time.ParseInLocation("2006-01-02", c.FormValue("start_date"), time.Local)
+	if studentID == "" || err != nil {
+		return c.String(http.StatusBadRequest, "Invalid room assignment.")
+	}
+
+	if c.FormValue("action") == "end" {
+		err = endRoomAssignment(db, studentID, startDate)
+	} else if roomID > 0 {
+		err = assignRoom(db, studentID, roomID, startDate)
+	} else {
+		return c.String(http.StatusBadRequest, "Room is required.")
+	}
+	if errors.Is(err, errRoomAssignmentOverlap) {
+		return redirectWithFlash(c, "/admin/user/"+studentID, "開始日が現在または以前の部屋割りの期間と重なっています。現在の部屋割りの開始日・以前の部屋割りの終了日以降の日付を指定してください。", false, "update_success", "update_error")
+	}
+	if err != nil {
+		log.Printf("Failed to update room assignment for %s: %v", studentID, err)
+		return c.String(http.StatusInternalServerError, "Failed to update room assignment.")
+	}
+	log.Printf("Room assignment of %s updated by %s", studentID, currentUser(c).Username)
+
+	return redirectWithFlash(c, "/admin/user/"+studentID, "部屋割りを更新しました。", true, "update_success", "update_error")
+}
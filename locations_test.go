@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// roomHistory は学生の部屋割りを "部屋ID:開始日-終了日" の形式で古い順に返します
+func roomHistory(t *testing.T, studentID string) []string {
+	t.Helper()
+	rows, err := db.Query(`SELECT room_id, start_date, end_date FROM room_assignments WHERE student_id = $1 ORDER BY start_date`, studentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var history []string
+	for rows.Next() {
+		var roomID int
+		var start time.Time
+		var end *time.Time
+		if err := rows.Scan(&roomID, &start, &end); err != nil {
+			t.Fatal(err)
+		}
+		s := fmt.Sprintf("%d:%s-", roomID, start.Format("01/02"))
+		if end != nil {
+			s += end.Format("01/02")
+		}
+		history = append(history, s)
+	}
+	return history
+}
+
+func createTestRooms(t *testing.T) {
+	t.Helper()
+	// ID を指定せずに入れ、後から追加する場所と連番が衝突しないようにする (新しいスキーマでは 1 から振られる)
+	mustExec(t, db, `INSERT INTO buildings (name) VALUES ('北')`)
+	mustExec(t, db, `INSERT INTO floors (building_id, name) VALUES (1, '1F')`)
+	mustExec(t, db, `INSERT INTO rooms (floor_id, number, capacity) VALUES (1, '101', 2), (1, '102', 2)`)
+}
+
+func TestAssignRoom(t *testing.T) {
+	openTestDB(t)
+	createTestRooms(t)
+	day := func(d int) time.Time { return time.Date(2024, 4, d, 0, 0, 0, 0, time.Local) }
+	assertHistory := func(step string, want ...string) {
+		t.Helper()
+		got := roomHistory(t, "s1")
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: history = %v, want %v", step, got, want)
+		}
+	}
+
+	if err := assignRoom(db, "s1", 1, day(1)); err != nil {
+		t.Fatal(err)
+	}
+	// 同じ日にやり直すと、その日の割り当てを置き換える
+	if err := assignRoom(db, "s1", 2, day(1)); err != nil {
+		t.Fatal(err)
+	}
+	assertHistory("same-day reassignment", "2:04/01-")
+
+	// 転室すると以前の部屋割りは履歴に残る
+	if err := assignRoom(db, "s1", 1, day(10)); err != nil {
+		t.Fatal(err)
+	}
+	assertHistory("move", "2:04/01-04/10", "1:04/10-")
+
+	// 現在の部屋割りの開始日より前からの転室は、現在の部屋割りを消さずに拒否する
+	if err := assignRoom(db, "s1", 2, day(5)); !errors.Is(err, errRoomAssignmentOverlap) {
+		t.Errorf("backdated move: err = %v, want errRoomAssignmentOverlap", err)
+	}
+	assertHistory("after backdated move", "2:04/01-04/10", "1:04/10-")
+
+	// 終了済みの部屋割りの期間と重なる割り当ても拒否する
+	mustExec(t, db, `UPDATE room_assignments SET end_date = '2024-04-20' WHERE student_id = 's1' AND end_date IS NULL`)
+	if err := assignRoom(db, "s1", 2, day(15)); !errors.Is(err, errRoomAssignmentOverlap) {
+		t.Errorf("move into closed history: err = %v, want errRoomAssignmentOverlap", err)
+	}
+	if err := assignRoom(db, "s1", 2, day(20)); err != nil {
+		t.Errorf("move on the day the last assignment ended: %v", err)
+	}
+	assertHistory("after moving back in", "2:04/01-04/10", "1:04/10-04/20", "2:04/20-")
+}
+
+func TestResidentOnDayBoundaries(t *testing.T) {
+	openTestDB(t)
+	createTestRooms(t)
+	mustExec(t, db, `INSERT INTO users (username, password, role, active) VALUES
+		('room', 'x', 'user', TRUE), ('noroom', 'x', 'user', TRUE), ('gone', 'x', 'user', FALSE), ('cook', 'x', 'kitchen', TRUE)`)
+	mustExec(t, db, `INSERT INTO room_assignments (student_id, room_id, start_date, end_date) VALUES
+		('room', 1, CURRENT_DATE - 5, CURRENT_DATE + 5),
+		('gone', 2, CURRENT_DATE - 5, NULL)`)
+	resident := func(studentID string, offset int) bool {
+		t.Helper()
+		var ok bool
+		err := db.QueryRow(`SELECT `+residentOnDaySQL("(CURRENT_DATE + $2::int)")+`
+		FROM users u`+locationJoinSQL("(CURRENT_DATE + $2::int)")+`
+		WHERE u.username = $1`, studentID, offset).Scan(&ok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	tests := []struct {
+		studentID string
+		offset    int
+		want      bool
+	}{
+		{"room", -6, false}, // 部屋割りの開始日の前日
+		{"room", -5, true},  // 開始日を含む
+		{"room", 4, true},
+		{"room", 5, false},    // 終了日は含まない
+		{"noroom", -30, true}, // 部屋を割り当てたことがなければ、有効な間は在寮
+		{"noroom", 30, true},
+		{"gone", -1, true}, // 無効にした寮生は今日より前のみ
+		{"gone", 0, false},
+		{"cook", 0, false},
+	}
+	for _, tt := range tests {
+		if got := resident(tt.studentID, tt.offset); got != tt.want {
+			t.Errorf("%s on day %+d: resident = %v, want %v", tt.studentID, tt.offset, got, tt.want)
+		}
+	}
+}
+
+func TestAdminAddLocationValidatesBeforeInserting(t *testing.T) {
+	openTestDB(t)
+	createTestRooms(t)
+	admin := &User{Username: "admin", Role: RoleAdmin, Active: true}
+	count := func() int {
+		var n int
+		db.QueryRow(`SELECT (SELECT COUNT(*) FROM buildings) + (SELECT COUNT(*) FROM floors) + (SELECT COUNT(*) FROM rooms)`).Scan(&n)
+		return n
+	}
+	before := count()
+
+	for _, form := range []url.Values{
+		{"kind": {"building"}, "name": {"  "}},
+		{"kind": {"floor"}, "parent_id": {"1"}, "name": {""}},
+		{"kind": {"room"}, "parent_id": {"1"}, "name": {"103"}, "capacity": {"0"}},
+		{"kind": {"room"}, "parent_id": {"1"}, "name": {"103"}, "capacity": {"two"}},
+		{"kind": {"room"}, "name": {"103"}},
+		{"kind": {"room"}, "parent_id": {"1"}, "name": {"101"}}, // 既にある部屋番号
+	} {
+		serveAs(t, adminAddLocationHandler, admin, http.MethodPost, "/admin/rooms/add", form)
+		if n := count(); n != before {
+			t.Errorf("invalid location %v was inserted", form)
+			before = n
+		}
+	}
+
+	rec := serveAs(t, adminAddLocationHandler, admin, http.MethodPost, "/admin/rooms/add",
+		url.Values{"kind": {"room"}, "parent_id": {"1"}, "name": {" 103 "}, "capacity": {"3"}})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("add room: status %d", rec.Code)
+	}
+	var capacity int
+	if err := db.QueryRow(`SELECT capacity FROM rooms WHERE number = '103'`).Scan(&capacity); err != nil || capacity != 3 {
+		t.Errorf("added room capacity = %d (%v), want 3", capacity, err)
+	}
+}
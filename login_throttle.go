@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ログイン試行の制限に関する設定値
+const (
+	loginScopeAccount = "account"
+	loginScopeIP      = "ip"
+
+	loginAccountMaxFailures = 5                // 学籍番号ごとのロックまでの失敗回数
+	loginIPMaxFailures      = 20               // IPアドレスごとのロックまでの失敗回数
+	loginFailureWindow      = 15 * time.Minute // この期間失敗がなければ失敗回数をリセット
+	loginLockoutDuration    = 15 * time.Minute // 一時ロックの期間
+	loginMaxDelay           = 8 * time.Second  // 失敗時の応答遅延の上限
+)
+
+// createLoginThrottlesTable はログイン失敗の記録テーブルを作成します
+func createLoginThrottlesTable(db *sql.DB) error {
+	const createTableSQL = `
+	CREATE TABLE IF NOT EXISTS login_throttles (
+		scope VARCHAR(10) NOT NULL,
+		subject VARCHAR(100) NOT NULL,
+		failures INTEGER NOT NULL DEFAULT 0,
+		last_failure_at TIMESTAMP WITH TIME ZONE,
+		locked_until TIMESTAMP WITH TIME ZONE,
+		PRIMARY KEY (scope, subject)
+	);`
+
+	_, err := db.Exec(createTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to execute SQL: %w", err)
+	}
+
+	return nil
+}
+
+// isLoginLocked は学籍番号またはIPアドレスが一時ロック中かを確認します
+func isLoginLocked(db *sql.DB, scope, subject string) (bool, error) {
+	var locked bool
+	err := db.QueryRow(`
+	SELECT EXISTS(SELECT 1 FROM login_throttles WHERE scope = $1 AND subject = $2 AND locked_until > NOW())`,
+		scope, subject).Scan(&locked)
+	if err != nil {
+		return false, fmt.Errorf("failed to check login lock: %w", err)
+	}
+	return locked, nil
+}
+
+// recordLoginFailure はログイン失敗を記録し、現在の失敗回数を返します
+// 失敗回数が maxFailures に達した場合は一時ロックし、locked に true を返します
+func recordLoginFailure(db *sql.DB, scope, subject string, maxFailures int) (failures int, locked bool, err error) {
+	err = db.QueryRow(`
+	INSERT INTO login_throttles (scope, subject, failures, last_failure_at) VALUES ($1, $2, 1, NOW())
+	ON CONFLICT (scope, subject) DO UPDATE SET
+		failures = CASE
+			WHEN login_throttles.last_failure_at < NOW() - make_interval(secs => $3) THEN 1
+			ELSE login_throttles.failures + 1
+		END,
+		last_failure_at = NOW()
+	RETURNING failures`, scope, subject, loginFailureWindow.Seconds()).Scan(&failures)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to record login failure: %w", err)
+	}
+
+	if failures < maxFailures {
+		return failures, false, nil
+	}
+
+	// ロック後は失敗回数を数え直す
+	_, err = db.Exec(`
+	UPDATE login_throttles SET locked_until = NOW() + make_interval(secs => $3), failures = 0
+	WHERE scope = $1 AND subject = $2`, scope, subject, loginLockoutDuration.Seconds())
+	if err != nil {
+		return failures, false, fmt.Errorf("failed to lock login: %w", err)
+	}
+	log.Printf("Login locked out: %s %q after %d failures (for %s)", scope, subject, failures, loginLockoutDuration)
+
+	return failures, true, nil
+}
+
+// clearLoginFailures は失敗記録とロックを解除します
+func clearLoginFailures(db *sql.DB, scope, subject string) error {
+	_, err := db.Exec("DELETE FROM login_throttles WHERE scope = $1 AND subject = $2", scope, subject)
+	if err != nil {
+		return fmt.Errorf("failed to clear login failures: %w", err)
+	}
+	return nil
+}
+
+// getLockedLogins は現在ロック中の学籍番号・IPアドレスを取得します
+func getLockedLogins(db *sql.DB) ([]LoginLock, error) {
+	rows, err := db.Query(`
+	SELECT scope, subject, last_failure_at, locked_until
+	FROM login_throttles
+	WHERE locked_until > NOW()
+	ORDER BY locked_until DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query login locks: %w", err)
+	}
+	defer rows.Close()
+
+	var locks []LoginLock
+	for rows.Next() {
+		var l LoginLock
+		if err := rows.Scan(&l.Scope, &l.Subject, &l.LastFailureAt, &l.LockedUntil); err != nil {
+			log.Printf("Failed to scan login lock: %v", err)
+			continue
+		}
+		locks = append(locks, l)
+	}
+
+	return locks, nil
+}
+
+// loginFailureDelay は失敗回数に応じた応答遅延を返します (1秒, 2秒, 4秒, ... 上限 loginMaxDelay)
+func loginFailureDelay(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	delay := time.Second
+	for i := 1; i < failures && delay < loginMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > loginMaxDelay {
+		delay = loginMaxDelay
+	}
+	return delay
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginFailureDelayDoublesUpToLimit(t *testing.T) {
+	if d := loginFailureDelay(0); d != 0 {
+		t.Errorf("loginFailureDelay(0) = %v, want no delay", d)
+	}
+	prev := time.Duration(0)
+	for failures := 1; failures <= 10; failures++ {
+		d := loginFailureDelay(failures)
+		if d > loginMaxDelay {
+			t.Fatalf("loginFailureDelay(%d) = %v, exceeds limit %v", failures, d, loginMaxDelay)
+		}
+		if d < prev {
+			t.Fatalf("loginFailureDelay(%d) = %v, shorter than previous %v", failures, d, prev)
+		}
+		if prev > 0 && prev < loginMaxDelay && d != min(2*prev, loginMaxDelay) {
+			t.Errorf("loginFailureDelay(%d) = %v, want double of %v", failures, d, prev)
+		}
+		prev = d
+	}
+	if prev != loginMaxDelay {
+		t.Errorf("delay after many failures = %v, want %v", prev, loginMaxDelay)
+	}
+}
+
+func TestRecordLoginFailureLocksAtLimit(t *testing.T) {
+	db := openTestDB(t)
+
+	for i := 1; i < loginAccountMaxFailures; i++ {
+		failures, locked, err := recordLoginFailure(db, loginScopeAccount, "s1", loginAccountMaxFailures)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failures != i || locked {
+			t.Fatalf("failure %d: got failures=%d locked=%v, want %d and not locked", i, failures, locked, i)
+		}
+	}
+	if locked, _ := isLoginLocked(db, loginScopeAccount, "s1"); locked {
+		t.Fatal("account locked before reaching the limit")
+	}
+
+	_, locked, err := recordLoginFailure(db, loginScopeAccount, "s1", loginAccountMaxFailures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Fatalf("failure %d did not lock the account", loginAccountMaxFailures)
+	}
+	if locked, _ := isLoginLocked(db, loginScopeAccount, "s1"); !locked {
+		t.Error("isLoginLocked = false after lockout")
+	}
+	// ロックは学籍番号・スコープごと
+	if locked, _ := isLoginLocked(db, loginScopeAccount, "s2"); locked {
+		t.Error("another account is locked")
+	}
+	if locked, _ := isLoginLocked(db, loginScopeIP, "s1"); locked {
+		t.Error("IP scope with the same subject is locked")
+	}
+
+	// ロック後は失敗回数を数え直す
+	failures, locked, err := recordLoginFailure(db, loginScopeAccount, "s1", loginAccountMaxFailures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures != 1 || locked {
+		t.Errorf("failure after lockout: got failures=%d locked=%v, want 1 and not locked again", failures, locked)
+	}
+
+	if err := clearLoginFailures(db, loginScopeAccount, "s1"); err != nil {
+		t.Fatal(err)
+	}
+	if locked, _ := isLoginLocked(db, loginScopeAccount, "s1"); locked {
+		t.Error("account still locked after clearLoginFailures")
+	}
+}
+
+func TestRecordLoginFailureExpiredLock(t *testing.T) {
+	db := openTestDB(t)
+
+	for i := 0; i < loginIPMaxFailures; i++ {
+		if _, _, err := recordLoginFailure(db, loginScopeIP, "192.0.2.1", loginIPMaxFailures); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if locked, _ := isLoginLocked(db, loginScopeIP, "192.0.2.1"); !locked {
+		t.Fatal("IP address not locked at the limit")
+	}
+
+	mustExec(t, db, `UPDATE login_throttles SET locked_until = NOW() - INTERVAL '1 second'`)
+	if locked, _ := isLoginLocked(db, loginScopeIP, "192.0.2.1"); locked {
+		t.Error("IP address still locked after the lockout expired")
+	}
+	if locks, _ := getLockedLogins(db); len(locks) != 0 {
+		t.Errorf("getLockedLogins = %+v, want none", locks)
+	}
+}
+
+func TestRecordLoginFailureWindow(t *testing.T) {
+	db := openTestDB(t)
+
+	for i := 0; i < loginAccountMaxFailures-1; i++ {
+		if _, _, err := recordLoginFailure(db, loginScopeAccount, "s1", loginAccountMaxFailures); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 直前の失敗が期間内なら数え続ける
+	mustExec(t, db, `UPDATE login_throttles SET last_failure_at = NOW() - make_interval(secs => $1)`,
+		(loginFailureWindow - time.Minute).Seconds())
+	failures, locked, err := recordLoginFailure(db, loginScopeAccount, "s1", loginAccountMaxFailures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures != loginAccountMaxFailures || !locked {
+		t.Fatalf("failure inside the window: got failures=%d locked=%v, want %d and locked", failures, locked, loginAccountMaxFailures)
+	}
+
+	// 期間を過ぎてからの失敗は1回目として数える
+	if err := clearLoginFailures(db, loginScopeAccount, "s1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < loginAccountMaxFailures-1; i++ {
+		if _, _, err := recordLoginFailure(db, loginScopeAccount, "s1", loginAccountMaxFailures); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustExec(t, db, `UPDATE login_throttles SET last_failure_at = NOW() - make_interval(secs => $1)`,
+		(loginFailureWindow + time.Minute).Seconds())
+	failures, locked, err = recordLoginFailure(db, loginScopeAccount, "s1", loginAccountMaxFailures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures != 1 || locked {
+		t.Errorf("failure after the window: got failures=%d locked=%v, want 1 and not locked", failures, locked)
+	}
+}
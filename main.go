@@ -1,14 +1,20 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"html/template"
 	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 
-	"github.com/gorilla/sessions"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
 )
 
 // TemplateRenderer はHTMLテンプレートをレンダリングする構造体です
@@ -17,62 +23,296 @@ type TemplateRenderer struct {
 }
 
 // Render はTemplateRendererのメソッドで、テンプレートをレンダリングします
+// フォームで使うCSRFトークンは "csrf"、ログイン中のユーザーは "currentUser" として全テンプレートに渡されます
 func (t *TemplateRenderer) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
+	if m, ok := data.(map[string]interface{}); ok {
+		m["csrf"] = c.Get(middleware.DefaultCSRFConfig.ContextKey)
+		m["currentUser"] = currentUser(c)
+	}
 	return t.templates.ExecuteTemplate(w, name, data)
 }
 
+// templateFuncs はテンプレートで使用できる関数です
+var templateFuncs = template.FuncMap{
+	// weekday は日付の曜日を日本語で返します
+	"weekday": japaneseWeekday,
+	// roleLabel は役割の表示名を返します
+	"roleLabel": func(role string) string {
+		for _, r := range Roles {
+			if r.Name == role {
+				return r.Label
+			}
+		}
+		return role
+	},
+	// safetyStatusLabel は安否確認の回答の表示名を返します
+	"safetyStatusLabel": safetyStatusLabel,
+	// dietLabel は食事制限の種類の表示名を返します
+	"dietLabel": dietLabel,
+	// mealLabel は食事の表示名を返します
+	"mealLabel": mealLabel,
+	// guestPayerLabel は来客の食事の支払い方法の表示名を返します
+	"guestPayerLabel": guestPayerLabel,
+	// historyActionLabel は外泊・欠食記録の変更の種類の表示名を返します
+	"historyActionLabel": historyActionLabel,
+	// presenceLabel は出入りの向きの表示名を返します
+	"presenceLabel": presenceLabel,
+	// staffStatusLabel は寮監督者の承認状況の表示名を返します
+	"staffStatusLabel": staffStatusLabel,
+	// guardianStatusLabel は保護者の承認状況の表示名を返します
+	"guardianStatusLabel": func(status string) string {
+		switch status {
+		case ApprovalPending:
+			return "保護者承認待ち"
+		case ApprovalApproved:
+			return "保護者承認済み"
+		case ApprovalRejected:
+			return "保護者却下"
+		}
+		return ""
+	},
+}
+
+// japaneseWeekday は日付の曜日を日本語で返します
+func japaneseWeekday(t time.Time) string {
+	return [...]string{"日", "月", "火", "水", "木", "金", "土"}[t.Weekday()]
+}
+
 func main() {
+	if err := run(); err != nil {
+		// log.Fatal では run の defer (データベースなどの接続を閉じる処理) が実行されないため、run が戻ってから終了する
+		log.Printf("Server error: %v", err)
+		os.Exit(1)
+	}
+}
+
+// run はデータベースに接続してサーバーを起動し、SIGINT・SIGTERM を受け取って停止するまで待ちます
+func run() error {
 	// データベースに接続
 	var err error
 	db, err = connectDB()
 	if err != nil {
-		log.Fatal("Failed to connect to the database:", err)
+		return fmt.Errorf("failed to connect to the database: %w", err)
 	}
 	defer db.Close()
 
-	// データベーススキーマを初期化
-	if err = initDBSchema(db); err != nil {
-		log.Fatal("Failed to initialize database schema:", err)
-	}
-
-	// 管理者ユーザーが存在しない場合は作成
-	if err = createAdminUserIfNotExists(db); err != nil {
-		log.Fatal("Failed to create admin user:", err)
-	}
-
 	// Echoインスタンスの作成
 	e := echo.New()
+	// スキーマの初期化前に待ち受けを始めるため、初期化が終わるまでは死活監視以外に 503 を返す
+	// (セッションの読み込みより前に判定するよう、ルーティング前に実行する)
+	e.Pre(schemaReadyMiddleware)
+	// リクエスト元のIPアドレス (ログインの試行回数の制限に使う) は、信頼するプロキシ経由の場合のみヘッダーから読み込む
+	ipExtractor = ipExtractorFromEnv()
+	e.IPExtractor = ipExtractor
 
 	// テンプレートエンジンの設定
-	renderer := &TemplateRenderer{
-		templates: template.Must(template.ParseGlob("templates/*.html")),
+	templates, err := template.New("").Funcs(templateFuncs).ParseGlob("templates/*.html")
+	if err != nil {
+		return fmt.Errorf("failed to parse templates: %w", err)
 	}
-	e.Renderer = renderer
+	e.Renderer = &TemplateRenderer{templates: templates}
 
 	// セッション管理ミドルウェアの設定
 	secretKey := os.Getenv("SESSION_SECRET_KEY")
 	if secretKey == "" {
-		log.Fatal("SESSION_SECRET_KEY environment variable not set")
+		return errors.New("SESSION_SECRET_KEY environment variable not set")
+	}
+	// セッションはサーバー側に保存し、クッキーには署名付きのトークンのみを持たせる
+	// SESSION_STORE=memory の場合はメモリ上に保存する (テスト・開発用)
+	var backend sessionBackend = &pgSessionBackend{db: db}
+	if os.Getenv("SESSION_STORE") == "memory" {
+		backend = newMemorySessionBackend()
 	}
-	e.Use(session.Middleware(sessions.NewCookieStore([]byte(secretKey))))
+	sessionStore = NewServerSessionStore(backend, []byte(secretKey),
+		durationFromEnv("SESSION_IDLE_TIMEOUT", defaultSessionIdleTimeout),
+		durationFromEnv("SESSION_ABSOLUTE_TIMEOUT", defaultSessionAbsoluteTimeout))
+	go sessionStore.RunCleanup(10 * time.Minute)
+	e.Use(session.Middleware(sessionStore))
+
+	// 保護者への承認依頼
+	approvalKey = []byte(secretKey)
+	notifier = newNotifierFromEnv()
+
+	// 状態を変更する全てのPOSTでCSRFトークンを検証
+	e.Use(csrfMiddleware())
 
 	// ルーティングの設定
+	// 死活監視 (ログイン不要)
+	e.GET("/healthz", healthzHandler)
+	e.GET("/readyz", readyzHandler)
 	e.Static("/static", "static")
 	e.GET("/", loginFormHandler)
 	e.POST("/login", loginHandler)
-	e.GET("/main", mainPageHandler)
-	e.POST("/gaihaku", gaihakuHandler)
-	e.GET("/logout", logoutHandler)
+	e.POST("/logout", logoutHandler)
+
+	// 保護者向けの外泊承認 (ログイン不要、署名付きの一回限りのリンクで認証)
+	e.GET("/guardian/approval", guardianApprovalPageHandler)
+	e.POST("/guardian/approval", guardianApprovalHandler)
+	e.GET("/safety/respond", safetyRespondPageHandler)
+	e.POST("/safety/respond", safetyRespondHandler)
+
+	// ログインが必要なルート (ユーザーはリクエストごとにデータベースから読み込む)
+	e.GET("/main", mainPageHandler, AuthMiddleware)
+	e.POST("/gaihaku", gaihakuHandler, AuthMiddleware)
+	e.GET("/settings", settingsPageHandler, AuthMiddleware)
+	e.POST("/settings/password", changePasswordHandler, AuthMiddleware)
+	e.POST("/settings/profile", updateOwnProfileHandler, AuthMiddleware)
+	e.POST("/settings/contacts/add", addOwnContactHandler, AuthMiddleware)
+	e.POST("/settings/contacts/delete", deleteOwnContactHandler, AuthMiddleware)
+	e.POST("/settings/diet", updateOwnDietHandler, AuthMiddleware)
+	e.GET("/settings/qr.png", ownQRCodeHandler, AuthMiddleware)
+	e.POST("/settings/qr/rotate", rotateOwnQRCodeHandler, AuthMiddleware)
+	e.POST("/settings/sessions/revoke", revokeSessionHandler, AuthMiddleware)
+	e.POST("/settings/sessions/revoke_all", revokeAllSessionsHandler, AuthMiddleware)
+	e.GET("/billing", billingHandler, AuthMiddleware)
+	e.GET("/guests", guestsPageHandler, AuthMiddleware)
+	e.POST("/guests/add", addOwnGuestMealHandler, AuthMiddleware)
+	e.POST("/guests/cancel", cancelOwnGuestMealHandler, AuthMiddleware)
+
+	// スタッフ用ルート
+	e.GET("/kitchen", kitchenHandler, AuthMiddleware, RequirePermission(PermMealsRead))
+	e.GET("/kitchen/live", kitchenLiveHandler, AuthMiddleware, RequirePermission(PermMealsRead))
+	e.GET("/kitchen/live/events", kitchenLiveEventsHandler, AuthMiddleware, RequirePermission(PermMealsRead))
+	e.GET("/kitchen/menu", kitchenMenuHandler, AuthMiddleware, RequirePermission(PermMenuManage))
+	e.POST("/kitchen/menu", kitchenSaveMenuHandler, AuthMiddleware, RequirePermission(PermMenuManage))
+	e.POST("/kitchen/menu/import", kitchenImportMenuHandler, AuthMiddleware, RequirePermission(PermMenuManage))
+	e.GET("/rollcall", rollCallHandler, AuthMiddleware, RequirePermission(PermRollCallRun))
+	e.POST("/rollcall", rollCallUpdateHandler, AuthMiddleware, RequirePermission(PermRollCallRun))
+	e.GET("/safety", ownSafetyPageHandler, AuthMiddleware)
+	e.POST("/safety", ownSafetyRespondHandler, AuthMiddleware)
+	e.GET("/checkin", checkinPageHandler, AuthMiddleware, RequirePermission(PermPresenceLog))
+	e.POST("/checkin", checkinHandler, AuthMiddleware, RequirePermission(PermPresenceLog))
+	e.GET("/overnight", overnightStatusHandler, AuthMiddleware, RequirePermission(PermRecordsReadAll, PermRecordsReadFloor))
 
-	// 管理者用ルート
+	// 管理者用ルート (ルートごとに必要な権限を確認)
 	adminGroup := e.Group("/admin")
-	adminGroup.Use(AdminMiddleware)
-	adminGroup.GET("", adminDashboardHandler)
-	adminGroup.GET("/user/:student_id", adminViewUserRecordsHandler)
-	adminGroup.POST("/user/:student_id", adminUpdateUserRecordsHandler)
-	adminGroup.GET("/add_user", adminAddUserFormHandler)
-	adminGroup.POST("/add_user", adminAddUserHandler)
-
-	// サーバーをポート8080で起動
-	e.Logger.Fatal(e.Start(":8080"))
+	adminGroup.Use(AuthMiddleware)
+	adminGroup.GET("", adminDashboardHandler, RequirePermission(PermRecordsReadAll))
+	adminGroup.GET("/user/:student_id", adminViewUserRecordsHandler, RequirePermission(PermRecordsReadAll))
+	adminGroup.POST("/user/:student_id", adminUpdateUserRecordsHandler, RequirePermission(PermRecordsWriteAll))
+	adminGroup.GET("/user/:student_id/calendar", adminUserCalendarHandler, RequirePermission(PermRecordsReadAll))
+	adminGroup.POST("/user/:student_id/calendar", adminSaveUserCalendarDayHandler, RequirePermission(PermRecordsWriteAll))
+	adminGroup.POST("/user/:student_id/profile", adminUpdateUserProfileHandler, RequirePermission(PermUsersManage))
+	adminGroup.POST("/user/:student_id/contacts/add", adminAddContactHandler, RequirePermission(PermUsersManage))
+	adminGroup.POST("/user/:student_id/contacts/delete", adminDeleteContactHandler, RequirePermission(PermUsersManage))
+	adminGroup.POST("/user/:student_id/diet", adminUpdateDietHandler, RequirePermission(PermUsersManage))
+	adminGroup.POST("/user/:student_id/role", adminUpdateUserRoleHandler, RequirePermission(PermUsersManage))
+	adminGroup.POST("/user/:student_id/revoke_sessions", adminRevokeUserSessionsHandler, RequirePermission(PermUsersManage))
+	adminGroup.POST("/user/:student_id/active", adminUpdateUserActiveHandler, RequirePermission(PermUsersManage))
+	adminGroup.GET("/add_user", adminAddUserFormHandler, RequirePermission(PermUsersManage))
+	adminGroup.POST("/add_user", adminAddUserHandler, RequirePermission(PermUsersManage))
+	adminGroup.POST("/unlock_login", adminUnlockLoginHandler, RequirePermission(PermUsersManage))
+	adminGroup.GET("/approvals", adminApprovalsHandler, RequirePermission(PermOvernightApprove))
+	adminGroup.POST("/approvals/decide", adminDecideApprovalHandler, RequirePermission(PermOvernightApprove))
+	adminGroup.GET("/presence", adminPresenceHandler, RequirePermission(PermRecordsReadAll))
+	adminGroup.GET("/user/:student_id/qr.png", adminQRCodeHandler, RequirePermission(PermUsersManage))
+	adminGroup.POST("/user/:student_id/qr/rotate", adminRotateQRCodeHandler, RequirePermission(PermUsersManage))
+	adminGroup.GET("/safety", adminSafetyHandler, RequirePermission(PermSafetyManage, PermRollCallRun))
+	adminGroup.POST("/safety", adminStartSafetyHandler, RequirePermission(PermSafetyManage))
+	adminGroup.GET("/safety/:id", adminSafetyDashboardHandler, RequirePermission(PermSafetyManage, PermRollCallRun))
+	adminGroup.POST("/safety/:id/end", adminEndSafetyHandler, RequirePermission(PermSafetyManage))
+	adminGroup.POST("/safety/:id/respond", adminSafetyProxyHandler, RequirePermission(PermSafetyManage, PermRollCallRun))
+	adminGroup.GET("/curfew", adminCurfewHandler, RequirePermission(PermRecordsReadAll))
+	adminGroup.GET("/settings", adminSettingsHandler, RequirePermission(PermSettingsManage))
+	adminGroup.POST("/settings", adminUpdateSettingsHandler, RequirePermission(PermSettingsManage))
+	adminGroup.GET("/calendar", adminCalendarHandler, RequirePermission(PermSettingsManage))
+	adminGroup.POST("/calendar/add", adminAddCalendarHandler, RequirePermission(PermSettingsManage))
+	adminGroup.POST("/calendar/delete", adminDeleteCalendarHandler, RequirePermission(PermSettingsManage))
+	adminGroup.GET("/billing", adminBillingHandler, RequirePermission(PermRecordsReadAll))
+	adminGroup.GET("/analytics", adminAnalyticsHandler, RequirePermission(PermRecordsReadAll))
+	adminGroup.GET("/analytics.json", adminAnalyticsAPIHandler, RequirePermission(PermRecordsReadAll))
+	adminGroup.GET("/analytics.csv", adminAnalyticsCSVHandler, RequirePermission(PermRecordsReadAll))
+	adminGroup.GET("/bulk", adminBulkHandler, RequirePermission(PermRecordsWriteAll))
+	adminGroup.POST("/bulk", adminSaveBulkHandler, RequirePermission(PermRecordsWriteAll))
+	adminGroup.GET("/guests", adminGuestsHandler, RequirePermission(PermRecordsReadAll))
+	adminGroup.POST("/guests/add", adminAddGuestMealHandler, RequirePermission(PermRecordsWriteAll))
+	adminGroup.POST("/guests/cancel", adminCancelGuestMealHandler, RequirePermission(PermRecordsWriteAll))
+	adminGroup.GET("/rooms", adminRoomsHandler, RequirePermission(PermUsersManage))
+	adminGroup.POST("/rooms/add", adminAddLocationHandler, RequirePermission(PermUsersManage))
+	adminGroup.POST("/rooms/delete", adminDeleteLocationHandler, RequirePermission(PermUsersManage))
+	adminGroup.POST("/user/:student_id/room", adminAssignRoomHandler, RequirePermission(PermUsersManage))
+
+	// サーバーを起動し、SIGINT・SIGTERM を受け取ったら処理中のリクエストを待ってから停止
+	// 停止処理では厨房のライブ表示の接続も終了させる
+	e.Server.RegisterOnShutdown(kitchenLive.close)
+	serverErr := startServer(e, listenAddr())
+
+	// データベーススキーマを初期化 (管理者ユーザーの作成まで完了するまで /readyz は失敗し、/healthz のみ応答する)
+	if err = initDBSchema(db); err != nil {
+		return fmt.Errorf("failed to initialize database schema: %w", err)
+	}
+
+	// 記録の変更を厨房のライブ表示に配信する
+	listener := startRecordChangeListener(dbConnStr)
+	defer listener.Close()
+
+	// 管理者ユーザーが存在しない場合は作成
+	if err = createAdminUserIfNotExists(db); err != nil {
+		return fmt.Errorf("failed to create admin user: %w", err)
+	}
+	schemaReady.Store(true)
+
+	return waitForShutdown(e, serverErr,
+		durationFromEnv("SHUTDOWN_DRAIN_DELAY", defaultShutdownDrainDelay),
+		durationFromEnv("SHUTDOWN_TIMEOUT", defaultShutdownTimeout))
+}
+
+// csrfMiddleware は GET などの安全なメソッド以外のリクエストで、フォームの _csrf またはヘッダーの CSRF トークンを検証するミドルウェアを作成します
+// トークンがない場合は 400、クッキーのトークンと一致しない場合は 403 を返します
+func csrfMiddleware() echo.MiddlewareFunc {
+	return middleware.CSRFWithConfig(middleware.CSRFConfig{
+		TokenLookup:    "form:_csrf,header:" + echo.HeaderXCSRFToken,
+		CookiePath:     "/",
+		CookieHTTPOnly: true,
+		CookieSameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ipExtractor はリクエスト元のIPアドレスを判定する規則です (ipExtractorFromEnv で設定します)
+var ipExtractor = echo.ExtractIPDirect()
+
+// ipExtractorFromEnv は TRUSTED_PROXIES 環境変数 (例: "10.0.0.0/8,192.168.1.10") からリクエスト元のIPアドレスを判定する規則を作成します
+// 未設定の場合はヘッダーを信頼せず、接続元のアドレスを使います (X-Forwarded-For を書き換えて制限を回避されないため)
+// 設定した場合は、指定したアドレスからの接続のみ X-Forwarded-For を信頼します
+func ipExtractorFromEnv() echo.IPExtractor {
+	v := os.Getenv("TRUSTED_PROXIES")
+	if v == "" {
+		return echo.ExtractIPDirect()
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			log.Printf("Invalid TRUSTED_PROXIES entry %q, ignoring", s)
+			continue
+		}
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+// durationFromEnv は環境変数から時間を読み込みます (例: "30m", "12h")
+// 未設定または不正な値の場合は def を返します
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid %s %q, using default %s", name, v, def)
+		return def
+	}
+	return d
 }
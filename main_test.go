@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestCSRFMiddlewareRejectsPostsWithoutToken(t *testing.T) {
+	e := echo.New()
+	e.Use(csrfMiddleware())
+	e.GET("/form", func(c echo.Context) error { return c.String(http.StatusOK, c.Get("csrf").(string)) })
+	e.POST("/gaihaku", func(c echo.Context) error { return c.String(http.StatusOK, "saved") })
+
+	// フォームを表示したときのクッキーとトークン
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/form", nil))
+	token := rec.Body.String()
+	cookies := rec.Result().Cookies()
+	if token == "" || len(cookies) == 0 {
+		t.Fatalf("GET /form: token %q, cookies %v", token, cookies)
+	}
+
+	post := func(form url.Values, header string, withCookie bool) int {
+		req := httptest.NewRequest(http.MethodPost, "/gaihaku", strings.NewReader(form.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		if header != "" {
+			req.Header.Set(echo.HeaderXCSRFToken, header)
+		}
+		if withCookie {
+			for _, c := range cookies {
+				req.AddCookie(c)
+			}
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	tests := []struct {
+		name       string
+		form       url.Values
+		header     string
+		withCookie bool
+		want       int
+	}{
+		{"no token", url.Values{"note": {"x"}}, "", true, http.StatusBadRequest},
+		{"no token and no cookie", url.Values{}, "", false, http.StatusBadRequest},
+		{"wrong token", url.Values{"_csrf": {"forged"}}, "", true, http.StatusForbidden},
+		{"token from another browser", url.Values{"_csrf": {token}}, "", false, http.StatusForbidden},
+		{"form token", url.Values{"_csrf": {token}}, "", true, http.StatusOK},
+		{"header token", url.Values{}, token, true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := post(tt.form, tt.header, tt.withCookie); got != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+// menuMeals は献立を登録する食事の一覧です
+var menuMeals = []struct {
+	Name  string
+	Label string
+}{
+	{"breakfast", "朝食"},
+	{"lunch", "昼食"},
+	{"dinner", "夕食"},
+}
+
+const (
+	// maxMenuDishLength は料理名の最大文字数です
+	maxMenuDishLength = 100
+	// maxMenuCalories は1品のカロリーとして登録できる上限 (kcal) です
+	maxMenuCalories = 5000
+	// maxMenuImportSize は献立の取り込みファイルの最大サイズです
+	maxMenuImportSize = 1 << 20
+	// menuLineSeparators は一括入力欄の1行 (料理名 | アレルゲン | カロリー) の区切りです (全角の「｜」も使えます)
+	// 料理名には使えないため、「ハヤシ/オムライス」のような料理名もそのまま入力できます
+	menuLineSeparators = "|｜"
+)
+
+// createMenuItemsTable は献立 (日付・食事ごとの料理) のテーブルを作成します
+func createMenuItemsTable(db *sql.DB) error {
+	const createTableSQL = `
+	CREATE TABLE IF NOT EXISTS menu_items (
+		id SERIAL PRIMARY KEY,
+		menu_date DATE NOT NULL,
+		meal VARCHAR(10) NOT NULL,
+		sort_order INTEGER NOT NULL DEFAULT 0,
+		dish VARCHAR(100) NOT NULL,
+		allergens TEXT[] NOT NULL DEFAULT '{}',
+		calories INTEGER,
+		updated_by VARCHAR(50),
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS menu_items_date_idx ON menu_items (menu_date, meal, sort_order);
+	-- 以前はアレルゲンを「,」区切りの文字列で保存していたため、配列に変換する
+	DO $$ BEGIN
+		IF EXISTS (SELECT 1 FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = 'menu_items' AND column_name = 'allergens' AND data_type = 'text') THEN
+			ALTER TABLE menu_items ALTER COLUMN allergens DROP DEFAULT;
+			ALTER TABLE menu_items ALTER COLUMN allergens TYPE TEXT[]
+				USING CASE WHEN allergens = '' THEN '{}'::text[] ELSE string_to_array(allergens, ',') END;
+			ALTER TABLE menu_items ALTER COLUMN allergens SET DEFAULT '{}';
+		END IF;
+	END $$;`
+
+	_, err := db.Exec(createTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to execute SQL: %w", err)
+	}
+
+	return nil
+}
+
+// menuKey は献立を登録する単位 (日付と食事) です
+type menuKey struct {
+	Date string // "2006-01-02"
+	Meal string
+}
+
+// AllergenLabel はアレルゲンを「・」区切りで返します
+func (m MenuItem) AllergenLabel() string {
+	return strings.Join(m.Allergens, "・")
+}
+
+// Items は食事 meal の料理を返します
+func (d DayMenu) Items(meal string) []MenuItem {
+	switch meal {
+	case "breakfast":
+		return d.Breakfast
+	case "lunch":
+		return d.Lunch
+	case "dinner":
+		return d.Dinner
+	}
+	return nil
+}
+
+// parseMenuMeal は食事の名前 (breakfast など) または表示名 (朝食など) を食事の名前に変換します
+func parseMenuMeal(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	for _, m := range menuMeals {
+		if strings.EqualFold(s, m.Name) || s == m.Label {
+			return m.Name, true
+		}
+	}
+	return "", false
+}
+
+// splitAllergens はアレルゲンの入力 (「・」「、」「,」区切り) を一覧にします
+func splitAllergens(s string) []string {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == '・' || r == '、' || r == ',' || r == ';'
+	})
+	allergens := make([]string, 0, len(fields))
+	for _, f := range fields {
+		if f = strings.TrimSpace(f); f != "" {
+			allergens = append(allergens, f)
+		}
+	}
+	return allergens
+}
+
+// validateMenuItem は料理の入力を確認し、エラーがあればその内容を返します
+func validateMenuItem(m MenuItem) string {
+	switch {
+	case m.Dish == "":
+		return "料理名を入力してください。"
+	case strings.ContainsAny(m.Dish, menuLineSeparators):
+		return "料理名に「|」は使えません。"
+	case utf8.RuneCountInString(m.Dish) > maxMenuDishLength:
+		return fmt.Sprintf("料理名は%d文字以内で入力してください。", maxMenuDishLength)
+	case utf8.RuneCountInString(m.AllergenLabel()) > 200:
+		return "アレルゲンは200文字以内で入力してください。"
+	case m.Calories < 0 || m.Calories > maxMenuCalories:
+		return fmt.Sprintf("カロリーは0〜%dの数値で入力してください。", maxMenuCalories)
+	}
+	return ""
+}
+
+// parseCalories はカロリーの入力 ("650" や "650kcal") を数値にします。空欄は0 (未登録) です
+func parseCalories(s string) (int, bool) {
+	s = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "kcal")
+	if s = strings.TrimSpace(s); s == "" {
+		return 0, true
+	}
+	n, err := strconv.Atoi(s)
+	return n, err == nil
+}
+
+// splitMenuLine は一括入力欄の1行を menuLineSeparators で最大 3 つに分けます
+func splitMenuLine(line string) []string {
+	var parts []string
+	for len(parts) < 2 {
+		i := strings.IndexAny(line, menuLineSeparators)
+		if i < 0 {
+			break
+		}
+		_, size := utf8.DecodeRuneInString(line[i:])
+		parts = append(parts, line[:i])
+		line = line[i+size:]
+	}
+	return append(parts, line)
+}
+
+// parseMenuLines は一括入力欄の内容を料理の一覧にします
+// 1行に1品、「料理名 | アレルゲン | カロリー」の形式で、アレルゲンとカロリーは省略できます
+func parseMenuLines(text string) ([]MenuItem, string) {
+	var items []MenuItem
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		parts := splitMenuLine(line)
+		item := MenuItem{Dish: strings.TrimSpace(parts[0])}
+		if len(parts) > 1 {
+			item.Allergens = splitAllergens(parts[1])
+		}
+		if len(parts) > 2 {
+			calories, ok := parseCalories(parts[2])
+			if !ok {
+				return nil, fmt.Sprintf("「%s」のカロリーは数値で入力してください。", item.Dish)
+			}
+			item.Calories = calories
+		}
+		if msg := validateMenuItem(item); msg != "" {
+			return nil, msg
+		}
+		items = append(items, item)
+	}
+	return items, ""
+}
+
+// formatMenuLines は料理の一覧を一括入力欄の形式にします
+func formatMenuLines(items []MenuItem) string {
+	lines := make([]string, 0, len(items))
+	for _, m := range items {
+		line := m.Dish
+		if m.Calories > 0 {
+			line += " | " + m.AllergenLabel() + " | " + strconv.Itoa(m.Calories)
+		} else if len(m.Allergens) > 0 {
+			line += " | " + m.AllergenLabel()
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// getMenus は期間内の献立を日付 ("2006-01-02") ごとに取得します
+func getMenus(db *sql.DB, from, to time.Time) (map[string]DayMenu, error) {
+	rows, err := db.Query(`SELECT menu_date, meal, dish, allergens, COALESCE(calories, 0) FROM menu_items
+	WHERE menu_date BETWEEN $1 AND $2
+	ORDER BY menu_date ASC, meal ASC, sort_order ASC, id ASC`, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query menus: %w", err)
+	}
+	defer rows.Close()
+
+	menus := make(map[string]DayMenu)
+	for rows.Next() {
+		var m MenuItem
+		if err := rows.Scan(&m.Date, &m.Meal, &m.Dish, pq.Array(&m.Allergens), &m.Calories); err != nil {
+			log.Printf("Failed to scan menu item: %v", err)
+			continue
+		}
+
+		date := m.Date.Format("2006-01-02")
+		d := menus[date]
+		switch m.Meal {
+		case "breakfast":
+			d.Breakfast = append(d.Breakfast, m)
+		case "lunch":
+			d.Lunch = append(d.Lunch, m)
+		case "dinner":
+			d.Dinner = append(d.Dinner, m)
+		}
+		menus[date] = d
+	}
+	return menus, nil
+}
+
+// replaceMenus は日付・食事ごとに献立を置き換えます。料理が空の場合はその食事の献立を削除します
+func replaceMenus(db *sql.DB, menus map[menuKey][]MenuItem, updatedBy string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for key, items := range menus {
+		if _, err := tx.Exec("DELETE FROM menu_items WHERE menu_date = $1 AND meal = $2", key.Date, key.Meal); err != nil {
+			return fmt.Errorf("failed to delete menu: %w", err)
+		}
+		for i, m := range items {
+			_, err := tx.Exec(`INSERT INTO menu_items (menu_date, meal, sort_order, dish, allergens, calories, updated_by)
+			VALUES ($1, $2, $3, $4, COALESCE($5::text[], '{}'), NULLIF($6, 0), $7)`,
+				key.Date, key.Meal, i, m.Dish, pq.Array(m.Allergens), m.Calories, updatedBy)
+			if err != nil {
+				return fmt.Errorf("failed to insert menu item: %w", err)
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// menuImportRow は取り込みファイル (JSON) の1品です
+type menuImportRow struct {
+	Date      string   `json:"date"`
+	Meal      string   `json:"meal"`
+	Dish      string   `json:"dish"`
+	Allergens []string `json:"allergens"`
+	Calories  int      `json:"calories"`
+}
+
+// collectMenuImport は取り込んだ料理を日付・食事ごとにまとめます。row は行番号などエラー表示用の位置です
+func collectMenuImport(menus map[menuKey][]MenuItem, r menuImportRow, row string) string {
+	date, err := time.ParseInLocation("2006-01-02", strings.TrimSpace(r.Date), time.Local)
+	if err != nil {
+		return fmt.Sprintf("%s: 日付は YYYY-MM-DD の形式で入力してください。", row)
+	}
+	meal, ok := parseMenuMeal(r.Meal)
+	if !ok {
+		return fmt.Sprintf("%s: 食事は breakfast・lunch・dinner (朝食・昼食・夕食) のいずれかにしてください。", row)
+	}
+	item := MenuItem{Date: date, Meal: meal, Dish: strings.TrimSpace(r.Dish), Calories: r.Calories}
+	for _, a := range r.Allergens {
+		item.Allergens = append(item.Allergens, splitAllergens(a)...)
+	}
+	if msg := validateMenuItem(item); msg != "" {
+		return row + ": " + msg
+	}
+	key := menuKey{Date: date.Format("2006-01-02"), Meal: meal}
+	menus[key] = append(menus[key], item)
+	return ""
+}
+
+// parseMenuJSON は献立のJSON (料理の配列) を読み込みます
+func parseMenuJSON(r io.Reader) (map[menuKey][]MenuItem, string) {
+	var rows []menuImportRow
+	if err := json.NewDecoder(r).Decode(&rows); err != nil {
+		return nil, "JSONの形式が正しくありません。"
+	}
+	menus := make(map[menuKey][]MenuItem)
+	for i, row := range rows {
+		if msg := collectMenuImport(menus, row, fmt.Sprintf("%d件目", i+1)); msg != "" {
+			return nil, msg
+		}
+	}
+	return menus, ""
+}
+
+// parseMenuCSV は献立のCSV (見出し行: date,meal,dish,allergens,calories) を読み込みます
+func parseMenuCSV(r io.Reader) (map[menuKey][]MenuItem, string) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, "CSVの形式が正しくありません。"
+	}
+	if len(records) == 0 {
+		return nil, "CSVに献立がありません。"
+	}
+
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	for _, name := range []string{"date", "meal", "dish"} {
+		if _, ok := columns[name]; !ok {
+			return nil, "CSVの1行目に date,meal,dish,allergens,calories の見出しが必要です。"
+		}
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+
+	menus := make(map[menuKey][]MenuItem)
+	for i, record := range records[1:] {
+		row := fmt.Sprintf("%d行目", i+2)
+		calories, ok := parseCalories(field(record, "calories"))
+		if !ok {
+			return nil, row + ": カロリーは数値で入力してください。"
+		}
+		r := menuImportRow{
+			Date:      field(record, "date"),
+			Meal:      field(record, "meal"),
+			Dish:      field(record, "dish"),
+			Allergens: []string{field(record, "allergens")},
+			Calories:  calories,
+		}
+		if msg := collectMenuImport(menus, r, row); msg != "" {
+			return nil, msg
+		}
+	}
+	return menus, ""
+}
+
+// menuWeekStart は一括入力フォームの最初の日 (week) を返します。指定がなければ今日です
+func menuWeekStart(week string) time.Time {
+	if d, err := time.ParseInLocation("2006-01-02", week, time.Local); err == nil {
+		return d
+	}
+	y, m, d := time.Now().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+}
+
+// menuCellName は一括入力欄の名前 (menu-日付-食事) を返します
+func menuCellName(date time.Time, meal string) string {
+	return "menu-" + date.Format("2006-01-02") + "-" + meal
+}
+
+// renderKitchenMenu は献立の一括入力ページを表示します
+// cells は入力欄ごとの内容で、入力エラーの場合は送信された内容をそのまま表示し直します
+func renderKitchenMenu(c echo.Context, status int, week time.Time, cells map[string]string, errorMessage string) error {
+	dates := make([]time.Time, 7)
+	for i := range dates {
+		dates[i] = week.AddDate(0, 0, i)
+	}
+	calendar, err := getDormCalendar(db, dates[0], dates[6])
+	if err != nil {
+		log.Printf("Failed to get dorm calendar: %v", err)
+	}
+
+	successMessage := popFlash(c, "menu_success")
+	if errorMessage == "" {
+		errorMessage = popFlash(c, "menu_error")
+	}
+
+	return c.Render(status, "kitchen_menu.html", map[string]interface{}{
+		"week":           week,
+		"prevWeek":       week.AddDate(0, 0, -7),
+		"nextWeek":       week.AddDate(0, 0, 7),
+		"dates":          dates,
+		"meals":          menuMeals,
+		"cells":          cells,
+		"calendar":       calendar,
+		"successMessage": successMessage,
+		"errorMessage":   errorMessage,
+	})
+}
+
+// kitchenMenuHandler は1週間分の献立の一括入力フォームを表示します
+func kitchenMenuHandler(c echo.Context) error {
+	week := menuWeekStart(c.QueryParam("week"))
+	menus, err := getMenus(db, week, week.AddDate(0, 0, 6))
+	if err != nil {
+		log.Printf("Failed to get menus: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to retrieve menus.")
+	}
+
+	cells := make(map[string]string)
+	for i := 0; i < 7; i++ {
+		date := week.AddDate(0, 0, i)
+		for _, meal := range menuMeals {
+			cells[menuCellName(date, meal.Name)] = formatMenuLines(menus[date.Format("2006-01-02")].Items(meal.Name))
+		}
+	}
+	return renderKitchenMenu(c, http.StatusOK, week, cells, "")
+}
+
+// readMenuWeekForm は一括入力フォームから1週間分の献立を読み込み、最初に見つかった入力エラーを返します
+// フォームに入力欄のない日付・食事は読み込まず、登録済みの献立をそのまま残します (空欄の場合のみ削除します)
+func readMenuWeekForm(form url.Values, week time.Time) (map[menuKey][]MenuItem, map[string]string, string) {
+	menus := make(map[menuKey][]MenuItem)
+	cells := make(map[string]string)
+	errorMessage := ""
+	for i := 0; i < 7; i++ {
+		date := week.AddDate(0, 0, i)
+		for _, meal := range menuMeals {
+			name := menuCellName(date, meal.Name)
+			if _, ok := form[name]; !ok {
+				continue
+			}
+			cells[name] = form.Get(name)
+			items, msg := parseMenuLines(cells[name])
+			if msg != "" {
+				if errorMessage == "" {
+					errorMessage = fmt.Sprintf("%s (%s) の%s: %s", date.Format("01/02"), japaneseWeekday(date), meal.Label, msg)
+				}
+				continue
+			}
+			menus[menuKey{Date: date.Format("2006-01-02"), Meal: meal.Name}] = items
+		}
+	}
+	return menus, cells, errorMessage
+}
+
+// kitchenSaveMenuHandler は一括入力フォームの1週間分の献立を保存します
+func kitchenSaveMenuHandler(c echo.Context) error {
+	formValues, err := c.FormParams()
+	if err != nil {
+		log.Printf("Failed to parse form data for menu: %v", err)
+		return c.String(http.StatusBadRequest, "Invalid form data.")
+	}
+	week := menuWeekStart(formValues.Get("week"))
+	menus, cells, errorMessage := readMenuWeekForm(formValues, week)
+	if errorMessage != "" {
+		return renderKitchenMenu(c, http.StatusUnprocessableEntity, week, cells, errorMessage)
+	}
+
+	user := currentUser(c)
+	if err := replaceMenus(db, menus, user.Username); err != nil {
+		log.Printf("Failed to save menus: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to save menus.")
+	}
+	log.Printf("Menus for the week of %s saved by %s", week.Format("2006-01-02"), user.Username)
+
+	path := "/kitchen/menu?week=" + week.Format("2006-01-02")
+	return redirectWithFlash(c, path, "献立を保存しました。", true, "menu_success", "menu_error")
+}
+
+// kitchenImportMenuHandler はJSONまたはCSVのファイルから献立を取り込みます
+// ファイルに含まれる日付・食事の献立は、ファイルの内容で置き換えます
+func kitchenImportMenuHandler(c echo.Context) error {
+	week := menuWeekStart(c.FormValue("week"))
+	path := "/kitchen/menu?week=" + week.Format("2006-01-02")
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		return redirectWithFlash(c, path, "取り込むファイルを選択してください。", false, "menu_success", "menu_error")
+	}
+	if file.Size > maxMenuImportSize {
+		return redirectWithFlash(c, path, "ファイルが大きすぎます (1MBまで)。", false, "menu_success", "menu_error")
+	}
+	src, err := file.Open()
+	if err != nil {
+		log.Printf("Failed to open uploaded menu file: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to read file.")
+	}
+	defer src.Close()
+
+	var menus map[menuKey][]MenuItem
+	var errorMessage string
+	switch strings.ToLower(filepath.Ext(file.Filename)) {
+	case ".json":
+		menus, errorMessage = parseMenuJSON(src)
+	case ".csv":
+		menus, errorMessage = parseMenuCSV(src)
+	default:
+		errorMessage = "JSON (.json) または CSV (.csv) のファイルを選択してください。"
+	}
+	if errorMessage == "" && len(menus) == 0 {
+		errorMessage = "ファイルに献立がありません。"
+	}
+	if errorMessage != "" {
+		return redirectWithFlash(c, path, errorMessage, false, "menu_success", "menu_error")
+	}
+
+	user := currentUser(c)
+	if err := replaceMenus(db, menus, user.Username); err != nil {
+		log.Printf("Failed to import menus: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to save menus.")
+	}
+	log.Printf("%d menus imported from %s by %s", len(menus), file.Filename, user.Username)
+
+	return redirectWithFlash(c, path, fmt.Sprintf("%d食分の献立を取り込みました。", len(menus)), true, "menu_success", "menu_error")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestParseMenuLines(t *testing.T) {
+	items, msg := parseMenuLines("ハヤシ/オムライス | 卵・乳, 小麦 | 720kcal\n\n  みそ汁｜大豆\nサラダ\n")
+	if msg != "" {
+		t.Fatalf("parseMenuLines: %s", msg)
+	}
+	want := []MenuItem{
+		{Dish: "ハヤシ/オムライス", Allergens: []string{"卵", "乳", "小麦"}, Calories: 720},
+		{Dish: "みそ汁", Allergens: []string{"大豆"}},
+		{Dish: "サラダ"},
+	}
+	if len(items) != len(want) {
+		t.Fatalf("got %d items, want %d: %+v", len(items), len(want), items)
+	}
+	for i := range want {
+		if items[i].Dish != want[i].Dish || items[i].Calories != want[i].Calories || len(items[i].Allergens) != len(want[i].Allergens) {
+			t.Errorf("item %d = %+v, want %+v", i, items[i], want[i])
+			continue
+		}
+		for j := range want[i].Allergens {
+			if items[i].Allergens[j] != want[i].Allergens[j] {
+				t.Errorf("item %d allergens = %v, want %v", i, items[i].Allergens, want[i].Allergens)
+			}
+		}
+	}
+
+	// 一括入力欄の形式に戻して読み込むと同じ内容になる
+	again, msg := parseMenuLines(formatMenuLines(items))
+	if msg != "" || !reflect.DeepEqual(again, items) {
+		t.Errorf("round trip = %+v (%q), want %+v", again, msg, items)
+	}
+}
+
+func TestParseMenuLinesErrors(t *testing.T) {
+	for _, text := range []string{
+		"カレー | | たくさん",
+		" | 卵",
+		"カレー | 小麦 | 700 | 余分",
+	} {
+		if items, msg := parseMenuLines(text); msg == "" {
+			t.Errorf("parseMenuLines(%q) = %+v, want an error", text, items)
+		}
+	}
+}
+
+func TestCreateMenuItemsTableConvertsTextAllergens(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, `DROP TABLE menu_items`)
+	mustExec(t, db, `CREATE TABLE menu_items (
+		id SERIAL PRIMARY KEY,
+		menu_date DATE NOT NULL,
+		meal VARCHAR(10) NOT NULL,
+		sort_order INTEGER NOT NULL DEFAULT 0,
+		dish VARCHAR(100) NOT NULL,
+		allergens TEXT NOT NULL DEFAULT '',
+		calories INTEGER,
+		updated_by VARCHAR(50),
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	)`)
+	mustExec(t, db, `INSERT INTO menu_items (menu_date, meal, dish, allergens) VALUES
+		('2024-04-01', 'dinner', 'カレー', '小麦,乳'),
+		('2024-04-01', 'dinner', 'サラダ', '')`)
+
+	// 2回実行しても変換済みの列はそのまま
+	for i := 0; i < 2; i++ {
+		if err := createMenuItemsTable(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := make(map[string][]string)
+	rows, err := db.Query(`SELECT dish, allergens FROM menu_items`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var dish string
+		var allergens pq.StringArray
+		if err := rows.Scan(&dish, &allergens); err != nil {
+			t.Fatal(err)
+		}
+		got[dish] = allergens
+	}
+	if !reflect.DeepEqual(got["カレー"], []string{"小麦", "乳"}) || len(got["サラダ"]) != 0 {
+		t.Errorf("converted allergens = %v", got)
+	}
+	mustExec(t, db, `INSERT INTO menu_items (menu_date, meal, dish) VALUES ('2024-04-02', 'lunch', 'うどん')`)
+}
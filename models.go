@@ -3,20 +3,418 @@ package main
 import "time"
 
 type User struct {
-	ID       int
-	Username string
-	Password string
-	Role     string
+	ID          int
+	Username    string
+	Password    string
+	Role        string
+	Active      bool
+	DisplayName string
+	Furigana    string
+	Grade       int // 学年 (0 は未登録)
+	Department  string
+	Phone       string
+	Email       string
+	BirthDate   *time.Time   // 未登録の場合は nil (未成年として扱います)
+	Location    RoomLocation // 一覧表示時の現在の部屋
+	AwayTonight bool         // 一覧表示時の今夜の外泊 (寮監督者の承認待ち・却下を除く)
+}
+
+// Name は画面に表示する名前を返します。氏名が未登録の場合は学籍番号を返します
+func (u User) Name() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return u.Username
 }
 
 type GaihakuKesshokuRecord struct {
+	ID              int
+	StudentID       string
+	RecordDate      time.Time
+	Breakfast       bool
+	Lunch           bool
+	Dinner          bool
+	Overnight       bool
+	Note            string
+	Destination     string     // 外泊先
+	StayPhone       string     // 外泊中の連絡先
+	ExpectedReturn  *time.Time // 帰寮予定日時
+	GuardianStatus  string     // 保護者の承認状況 (承認が不要な場合は空文字)
+	StaffStatus     string     // 寮監督者の承認状況 (承認が不要な場合は空文字)
+	StaffComment    string
+	LateReturn      bool       // 門限後の帰寮の届出
+	ExpectedArrival *time.Time // 門限後の帰寮予定時刻
+	CreatedAt       time.Time
+}
+
+type CurfewViolation struct {
+	StudentID       string
+	StudentName     string
+	RecordDate      time.Time
+	LateReturn      bool
+	ExpectedArrival *time.Time
+	ActualArrival   time.Time
+}
+
+type PresenceLog struct {
+	ID          int
+	StudentID   string
+	StudentName string
+	Direction   string // "out" (外出) または "in" (帰寮)
+	LoggedAt    time.Time
+	LoggedBy    string
+}
+
+type PresenceStatus struct {
+	StudentID       string
+	Name            string
+	Location        RoomLocation
+	Overnight       bool
+	StaffStatus     string // 外泊の寮監督者の承認状況
+	LateReturn      bool
+	ExpectedArrival *time.Time
+	Last            *PresenceLog // 確認時刻までの最後の出入り (記録がなければ nil)
+	Discrepancy     string       // 予定と実際の出入りの食い違い (なければ空文字)
+}
+
+type DormDay struct {
+	Date      time.Time
+	Kind      string // 特別な日の種類 (通常の日は空文字)
+	Note      string
+	CreatedBy string
+}
+
+type MenuItem struct {
+	Date      time.Time
+	Meal      string // breakfast / lunch / dinner
+	Dish      string
+	Allergens []string
+	Calories  int // 0 は未登録
+}
+
+// DayMenu は1日分の献立です
+type DayMenu struct {
+	Breakfast []MenuItem
+	Lunch     []MenuItem
+	Dinner    []MenuItem
+}
+
+type MealPrices struct {
+	Breakfast int
+	Lunch     int
+	Dinner    int
+}
+
+type BillingDay struct {
+	Date      time.Time
+	Resident  bool // 在寮していた日か
+	Breakfast bool
+	Lunch     bool
+	Dinner    bool
+	Day       DormDay
+}
+
+// BillingStatement は寮生の月の食費です (食べた食事の数と単価)
+type BillingStatement struct {
+	StudentID   string
+	StudentName string
+	Month       time.Time
+	Breakfast   int
+	Lunch       int
+	Dinner      int
+	Guests      int // 食費に加算する来客の食事の数
+	GuestAmount int // 来客の食事の請求額 (円)
+	Prices      MealPrices
+	Days        []BillingDay // 日ごとの内訳 (寮生本人の明細のみ)
+	GuestMeals  []GuestMeal  // 食費に加算する来客の食事 (寮生本人の明細のみ)
+}
+
+type SafetyEvent struct {
 	ID         int
+	Message    string
+	RecordDate time.Time // 外泊の届出と照合する夜の日付
+	StartedBy  string
+	StartedAt  time.Time
+	EndedAt    *time.Time
+}
+
+type SafetyStatus struct {
+	StudentID    string
+	Name         string
+	Location     RoomLocation
+	Overnight    bool
+	LastPresence *PresenceLog
+	Status       string // 回答 (未回答の場合は空文字)
+	Comment      string
+	RespondedAt  *time.Time
+	RespondedBy  string
+	Attention    string // 確認が必要な理由 (なければ空文字)
+}
+
+type SafetySummary struct {
+	Total               int
+	Safe                int
+	Help                int
+	Away                int
+	NoResponseInDorm    int // 未回答のうち外泊の届出がない寮生
+	NoResponseOvernight int // 未回答のうち外泊の届出がある寮生
+}
+
+type CurfewViolationSummary struct {
+	StudentID         string
+	StudentName       string
+	Unregistered      int // 届出のない門限超え
+	LaterThanExpected int // 届け出た予定時刻より遅れた帰寮
+	Violations        []CurfewViolation
+}
+
+type OvernightRequest struct {
+	StudentID      string
+	StudentName    string
+	RecordDate     time.Time
+	Destination    string
+	StayPhone      string
+	ExpectedReturn *time.Time
+	GuardianStatus string
+	StaffStatus    string
+	StaffComment   string
+	DecidedBy      string
+	DecidedAt      *time.Time
+}
+
+type GuardianApproval struct {
+	ID             int
+	StudentID      string
+	StudentName    string
+	RecordDate     time.Time
+	GuardianName   string
+	Destination    string
+	StayPhone      string
+	ExpectedReturn *time.Time
+	Status         string
+}
+
+// DietaryRequirement は寮生のアレルギー・食事制限です
+type DietaryRequirement struct {
+	StudentID string
+	Diet      string // 食事制限の種類 (制限なしは空文字)
+	Allergens []string
+	Note      string
+}
+
+// DietaryEater は厨房向けの、食事をとるアレルギー・食事制限のある寮生です
+type DietaryEater struct {
+	DietaryRequirement
+	StudentName string
+	Breakfast   bool
+	Lunch       bool
+	Dinner      bool
+	Location    RoomLocation
+}
+
+type DietCount struct {
+	Diet      string // 食事制限の種類 (通常食・アレルギー対応は空文字)
+	Label     string
+	Allergy   bool // アレルギー対応の区分か
+	Breakfast int
+	Lunch     int
+	Dinner    int
+}
+
+type EmergencyContact struct {
+	ID           int
+	StudentID    string
+	Name         string
+	Relationship string
+	Phone        string
+	Email        string
+	IsGuardian   bool
+}
+
+type LoginLock struct {
+	Scope         string
+	Subject       string
+	LastFailureAt time.Time
+	LockedUntil   time.Time
+}
+
+type SessionInfo struct {
+	ID         string
 	StudentID  string
-	RecordDate time.Time
-	Breakfast  bool
-	Lunch      bool
-	Dinner     bool
-	Overnight  bool
-	Note       string
+	IPAddress  string
+	UserAgent  string
 	CreatedAt  time.Time
+	LastSeenAt time.Time
+	Current    bool
+}
+
+// MealCount の Overnight は寮監督者の承認が不要か承認済みの外泊、OvernightPending は承認待ちの外泊の人数です
+type MealCount struct {
+	Date             time.Time
+	Label            string // 棟・フロア別の集計のときの表示名
+	Residents        int
+	Breakfast        int // 来客を含む食数
+	Lunch            int
+	Dinner           int
+	GuestBreakfast   int // うち来客の食数
+	GuestLunch       int
+	GuestDinner      int
+	Overnight        int
+	OvernightPending int
+}
+
+// DayOverview は管理ダッシュボードに表示する1日分の概況です
+type DayOverview struct {
+	Date             time.Time
+	Day              DormDay
+	Meals            MealCount // 食数・外泊者数・寮生数
+	Unregistered     int       // その日の記録がない寮生の数
+	RollCallExpected int       // 点呼の対象 (外泊しない寮生) の数
+	RollCalled       int       // 点呼済みの寮生の数
+	LateReturns      int       // 門限後の帰寮の届出の数
+}
+
+// MealEstimate は1回の食事の予測食数です
+// 予測は記録で食べると登録した寮生と来客の数に、記録のない寮生が食べる見込みを加えたものです
+type MealEstimate struct {
+	Served       bool // 食事が提供される日か
+	Current      int  // 現在の食数 (記録のない寮生は食べるものとして数えた数)
+	Registered   int  // 記録で食べると登録した寮生の数
+	Guests       int  // 来客の食数
+	Unregistered int  // 記録のない寮生の数
+	Expected     int  // 予測食数
+	Low          int  // 予測の範囲の下限
+	High         int  // 予測の範囲の上限
+}
+
+// MealForecast は1日分の食数の予測です
+type MealForecast struct {
+	Date      time.Time
+	Day       DormDay
+	Breakfast MealEstimate
+	Lunch     MealEstimate
+	Dinner    MealEstimate
+}
+
+// StudentDay は寮生ごとの月のカレンダーに表示する1日分の記録です
+type StudentDay struct {
+	Date          time.Time
+	Day           DormDay
+	Record        GaihakuKesshokuRecord // 記録のない日は全ての食事を食べ外泊しないものとします
+	Registered    bool                  // 記録があるか
+	RollCall      bool
+	ActualArrival *time.Time
+	History       []RecordHistory // その日の記録の変更履歴 (新しい順)
+	Past          bool            // 今日より前の日か
+}
+
+// RecordHistory は外泊・欠食記録の変更履歴です (変更後の内容を残します)
+type RecordHistory struct {
+	StudentID   string
+	StudentName string // 全寮生の最近の変更を表示するときのみ
+	RecordDate  time.Time
+	Action      string // self / admin / admin_bulk
+	Breakfast   bool
+	Lunch       bool
+	Dinner      bool
+	Overnight   bool
+	Destination string
+	LateReturn  bool
+	Note        string
+	ChangedBy   string
+	ChangedAt   time.Time
+}
+
+// GuestMeal は寮生が申し込んだ来客の食事です
+type GuestMeal struct {
+	ID          int
+	StudentID   string
+	StudentName string
+	Date        time.Time
+	Meal        string // breakfast / lunch / dinner
+	Guests      int
+	GuestName   string
+	Payer       string // student / guest
+	CreatedBy   string
+}
+
+// RollCallRecord は当直が記録した点呼の結果と帰寮時刻です (受付端末で記録した門限後の帰寮を含みます)
+type RollCallRecord struct {
+	StudentID     string
+	Date          time.Time
+	RollCall      bool
+	ActualArrival *time.Time
+}
+
+type RollCallEntry struct {
+	StudentID       string
+	Name            string
+	Location        RoomLocation
+	Overnight       bool
+	RollCall        bool
+	Note            string
+	Destination     string
+	StayPhone       string
+	ExpectedReturn  *time.Time
+	ContactName     string // 緊急連絡先 (保護者を優先)
+	ContactPhone    string
+	GuardianStatus  string
+	StaffStatus     string
+	LateReturn      bool
+	ExpectedArrival *time.Time
+	ActualArrival   *time.Time // 当直が記録した帰寮時刻
+}
+
+type RoomLocation struct {
+	BuildingID   int
+	BuildingName string
+	FloorID      int
+	FloorName    string
+	RoomID       int
+	RoomNumber   string
+}
+
+// FloorLabel は棟・フロアの表示名を返します
+func (l RoomLocation) FloorLabel() string {
+	if l.FloorID == 0 {
+		return "部屋未割り当て"
+	}
+	return l.BuildingName + " " + l.FloorName
+}
+
+// String は棟・フロア・部屋番号の表示名を返します
+func (l RoomLocation) String() string {
+	if l.RoomID == 0 {
+		return ""
+	}
+	return l.BuildingName + " " + l.FloorName + " " + l.RoomNumber
+}
+
+type Building struct {
+	ID     int
+	Name   string
+	Floors []Floor
+}
+
+type Floor struct {
+	ID           int
+	BuildingID   int
+	BuildingName string
+	Name         string
+	SortOrder    int
+	Rooms        []Room
+}
+
+type Room struct {
+	ID        int
+	Number    string
+	Capacity  int
+	Occupants string
+}
+
+type RoomAssignment struct {
+	ID        int
+	Location  RoomLocation
+	StartDate time.Time
+	EndDate   *time.Time
 }
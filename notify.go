@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// Notifier は保護者や寮生へのお知らせを送信します
+type Notifier interface {
+	Send(to, subject, body string) error
+}
+
+// notifier はアプリケーション全体で使用する送信手段です
+var notifier Notifier = logNotifier{}
+
+// newNotifierFromEnv は環境変数から送信手段を作成します
+// SMTP_HOST が設定されていない場合は、送信内容をログに出力するだけにします (開発用)
+func newNotifierFromEnv() Notifier {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		log.Println("SMTP_HOST not set, notifications will be written to the log")
+		return logNotifier{}
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = "gaihaku@" + host
+	}
+	n := &smtpNotifier{addr: host + ":" + port, from: from}
+	if user := os.Getenv("SMTP_USER"); user != "" {
+		n.auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return n
+}
+
+// smtpNotifier はメールで送信します
+type smtpNotifier struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// Send はメールを送信します
+func (n *smtpNotifier) Send(to, subject, body string) error {
+	if strings.ContainsAny(to, "\r\n") {
+		return fmt.Errorf("invalid recipient %q", to)
+	}
+	msg := "From: " + n.from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + mime.BEncoding.Encode("UTF-8", subject) + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"Content-Transfer-Encoding: 8bit\r\n" +
+		"\r\n" + strings.ReplaceAll(body, "\n", "\r\n")
+	if err := smtp.SendMail(n.addr, n.auth, n.from, []string{to}, []byte(msg)); err != nil {
+		return fmt.Errorf("failed to send mail: %w", err)
+	}
+	return nil
+}
+
+// logNotifier は送信内容をログに出力します
+type logNotifier struct{}
+
+// Send は送信内容をログに出力します
+func (logNotifier) Send(to, subject, body string) error {
+	log.Printf("Notification to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+// appBaseURL はメールに記載するリンクの基準URLを返します
+func appBaseURL() string {
+	if u := os.Getenv("APP_BASE_URL"); u != "" {
+		return strings.TrimRight(u, "/")
+	}
+	return "http://localhost:8080"
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// overviewDays は管理ダッシュボードに概況を表示する日数 (今日・明日) です
+const overviewDays = 2
+
+// recentChangesLimit は管理ダッシュボードに表示する最近の記録の変更の件数です
+const recentChangesLimit = 10
+
+// getDayOverviews は from から days 日分の、食数・外泊・未登録・点呼の概況を取得します
+func getDayOverviews(db *sql.DB, from time.Time, days int) ([]DayOverview, error) {
+	counts, err := getMealCounts(db, from, days, LocationFilter{})
+	if err != nil {
+		return nil, err
+	}
+	calendar, err := getDormCalendar(db, from, from.AddDate(0, 0, days-1))
+	if err != nil {
+		log.Printf("Failed to get dorm calendar: %v", err)
+	}
+
+	rows, err := db.Query(`
+	SELECT d::date,
+		COUNT(u.id) FILTER (WHERE r.student_id IS NULL),
+		COUNT(u.id) FILTER (WHERE NOT (`+countedOvernightSQL+`)),
+		COUNT(u.id) FILTER (WHERE COALESCE(rc.roll_call, FALSE)),
+		COUNT(u.id) FILTER (WHERE COALESCE(r.late_return, FALSE))
+	FROM generate_series($1::date, $2::date, INTERVAL '1 day') AS d
+	JOIN users u ON `+residentRolesSQL+locationJoinSQL("d::date")+`
+	LEFT JOIN gaihaku_kesshoku_records r ON r.student_id = u.username AND r.record_date = d::date`+rollCallJoinSQL("d::date")+`
+	WHERE `+residentOnDaySQL("d::date")+`
+	GROUP BY d
+	ORDER BY d ASC`, from.Format("2006-01-02"), from.AddDate(0, 0, days-1).Format("2006-01-02"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query day overview: %w", err)
+	}
+	defer rows.Close()
+
+	byDate := make(map[string]DayOverview)
+	for rows.Next() {
+		var o DayOverview
+		if err := rows.Scan(&o.Date, &o.Unregistered, &o.RollCallExpected, &o.RollCalled, &o.LateReturns); err != nil {
+			log.Printf("Failed to scan day overview: %v", err)
+			continue
+		}
+		byDate[o.Date.Format("2006-01-02")] = o
+	}
+
+	overviews := make([]DayOverview, 0, len(counts))
+	for _, m := range counts {
+		key := m.Date.Format("2006-01-02")
+		o := byDate[key]
+		o.Date, o.Meals, o.Day = m.Date, m, calendar[key]
+		overviews = append(overviews, o)
+	}
+	return overviews, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestGetDayOverviews(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, `INSERT INTO users (username, password, role, active) VALUES
+		('s1', 'x', 'user', TRUE), ('s2', 'x', 'user', TRUE), ('s3', 'x', 'floor_leader', TRUE), ('s4', 'x', 'user', TRUE),
+		('old', 'x', 'user', FALSE), ('k1', 'x', 'kitchen', TRUE)`)
+	mustExec(t, db, `INSERT INTO gaihaku_kesshoku_records (student_id, record_date, overnight, staff_status, late_return) VALUES
+		('s1', CURRENT_DATE, TRUE, 'approved', FALSE),
+		('s2', CURRENT_DATE, FALSE, '', TRUE),
+		('s3', CURRENT_DATE, TRUE, 'pending', FALSE)`)
+	today := time.Now()
+	if err := saveRollCall(db, "s2", today, true, sql.NullTime{}, false, "n1"); err != nil {
+		t.Fatal(err)
+	}
+
+	overviews, err := getDayOverviews(db, today, overviewDays)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overviews) != 2 {
+		t.Fatalf("got %d days, want 2", len(overviews))
+	}
+
+	// 承認待ちの外泊は外泊として数えず、点呼の対象に含める。無効な寮生と寮生以外のユーザーは数えない
+	o := overviews[0]
+	if o.Meals.Residents != 4 || o.Meals.Overnight != 1 || o.Meals.OvernightPending != 1 {
+		t.Errorf("today meals: residents=%d overnight=%d pending=%d, want 4, 1 and 1", o.Meals.Residents, o.Meals.Overnight, o.Meals.OvernightPending)
+	}
+	if o.Unregistered != 1 || o.RollCallExpected != 3 || o.RollCalled != 1 || o.LateReturns != 1 {
+		t.Errorf("today: unregistered=%d expected=%d roll called=%d late=%d, want 1, 3, 1 and 1",
+			o.Unregistered, o.RollCallExpected, o.RollCalled, o.LateReturns)
+	}
+
+	// 記録のない日は全員が未登録・点呼の対象
+	o = overviews[1]
+	if o.Date.Format("2006-01-02") != today.AddDate(0, 0, 1).Format("2006-01-02") {
+		t.Errorf("second day = %s, want tomorrow", o.Date.Format("2006-01-02"))
+	}
+	if o.Unregistered != 4 || o.RollCallExpected != 4 || o.RollCalled != 0 || o.LateReturns != 0 {
+		t.Errorf("tomorrow: unregistered=%d expected=%d roll called=%d late=%d, want 4, 4, 0 and 0",
+			o.Unregistered, o.RollCallExpected, o.RollCalled, o.LateReturns)
+	}
+}
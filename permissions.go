@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 役割
+const (
+	RoleAdmin       = "admin"        // 寮務担当の管理者
+	RoleUser        = "user"         // 寮生
+	RoleFloorLeader = "floor_leader" // 寮長・階長 (寮生)
+	RoleKitchen     = "kitchen"      // 厨房スタッフ
+	RoleNightDuty   = "night_duty"   // 当直スタッフ
+	RoleKiosk       = "kiosk"        // 玄関の受付端末 (入退寮の記録専用)
+)
+
+// 権限
+const (
+	PermRecordsReadAll   = "records.read.all"   // 全寮生の記録の閲覧
+	PermRecordsReadFloor = "records.read.floor" // 自分のフロアの外泊状況の閲覧
+	PermRecordsWriteAll  = "records.write.all"  // 全寮生の記録の編集
+	PermUsersManage      = "users.manage"       // ユーザーの追加・役割変更・無効化
+	PermRollCallRun      = "rollcall.run"       // 点呼の実施
+	PermMealsRead        = "meals.read"         // 食数の閲覧
+	PermOvernightApprove = "overnight.approve"  // 外泊届の承認・却下
+	PermSettingsManage   = "settings.manage"    // 寮の運用に関する設定の変更
+	PermPresenceLog      = "presence.log"       // QRコードによる入退寮の記録
+	PermSafetyManage     = "safety.manage"      // 安否確認の開始・終了
+	PermMenuManage       = "menu.manage"        // 献立の登録
+)
+
+// rolePermissions は役割ごとに与えられる権限です
+var rolePermissions = map[string][]string{
+	RoleAdmin: {
+		PermRecordsReadAll,
+		PermRecordsWriteAll,
+		PermUsersManage,
+		PermRollCallRun,
+		PermMealsRead,
+		PermOvernightApprove,
+		PermSettingsManage,
+		PermPresenceLog,
+		PermSafetyManage,
+		PermMenuManage,
+	},
+	RoleUser:        {},
+	RoleFloorLeader: {PermRecordsReadFloor},
+	RoleKitchen:     {PermMealsRead, PermMenuManage},
+	RoleNightDuty:   {PermRollCallRun, PermPresenceLog},
+	RoleKiosk:       {PermPresenceLog},
+}
+
+// Roles は画面に表示する役割の一覧です
+var Roles = []struct {
+	Name  string
+	Label string
+}{
+	{RoleUser, "寮生"},
+	{RoleFloorLeader, "寮長・階長"},
+	{RoleKitchen, "厨房"},
+	{RoleNightDuty, "当直"},
+	{RoleKiosk, "受付端末"},
+	{RoleAdmin, "管理者"},
+}
+
+// residentRolesSQL は寮生の役割のユーザーを、有効・無効を問わずに絞り込むSQLの条件です
+const residentRolesSQL = "u.role IN ('user', 'floor_leader')"
+
+// residentRoleCondition は寮生 (食事・外泊の登録対象者) を絞り込むSQLの条件です
+const residentRoleCondition = "u.active AND " + residentRolesSQL
+
+// isValidRole は役割名が定義済みのものかを確認します
+func isValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// Can はユーザーが指定した権限を持つかを返します
+func (u *User) Can(perm string) bool {
+	if u == nil {
+		return false
+	}
+	for _, p := range rolePermissions[u.Role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// IsResident はユーザーが寮生 (外泊・欠食を登録する側) かを返します
+func (u *User) IsResident() bool {
+	return u != nil && (u.Role == RoleUser || u.Role == RoleFloorLeader)
+}
+
+// homePath はログイン後に表示するページを役割に応じて返します
+func homePath(role string) string {
+	switch role {
+	case RoleAdmin:
+		return "/admin"
+	case RoleKitchen:
+		return "/kitchen"
+	case RoleNightDuty:
+		return "/rollcall"
+	case RoleKiosk:
+		return "/checkin"
+	default:
+		return "/main"
+	}
+}
+
+// RequirePermission は指定した権限のいずれかを持つユーザーのみを通すミドルウェアを返します
+// AuthMiddleware の後に使用します
+func RequirePermission(perms ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			user := currentUser(c)
+			if user == nil {
+				return c.Redirect(http.StatusSeeOther, "/") // 未認証
+			}
+
+			for _, perm := range perms {
+				if user.Can(perm) {
+					return next(c)
+				}
+			}
+
+			// 権限がない場合は、その役割の最初のページへ戻す
+			if c.Request().Method == http.MethodGet {
+				return c.Redirect(http.StatusSeeOther, homePath(user.Role))
+			}
+			return c.String(http.StatusForbidden, "Permission denied.")
+		}
+	}
+}
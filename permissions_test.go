@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestRolePermissions(t *testing.T) {
+	allPerms := []string{PermRecordsReadAll, PermRecordsReadFloor, PermRecordsWriteAll, PermUsersManage, PermRollCallRun,
+		PermMealsRead, PermOvernightApprove, PermSettingsManage, PermPresenceLog, PermSafetyManage, PermMenuManage}
+	want := map[string][]string{
+		RoleAdmin:       {PermRecordsReadAll, PermRecordsWriteAll, PermUsersManage, PermRollCallRun, PermMealsRead, PermOvernightApprove, PermSettingsManage, PermPresenceLog, PermSafetyManage, PermMenuManage},
+		RoleUser:        {},
+		RoleFloorLeader: {PermRecordsReadFloor},
+		RoleKitchen:     {PermMealsRead, PermMenuManage},
+		RoleNightDuty:   {PermRollCallRun, PermPresenceLog},
+		RoleKiosk:       {PermPresenceLog},
+		"unknown":       {},
+	}
+	for role, perms := range want {
+		granted := make(map[string]bool)
+		for _, p := range perms {
+			granted[p] = true
+		}
+		u := &User{Role: role}
+		for _, p := range allPerms {
+			if got := u.Can(p); got != granted[p] {
+				t.Errorf("%s can %s = %v, want %v", role, p, got, granted[p])
+			}
+		}
+	}
+
+	var nobody *User
+	if nobody.Can(PermMealsRead) {
+		t.Error("nil user has a permission")
+	}
+	for _, r := range Roles {
+		if !isValidRole(r.Name) {
+			t.Errorf("listed role %q is not valid", r.Name)
+		}
+	}
+	if isValidRole("superuser") {
+		t.Error(`isValidRole("superuser") = true`)
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	handler := RequirePermission(PermRollCallRun, PermSafetyManage)(func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+	serve := func(user *User, method string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(method, "/rollcall", nil), rec)
+		if user != nil {
+			c.Set(contextUserKey, user)
+		}
+		if err := handler(c); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	tests := []struct {
+		name     string
+		user     *User
+		method   string
+		code     int
+		location string
+	}{
+		{"not logged in", nil, http.MethodGet, http.StatusSeeOther, "/"},
+		{"one of the permissions", &User{Role: RoleNightDuty}, http.MethodPost, http.StatusOK, ""},
+		{"all permissions", &User{Role: RoleAdmin}, http.MethodGet, http.StatusOK, ""},
+		{"GET without permission goes home", &User{Role: RoleKitchen}, http.MethodGet, http.StatusSeeOther, "/kitchen"},
+		{"resident GET goes home", &User{Role: RoleUser}, http.MethodGet, http.StatusSeeOther, "/main"},
+		{"POST without permission", &User{Role: RoleKiosk}, http.MethodPost, http.StatusForbidden, ""},
+		{"resident POST", &User{Role: RoleFloorLeader}, http.MethodPost, http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		rec := serve(tt.user, tt.method)
+		if rec.Code != tt.code || rec.Header().Get(echo.HeaderLocation) != tt.location {
+			t.Errorf("%s: %d to %q, want %d to %q", tt.name, rec.Code, rec.Header().Get(echo.HeaderLocation), tt.code, tt.location)
+		}
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// 出入りの向き
+const (
+	PresenceOut = "out" // 外出
+	PresenceIn  = "in"  // 帰寮
+)
+
+const (
+	// qrCodeSize はQRコード画像の一辺のピクセル数です
+	qrCodeSize = 256
+	// presenceRepeatInterval 以内に同じQRコードを読み取った場合は、読み取りの重複として記録しません
+	presenceRepeatInterval = 30 * time.Second
+	// nightEndHour は夜間の出入りを確認する区切りの時刻 (翌日の時) です
+	nightEndHour = 5
+)
+
+// createPresenceLogsTable は入退寮の記録テーブルを作成します
+func createPresenceLogsTable(db *sql.DB) error {
+	const createTableSQL = `
+	CREATE TABLE IF NOT EXISTS presence_logs (
+		id SERIAL PRIMARY KEY,
+		student_id VARCHAR(50) NOT NULL,
+		direction VARCHAR(3) NOT NULL,
+		logged_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		logged_by VARCHAR(50)
+	);
+	CREATE INDEX IF NOT EXISTS presence_logs_student_idx ON presence_logs (student_id, logged_at);
+	CREATE INDEX IF NOT EXISTS presence_logs_logged_at_idx ON presence_logs (logged_at);`
+
+	_, err := db.Exec(createTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to execute SQL: %w", err)
+	}
+
+	return nil
+}
+
+// presenceLabel は出入りの向きの表示名を返します
+func presenceLabel(direction string) string {
+	switch direction {
+	case PresenceOut:
+		return "外出"
+	case PresenceIn:
+		return "帰寮"
+	default:
+		return direction
+	}
+}
+
+// nightOf は日時が属する夜の日付を返します。正午より前はその前日の夜として扱います
+func nightOf(t time.Time) time.Time {
+	y, m, d := t.Date()
+	if t.Hour() < 12 {
+		d--
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+}
+
+// nightEnd は指定日の夜の出入りを確認する区切りの日時 (翌日の早朝) を返します
+func nightEnd(date time.Time) time.Time {
+	y, m, d := date.Date()
+	return time.Date(y, m, d+1, nightEndHour, 0, 0, 0, time.Local)
+}
+
+// getQRToken は寮生のQRコードの値を取得します。まだ発行されていない場合は発行します
+func getQRToken(db *sql.DB, studentID string) (string, error) {
+	var token string
+	err := db.QueryRow("SELECT COALESCE(qr_token, '') FROM users WHERE username = $1", studentID).Scan(&token)
+	if err != nil {
+		return "", fmt.Errorf("failed to get QR token: %w", err)
+	}
+	if token != "" {
+		return token, nil
+	}
+
+	newToken, err := newApprovalToken()
+	if err != nil {
+		return "", err
+	}
+	// 同時に発行された場合は先に保存された値を使う
+	if _, err := db.Exec("UPDATE users SET qr_token = $2 WHERE username = $1 AND qr_token IS NULL", studentID, newToken); err != nil {
+		return "", fmt.Errorf("failed to issue QR token: %w", err)
+	}
+	if err := db.QueryRow("SELECT qr_token FROM users WHERE username = $1", studentID).Scan(&token); err != nil {
+		return "", fmt.Errorf("failed to get QR token: %w", err)
+	}
+	return token, nil
+}
+
+// rotateQRToken は寮生のQRコードを再発行します。以前のQRコードは使えなくなります
+func rotateQRToken(db *sql.DB, studentID string) error {
+	token, err := newApprovalToken()
+	if err != nil {
+		return err
+	}
+	result, err := db.Exec("UPDATE users SET qr_token = $2 WHERE username = $1", studentID, token)
+	if err != nil {
+		return fmt.Errorf("failed to rotate QR token: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// getUserByQRToken はQRコードの値から有効な寮生を取得します
+func getUserByQRToken(db *sql.DB, token string) (*User, error) {
+	var u User
+	err := db.QueryRow(`SELECT u.username, `+userNameSQL+` FROM users u WHERE u.qr_token = $1 AND `+residentRoleCondition, token).
+		Scan(&u.Username, &u.DisplayName)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// getLastPresence は寮生の最後の出入りを取得します (記録がなければ nil)
+func getLastPresence(q queryRower, studentID string) (*PresenceLog, error) {
+	var p PresenceLog
+	var loggedBy sql.NullString
+	err := q.QueryRow(`SELECT id, student_id, direction, logged_at, logged_by FROM presence_logs
+	WHERE student_id = $1 ORDER BY logged_at DESC, id DESC LIMIT 1`, studentID).
+		Scan(&p.ID, &p.StudentID, &p.Direction, &p.LoggedAt, &loggedBy)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last presence: %w", err)
+	}
+	p.LoggedBy = loggedBy.String
+	return &p, nil
+}
+
+// getNightPlan は指定日の外泊・門限後の帰寮の届出を取得します (記録がなければ届出なし)
+func getNightPlan(db *sql.DB, studentID string, date time.Time) (GaihakuKesshokuRecord, error) {
+	r := GaihakuKesshokuRecord{StudentID: studentID, RecordDate: date}
+	var expectedArrival sql.NullTime
+	err := db.QueryRow(`SELECT overnight, late_return, expected_arrival FROM gaihaku_kesshoku_records
+	WHERE student_id = $1 AND record_date = $2`, studentID, date.Format("2006-01-02")).
+		Scan(&r.Overnight, &r.LateReturn, &expectedArrival)
+	if err != nil && err != sql.ErrNoRows {
+		return r, fmt.Errorf("failed to get night plan: %w", err)
+	}
+	if expectedArrival.Valid {
+		r.ExpectedArrival = &expectedArrival.Time
+	}
+	return r, nil
+}
+
+// presenceDiscrepancy は届出 (外泊・門限後の帰寮) と、時刻 at までの最後の出入り last の食い違いを返します (なければ空文字)
+// 門限 (門限後の帰寮を届け出た場合は帰寮予定時刻) を過ぎた時点で判定します
+// 寮監督者が却下した外泊は届出がないものとして扱い、承認待ちの外泊は届出があるものとして扱います
+func presenceDiscrepancy(plan *GaihakuKesshokuRecord, last *PresenceLog, at time.Time, curfew string) string {
+	if last == nil {
+		return ""
+	}
+	overnight := plan.Overnight && plan.StaffStatus != ApprovalRejected
+	deadline := curfewOn(plan.RecordDate, curfew)
+	if plan.LateReturn && plan.ExpectedArrival != nil {
+		deadline = *plan.ExpectedArrival
+	}
+	if !at.After(deadline) {
+		return ""
+	}
+
+	switch {
+	case overnight && last.Direction == PresenceIn:
+		return "外泊の届出がありますが在寮しています"
+	case !overnight && last.Direction == PresenceOut && plan.LateReturn:
+		return "帰寮予定時刻を過ぎても帰寮していません"
+	case !overnight && last.Direction == PresenceOut:
+		return "届出がないまま不在です"
+	}
+	return ""
+}
+
+// logPresence は寮生の出入りを記録し、記録した内容を返します
+// direction が空の場合は、最後の出入りと逆の向きで記録します。直前に記録したばかりの場合は記録せずに直前の記録を返します
+// 門限後に帰寮した場合は、その夜の帰寮時刻としても記録します (当直が記録済みの場合は変更しません)
+func logPresence(db *sql.DB, studentID, direction, loggedBy string, at time.Time, curfew string) (*PresenceLog, bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// 同じ寮生の読み取りが重なった場合に向きが食い違わないよう、ユーザーの行をロックする
+	if _, err := tx.Exec("SELECT 1 FROM users WHERE username = $1 FOR UPDATE", studentID); err != nil {
+		return nil, false, fmt.Errorf("failed to lock user: %w", err)
+	}
+	last, err := getLastPresence(tx, studentID)
+	if err != nil {
+		return nil, false, err
+	}
+	if last != nil && at.Sub(last.LoggedAt) < presenceRepeatInterval && (direction == "" || direction == last.Direction) {
+		return last, false, nil
+	}
+	if direction == "" {
+		direction = PresenceOut
+		if last != nil && last.Direction == PresenceOut {
+			direction = PresenceIn
+		}
+	}
+
+	p := PresenceLog{StudentID: studentID, Direction: direction, LoggedAt: at, LoggedBy: loggedBy}
+	err = tx.QueryRow(`INSERT INTO presence_logs (student_id, direction, logged_at, logged_by) VALUES ($1, $2, $3, $4) RETURNING id`,
+		studentID, direction, at, loggedBy).Scan(&p.ID)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to insert presence log: %w", err)
+	}
+
+	night := nightOf(at)
+	if direction == PresenceIn && at.After(curfewOn(night, curfew)) {
+		if err := recordArrival(tx, studentID, night, at, loggedBy); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, fmt.Errorf("failed to commit presence log: %w", err)
+	}
+	return &p, true, nil
+}
+
+// getPresenceStatuses は指定日の夜について、寮生ごとの届出と時刻 at までの最後の出入りを、棟・フロア・部屋の順に取得します
+func getPresenceStatuses(db *sql.DB, date, at time.Time, curfew string, filter LocationFilter) ([]PresenceStatus, error) {
+	args := []interface{}{date.Format("2006-01-02"), at}
+	query := `
+	SELECT u.username, ` + userNameSQL + `, ` + locationColumnsSQL + `,
+		COALESCE(r.overnight, FALSE), COALESCE(r.staff_status, ''), COALESCE(r.late_return, FALSE), r.expected_arrival,
+		p.id, p.direction, p.logged_at, COALESCE(p.logged_by, '')
+	FROM users u ` + locationJoinSQL("$1::date") + `
+	LEFT JOIN gaihaku_kesshoku_records r ON r.student_id = u.username AND r.record_date = $1::date
+	LEFT JOIN LATERAL (
+		SELECT pl.id, pl.direction, pl.logged_at, pl.logged_by FROM presence_logs pl
+		WHERE pl.student_id = u.username AND pl.logged_at <= $2
+		ORDER BY pl.logged_at DESC, pl.id DESC LIMIT 1
+	) p ON TRUE
+	WHERE ` + residentRoleCondition + filter.where(&args) + `
+	ORDER BY ` + locationOrderSQL + `, u.username ASC`
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query presence: %w", err)
+	}
+	defer rows.Close()
+
+	var statuses []PresenceStatus
+	for rows.Next() {
+		var s PresenceStatus
+		var expectedArrival, loggedAt sql.NullTime
+		var logID sql.NullInt64
+		var direction sql.NullString
+		var loggedBy string
+		dest := append([]interface{}{&s.StudentID, &s.Name}, locationScanDest(&s.Location)...)
+		dest = append(dest, &s.Overnight, &s.StaffStatus, &s.LateReturn, &expectedArrival, &logID, &direction, &loggedAt, &loggedBy)
+		if err := rows.Scan(dest...); err != nil {
+			log.Printf("Failed to scan presence status: %v", err)
+			continue
+		}
+		if expectedArrival.Valid {
+			s.ExpectedArrival = &expectedArrival.Time
+		}
+		if logID.Valid {
+			s.Last = &PresenceLog{ID: int(logID.Int64), StudentID: s.StudentID, Direction: direction.String, LoggedAt: loggedAt.Time, LoggedBy: loggedBy}
+		}
+		plan := GaihakuKesshokuRecord{RecordDate: date, Overnight: s.Overnight, StaffStatus: s.StaffStatus, LateReturn: s.LateReturn, ExpectedArrival: s.ExpectedArrival}
+		s.Discrepancy = presenceDiscrepancy(&plan, s.Last, at, curfew)
+		statuses = append(statuses, s)
+	}
+
+	return statuses, nil
+}
+
+// presenceStatusLocation は入退寮の状況をフロアごとにまとめるときの場所を返します
+func presenceStatusLocation(s PresenceStatus) RoomLocation {
+	return s.Location
+}
+
+// getPresenceLogs は期間内の出入りの記録を新しい順に取得します
+func getPresenceLogs(db *sql.DB, from, to time.Time) ([]PresenceLog, error) {
+	rows, err := db.Query(`
+	SELECT p.id, p.student_id, `+userNameSQL+`, p.direction, p.logged_at, COALESCE(p.logged_by, '')
+	FROM presence_logs p
+	JOIN users u ON u.username = p.student_id
+	WHERE p.logged_at >= $1 AND p.logged_at < $2
+	ORDER BY p.logged_at DESC, p.id DESC`, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query presence logs: %w", err)
+	}
+	defer rows.Close()
+
+	var logs []PresenceLog
+	for rows.Next() {
+		var p PresenceLog
+		if err := rows.Scan(&p.ID, &p.StudentID, &p.StudentName, &p.Direction, &p.LoggedAt, &p.LoggedBy); err != nil {
+			log.Printf("Failed to scan presence log: %v", err)
+			continue
+		}
+		logs = append(logs, p)
+	}
+
+	return logs, nil
+}
+
+// writeQRCode は寮生のQRコードをPNG画像で返します
+func writeQRCode(c echo.Context, studentID string) error {
+	token, err := getQRToken(db, studentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c.String(http.StatusNotFound, "User not found.")
+	}
+	if err != nil {
+		log.Printf("Failed to get QR token for %s: %v", studentID, err)
+		return c.String(http.StatusInternalServerError, "Failed to generate QR code.")
+	}
+
+	png, err := qrcode.Encode(token, qrcode.Medium, qrCodeSize)
+	if err != nil {
+		log.Printf("Failed to encode QR code for %s: %v", studentID, err)
+		return c.String(http.StatusInternalServerError, "Failed to generate QR code.")
+	}
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.Blob(http.StatusOK, "image/png", png)
+}
+
+// ownQRCodeHandler はログイン中の寮生のQRコードを返します
+func ownQRCodeHandler(c echo.Context) error {
+	if !currentUser(c).IsResident() {
+		return c.String(http.StatusForbidden, "Permission denied.")
+	}
+	return writeQRCode(c, currentUser(c).Username)
+}
+
+// rotateOwnQRCodeHandler はログイン中の寮生のQRコードを再発行します
+func rotateOwnQRCodeHandler(c echo.Context) error {
+	if !currentUser(c).IsResident() {
+		return c.String(http.StatusForbidden, "Permission denied.")
+	}
+	studentID := currentUser(c).Username
+	if err := rotateQRToken(db, studentID); err != nil {
+		log.Printf("Failed to rotate QR token for %s: %v", studentID, err)
+		return redirectWithFlash(c, "/settings", "QRコードを再発行できませんでした。", false, "settings_success", "settings_error")
+	}
+	log.Printf("QR token of %s rotated", studentID)
+	return redirectWithFlash(c, "/settings", "QRコードを再発行しました。以前のQRコードは使えません。", true, "settings_success", "settings_error")
+}
+
+// adminQRCodeHandler は指定した寮生のQRコードを返します (印刷・配布用)
+func adminQRCodeHandler(c echo.Context) error {
+	return writeQRCode(c, c.Param("student_id"))
+}
+
+// adminRotateQRCodeHandler は指定した寮生のQRコードを再発行します (紛失時など)
+func adminRotateQRCodeHandler(c echo.Context) error {
+	studentID := c.Param("student_id")
+	path := "/admin/user/" + studentID
+	if err := rotateQRToken(db, studentID); err != nil {
+		log.Printf("Failed to rotate QR token for %s: %v", studentID, err)
+		return redirectWithFlash(c, path, "QRコードを再発行できませんでした。", false, "update_success", "update_error")
+	}
+	log.Printf("QR token of %s rotated by %s", studentID, currentUser(c).Username)
+	return redirectWithFlash(c, path, "QRコードを再発行しました。以前のQRコードは使えません。", true, "update_success", "update_error")
+}
+
+// checkinPageHandler は玄関の受付端末向けに、QRコードを読み取って入退寮を記録するページを表示します
+func checkinPageHandler(c echo.Context) error {
+	return c.Render(http.StatusOK, "checkin.html", map[string]interface{}{})
+}
+
+type checkinRequest struct {
+	Token     string `json:"token"`
+	Direction string `json:"direction"` // 空の場合は最後の出入りと逆の向き
+}
+
+type checkinResponse struct {
+	StudentID string `json:"student_id"`
+	Name      string `json:"name"`
+	Direction string `json:"direction"`
+	Label     string `json:"label"`
+	LoggedAt  string `json:"logged_at"`
+	Duplicate bool   `json:"duplicate"`
+	Warning   string `json:"warning,omitempty"`
+}
+
+// checkinHandler は読み取ったQRコードから寮生の出入りを記録し、届出との食い違いがあれば警告を返します
+func checkinHandler(c echo.Context) error {
+	var req checkinRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "読み取った内容を処理できませんでした。"})
+	}
+	req.Token = strings.TrimSpace(req.Token)
+	if req.Direction != "" && req.Direction != PresenceOut && req.Direction != PresenceIn {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "出入りの向きが正しくありません。"})
+	}
+
+	student, err := getUserByQRToken(db, req.Token)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "登録されていないQRコードです。"})
+	}
+	if err != nil {
+		log.Printf("Failed to look up QR token: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "記録できませんでした。"})
+	}
+
+	now := time.Now()
+	curfew := getCurfew(db)
+	p, logged, err := logPresence(db, student.Username, req.Direction, currentUser(c).Username, now, curfew)
+	if err != nil {
+		log.Printf("Failed to log presence of %s: %v", student.Username, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "記録できませんでした。"})
+	}
+	if logged {
+		log.Printf("Presence of %s logged as %s by %s", student.Username, p.Direction, currentUser(c).Username)
+	}
+
+	res := checkinResponse{
+		StudentID: student.Username,
+		Name:      student.Name(),
+		Direction: p.Direction,
+		Label:     presenceLabel(p.Direction),
+		LoggedAt:  p.LoggedAt.Local().Format("15:04"),
+		Duplicate: !logged,
+	}
+	plan, err := getNightPlan(db, student.Username, nightOf(now))
+	if err != nil {
+		log.Printf("Failed to get night plan of %s: %v", student.Username, err)
+		return c.JSON(http.StatusOK, res)
+	}
+	res.Warning = presenceDiscrepancy(&plan, p, now, curfew)
+	if res.Warning == "" && p.Direction == PresenceIn && isCurfewViolation(plan.LateReturn, plan.ExpectedArrival, &now, curfewOn(plan.RecordDate, curfew)) {
+		res.Warning = "門限を過ぎての帰寮です"
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// adminPresenceHandler は指定日の夜の入退寮の記録と、届出との食い違いを表示します
+// 確認時刻は現在時刻 (過去の日付は翌日の早朝) です
+func adminPresenceHandler(c echo.Context) error {
+	now := time.Now()
+	date := nightOf(now)
+	if d, err := time.ParseInLocation("2006-01-02", c.QueryParam("date"), time.Local); err == nil {
+		date = d
+	}
+	at := nightEnd(date)
+	if now.Before(at) {
+		at = now
+	}
+	filter := parseLocationFilter(c)
+
+	statuses, err := getPresenceStatuses(db, date, at, getCurfew(db), filter)
+	if err != nil {
+		log.Printf("Failed to get presence statuses: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to retrieve presence.")
+	}
+	discrepancies := 0
+	for _, s := range statuses {
+		if s.Discrepancy != "" {
+			discrepancies++
+		}
+	}
+
+	logs, err := getPresenceLogs(db, date, nightEnd(date))
+	if err != nil {
+		log.Printf("Failed to get presence logs: %v", err)
+	}
+
+	floors, err := getFloors(db)
+	if err != nil {
+		log.Printf("Failed to get floors: %v", err)
+	}
+
+	return c.Render(http.StatusOK, "admin_presence.html", map[string]interface{}{
+		"date":          date,
+		"at":            at,
+		"groups":        groupByFloor(statuses, presenceStatusLocation),
+		"discrepancies": discrepancies,
+		"logs":          logs,
+		"floors":        floors,
+		"filter":        filter,
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPresenceDiscrepancy(t *testing.T) {
+	night := time.Date(2024, 4, 10, 0, 0, 0, 0, time.Local)
+	at := func(hour, min int) time.Time { return time.Date(2024, 4, 10, hour, min, 0, 0, time.Local) }
+	arrival := at(23, 30)
+	out := &PresenceLog{Direction: PresenceOut, LoggedAt: at(18, 0)}
+	in := &PresenceLog{Direction: PresenceIn, LoggedAt: at(18, 0)}
+
+	tests := []struct {
+		name string
+		plan GaihakuKesshokuRecord
+		last *PresenceLog
+		at   time.Time
+		want string
+	}{
+		{"no log", GaihakuKesshokuRecord{}, nil, at(23, 0), ""},
+		{"absent before curfew", GaihakuKesshokuRecord{}, out, at(21, 59), ""},
+		{"absent after curfew", GaihakuKesshokuRecord{}, out, at(22, 1), "届出がないまま不在です"},
+		{"in after curfew", GaihakuKesshokuRecord{}, in, at(22, 1), ""},
+		{"overnight away", GaihakuKesshokuRecord{Overnight: true}, out, at(23, 0), ""},
+		{"overnight but in", GaihakuKesshokuRecord{Overnight: true}, in, at(23, 0), "外泊の届出がありますが在寮しています"},
+		{"pending overnight away", GaihakuKesshokuRecord{Overnight: true, StaffStatus: ApprovalPending}, out, at(23, 0), ""},
+		{"pending overnight but in", GaihakuKesshokuRecord{Overnight: true, StaffStatus: ApprovalPending}, in, at(23, 0), "外泊の届出がありますが在寮しています"},
+		{"rejected overnight away", GaihakuKesshokuRecord{Overnight: true, StaffStatus: ApprovalRejected}, out, at(23, 0), "届出がないまま不在です"},
+		{"rejected overnight in", GaihakuKesshokuRecord{Overnight: true, StaffStatus: ApprovalRejected}, in, at(23, 0), ""},
+		{"late return before expected arrival", GaihakuKesshokuRecord{LateReturn: true, ExpectedArrival: &arrival}, out, at(23, 0), ""},
+		{"late return after expected arrival", GaihakuKesshokuRecord{LateReturn: true, ExpectedArrival: &arrival}, out, at(23, 31), "帰寮予定時刻を過ぎても帰寮していません"},
+		{"after midnight", GaihakuKesshokuRecord{}, out, time.Date(2024, 4, 11, 1, 0, 0, 0, time.Local), "届出がないまま不在です"},
+	}
+	for _, tt := range tests {
+		tt.plan.RecordDate = night
+		if got := presenceDiscrepancy(&tt.plan, tt.last, tt.at, "22:00"); got != tt.want {
+			t.Errorf("%s: discrepancy = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLogPresence(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, `INSERT INTO users (username, password, role, active) VALUES ('s1', 'x', 'user', TRUE)`)
+	at := func(day, hour, min int) time.Time { return time.Date(2024, 4, day, hour, min, 0, 0, time.Local) }
+	arrivalOf := func(night string) *time.Time {
+		t.Helper()
+		var a *time.Time
+		db.QueryRow(`SELECT actual_arrival FROM roll_calls WHERE student_id = 's1' AND roll_date = $1`, night).Scan(&a)
+		return a
+	}
+
+	// 向きを指定しない読み取りは、最後の出入りと逆の向きで記録する
+	p, logged, err := logPresence(db, "s1", "", "kiosk", at(10, 18, 0), "22:00")
+	if err != nil || !logged || p.Direction != PresenceOut {
+		t.Fatalf("first scan: %+v logged=%v err=%v, want out", p, logged, err)
+	}
+	// 直前の読み取りの重複は記録しない
+	if p, logged, _ = logPresence(db, "s1", "", "kiosk", at(10, 18, 0).Add(10*time.Second), "22:00"); logged || p.Direction != PresenceOut {
+		t.Errorf("repeated scan: %+v logged=%v, want the previous out", p, logged)
+	}
+	// 門限前の帰寮は帰寮時刻として記録しない
+	if p, _, _ = logPresence(db, "s1", "", "kiosk", at(10, 21, 0), "22:00"); p.Direction != PresenceIn {
+		t.Errorf("second scan direction = %s, want in", p.Direction)
+	}
+	if a := arrivalOf("2024-04-10"); a != nil {
+		t.Errorf("arrival before curfew recorded as %v", a)
+	}
+
+	// 日付が変わった後の帰寮は、前日の夜の帰寮時刻として記録する
+	logPresence(db, "s1", PresenceOut, "kiosk", at(10, 21, 30), "22:00")
+	logPresence(db, "s1", PresenceIn, "kiosk", at(11, 0, 40), "22:00")
+	if a := arrivalOf("2024-04-10"); a == nil || !a.Equal(at(11, 0, 40)) {
+		t.Errorf("arrival after midnight = %v, want %v", a, at(11, 0, 40))
+	}
+	// 記録済みの帰寮時刻は変更しない
+	logPresence(db, "s1", PresenceOut, "kiosk", at(11, 1, 0), "22:00")
+	logPresence(db, "s1", PresenceIn, "kiosk", at(11, 2, 0), "22:00")
+	if a := arrivalOf("2024-04-10"); a == nil || !a.Equal(at(11, 0, 40)) {
+		t.Errorf("arrival after a second return = %v, want %v", a, at(11, 0, 40))
+	}
+}
+
+func TestPresenceStatusesWithPendingAndRejectedOvernights(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, `INSERT INTO users (username, password, role, active) VALUES
+		('pending', 'x', 'user', TRUE), ('rejected', 'x', 'user', TRUE), ('approved', 'x', 'user', TRUE)`)
+	mustExec(t, db, `INSERT INTO gaihaku_kesshoku_records (student_id, record_date, overnight, staff_status) VALUES
+		('pending', '2024-04-10', TRUE, 'pending'),
+		('rejected', '2024-04-10', TRUE, 'rejected'),
+		('approved', '2024-04-10', TRUE, 'approved')`)
+	for _, id := range []string{"pending", "rejected", "approved"} {
+		mustExec(t, db, `INSERT INTO presence_logs (student_id, direction, logged_at) VALUES ($1, 'out', $2)`, id, time.Date(2024, 4, 10, 17, 0, 0, 0, time.Local))
+	}
+
+	night := time.Date(2024, 4, 10, 0, 0, 0, 0, time.Local)
+	statuses, err := getPresenceStatuses(db, night, time.Date(2024, 4, 10, 23, 0, 0, 0, time.Local), "22:00", LocationFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"pending": "", "rejected": "届出がないまま不在です", "approved": ""}
+	if len(statuses) != len(want) {
+		t.Fatalf("got %d statuses, want %d", len(statuses), len(want))
+	}
+	for _, s := range statuses {
+		if s.Discrepancy != want[s.StudentID] {
+			t.Errorf("%s: discrepancy = %q, want %q", s.StudentID, s.Discrepancy, want[s.StudentID])
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// profileColumnsSQL は users u のプロフィールの列です (profileScanDest で読み込みます)
+const profileColumnsSQL = `u.display_name, u.furigana, u.grade, u.department, u.phone, u.email, u.birth_date`
+
+// userNameSQL は users u の表示名です。氏名が未登録の場合は学籍番号を使います
+const userNameSQL = `COALESCE(NULLIF(u.display_name, ''), u.username)`
+
+// profileScanDest は profileColumnsSQL の列を読み込む Scan の引数を返します
+func profileScanDest(u *User) []interface{} {
+	return []interface{}{&u.DisplayName, &u.Furigana, &u.Grade, &u.Department, &u.Phone, &u.Email, &u.BirthDate}
+}
+
+// maxGrade は学年として入力できる最大値です
+const maxGrade = 6
+
+var phonePattern = regexp.MustCompile(`^\+?[0-9][0-9-]{8,18}$`)
+
+// validateContactInfo は電話番号とメールアドレスの形式を確認し、エラーメッセージを返します (問題がなければ空文字)
+// 空の項目は確認しません
+func validateContactInfo(phone, email string) string {
+	if phone != "" && !phonePattern.MatchString(phone) {
+		return "電話番号の形式が正しくありません。"
+	}
+	if email != "" {
+		addr, err := mail.ParseAddress(email)
+		if err != nil || addr.Address != email || utf8.RuneCountInString(email) > 255 {
+			return "メールアドレスの形式が正しくありません。"
+		}
+	}
+	return ""
+}
+
+// validateProfile はプロフィール全体を確認し、エラーメッセージを返します (問題がなければ空文字)
+func validateProfile(u *User) string {
+	if utf8.RuneCountInString(u.DisplayName) > 100 || utf8.RuneCountInString(u.Furigana) > 100 {
+		return "氏名・ふりがなは100文字以内で入力してください。"
+	}
+	if utf8.RuneCountInString(u.Department) > 100 {
+		return "学科は100文字以内で入力してください。"
+	}
+	if u.Grade < 0 || u.Grade > maxGrade {
+		return fmt.Sprintf("学年は1〜%dで入力してください。", maxGrade)
+	}
+	if u.BirthDate != nil && u.BirthDate.After(time.Now()) {
+		return "生年月日が正しくありません。"
+	}
+	return validateContactInfo(u.Phone, u.Email)
+}
+
+// readProfileForm はフォームからプロフィールを読み込みます
+// contactOnly が true の場合は、寮生本人が変更できる連絡先のみを読み込みます
+func readProfileForm(c echo.Context, u *User, contactOnly bool) {
+	u.Phone = strings.TrimSpace(c.FormValue("phone"))
+	u.Email = strings.TrimSpace(c.FormValue("email"))
+	if contactOnly {
+		return
+	}
+	u.DisplayName = strings.TrimSpace(c.FormValue("display_name"))
+	u.Furigana = strings.TrimSpace(c.FormValue("furigana"))
+	u.Department = strings.TrimSpace(c.FormValue("department"))
+	u.Grade, _ = strconv.Atoi(c.FormValue("grade"))
+	u.BirthDate = nil
+	if t, err := time.ParseInLocation("2006-01-02", c.FormValue("birth_date"), time.Local); err == nil {
+		u.BirthDate = &t
+	}
+}
+
+// updateUserProfile はユーザーのプロフィールを更新します
+func updateUserProfile(db *sql.DB, u *User) error {
+	var birthDate sql.NullTime
+	if u.BirthDate != nil {
+		birthDate = sql.NullTime{Time: *u.BirthDate, Valid: true}
+	}
+	_, err := db.Exec(`UPDATE users SET display_name = $1, furigana = $2, grade = $3, department = $4, phone = $5, email = $6, birth_date = $7
+	WHERE username = $8`, u.DisplayName, u.Furigana, u.Grade, u.Department, u.Phone, u.Email, birthDate, u.Username)
+	if err != nil {
+		return fmt.Errorf("failed to update profile: %w", err)
+	}
+	return nil
+}
+
+// updateOwnProfileHandler はログイン中のユーザーが自分の連絡先を変更します
+// 氏名・学年・学科は管理者のみが変更できます
+func updateOwnProfileHandler(c echo.Context) error {
+	user := *currentUser(c)
+	readProfileForm(c, &user, true)
+
+	if message := validateContactInfo(user.Phone, user.Email); message != "" {
+		return redirectWithFlash(c, "/settings", message, false, "settings_success", "settings_error")
+	}
+	if err := updateUserProfile(db, &user); err != nil {
+		log.Printf("Failed to update profile of %s: %v", user.Username, err)
+		return redirectWithFlash(c, "/settings", "連絡先の変更に失敗しました。", false, "settings_success", "settings_error")
+	}
+	return redirectWithFlash(c, "/settings", "連絡先を変更しました。", true, "settings_success", "settings_error")
+}
+
+// adminUpdateUserProfileHandler は管理者がユーザーのプロフィールを変更します
+func adminUpdateUserProfileHandler(c echo.Context) error {
+	studentID := c.Param("student_id")
+	user, err := getUserByUsername(db, studentID)
+	if err != nil {
+		log.Printf("Failed to get user %s: %v", studentID, err)
+		return c.String(http.StatusNotFound, "User not found.")
+	}
+	readProfileForm(c, user, false)
+
+	if message := validateProfile(user); message != "" {
+		return redirectWithFlash(c, "/admin/user/"+studentID, message, false, "update_success", "update_error")
+	}
+	if err := updateUserProfile(db, user); err != nil {
+		log.Printf("Failed to update profile of %s: %v", studentID, err)
+		return c.String(http.StatusInternalServerError, "Failed to update profile.")
+	}
+	log.Printf("Profile of %s updated by %s", studentID, currentUser(c).Username)
+	return redirectWithFlash(c, "/admin/user/"+studentID, "プロフィールを更新しました。", true, "update_success", "update_error")
+}
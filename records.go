@@ -0,0 +1,208 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// execer は *sql.DB と *sql.Tx に共通する Exec です
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// queryRower は *sql.DB と *sql.Tx に共通する QueryRow です
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// expectedReturnLayout は帰寮予定日時の入力欄 (datetime-local) の形式です
+const expectedReturnLayout = "2006-01-02T15:04"
+
+// readRecordForm はフォームから指定日の外泊・欠食記録を読み込みます
+// mealOn は食事ボタンの値 "on" が喫食 (true) と欠食 (false) のどちらを表すかです
+func readRecordForm(form url.Values, studentID string, date time.Time, mealOn bool) GaihakuKesshokuRecord {
+	dateStr := date.Format("2006-01-02")
+	r := GaihakuKesshokuRecord{
+		StudentID:   studentID,
+		RecordDate:  date,
+		Breakfast:   (form.Get("breakfast-"+dateStr) == "on") == mealOn,
+		Lunch:       (form.Get("lunch-"+dateStr) == "on") == mealOn,
+		Dinner:      (form.Get("dinner-"+dateStr) == "on") == mealOn,
+		Overnight:   form.Get("overnight-"+dateStr) == "on",
+		Note:        form.Get("note-" + dateStr),
+		Destination: strings.TrimSpace(form.Get("destination-" + dateStr)),
+		StayPhone:   strings.TrimSpace(form.Get("stay_phone-" + dateStr)),
+	}
+	if t, err := time.ParseInLocation(expectedReturnLayout, form.Get("expected_return-"+dateStr), time.Local); err == nil {
+		r.ExpectedReturn = &t
+	}
+	if !r.Overnight {
+		// 外泊しない日は外泊先の情報を保存しない
+		r.Destination, r.StayPhone, r.ExpectedReturn = "", "", nil
+	}
+	// 門限後の帰寮予定時刻が入力されている日は門限後の帰寮として届け出る
+	if t, err := clockOn(date, form.Get("expected_arrival-"+dateStr)); err == nil {
+		r.LateReturn, r.ExpectedArrival = true, &t
+	}
+	return r
+}
+
+// validateRecord は外泊・欠食記録を確認し、エラーメッセージを返します (問題がなければ空文字)
+// 外泊する日は、外泊先・滞在中の連絡先・帰寮予定日時が必須です
+// 門限後に帰寮する日は、帰寮予定時刻が門限 (curfew) より後である必要があります
+func validateRecord(r *GaihakuKesshokuRecord, curfew string) string {
+	day := r.RecordDate.Format("01/02")
+	if r.LateReturn {
+		if r.Overnight {
+			return day + " は外泊と門限後の帰寮を同時に登録できません。"
+		}
+		if !r.ExpectedArrival.After(curfewOn(r.RecordDate, curfew)) {
+			return day + " の門限後の帰寮予定時刻は門限 (" + curfew + ") より後にしてください。"
+		}
+		return ""
+	}
+	if !r.Overnight {
+		return ""
+	}
+	switch {
+	case r.Destination == "":
+		return day + " の外泊先を入力してください。"
+	case utf8.RuneCountInString(r.Destination) > 200:
+		return day + " の外泊先は200文字以内で入力してください。"
+	case !phonePattern.MatchString(r.StayPhone):
+		return day + " の滞在中の連絡先 (電話番号) を正しく入力してください。"
+	case r.ExpectedReturn == nil:
+		return day + " の帰寮予定日時を入力してください。"
+	}
+	y, m, d := r.RecordDate.Date()
+	if !r.ExpectedReturn.After(time.Date(y, m, d+1, 0, 0, 0, 0, time.Local)) {
+		return day + " の帰寮予定日時は外泊日の翌日以降にしてください。"
+	}
+	return ""
+}
+
+// upsertRecord は外泊・欠食記録を保存します。点呼の結果・帰寮時刻と承認状況は変更しません (外泊を取り消した場合は承認状況を消去します)
+// 記録の保存はこの関数に集約します
+func upsertRecord(ex execer, r *GaihakuKesshokuRecord) error {
+	var expectedReturn, expectedArrival sql.NullTime
+	if r.ExpectedReturn != nil {
+		expectedReturn = sql.NullTime{Time: *r.ExpectedReturn, Valid: true}
+	}
+	if r.ExpectedArrival != nil {
+		expectedArrival = sql.NullTime{Time: *r.ExpectedArrival, Valid: true}
+	}
+	_, err := ex.Exec(`INSERT INTO gaihaku_kesshoku_records (student_id, record_date, breakfast, lunch, dinner, overnight, note, destination, stay_phone, expected_return, late_return, expected_arrival)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	ON CONFLICT (student_id, record_date) DO UPDATE SET breakfast = EXCLUDED.breakfast, lunch = EXCLUDED.lunch, dinner = EXCLUDED.dinner,
+		overnight = EXCLUDED.overnight, note = EXCLUDED.note, destination = EXCLUDED.destination,
+		stay_phone = EXCLUDED.stay_phone, expected_return = EXCLUDED.expected_return,
+		late_return = EXCLUDED.late_return, expected_arrival = EXCLUDED.expected_arrival,
+		guardian_status = CASE WHEN EXCLUDED.overnight THEN gaihaku_kesshoku_records.guardian_status ELSE '' END,
+		guardian_decided_at = CASE WHEN EXCLUDED.overnight THEN gaihaku_kesshoku_records.guardian_decided_at END,
+		staff_status = CASE WHEN EXCLUDED.overnight THEN gaihaku_kesshoku_records.staff_status ELSE '' END,
+		staff_comment = CASE WHEN EXCLUDED.overnight THEN gaihaku_kesshoku_records.staff_comment ELSE '' END;`,
+		r.StudentID, r.RecordDate.Format("2006-01-02"), r.Breakfast, r.Lunch, r.Dinner, r.Overnight, r.Note,
+		r.Destination, r.StayPhone, expectedReturn, r.LateReturn, expectedArrival)
+	if err != nil {
+		return fmt.Errorf("failed to upsert record for %s: %w", r.RecordDate.Format("2006-01-02"), err)
+	}
+	return nil
+}
+
+// saveRecords は複数日分の記録を1つのトランザクションで保存し、変更を履歴に残して厨房の画面に通知します
+// action は変更の種類 (HistorySelf など)、changedBy は変更したユーザーです
+// staffApproval が true の場合は、新しい外泊や内容が変わった外泊を同じトランザクションで寮監督者の承認待ちにします
+// (承認待ちの外泊は食数の集計で外泊として数えないため、承認待ちにする前の状態をコミットしないようにします)
+// guardianConsent が nil でない場合は、その寮生の保護者の承認が必要な外泊を同じトランザクションで保護者の承認待ちにし、
+// 承認待ちにした外泊を返します (承認依頼のメールはコミットした後に sendGuardianApprovals で送ります)
+func saveRecords(db *sql.DB, records []GaihakuKesshokuRecord, action, changedBy string, staffApproval bool, guardianConsent *User) ([]GaihakuKesshokuRecord, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var guardianPending []GaihakuKesshokuRecord
+	for i := range records {
+		r := &records[i]
+		staffPending, guardianPendingDay := false, false
+		if r.Overnight && (staffApproval || guardianConsent != nil) {
+			prev, err := getPreviousOvernight(tx, r)
+			if err != nil {
+				return nil, err
+			}
+			if staffApproval {
+				staffPending = needsStaffApproval(prev, r)
+			}
+			if guardianConsent != nil && guardianConsent.NeedsGuardianConsent(r.RecordDate) {
+				guardianPendingDay = needsGuardianApproval(prev, r)
+			}
+		}
+		changed, err := logRecordChange(tx, r, action, changedBy)
+		if err != nil {
+			return nil, err
+		}
+		if err := upsertRecord(tx, r); err != nil {
+			return nil, err
+		}
+		if staffPending {
+			if err := markStaffPending(tx, r.StudentID, r.RecordDate); err != nil {
+				return nil, err
+			}
+		}
+		if guardianPendingDay {
+			if err := setGuardianStatus(tx, r.StudentID, r.RecordDate, ApprovalPending); err != nil {
+				return nil, err
+			}
+			guardianPending = append(guardianPending, *r)
+		}
+		if changed || staffPending {
+			if err := notifyRecordChange(tx, r, action); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return guardianPending, nil
+}
+
+// recordRules は記録の入力を確認するときの寮の決まり (門限・特別な日) です
+type recordRules struct {
+	Curfew   string
+	Calendar map[string]DormDay
+}
+
+// loadRecordRules は from から days 日分の記録の確認に使う決まりを取得します
+func loadRecordRules(db *sql.DB, from time.Time, days int) recordRules {
+	calendar, err := getDormCalendar(db, from, from.AddDate(0, 0, days-1))
+	if err != nil {
+		log.Printf("Failed to get dorm calendar: %v", err)
+	}
+	return recordRules{Curfew: getCurfew(db), Calendar: calendar}
+}
+
+// readWeekRecordForm は今日から7日分の記録をフォームから読み込み、最初に見つかった入力エラーを返します
+// 特別な日に提供されない食事などは、入力にかかわらず登録しません
+func readWeekRecordForm(form url.Values, studentID string, mealOn bool, rules recordRules) ([]GaihakuKesshokuRecord, string) {
+	now := time.Now()
+	records := make([]GaihakuKesshokuRecord, 0, 7)
+	errorMessage := ""
+	for i := 0; i < 7; i++ {
+		date := now.AddDate(0, 0, i)
+		r := readRecordForm(form, studentID, date, mealOn)
+		rules.Calendar[date.Format("2006-01-02")].apply(&r)
+		if errorMessage == "" {
+			errorMessage = validateRecord(&r, rules.Curfew)
+		}
+		records = append(records, r)
+	}
+	return records, errorMessage
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// overnightRecord は 2024/01/10 の入力が揃った外泊の記録を返します
+func overnightRecord() *GaihakuKesshokuRecord {
+	ret := time.Date(2024, 1, 11, 18, 0, 0, 0, time.Local)
+	return &GaihakuKesshokuRecord{
+		RecordDate:     time.Date(2024, 1, 10, 0, 0, 0, 0, time.Local),
+		Overnight:      true,
+		Destination:    "実家",
+		StayPhone:      "090-1234-5678",
+		ExpectedReturn: &ret,
+	}
+}
+
+// assertRecordError は validateRecord のエラーメッセージに want が含まれることを確認します (want が空ならエラーなし)
+func assertRecordError(t *testing.T, r *GaihakuKesshokuRecord, want string) {
+	t.Helper()
+	got := validateRecord(r, "22:00")
+	if want == "" {
+		if got != "" {
+			t.Errorf("validateRecord() = %q, want no error", got)
+		}
+		return
+	}
+	if !strings.Contains(got, want) {
+		t.Errorf("validateRecord() = %q, want message containing %q", got, want)
+	}
+}
+
+func TestValidateRecordOvernightDetails(t *testing.T) {
+	assertRecordError(t, overnightRecord(), "")
+
+	// 外泊しない日は外泊の項目を求めない
+	assertRecordError(t, &GaihakuKesshokuRecord{RecordDate: overnightRecord().RecordDate, Breakfast: true}, "")
+
+	r := overnightRecord()
+	r.Destination = ""
+	assertRecordError(t, r, "01/10 の外泊先を入力")
+
+	r = overnightRecord()
+	r.Destination = strings.Repeat("寮", 200)
+	assertRecordError(t, r, "")
+	r.Destination += "寮"
+	assertRecordError(t, r, "200文字以内")
+
+	for _, phone := range []string{"", "abc", "0901", "090-1234-5678-9999-0000"} {
+		r = overnightRecord()
+		r.StayPhone = phone
+		assertRecordError(t, r, "滞在中の連絡先")
+	}
+	r = overnightRecord()
+	r.StayPhone = "+819012345678"
+	assertRecordError(t, r, "")
+
+	r = overnightRecord()
+	r.ExpectedReturn = nil
+	assertRecordError(t, r, "帰寮予定日時を入力")
+}
+
+func TestValidateRecordOvernightReturnsNextDayOrLater(t *testing.T) {
+	at := func(day, hour int) *time.Time {
+		t := time.Date(2024, 1, day, hour, 0, 0, 0, time.Local)
+		return &t
+	}
+
+	r := overnightRecord()
+	r.ExpectedReturn = at(10, 23)
+	assertRecordError(t, r, "翌日以降")
+
+	r.ExpectedReturn = at(11, 0)
+	assertRecordError(t, r, "翌日以降")
+
+	r.ExpectedReturn = at(11, 1)
+	assertRecordError(t, r, "")
+
+	r.ExpectedReturn = at(14, 12)
+	assertRecordError(t, r, "")
+}
+
+func TestValidateRecordLateReturn(t *testing.T) {
+	date := time.Date(2024, 1, 10, 0, 0, 0, 0, time.Local)
+	lateReturn := func(clock string) *GaihakuKesshokuRecord {
+		at, err := clockOn(date, clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &GaihakuKesshokuRecord{RecordDate: date, LateReturn: true, ExpectedArrival: &at}
+	}
+
+	assertRecordError(t, lateReturn("23:00"), "")
+	assertRecordError(t, lateReturn("00:30"), "")
+	assertRecordError(t, lateReturn("22:00"), "門限 (22:00) より後")
+	assertRecordError(t, lateReturn("21:00"), "門限 (22:00) より後")
+
+	r := overnightRecord()
+	r.LateReturn, r.ExpectedArrival = true, lateReturn("23:00").ExpectedArrival
+	assertRecordError(t, r, "同時に登録できません")
+}
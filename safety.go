@@ -0,0 +1,619 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 安否確認の回答
+const (
+	SafetySafe = "safe" // 無事
+	SafetyHelp = "help" // 救助が必要
+	SafetyAway = "away" // 寮外にいる
+)
+
+// createSafetyTables は安否確認とその回答のテーブルを作成します
+func createSafetyTables(db *sql.DB) error {
+	const createTableSQL = `
+	CREATE TABLE IF NOT EXISTS safety_events (
+		id SERIAL PRIMARY KEY,
+		message TEXT NOT NULL,
+		record_date DATE NOT NULL,
+		started_by VARCHAR(50) NOT NULL,
+		started_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		ended_at TIMESTAMP WITH TIME ZONE
+	);
+	CREATE TABLE IF NOT EXISTS safety_responses (
+		event_id INTEGER NOT NULL REFERENCES safety_events(id) ON DELETE CASCADE,
+		student_id VARCHAR(50) NOT NULL,
+		status VARCHAR(10) NOT NULL,
+		comment TEXT NOT NULL DEFAULT '',
+		responded_by VARCHAR(50) NOT NULL,
+		responded_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (event_id, student_id)
+	);`
+
+	_, err := db.Exec(createTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to execute SQL: %w", err)
+	}
+
+	return nil
+}
+
+// safetyStatusLabel は安否確認の回答の表示名を返します
+func safetyStatusLabel(status string) string {
+	switch status {
+	case SafetySafe:
+		return "無事"
+	case SafetyHelp:
+		return "救助が必要"
+	case SafetyAway:
+		return "寮外にいる"
+	case "":
+		return "未回答"
+	default:
+		return status
+	}
+}
+
+// isValidSafetyStatus は回答が定義済みのものかを確認します
+func isValidSafetyStatus(status string) bool {
+	return status == SafetySafe || status == SafetyHelp || status == SafetyAway
+}
+
+// safetySignature は安否確認の回答リンクの署名を返します。ログインせずに回答できるよう、寮生ごとに署名します
+func safetySignature(eventID int, studentID string) string {
+	mac := hmac.New(sha256.New, approvalKey)
+	fmt.Fprintf(mac, "safety:%d:%s", eventID, studentID)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// safetyResponseLink は寮生ごとの回答リンクを返します
+func safetyResponseLink(eventID int, studentID string) string {
+	q := url.Values{}
+	q.Set("e", strconv.Itoa(eventID))
+	q.Set("u", studentID)
+	q.Set("sig", safetySignature(eventID, studentID))
+	return appBaseURL() + "/safety/respond?" + q.Encode()
+}
+
+// scanSafetyEvent は安否確認を1件読み込みます
+func scanSafetyEvent(row interface{ Scan(...interface{}) error }) (*SafetyEvent, error) {
+	var e SafetyEvent
+	var endedAt sql.NullTime
+	if err := row.Scan(&e.ID, &e.Message, &e.RecordDate, &e.StartedBy, &e.StartedAt, &endedAt); err != nil {
+		return nil, err
+	}
+	if endedAt.Valid {
+		e.EndedAt = &endedAt.Time
+	}
+	return &e, nil
+}
+
+const safetyEventColumnsSQL = "id, message, record_date, started_by, started_at, ended_at"
+
+// getSafetyEvent は安否確認を取得します
+func getSafetyEvent(db *sql.DB, id int) (*SafetyEvent, error) {
+	return scanSafetyEvent(db.QueryRow("SELECT "+safetyEventColumnsSQL+" FROM safety_events WHERE id = $1", id))
+}
+
+// getActiveSafetyEvent は実施中の安否確認を取得します (なければ nil)
+func getActiveSafetyEvent(db *sql.DB) (*SafetyEvent, error) {
+	e, err := scanSafetyEvent(db.QueryRow("SELECT " + safetyEventColumnsSQL + " FROM safety_events WHERE ended_at IS NULL ORDER BY started_at DESC LIMIT 1"))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get active safety event: %w", err)
+	}
+	return e, nil
+}
+
+// getSafetyEvents は安否確認を新しい順に取得します
+func getSafetyEvents(db *sql.DB, limit int) ([]SafetyEvent, error) {
+	rows, err := db.Query("SELECT "+safetyEventColumnsSQL+" FROM safety_events ORDER BY started_at DESC LIMIT $1", limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query safety events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []SafetyEvent
+	for rows.Next() {
+		e, err := scanSafetyEvent(rows)
+		if err != nil {
+			log.Printf("Failed to scan safety event: %v", err)
+			continue
+		}
+		events = append(events, *e)
+	}
+	return events, nil
+}
+
+// startSafetyEvent は安否確認を開始します。実施中の安否確認がある場合は開始しません
+// 外泊の届出は、開始した時刻が属する夜の記録と照合します
+func startSafetyEvent(db *sql.DB, message, startedBy string, now time.Time) (*SafetyEvent, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// 同時に開始されないよう、テーブルをロックしてから実施中の安否確認を確認する
+	if _, err := tx.Exec("LOCK TABLE safety_events IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		return nil, fmt.Errorf("failed to lock safety events: %w", err)
+	}
+	var active int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM safety_events WHERE ended_at IS NULL").Scan(&active); err != nil {
+		return nil, fmt.Errorf("failed to count active safety events: %w", err)
+	}
+	if active > 0 {
+		return nil, nil
+	}
+
+	e, err := scanSafetyEvent(tx.QueryRow(`INSERT INTO safety_events (message, record_date, started_by, started_at) VALUES ($1, $2, $3, $4)
+	RETURNING `+safetyEventColumnsSQL, message, nightOf(now).Format("2006-01-02"), startedBy, now))
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert safety event: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit safety event: %w", err)
+	}
+	return e, nil
+}
+
+// saveSafetyResponse は安否確認の回答を保存します。実施中の安否確認のみ回答でき、回答は何度でも変更できます
+func saveSafetyResponse(db *sql.DB, eventID int, studentID, status, comment, respondedBy string) error {
+	result, err := db.Exec(`INSERT INTO safety_responses (event_id, student_id, status, comment, responded_by)
+	SELECT id, $2, $3, $4, $5 FROM safety_events WHERE id = $1 AND ended_at IS NULL
+	ON CONFLICT (event_id, student_id) DO UPDATE SET status = EXCLUDED.status, comment = EXCLUDED.comment,
+		responded_by = EXCLUDED.responded_by, responded_at = CURRENT_TIMESTAMP`,
+		eventID, studentID, status, comment, respondedBy)
+	if err != nil {
+		return fmt.Errorf("failed to save safety response: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// getOwnSafetyResponse は寮生の回答を取得します (未回答の場合は空文字)
+func getOwnSafetyResponse(db *sql.DB, eventID int, studentID string) (status, comment string, err error) {
+	err = db.QueryRow("SELECT status, comment FROM safety_responses WHERE event_id = $1 AND student_id = $2", eventID, studentID).Scan(&status, &comment)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	}
+	return status, comment, err
+}
+
+// safetyAttention は回答と外泊の届出を照合し、確認が必要な理由を返します (なければ空文字)
+func safetyAttention(s *SafetyStatus) string {
+	switch {
+	case s.Status == SafetyHelp:
+		return "救助が必要"
+	case s.Status == "" && !s.Overnight:
+		return "未回答 (在寮予定)"
+	case s.Status == "" && s.Overnight:
+		return "未回答 (外泊中)"
+	case s.Status == SafetyAway && !s.Overnight:
+		return "外泊の届出なし"
+	}
+	return ""
+}
+
+// getSafetyStatuses は安否確認の回答を、その夜の外泊の届出と最後の出入りとともに棟・フロア・部屋の順に取得します
+func getSafetyStatuses(db *sql.DB, event *SafetyEvent, filter LocationFilter) ([]SafetyStatus, SafetySummary, error) {
+	var summary SafetySummary
+	args := []interface{}{event.RecordDate.Format("2006-01-02"), event.ID}
+	query := `
+	SELECT u.username, ` + userNameSQL + `, ` + locationColumnsSQL + `,
+		COALESCE(r.overnight, FALSE), COALESCE(s.status, ''), COALESCE(s.comment, ''), s.responded_at, COALESCE(s.responded_by, ''),
+		p.direction, p.logged_at
+	FROM users u ` + locationJoinSQL("$1::date") + `
+	LEFT JOIN gaihaku_kesshoku_records r ON r.student_id = u.username AND r.record_date = $1::date
+	LEFT JOIN safety_responses s ON s.event_id = $2 AND s.student_id = u.username
+	LEFT JOIN LATERAL (
+		SELECT pl.direction, pl.logged_at FROM presence_logs pl
+		WHERE pl.student_id = u.username
+		ORDER BY pl.logged_at DESC, pl.id DESC LIMIT 1
+	) p ON TRUE
+	WHERE ` + residentRoleCondition + filter.where(&args) + `
+	ORDER BY ` + locationOrderSQL + `, u.username ASC`
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, summary, fmt.Errorf("failed to query safety statuses: %w", err)
+	}
+	defer rows.Close()
+
+	var statuses []SafetyStatus
+	for rows.Next() {
+		var s SafetyStatus
+		var respondedAt, loggedAt sql.NullTime
+		var direction sql.NullString
+		dest := append([]interface{}{&s.StudentID, &s.Name}, locationScanDest(&s.Location)...)
+		dest = append(dest, &s.Overnight, &s.Status, &s.Comment, &respondedAt, &s.RespondedBy, &direction, &loggedAt)
+		if err := rows.Scan(dest...); err != nil {
+			log.Printf("Failed to scan safety status: %v", err)
+			continue
+		}
+		if respondedAt.Valid {
+			s.RespondedAt = &respondedAt.Time
+		}
+		if direction.Valid {
+			s.LastPresence = &PresenceLog{StudentID: s.StudentID, Direction: direction.String, LoggedAt: loggedAt.Time}
+		}
+		s.Attention = safetyAttention(&s)
+
+		summary.Total++
+		switch {
+		case s.Status == SafetySafe:
+			summary.Safe++
+		case s.Status == SafetyHelp:
+			summary.Help++
+		case s.Status == SafetyAway:
+			summary.Away++
+		case s.Overnight:
+			summary.NoResponseOvernight++
+		default:
+			summary.NoResponseInDorm++
+		}
+		statuses = append(statuses, s)
+	}
+
+	return statuses, summary, nil
+}
+
+// safetyStatusLocation は安否確認の状況をフロアごとにまとめるときの場所を返します
+func safetyStatusLocation(s SafetyStatus) RoomLocation {
+	return s.Location
+}
+
+// notifySafetyEvent は有効な全ユーザーに安否確認の開始を通知します。メールアドレスが未登録のユーザーには送信しません
+func notifySafetyEvent(db *sql.DB, event *SafetyEvent) {
+	rows, err := db.Query(`SELECT u.username, ` + userNameSQL + `, u.role, u.email FROM users u WHERE u.active AND u.email <> ''`)
+	if err != nil {
+		log.Printf("Failed to query users for safety notification: %v", err)
+		return
+	}
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.Username, &u.DisplayName, &u.Role, &u.Email); err != nil {
+			log.Printf("Failed to scan user for safety notification: %v", err)
+			continue
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+
+	subject := "【安否確認】" + event.StartedAt.Local().Format("01/02 15:04")
+	sent := 0
+	for _, u := range users {
+		if err := notifier.Send(u.Email, subject, safetyNotificationBody(u, event)); err != nil {
+			log.Printf("Failed to send safety notification to %s: %v", u.Username, err)
+			continue
+		}
+		sent++
+	}
+	log.Printf("Safety event %d notified to %d users", event.ID, sent)
+}
+
+// safetyNotificationBody は安否確認の開始を知らせるメールの本文を返します
+// 寮生には回答リンクを、安否確認や点呼を担当するスタッフには確認ページのリンクを送り、それ以外のユーザー (厨房・受付端末など) にはお知らせのみを送ります
+func safetyNotificationBody(u User, event *SafetyEvent) string {
+	switch {
+	case u.IsResident():
+		return fmt.Sprintf(`%s さん
+
+%s
+
+下記のリンクから、現在の状況（無事・救助が必要・寮外にいる）を回答してください。
+状況が変わった場合は、同じリンクから回答し直せます。
+
+%s
+`, u.Name(), event.Message, safetyResponseLink(event.ID, u.Username))
+	case u.Can(PermSafetyManage) || u.Can(PermRollCallRun):
+		return fmt.Sprintf(`%s さん
+
+安否確認を開始しました。
+
+%s
+
+回答の状況は下記のページで確認できます。
+%s/admin/safety/%d
+`, u.Name(), event.Message, appBaseURL(), event.ID)
+	default:
+		return fmt.Sprintf(`%s さん
+
+安否確認を開始しました。
+
+%s
+`, u.Name(), event.Message)
+	}
+}
+
+// readSafetyResponseForm はフォームから回答とコメントを読み込み、エラーメッセージを返します (問題がなければ空文字)
+func readSafetyResponseForm(c echo.Context) (status, comment, errorMessage string) {
+	status = c.FormValue("status")
+	comment = strings.TrimSpace(c.FormValue("comment"))
+	if !isValidSafetyStatus(status) {
+		return status, comment, "回答を選択してください。"
+	}
+	if utf8.RuneCountInString(comment) > 500 {
+		return status, comment, "コメントは500文字以内で入力してください。"
+	}
+	return status, comment, ""
+}
+
+// renderSafetyRespond は安否確認の回答ページを表示します
+// 署名付きリンクから開いた場合は sig にその署名を、ログイン中の場合は空文字を渡します
+func renderSafetyRespond(c echo.Context, status int, event *SafetyEvent, studentID, sig, successMessage, errorMessage string) error {
+	data := map[string]interface{}{
+		"event":          event,
+		"studentID":      studentID,
+		"sig":            sig,
+		"successMessage": successMessage,
+		"errorMessage":   errorMessage,
+	}
+	if event != nil && studentID != "" {
+		response, comment, err := getOwnSafetyResponse(db, event.ID, studentID)
+		if err != nil {
+			log.Printf("Failed to get safety response of %s: %v", studentID, err)
+		}
+		data["response"] = response
+		data["comment"] = comment
+	}
+	return c.Render(status, "safety_respond.html", data)
+}
+
+// signedSafetyEvent は署名付きリンクの安否確認と寮生を確認します。署名が正しくない場合は nil を返します
+func signedSafetyEvent(eventParam, studentID, sig string) (*SafetyEvent, error) {
+	eventID, err := strconv.Atoi(eventParam)
+	if err != nil || studentID == "" || !hmac.Equal([]byte(sig), []byte(safetySignature(eventID, studentID))) {
+		return nil, nil
+	}
+	event, err := getSafetyEvent(db, eventID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return event, err
+}
+
+// safetyRespondPageHandler は署名付きリンクから開いた回答ページを表示します (ログイン不要)
+func safetyRespondPageHandler(c echo.Context) error {
+	studentID, sig := c.QueryParam("u"), c.QueryParam("sig")
+	event, err := signedSafetyEvent(c.QueryParam("e"), studentID, sig)
+	if err != nil {
+		log.Printf("Failed to get safety event: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to retrieve safety check.")
+	}
+	if event == nil {
+		return c.String(http.StatusNotFound, "Invalid link.")
+	}
+	return renderSafetyRespond(c, http.StatusOK, event, studentID, sig, "", "")
+}
+
+// safetyRespondHandler は署名付きリンクからの回答を保存します (ログイン不要)
+func safetyRespondHandler(c echo.Context) error {
+	studentID, sig := c.FormValue("u"), c.FormValue("sig")
+	event, err := signedSafetyEvent(c.FormValue("e"), studentID, sig)
+	if err != nil {
+		log.Printf("Failed to get safety event: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to save safety response.")
+	}
+	if event == nil {
+		return c.String(http.StatusNotFound, "Invalid link.")
+	}
+	return respondSafety(c, event, studentID, studentID, sig)
+}
+
+// ownSafetyPageHandler はログイン中の寮生に実施中の安否確認の回答ページを表示します
+func ownSafetyPageHandler(c echo.Context) error {
+	event, err := getActiveSafetyEvent(db)
+	if err != nil {
+		log.Printf("Failed to get active safety event: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to retrieve safety check.")
+	}
+	return renderSafetyRespond(c, http.StatusOK, event, currentUser(c).Username, "", "", "")
+}
+
+// ownSafetyRespondHandler はログイン中の寮生の回答を保存します
+func ownSafetyRespondHandler(c echo.Context) error {
+	if !currentUser(c).IsResident() {
+		return c.String(http.StatusForbidden, "Not a resident.")
+	}
+	eventID, _ := strconv.Atoi(c.FormValue("e"))
+	event, err := getSafetyEvent(db, eventID)
+	if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "Safety check not found.")
+	}
+	if err != nil {
+		log.Printf("Failed to get safety event: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to save safety response.")
+	}
+	studentID := currentUser(c).Username
+	return respondSafety(c, event, studentID, studentID, "")
+}
+
+// isSafetyTarget は学籍番号が安否確認の対象 (照合する夜の寮生) かを返します
+func isSafetyTarget(db *sql.DB, event *SafetyEvent, studentID string) (bool, error) {
+	students, _, err := resolveBulkStudents(db, []string{studentID}, 0, 0, event.RecordDate)
+	if err != nil {
+		return false, err
+	}
+	return len(students) > 0, nil
+}
+
+// respondSafety は寮生本人の回答を保存し、回答ページを表示し直します
+// 安否確認の対象 (照合する夜の寮生) でない場合は保存しません
+func respondSafety(c echo.Context, event *SafetyEvent, studentID, respondedBy, sig string) error {
+	target, err := isSafetyTarget(db, event, studentID)
+	if err != nil {
+		log.Printf("Failed to check safety target %s: %v", studentID, err)
+		return c.String(http.StatusInternalServerError, "Failed to save safety response.")
+	}
+	if !target {
+		return c.String(http.StatusForbidden, "Not a resident.")
+	}
+	status, comment, errorMessage := readSafetyResponseForm(c)
+	if errorMessage != "" {
+		return renderSafetyRespond(c, http.StatusUnprocessableEntity, event, studentID, sig, "", errorMessage)
+	}
+	err = saveSafetyResponse(db, event.ID, studentID, status, comment, respondedBy)
+	if err == sql.ErrNoRows {
+		return renderSafetyRespond(c, http.StatusConflict, event, studentID, sig, "", "この安否確認は終了しています。")
+	}
+	if err != nil {
+		log.Printf("Failed to save safety response of %s: %v", studentID, err)
+		return c.String(http.StatusInternalServerError, "Failed to save safety response.")
+	}
+	log.Printf("Safety response of %s for event %d: %s", studentID, event.ID, status)
+	return renderSafetyRespond(c, http.StatusOK, event, studentID, sig, "回答を受け付けました（"+safetyStatusLabel(status)+"）。状況が変わった場合は回答し直してください。", "")
+}
+
+// adminSafetyHandler は安否確認の一覧と開始フォームを表示します
+func adminSafetyHandler(c echo.Context) error {
+	events, err := getSafetyEvents(db, 20)
+	if err != nil {
+		log.Printf("Failed to get safety events: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to retrieve safety checks.")
+	}
+
+	return c.Render(http.StatusOK, "admin_safety.html", map[string]interface{}{
+		"events":         events,
+		"successMessage": popFlash(c, "safety_success"),
+		"errorMessage":   popFlash(c, "safety_error"),
+	})
+}
+
+// adminStartSafetyHandler は安否確認を開始し、全ユーザーに通知します
+func adminStartSafetyHandler(c echo.Context) error {
+	message := strings.TrimSpace(c.FormValue("message"))
+	if message == "" || utf8.RuneCountInString(message) > 1000 {
+		return redirectWithFlash(c, "/admin/safety", "お知らせの文面を1000文字以内で入力してください。", false, "safety_success", "safety_error")
+	}
+
+	user := currentUser(c)
+	event, err := startSafetyEvent(db, message, user.Username, time.Now())
+	if err != nil {
+		log.Printf("Failed to start safety event: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to start safety check.")
+	}
+	if event == nil {
+		return redirectWithFlash(c, "/admin/safety", "実施中の安否確認があります。終了してから開始してください。", false, "safety_success", "safety_error")
+	}
+	log.Printf("Safety event %d started by %s", event.ID, user.Username)
+
+	// 全ユーザーへの送信には時間がかかるため、応答を待たせずに送信する (停止するときは送信が終わるまで待つ)
+	runInBackground(func() { notifySafetyEvent(db, event) })
+
+	return redirectWithFlash(c, fmt.Sprintf("/admin/safety/%d", event.ID), "安否確認を開始し、全ユーザーに通知しています。", true, "safety_success", "safety_error")
+}
+
+// adminEndSafetyHandler は安否確認を終了します。終了後は回答を受け付けません
+func adminEndSafetyHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid safety check ID.")
+	}
+	if _, err := db.Exec("UPDATE safety_events SET ended_at = CURRENT_TIMESTAMP WHERE id = $1 AND ended_at IS NULL", id); err != nil {
+		log.Printf("Failed to end safety event %d: %v", id, err)
+		return c.String(http.StatusInternalServerError, "Failed to end safety check.")
+	}
+	log.Printf("Safety event %d ended by %s", id, currentUser(c).Username)
+	return redirectWithFlash(c, fmt.Sprintf("/admin/safety/%d", id), "安否確認を終了しました。", true, "safety_success", "safety_error")
+}
+
+// adminSafetyDashboardHandler は安否確認の回答状況を、その夜の外泊の届出と照合して表示します
+func adminSafetyDashboardHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid safety check ID.")
+	}
+	event, err := getSafetyEvent(db, id)
+	if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "Safety check not found.")
+	}
+	if err != nil {
+		log.Printf("Failed to get safety event %d: %v", id, err)
+		return c.String(http.StatusInternalServerError, "Failed to retrieve safety check.")
+	}
+
+	filter := parseLocationFilter(c)
+	statuses, summary, err := getSafetyStatuses(db, event, filter)
+	if err != nil {
+		log.Printf("Failed to get safety statuses: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to retrieve safety check.")
+	}
+	floors, err := getFloors(db)
+	if err != nil {
+		log.Printf("Failed to get floors: %v", err)
+	}
+
+	return c.Render(http.StatusOK, "admin_safety_dashboard.html", map[string]interface{}{
+		"event":          event,
+		"groups":         groupByFloor(statuses, safetyStatusLocation),
+		"summary":        summary,
+		"floors":         floors,
+		"filter":         filter,
+		"now":            time.Now(),
+		"successMessage": popFlash(c, "safety_success"),
+		"errorMessage":   popFlash(c, "safety_error"),
+	})
+}
+
+// adminSafetyProxyHandler はスタッフが寮生の安否を確認した結果を代理で記録します
+// 安否確認の対象 (照合する夜の寮生) でない学籍番号の場合は記録しません
+func adminSafetyProxyHandler(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid safety check ID.")
+	}
+	event, err := getSafetyEvent(db, id)
+	if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "Safety check not found.")
+	}
+	if err != nil {
+		log.Printf("Failed to get safety event %d: %v", id, err)
+		return c.String(http.StatusInternalServerError, "Failed to save safety response.")
+	}
+	path := fmt.Sprintf("/admin/safety/%d", id)
+	studentID := c.FormValue("student_id")
+	target, err := isSafetyTarget(db, event, studentID)
+	if err != nil {
+		log.Printf("Failed to check safety target %s: %v", studentID, err)
+		return c.String(http.StatusInternalServerError, "Failed to save safety response.")
+	}
+	if !target {
+		return c.String(http.StatusBadRequest, "Unknown student.")
+	}
+	status, comment, errorMessage := readSafetyResponseForm(c)
+	if errorMessage != "" {
+		return redirectWithFlash(c, path, errorMessage, false, "safety_success", "safety_error")
+	}
+
+	user := currentUser(c)
+	err = saveSafetyResponse(db, id, studentID, status, comment, user.Username)
+	if err == sql.ErrNoRows {
+		return redirectWithFlash(c, path, "この安否確認は終了しています。", false, "safety_success", "safety_error")
+	}
+	if err != nil {
+		log.Printf("Failed to save safety response of %s: %v", studentID, err)
+		return c.String(http.StatusInternalServerError, "Failed to save safety response.")
+	}
+	log.Printf("Safety response of %s for event %d recorded by %s: %s", studentID, id, user.Username, status)
+	return redirectWithFlash(c, path, studentID+" の安否を記録しました。", true, "safety_success", "safety_error")
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// recordingNotifier は送信したお知らせを記録します
+type recordingNotifier struct {
+	mu   sync.Mutex
+	sent map[string]string // 宛先ごとの本文
+}
+
+func (n *recordingNotifier) Send(to, subject, body string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sent[to] = body
+	return nil
+}
+
+func TestNotifySafetyEventReachesEveryActiveUser(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, `INSERT INTO users (username, password, role, active, email) VALUES
+		('s1', 'x', 'user', TRUE, 's1@example.com'),
+		('fl', 'x', 'floor_leader', TRUE, 'fl@example.com'),
+		('ad', 'x', 'admin', TRUE, 'ad@example.com'),
+		('nd', 'x', 'night_duty', TRUE, 'nd@example.com'),
+		('kt', 'x', 'kitchen', TRUE, 'kt@example.com'),
+		('ks', 'x', 'kiosk', TRUE, 'ks@example.com'),
+		('gone', 'x', 'user', FALSE, 'gone@example.com'),
+		('noemail', 'x', 'user', TRUE, '')`)
+	n := &recordingNotifier{sent: make(map[string]string)}
+	prev := notifier
+	notifier = n
+	t.Cleanup(func() { notifier = prev })
+
+	event := &SafetyEvent{ID: 7, Message: "地震が発生しました。", StartedAt: time.Now()}
+	notifySafetyEvent(db, event)
+
+	want := map[string]string{
+		"s1@example.com": "/safety/respond?",
+		"fl@example.com": "/safety/respond?",
+		"ad@example.com": "/admin/safety/7",
+		"nd@example.com": "/admin/safety/7",
+		"kt@example.com": "地震が発生しました。",
+		"ks@example.com": "地震が発生しました。",
+	}
+	for to, fragment := range want {
+		body, ok := n.sent[to]
+		if !ok {
+			t.Errorf("%s was not notified", to)
+			continue
+		}
+		if !strings.Contains(body, fragment) {
+			t.Errorf("notification to %s does not contain %q:\n%s", to, fragment, body)
+		}
+	}
+	if len(n.sent) != len(want) {
+		t.Errorf("notified %d users, want %d (inactive users and users without email are skipped)", len(n.sent), len(want))
+	}
+}
+
+func TestSafetyNotificationBodyLinks(t *testing.T) {
+	event := &SafetyEvent{ID: 3, Message: "避難してください。"}
+	for _, tc := range []struct {
+		role          string
+		respond, page bool
+	}{
+		{RoleUser, true, false},
+		{RoleFloorLeader, true, false},
+		{RoleAdmin, false, true},
+		{RoleNightDuty, false, true},
+		{RoleKitchen, false, false},
+		{RoleKiosk, false, false},
+	} {
+		body := safetyNotificationBody(User{Username: "u1", Role: tc.role, Active: true}, event)
+		if !strings.Contains(body, event.Message) {
+			t.Errorf("%s: body does not contain the message", tc.role)
+		}
+		if got := strings.Contains(body, "/safety/respond?"); got != tc.respond {
+			t.Errorf("%s: response link = %v, want %v", tc.role, got, tc.respond)
+		}
+		if got := strings.Contains(body, "/admin/safety/3"); got != tc.page {
+			t.Errorf("%s: status page link = %v, want %v", tc.role, got, tc.page)
+		}
+	}
+}
+
+func TestSafetyResponsesOnlyForResidents(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, `INSERT INTO users (username, password, role, active) VALUES
+		('s1', 'x', 'user', TRUE), ('gone', 'x', 'user', FALSE), ('k1', 'x', 'kitchen', TRUE)`)
+	event, err := startSafetyEvent(db, "地震が発生しました。", "admin", time.Now())
+	if err != nil || event == nil {
+		t.Fatalf("start safety event: %v", err)
+	}
+	responses := func() int {
+		var n int
+		db.QueryRow(`SELECT COUNT(*) FROM safety_responses`).Scan(&n)
+		return n
+	}
+	form := func(extra url.Values) url.Values {
+		v := url.Values{"e": {strconv.Itoa(event.ID)}, "status": {SafetySafe}}
+		for k, vs := range extra {
+			v[k] = vs
+		}
+		return v
+	}
+
+	if rec := serveAs(t, ownSafetyRespondHandler, &User{Username: "k1", Role: RoleKitchen, Active: true}, http.MethodPost, "/safety", form(nil)); rec.Code != http.StatusForbidden {
+		t.Errorf("kitchen response: status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+
+	proxy := func(c echo.Context) error {
+		c.SetParamNames("id")
+		c.SetParamValues(strconv.Itoa(event.ID))
+		return adminSafetyProxyHandler(c)
+	}
+	staff := &User{Username: "n1", Role: RoleNightDuty, Active: true}
+	for _, id := range []string{"gone", "k1", "nobody"} {
+		if rec := serveAs(t, proxy, staff, http.MethodPost, "/admin/safety/proxy", form(url.Values{"student_id": {id}})); rec.Code != http.StatusBadRequest {
+			t.Errorf("proxy response for %s: status %d, want %d", id, rec.Code, http.StatusBadRequest)
+		}
+	}
+	if n := responses(); n != 0 {
+		t.Fatalf("responses for non-residents saved %d rows, want 0", n)
+	}
+
+	if rec := serveAs(t, proxy, staff, http.MethodPost, "/admin/safety/proxy", form(url.Values{"student_id": {"s1"}})); rec.Code != http.StatusSeeOther {
+		t.Errorf("proxy response for s1: status %d", rec.Code)
+	}
+	if n := responses(); n != 1 {
+		t.Errorf("responses of s1 = %d rows, want 1", n)
+	}
+}
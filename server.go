@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// defaultListenAddr はサーバーが待ち受けるアドレスの既定値です
+	defaultListenAddr = ":8080"
+	// defaultShutdownDrainDelay は停止の合図を受け取ってから、/readyz を失敗させたまま新しいリクエストを受け付け続ける時間の既定値です
+	// ロードバランサーなどが /readyz の失敗に気付いて振り分けをやめるまでの間に届いたリクエストも処理します
+	defaultShutdownDrainDelay = 5 * time.Second
+	// defaultShutdownTimeout は停止するときに処理中のリクエストの完了を待つ時間の既定値です
+	defaultShutdownTimeout = 15 * time.Second
+	// readyzPingTimeout は /readyz でデータベースの応答を待つ時間です
+	readyzPingTimeout = 2 * time.Second
+)
+
+var (
+	// schemaReady はデータベーススキーマの初期化 (テーブルの作成・変更) が完了したかを表します
+	schemaReady atomic.Bool
+	// shuttingDown はサーバーが停止処理中かを表します。停止処理中は新しいリクエストを振り分けないよう /readyz が失敗します
+	shuttingDown atomic.Bool
+	// backgroundTasks はリクエストの応答後も続ける処理 (安否確認の一斉通知など) です。停止するときは完了を待ちます
+	backgroundTasks sync.WaitGroup
+)
+
+// runInBackground は f をリクエストの応答を待たせずに実行し、停止するときに完了を待てるよう backgroundTasks に登録します
+func runInBackground(f func()) {
+	backgroundTasks.Add(1)
+	go func() {
+		defer backgroundTasks.Done()
+		f()
+	}()
+}
+
+// waitBackgroundTasks は backgroundTasks の完了を ctx が終わるまで待ちます
+func waitBackgroundTasks(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		backgroundTasks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// listenAddr はサーバーが待ち受けるアドレスを返します
+// LISTEN_ADDR (例: "127.0.0.1:8080")、PORT (例: "8080") の順に読み込み、未設定の場合は defaultListenAddr を返します
+func listenAddr() string {
+	if addr := os.Getenv("LISTEN_ADDR"); addr != "" {
+		return addr
+	}
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return defaultListenAddr
+}
+
+// startServer はサーバーを起動します。起動に失敗した場合や停止以外の理由で終了した場合は、返すチャンネルにエラーを送ります
+func startServer(e *echo.Echo, addr string) <-chan error {
+	errCh := make(chan error, 1)
+	go func() {
+		log.Printf("Listening on %s", addr)
+		if err := e.Start(addr); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errCh <- err
+		}
+		close(errCh)
+	}()
+	return errCh
+}
+
+// waitForShutdown は SIGINT・SIGTERM を受け取るまで待ってからサーバーを停止します
+// 停止するときは、まず /readyz を失敗させて drainDelay の間は新しいリクエストも受け付け続け、
+// その後に新しい接続の受け付けをやめて、処理中のリクエストと backgroundTasks が終わるまで合わせて最大 timeout 待ちます
+// 停止処理中にもう一度 SIGINT・SIGTERM を受け取ると、待たずにすぐ終了します
+func waitForShutdown(e *echo.Echo, serverErr <-chan error, drainDelay, timeout time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-serverErr:
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+
+	shuttingDown.Store(true)
+	log.Printf("Shutting down, draining for %s before closing the listener", drainDelay)
+	select {
+	case err := <-serverErr:
+		return err
+	case <-time.After(drainDelay):
+	}
+
+	log.Printf("Closing the listener, waiting up to %s for in-flight requests", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shut down server: %w", err)
+	}
+	if err := waitBackgroundTasks(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to wait for background tasks: %w", err)
+	}
+	log.Println("Server stopped")
+	return nil
+}
+
+// healthzHandler はプロセスが動いていることを返します (データベースの状態は確認しません)
+func healthzHandler(c echo.Context) error {
+	return c.String(http.StatusOK, "ok")
+}
+
+// schemaReadyMiddleware はデータベーススキーマの初期化が完了するまで、死活監視と静的ファイル以外のリクエストに 503 を返すミドルウェアです
+// 起動直後はテーブルの作成・変更より先に待ち受けを始めるため、初期化前のテーブルを使うリクエスト (セッションの読み込みを含む) を受け付けないようにします
+func schemaReadyMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if schemaReady.Load() {
+			return next(c)
+		}
+		path := c.Request().URL.Path
+		if path == "/healthz" || path == "/readyz" || strings.HasPrefix(path, "/static/") {
+			return next(c)
+		}
+		c.Response().Header().Set("Retry-After", "5")
+		return c.String(http.StatusServiceUnavailable, "Starting up, please retry shortly.")
+	}
+}
+
+// readyzHandler はリクエストを受け付けられるかを返します
+// データベースに接続でき、スキーマの初期化が完了していて、停止処理中でない場合のみ成功します
+func readyzHandler(c echo.Context) error {
+	if shuttingDown.Load() {
+		return c.String(http.StatusServiceUnavailable, "Shutting down.")
+	}
+	if !schemaReady.Load() {
+		return c.String(http.StatusServiceUnavailable, "Database schema not initialized.")
+	}
+	ctx, cancel := context.WithTimeout(c.Request().Context(), readyzPingTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		log.Printf("Readiness check failed to ping database: %v", err)
+		return c.String(http.StatusServiceUnavailable, "Database unavailable.")
+	}
+	return c.String(http.StatusOK, "ok")
+}
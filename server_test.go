@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestSchemaReadyMiddleware(t *testing.T) {
+	prev := schemaReady.Load()
+	t.Cleanup(func() { schemaReady.Store(prev) })
+
+	e := echo.New()
+	e.Pre(schemaReadyMiddleware)
+	ok := func(c echo.Context) error { return c.String(http.StatusOK, "ok") }
+	for _, path := range []string{"/healthz", "/readyz", "/static/app.css", "/", "/main", "/kitchen/live/events"} {
+		e.GET(path, ok)
+	}
+	status := func(path string) int {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	// 初期化中は死活監視と静的ファイルのみ受け付ける
+	schemaReady.Store(false)
+	for path, want := range map[string]int{
+		"/healthz":             http.StatusOK,
+		"/readyz":              http.StatusOK,
+		"/static/app.css":      http.StatusOK,
+		"/":                    http.StatusServiceUnavailable,
+		"/main":                http.StatusServiceUnavailable,
+		"/kitchen/live/events": http.StatusServiceUnavailable,
+	} {
+		if got := status(path); got != want {
+			t.Errorf("before schema init: GET %s = %d, want %d", path, got, want)
+		}
+	}
+
+	schemaReady.Store(true)
+	for _, path := range []string{"/", "/main", "/kitchen/live/events"} {
+		if got := status(path); got != http.StatusOK {
+			t.Errorf("after schema init: GET %s = %d, want %d", path, got, http.StatusOK)
+		}
+	}
+}
+
+func TestWaitBackgroundTasks(t *testing.T) {
+	release := make(chan struct{})
+	finished := false
+	runInBackground(func() {
+		<-release
+		finished = true
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := waitBackgroundTasks(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("waiting for a running task: err = %v, want deadline exceeded", err)
+	}
+
+	close(release)
+	if err := waitBackgroundTasks(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !finished {
+		t.Error("waitBackgroundTasks returned before the task finished")
+	}
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// セッションのタイムアウトの既定値
+const (
+	defaultSessionIdleTimeout     = 24 * time.Hour
+	defaultSessionAbsoluteTimeout = 7 * 24 * time.Hour
+	sessionTouchInterval          = time.Minute // 最終アクセス時刻を更新する最小間隔
+)
+
+// sessionRecord はサーバー側に保存されるセッションの1件分です
+type sessionRecord struct {
+	Key        string // セッショントークンのハッシュ値
+	StudentID  string
+	Data       []byte
+	IPAddress  string
+	UserAgent  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+}
+
+// sessionBackend はサーバー側セッションの保存先です
+type sessionBackend interface {
+	// load はセッションを取得します。存在しない場合は nil を返します
+	load(key string) (*sessionRecord, error)
+	insert(rec *sessionRecord) error
+	// update はセッションの内容を更新します。既に失効していた場合は false を返します
+	update(rec *sessionRecord) (bool, error)
+	touch(key string, at time.Time) error
+	delete(key string) error
+	// deleteByUser はユーザーのセッションを exceptKey 以外全て削除します
+	deleteByUser(studentID, exceptKey string) error
+	listByUser(studentID string) ([]SessionInfo, error)
+	deleteExpired(idleBefore, createdBefore time.Time) error
+}
+
+// ServerSessionStore はセッションの内容をサーバー側に保存する sessions.Store の実装です
+// クッキーには署名付きの不透明なトークンのみを保存します
+type ServerSessionStore struct {
+	backend         sessionBackend
+	codec           *securecookie.SecureCookie
+	Options         *sessions.Options
+	IdleTimeout     time.Duration
+	AbsoluteTimeout time.Duration
+}
+
+// sessionStore はアプリケーション全体で使用するセッションストアです
+var sessionStore *ServerSessionStore
+
+// NewServerSessionStore は新しい ServerSessionStore を作成します
+func NewServerSessionStore(backend sessionBackend, hashKey []byte, idleTimeout, absoluteTimeout time.Duration) *ServerSessionStore {
+	codec := securecookie.New(hashKey, nil)
+	codec.MaxAge(int(absoluteTimeout.Seconds()))
+	return &ServerSessionStore{
+		backend: backend,
+		codec:   codec,
+		Options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   int(absoluteTimeout.Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		},
+		IdleTimeout:     idleTimeout,
+		AbsoluteTimeout: absoluteTimeout,
+	}
+}
+
+// Get はリクエスト内でキャッシュされたセッションを返します
+func (s *ServerSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New はクッキーのトークンに対応するセッションを読み込みます
+// 該当するセッションがない、または期限切れの場合は新しいセッションを返します
+func (s *ServerSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session, rec, err := s.read(r, name)
+	if err != nil || rec == nil {
+		return session, err
+	}
+
+	now := time.Now()
+	if now.Sub(rec.LastSeenAt) > sessionTouchInterval {
+		if err := s.backend.touch(rec.Key, now); err != nil {
+			log.Printf("Failed to update session last access: %v", err)
+		}
+	}
+
+	return session, nil
+}
+
+// Peek は New と同じくセッションを読み込みますが、最終アクセス時刻を更新しません
+// 利用者の操作ではない定期的な確認 (ライブ表示の接続の確認など) で、セッションのアイドルタイムアウトを延ばさないようにします
+// リクエスト内でキャッシュしないため、返したセッションを保存しないでください
+func (s *ServerSessionStore) Peek(r *http.Request, name string) (*sessions.Session, error) {
+	session, _, err := s.read(r, name)
+	return session, err
+}
+
+// read はクッキーのトークンに対応するセッションと、サーバー側の記録を読み込みます
+// 該当するセッションがない、または期限切れの場合は新しいセッションと nil を返します (期限切れのセッションは削除します)
+func (s *ServerSessionStore) read(r *http.Request, name string) (*sessions.Session, *sessionRecord, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil, nil
+	}
+	var token string
+	if err := s.codec.Decode(name, cookie.Value, &token); err != nil {
+		return session, nil, nil
+	}
+
+	key := sessionKey(token)
+	rec, err := s.backend.load(key)
+	if err != nil {
+		return session, nil, fmt.Errorf("failed to load session: %w", err)
+	}
+	if rec == nil {
+		return session, nil, nil
+	}
+
+	now := time.Now()
+	if now.Sub(rec.LastSeenAt) > s.IdleTimeout || now.Sub(rec.CreatedAt) > s.AbsoluteTimeout {
+		if err := s.backend.delete(key); err != nil {
+			log.Printf("Failed to delete expired session: %v", err)
+		}
+		return session, nil, nil
+	}
+
+	if err := (securecookie.GobEncoder{}).Deserialize(rec.Data, &session.Values); err != nil {
+		return session, nil, fmt.Errorf("failed to decode session: %w", err)
+	}
+	session.ID = token
+	session.IsNew = false
+	return session, rec, nil
+}
+
+// Save はセッションの内容をサーバー側に保存し、トークンをクッキーに設定します
+// Options.MaxAge が負の場合はセッションを削除します
+// ログインしていないセッションは新しく作成しません (フラッシュメッセージなども保存されません)
+func (s *ServerSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.backend.delete(sessionKey(session.ID)); err != nil {
+				return fmt.Errorf("failed to delete session: %w", err)
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	// ログインしていない匿名のセッションはサーバー側に保存しない (認証に失敗するたびに行が増えないようにする)
+	studentID := ""
+	if auth, ok := session.Values["authenticated"].(bool); ok && auth {
+		studentID, _ = session.Values["studentID"].(string)
+	}
+	if session.ID == "" && studentID == "" {
+		return nil
+	}
+
+	data, err := securecookie.GobEncoder{}.Serialize(session.Values)
+	if err != nil {
+		return fmt.Errorf("failed to encode session: %w", err)
+	}
+
+	now := time.Now()
+	rec := &sessionRecord{
+		StudentID:  studentID,
+		Data:       data,
+		IPAddress:  clientIP(r),
+		UserAgent:  r.UserAgent(),
+		CreatedAt:  now,
+		LastSeenAt: now,
+	}
+	if session.ID == "" {
+		session.ID = newSessionToken()
+		rec.Key = sessionKey(session.ID)
+		if err := s.backend.insert(rec); err != nil {
+			return fmt.Errorf("failed to insert session: %w", err)
+		}
+	} else {
+		rec.Key = sessionKey(session.ID)
+		ok, err := s.backend.update(rec)
+		if err != nil {
+			return fmt.Errorf("failed to update session: %w", err)
+		}
+		if !ok {
+			// 処理中に失効したセッションは復活させない
+			session.Options.MaxAge = -1
+			http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+			return nil
+		}
+	}
+
+	encoded, err := s.codec.Encode(session.Name(), session.ID)
+	if err != nil {
+		return fmt.Errorf("failed to encode session cookie: %w", err)
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// Renew は現在のセッションを破棄し、次回の保存時に新しいIDを発行させます (セッション固定化対策)
+func (s *ServerSessionStore) Renew(session *sessions.Session) error {
+	if session.ID != "" {
+		if err := s.backend.delete(sessionKey(session.ID)); err != nil {
+			return fmt.Errorf("failed to delete session: %w", err)
+		}
+	}
+	session.ID = ""
+	session.IsNew = true
+	return nil
+}
+
+// ListUserSessions はユーザーの有効なセッションを新しい順に返します
+// current に現在のセッションを渡すと、該当するものに Current が設定されます
+func (s *ServerSessionStore) ListUserSessions(studentID string, current *sessions.Session) ([]SessionInfo, error) {
+	infos, err := s.backend.listByUser(studentID)
+	if err != nil {
+		return nil, err
+	}
+
+	currentKey := ""
+	if current != nil && current.ID != "" {
+		currentKey = sessionKey(current.ID)
+	}
+	now := time.Now()
+	active := infos[:0]
+	for _, info := range infos {
+		if now.Sub(info.LastSeenAt) > s.IdleTimeout || now.Sub(info.CreatedAt) > s.AbsoluteTimeout {
+			continue
+		}
+		info.Current = info.ID == currentKey
+		active = append(active, info)
+	}
+	return active, nil
+}
+
+// RevokeSession はユーザーのセッションを1件無効化します
+func (s *ServerSessionStore) RevokeSession(studentID, key string) error {
+	infos, err := s.backend.listByUser(studentID)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.ID == key {
+			return s.backend.delete(key)
+		}
+	}
+	return nil
+}
+
+// RevokeUserSessions はユーザーの全てのセッションを無効化します
+// except に渡したセッションは残します (nil の場合は全て無効化)
+func (s *ServerSessionStore) RevokeUserSessions(studentID string, except *sessions.Session) error {
+	exceptKey := ""
+	if except != nil && except.ID != "" {
+		exceptKey = sessionKey(except.ID)
+	}
+	return s.backend.deleteByUser(studentID, exceptKey)
+}
+
+// RunCleanup は期限切れのセッションを定期的に削除します
+func (s *ServerSessionStore) RunCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		if err := s.backend.deleteExpired(now.Add(-s.IdleTimeout), now.Add(-s.AbsoluteTimeout)); err != nil {
+			log.Printf("Failed to delete expired sessions: %v", err)
+		}
+	}
+}
+
+// newSessionToken はランダムなセッショントークンを生成します
+func newSessionToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("failed to generate session token: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// sessionKey はトークンから保存用のキーを求めます
+// トークンそのものは保存しないため、保存先が漏洩してもセッションを乗っ取られません
+func sessionKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// clientIP はリクエスト元のIPアドレスを返します (echo.Context#RealIP と同じく ipExtractor の規則で判定します)
+func clientIP(r *http.Request) string {
+	return ipExtractor(r)
+}
+
+// pgSessionBackend はPostgreSQLにセッションを保存します
+type pgSessionBackend struct {
+	db *sql.DB
+}
+
+// createSessionsTable はセッションテーブルを作成します
+func createSessionsTable(db *sql.DB) error {
+	const createTableSQL = `
+	CREATE TABLE IF NOT EXISTS sessions (
+		id VARCHAR(64) PRIMARY KEY,
+		student_id VARCHAR(50),
+		data BYTEA NOT NULL,
+		ip_address VARCHAR(100),
+		user_agent TEXT,
+		created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		last_seen_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS sessions_student_id_idx ON sessions (student_id);`
+
+	_, err := db.Exec(createTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to execute SQL: %w", err)
+	}
+
+	return nil
+}
+
+func (b *pgSessionBackend) load(key string) (*sessionRecord, error) {
+	var rec sessionRecord
+	var studentID, ip, ua sql.NullString
+	err := b.db.QueryRow(`
+	SELECT id, student_id, data, ip_address, user_agent, created_at, last_seen_at
+	FROM sessions WHERE id = $1`, key).Scan(
+		&rec.Key, &studentID, &rec.Data, &ip, &ua, &rec.CreatedAt, &rec.LastSeenAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rec.StudentID, rec.IPAddress, rec.UserAgent = studentID.String, ip.String, ua.String
+	return &rec, nil
+}
+
+func (b *pgSessionBackend) insert(rec *sessionRecord) error {
+	_, err := b.db.Exec(`
+	INSERT INTO sessions (id, student_id, data, ip_address, user_agent, created_at, last_seen_at)
+	VALUES ($1, NULLIF($2, ''), $3, $4, $5, $6, $7)`,
+		rec.Key, rec.StudentID, rec.Data, rec.IPAddress, rec.UserAgent, rec.CreatedAt, rec.LastSeenAt)
+	return err
+}
+
+func (b *pgSessionBackend) update(rec *sessionRecord) (bool, error) {
+	res, err := b.db.Exec(`
+	UPDATE sessions SET student_id = NULLIF($2, ''), data = $3, ip_address = $4, user_agent = $5, last_seen_at = $6
+	WHERE id = $1`,
+		rec.Key, rec.StudentID, rec.Data, rec.IPAddress, rec.UserAgent, rec.LastSeenAt)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (b *pgSessionBackend) touch(key string, at time.Time) error {
+	_, err := b.db.Exec("UPDATE sessions SET last_seen_at = $2 WHERE id = $1", key, at)
+	return err
+}
+
+func (b *pgSessionBackend) delete(key string) error {
+	_, err := b.db.Exec("DELETE FROM sessions WHERE id = $1", key)
+	return err
+}
+
+func (b *pgSessionBackend) deleteByUser(studentID, exceptKey string) error {
+	_, err := b.db.Exec("DELETE FROM sessions WHERE student_id = $1 AND id <> $2", studentID, exceptKey)
+	return err
+}
+
+func (b *pgSessionBackend) listByUser(studentID string) ([]SessionInfo, error) {
+	rows, err := b.db.Query(`
+	SELECT id, student_id, ip_address, user_agent, created_at, last_seen_at
+	FROM sessions WHERE student_id = $1
+	ORDER BY last_seen_at DESC`, studentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var infos []SessionInfo
+	for rows.Next() {
+		var info SessionInfo
+		var ip, ua sql.NullString
+		if err := rows.Scan(&info.ID, &info.StudentID, &ip, &ua, &info.CreatedAt, &info.LastSeenAt); err != nil {
+			log.Printf("Failed to scan session: %v", err)
+			continue
+		}
+		info.IPAddress, info.UserAgent = ip.String, ua.String
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (b *pgSessionBackend) deleteExpired(idleBefore, createdBefore time.Time) error {
+	_, err := b.db.Exec("DELETE FROM sessions WHERE last_seen_at < $1 OR created_at < $2", idleBefore, createdBefore)
+	return err
+}
+
+// memorySessionBackend はメモリ上にセッションを保存します (テスト・開発用)
+type memorySessionBackend struct {
+	mu       sync.Mutex
+	sessions map[string]sessionRecord
+}
+
+func newMemorySessionBackend() *memorySessionBackend {
+	return &memorySessionBackend{sessions: make(map[string]sessionRecord)}
+}
+
+func (b *memorySessionBackend) load(key string) (*sessionRecord, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rec, ok := b.sessions[key]
+	if !ok {
+		return nil, nil
+	}
+	rec.Data = append([]byte(nil), rec.Data...)
+	return &rec, nil
+}
+
+func (b *memorySessionBackend) insert(rec *sessionRecord) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sessions[rec.Key] = *rec
+	return nil
+}
+
+func (b *memorySessionBackend) update(rec *sessionRecord) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	old, ok := b.sessions[rec.Key]
+	if !ok {
+		return false, nil
+	}
+	updated := *rec
+	updated.CreatedAt = old.CreatedAt
+	b.sessions[rec.Key] = updated
+	return true, nil
+}
+
+func (b *memorySessionBackend) touch(key string, at time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if rec, ok := b.sessions[key]; ok {
+		rec.LastSeenAt = at
+		b.sessions[key] = rec
+	}
+	return nil
+}
+
+func (b *memorySessionBackend) delete(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.sessions, key)
+	return nil
+}
+
+func (b *memorySessionBackend) deleteByUser(studentID, exceptKey string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, rec := range b.sessions {
+		if rec.StudentID == studentID && key != exceptKey {
+			delete(b.sessions, key)
+		}
+	}
+	return nil
+}
+
+func (b *memorySessionBackend) listByUser(studentID string) ([]SessionInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var infos []SessionInfo
+	for key, rec := range b.sessions {
+		if rec.StudentID != studentID {
+			continue
+		}
+		infos = append(infos, SessionInfo{
+			ID:         key,
+			StudentID:  rec.StudentID,
+			IPAddress:  rec.IPAddress,
+			UserAgent:  rec.UserAgent,
+			CreatedAt:  rec.CreatedAt,
+			LastSeenAt: rec.LastSeenAt,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].LastSeenAt.After(infos[j].LastSeenAt) })
+	return infos, nil
+}
+
+func (b *memorySessionBackend) deleteExpired(idleBefore, createdBefore time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, rec := range b.sessions {
+		if rec.LastSeenAt.Before(idleBefore) || rec.CreatedAt.Before(createdBefore) {
+			delete(b.sessions, key)
+		}
+	}
+	return nil
+}
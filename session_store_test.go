@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServerSessionStoreSkipsAnonymousSessions(t *testing.T) {
+	backend := newMemorySessionBackend()
+	store := NewServerSessionStore(backend, []byte("test-secret"), time.Hour, 24*time.Hour)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+	sess, err := store.New(req, "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.AddFlash("認証に失敗しました。", "login_error")
+	if err := store.Save(req, rec, sess); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(backend.sessions); n != 0 {
+		t.Fatalf("anonymous session stored %d rows, want 0", n)
+	}
+	if cookies := rec.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("anonymous session set cookies %v, want none", cookies)
+	}
+
+	sess.Values["authenticated"] = true
+	sess.Values["studentID"] = "s1"
+	rec = httptest.NewRecorder()
+	if err := store.Save(req, rec, sess); err != nil {
+		t.Fatal(err)
+	}
+	infos, _ := backend.listByUser("s1")
+	if len(infos) != 1 {
+		t.Fatalf("logged-in session stored %d rows for s1, want 1", len(infos))
+	}
+
+	// 保存したセッションはクッキーから読み込める
+	req = httptest.NewRequest("GET", "/", nil)
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	loaded, err := store.New(req, "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.IsNew || loaded.Values["studentID"] != "s1" {
+		t.Errorf("loaded session = %+v, want the saved session of s1", loaded.Values)
+	}
+}
+
+func TestServerSessionStorePeekDoesNotTouch(t *testing.T) {
+	backend := newMemorySessionBackend()
+	store := NewServerSessionStore(backend, []byte("test-secret"), time.Hour, 24*time.Hour)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+	sess, _ := store.New(req, "session")
+	sess.Values["authenticated"] = true
+	sess.Values["studentID"] = "s1"
+	if err := store.Save(req, rec, sess); err != nil {
+		t.Fatal(err)
+	}
+	lastSeen := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+	setLastSeen := func(at time.Time) {
+		for key, r := range backend.sessions {
+			r.LastSeenAt = at
+			backend.sessions[key] = r
+		}
+	}
+	getLastSeen := func() time.Time {
+		for _, r := range backend.sessions {
+			return r.LastSeenAt
+		}
+		return time.Time{}
+	}
+	request := func() *http.Request {
+		req := httptest.NewRequest("GET", "/kitchen/live/events", nil)
+		for _, c := range rec.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		return req
+	}
+
+	setLastSeen(lastSeen)
+	peeked, err := store.Peek(request(), "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peeked.IsNew || peeked.Values["studentID"] != "s1" {
+		t.Errorf("peeked session = %+v, want the saved session of s1", peeked.Values)
+	}
+	if got := getLastSeen(); !got.Equal(lastSeen) {
+		t.Errorf("Peek updated last access to %v, want %v", got, lastSeen)
+	}
+
+	// 通常の読み込みでは最終アクセス時刻を更新する
+	if _, err := store.New(request(), "session"); err != nil {
+		t.Fatal(err)
+	}
+	if got := getLastSeen(); !got.After(lastSeen) {
+		t.Errorf("New kept last access at %v, want it updated", got)
+	}
+
+	// アイドルタイムアウトを過ぎたセッションは Peek でも読み込まない
+	setLastSeen(time.Now().Add(-2 * time.Hour))
+	if peeked, _ = store.Peek(request(), "session"); !peeked.IsNew {
+		t.Error("Peek loaded an idle-expired session")
+	}
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// countedOvernightSQL は外泊として数える記録の条件です
+// 寮監督者の承認待ち・却下の外泊は数えません
+const countedOvernightSQL = `COALESCE(r.overnight, FALSE) AND r.staff_status NOT IN ('pending', 'rejected')`
+
+// getMealCounts は from から days 日分の食事ごとの喫食数と外泊者数を集計します
+// 記録のない寮生は、全ての食事を食べる・外泊しないものとして数えます
+// filter を指定すると、各日時点でその棟・フロアに住む寮生のみを数えます
+func getMealCounts(db *sql.DB, from time.Time, days int, filter LocationFilter) ([]MealCount, error) {
+	args := []interface{}{from.Format("2006-01-02"), from.AddDate(0, 0, days-1).Format("2006-01-02")}
+	query := `
+	SELECT d::date,
+		COUNT(u.id),
+		COUNT(u.id) FILTER (WHERE ` + mealEatenSQL("breakfast") + `),
+		COUNT(u.id) FILTER (WHERE ` + mealEatenSQL("lunch") + `),
+		COUNT(u.id) FILTER (WHERE ` + mealEatenSQL("dinner") + `),
+		` + guestCountSQL("breakfast") + `, ` + guestCountSQL("lunch") + `, ` + guestCountSQL("dinner") + `,
+		COUNT(u.id) FILTER (WHERE ` + countedOvernightSQL + `),
+		COUNT(u.id) FILTER (WHERE COALESCE(r.overnight, FALSE) AND r.staff_status = 'pending')
+	FROM generate_series($1::date, $2::date, INTERVAL '1 day') AS d
+	JOIN users u ON ` + residentRolesSQL + locationJoinSQL("d::date") + `
+	LEFT JOIN gaihaku_kesshoku_records r ON r.student_id = u.username AND r.record_date = d::date` + dormCalendarJoinSQL("d::date") + guestMealsJoinSQL("d::date") + `
+	WHERE ` + residentOnDaySQL("d::date") + filter.where(&args) + `
+	GROUP BY d`
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query meal counts: %w", err)
+	}
+	defer rows.Close()
+
+	byDate := make(map[string]MealCount)
+	for rows.Next() {
+		var m MealCount
+		if err := rows.Scan(&m.Date, &m.Residents, &m.Breakfast, &m.Lunch, &m.Dinner, &m.GuestBreakfast, &m.GuestLunch, &m.GuestDinner, &m.Overnight, &m.OvernightPending); err != nil {
+			log.Printf("Failed to scan meal count: %v", err)
+			continue
+		}
+		m.addGuests()
+		byDate[m.Date.Format("2006-01-02")] = m
+	}
+
+	// 該当する寮生がいない日も0件として返す
+	counts := make([]MealCount, 0, days)
+	for i := 0; i < days; i++ {
+		date := from.AddDate(0, 0, i)
+		m, ok := byDate[date.Format("2006-01-02")]
+		if !ok {
+			m = MealCount{Date: date}
+		}
+		counts = append(counts, m)
+	}
+
+	return counts, nil
+}
+
+// getMealCountsByFloor は指定日の食数を棟・フロアごとに集計します
+func getMealCountsByFloor(db *sql.DB, date time.Time) ([]MealCount, error) {
+	rows, err := db.Query(`
+	SELECT COALESCE(b.id, 0), COALESCE(b.name, ''), COALESCE(f.id, 0), COALESCE(f.name, ''),
+		COUNT(u.id),
+		COUNT(u.id) FILTER (WHERE `+mealEatenSQL("breakfast")+`),
+		COUNT(u.id) FILTER (WHERE `+mealEatenSQL("lunch")+`),
+		COUNT(u.id) FILTER (WHERE `+mealEatenSQL("dinner")+`),
+		`+guestCountSQL("breakfast")+`, `+guestCountSQL("lunch")+`, `+guestCountSQL("dinner")+`,
+		COUNT(u.id) FILTER (WHERE `+countedOvernightSQL+`),
+		COUNT(u.id) FILTER (WHERE COALESCE(r.overnight, FALSE) AND r.staff_status = 'pending')
+	FROM users u `+locationJoinSQL("$1::date")+`
+	LEFT JOIN gaihaku_kesshoku_records r ON r.student_id = u.username AND r.record_date = $1::date`+dormCalendarJoinSQL("$1::date")+guestMealsJoinSQL("$1::date")+`
+	WHERE `+residentOnDaySQL("$1::date")+`
+	GROUP BY b.id, b.name, f.id, f.name, f.sort_order
+	ORDER BY b.name ASC NULLS LAST, f.sort_order ASC, f.name ASC`, date.Format("2006-01-02"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query meal counts by floor: %w", err)
+	}
+	defer rows.Close()
+
+	var counts []MealCount
+	for rows.Next() {
+		var l RoomLocation
+		m := MealCount{Date: date}
+		if err := rows.Scan(&l.BuildingID, &l.BuildingName, &l.FloorID, &l.FloorName,
+			&m.Residents, &m.Breakfast, &m.Lunch, &m.Dinner, &m.GuestBreakfast, &m.GuestLunch, &m.GuestDinner, &m.Overnight, &m.OvernightPending); err != nil {
+			log.Printf("Failed to scan meal count: %v", err)
+			continue
+		}
+		m.addGuests()
+		m.Label = l.FloorLabel()
+		counts = append(counts, m)
+	}
+
+	return counts, nil
+}
+
+// createRollCallsTable は当直が記録した点呼の結果と帰寮時刻のテーブルを作成します
+// 外泊・欠食記録とは別に保存し、点呼をとっただけで記録を登録したことにならないようにします
+func createRollCallsTable(db *sql.DB) error {
+	const createTableSQL = `
+	CREATE TABLE IF NOT EXISTS roll_calls (
+		student_id VARCHAR(50) NOT NULL,
+		roll_date DATE NOT NULL,
+		roll_call BOOLEAN NOT NULL DEFAULT FALSE,
+		actual_arrival TIMESTAMP WITH TIME ZONE,
+		updated_by VARCHAR(50),
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (student_id, roll_date)
+	);
+	-- 以前は点呼の結果と帰寮時刻を外泊・欠食記録に保存していたため、点呼の記録に移す
+	-- 点呼・帰寮時刻のためだけに作られた記録 (備考が NULL で、全ての食事を食べ外泊しない) は削除し、未登録に戻す
+	DO $$ BEGIN
+		IF EXISTS (SELECT 1 FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = 'gaihaku_kesshoku_records' AND column_name = 'roll_call') THEN
+			ALTER TABLE gaihaku_kesshoku_records ADD COLUMN IF NOT EXISTS actual_arrival TIMESTAMP WITH TIME ZONE;
+			INSERT INTO roll_calls (student_id, roll_date, roll_call, actual_arrival)
+			SELECT student_id, record_date, roll_call, actual_arrival FROM gaihaku_kesshoku_records
+			WHERE roll_call OR actual_arrival IS NOT NULL
+			ON CONFLICT (student_id, roll_date) DO NOTHING;
+			DELETE FROM gaihaku_kesshoku_records
+			WHERE note IS NULL AND breakfast AND lunch AND dinner AND NOT overnight AND NOT late_return
+				AND destination = '' AND guardian_status = '' AND staff_status = '';
+			ALTER TABLE gaihaku_kesshoku_records DROP COLUMN roll_call, DROP COLUMN actual_arrival;
+		END IF;
+	END $$;`
+
+	_, err := db.Exec(createTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to execute SQL: %w", err)
+	}
+
+	return nil
+}
+
+// rollCallJoinSQL は寮生 (u) の dateExpr の日の点呼の記録 (rc) を結合するSQLです
+func rollCallJoinSQL(dateExpr string) string {
+	return `
+	LEFT JOIN roll_calls rc ON rc.student_id = u.username AND rc.roll_date = ` + dateExpr
+}
+
+// saveRollCall は寮生の date の夜の点呼結果を保存します
+// arrivalPosted が false の場合は、受付端末などで記録した帰寮時刻をそのまま残します
+func saveRollCall(ex execer, studentID string, date time.Time, rollCall bool, actualArrival sql.NullTime, arrivalPosted bool, updatedBy string) error {
+	_, err := ex.Exec(`INSERT INTO roll_calls (student_id, roll_date, roll_call, actual_arrival, updated_by) VALUES ($1, $2, $3, $4, $6)
+	ON CONFLICT (student_id, roll_date) DO UPDATE SET roll_call = EXCLUDED.roll_call,
+		actual_arrival = CASE WHEN $5 THEN EXCLUDED.actual_arrival ELSE roll_calls.actual_arrival END,
+		updated_by = EXCLUDED.updated_by, updated_at = CURRENT_TIMESTAMP`,
+		studentID, date.Format("2006-01-02"), rollCall, actualArrival, arrivalPosted, updatedBy)
+	if err != nil {
+		return fmt.Errorf("failed to save roll call for %s: %w", studentID, err)
+	}
+	return nil
+}
+
+// recordArrival は寮生の date の夜の帰寮時刻を記録します (記録済みの場合は変更しません)
+func recordArrival(ex execer, studentID string, date, at time.Time, updatedBy string) error {
+	_, err := ex.Exec(`INSERT INTO roll_calls (student_id, roll_date, actual_arrival, updated_by) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (student_id, roll_date) DO UPDATE SET actual_arrival = COALESCE(roll_calls.actual_arrival, EXCLUDED.actual_arrival)`,
+		studentID, date.Format("2006-01-02"), at, updatedBy)
+	if err != nil {
+		return fmt.Errorf("failed to record arrival: %w", err)
+	}
+	return nil
+}
+
+// getRollCalls は寮生の from から to までの点呼の記録を日付ごとに取得します
+func getRollCalls(db *sql.DB, studentID string, from, to time.Time) (map[string]RollCallRecord, error) {
+	rows, err := db.Query(`
+	SELECT roll_date, roll_call, actual_arrival FROM roll_calls
+	WHERE student_id = $1 AND roll_date BETWEEN $2 AND $3`, studentID, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query roll calls: %w", err)
+	}
+	defer rows.Close()
+
+	rollCalls := make(map[string]RollCallRecord)
+	for rows.Next() {
+		rc := RollCallRecord{StudentID: studentID}
+		var actualArrival sql.NullTime
+		if err := rows.Scan(&rc.Date, &rc.RollCall, &actualArrival); err != nil {
+			log.Printf("Failed to scan roll call: %v", err)
+			continue
+		}
+		if actualArrival.Valid {
+			rc.ActualArrival = &actualArrival.Time
+		}
+		rollCalls[rc.Date.Format("2006-01-02")] = rc
+	}
+	return rollCalls, nil
+}
+
+// getRollCallEntries は指定日の寮生ごとの外泊・点呼の状況を、棟・フロア・部屋の順に取得します
+func getRollCallEntries(db *sql.DB, date time.Time, filter LocationFilter) ([]RollCallEntry, error) {
+	args := []interface{}{date.Format("2006-01-02")}
+	query := `
+	SELECT u.username, ` + userNameSQL + `, ` + locationColumnsSQL + `,
+		COALESCE(r.overnight, FALSE), COALESCE(rc.roll_call, FALSE), COALESCE(r.note, ''),
+		COALESCE(r.destination, ''), COALESCE(r.stay_phone, ''), r.expected_return,
+		COALESCE(ec.name, ''), COALESCE(ec.phone, ''), COALESCE(r.guardian_status, ''), COALESCE(r.staff_status, ''),
+		COALESCE(r.late_return, FALSE), r.expected_arrival, rc.actual_arrival
+	FROM users u ` + locationJoinSQL("$1::date") + `
+	LEFT JOIN gaihaku_kesshoku_records r ON r.student_id = u.username AND r.record_date = $1::date` + rollCallJoinSQL("$1::date") + primaryContactJoinSQL + `
+	WHERE ` + residentRoleCondition + filter.where(&args) + `
+	ORDER BY ` + locationOrderSQL + `, u.username ASC`
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query roll call: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []RollCallEntry
+	for rows.Next() {
+		var e RollCallEntry
+		var expectedReturn, expectedArrival, actualArrival sql.NullTime
+		dest := append([]interface{}{&e.StudentID, &e.Name}, locationScanDest(&e.Location)...)
+		dest = append(dest, &e.Overnight, &e.RollCall, &e.Note,
+			&e.Destination, &e.StayPhone, &expectedReturn, &e.ContactName, &e.ContactPhone, &e.GuardianStatus, &e.StaffStatus,
+			&e.LateReturn, &expectedArrival, &actualArrival)
+		if err := rows.Scan(dest...); err != nil {
+			log.Printf("Failed to scan roll call entry: %v", err)
+			continue
+		}
+		if expectedReturn.Valid {
+			e.ExpectedReturn = &expectedReturn.Time
+		}
+		if expectedArrival.Valid {
+			e.ExpectedArrival = &expectedArrival.Time
+		}
+		if actualArrival.Valid {
+			e.ActualArrival = &actualArrival.Time
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// rollCallEntryLocation は点呼リストをフロアごとにまとめるときの場所を返します
+func rollCallEntryLocation(e RollCallEntry) RoomLocation {
+	return e.Location
+}
+
+// kitchenHandler は厨房向けに今日から1週間分の食数と、選択した日の棟・フロア別の食数を表示します
+func kitchenHandler(c echo.Context) error {
+	today := time.Now()
+	filter := parseLocationFilter(c)
+	counts, err := getMealCounts(db, today, 7, filter)
+	if err != nil {
+		log.Printf("Failed to get meal counts: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to retrieve meal counts.")
+	}
+
+	date := today
+	if d, err := time.ParseInLocation("2006-01-02", c.QueryParam("date"), time.Local); err == nil {
+		date = d
+	}
+	floorCounts, err := getMealCountsByFloor(db, date)
+	if err != nil {
+		log.Printf("Failed to get meal counts by floor: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to retrieve meal counts.")
+	}
+
+	floors, err := getFloors(db)
+	if err != nil {
+		log.Printf("Failed to get floors: %v", err)
+	}
+
+	calendar, err := getDormCalendar(db, today, today.AddDate(0, 0, 6))
+	if err != nil {
+		log.Printf("Failed to get dorm calendar: %v", err)
+	}
+	dateCalendar, err := getDormCalendar(db, date, date)
+	if err != nil {
+		log.Printf("Failed to get dorm calendar: %v", err)
+	}
+
+	// 指定日の食数を、食事制限の種類別に分けて表示する
+	var dateTotal MealCount
+	for _, m := range floorCounts {
+		dateTotal.Breakfast += m.Breakfast
+		dateTotal.Lunch += m.Lunch
+		dateTotal.Dinner += m.Dinner
+	}
+	dietaryEaters, err := getDietaryEaters(db, date)
+	if err != nil {
+		log.Printf("Failed to get dietary requirements: %v", err)
+	}
+
+	forecasts, err := getMealForecast(db, today, forecastDays, filter)
+	if err != nil {
+		log.Printf("Failed to get meal forecast: %v", err)
+	}
+
+	return c.Render(http.StatusOK, "kitchen.html", map[string]interface{}{
+		"counts":        counts,
+		"forecasts":     forecasts,
+		"floorCounts":   floorCounts,
+		"dietCounts":    countDiets(dateTotal, dietaryEaters),
+		"dietaryEaters": dietaryEaters,
+		"date":          date,
+		"day":           dateCalendar[date.Format("2006-01-02")],
+		"calendar":      calendar,
+		"floors":        floors,
+		"filter":        filter,
+	})
+}
+
+// rollCallHandler は当直向けに今夜の点呼リストを棟・フロアごとに表示します
+// 日付が変わった後 (正午まで) は前日の夜の点呼リストを表示します
+func rollCallHandler(c echo.Context) error {
+	date := nightOf(time.Now())
+	filter := parseLocationFilter(c)
+	entries, err := getRollCallEntries(db, date, filter)
+	if err != nil {
+		log.Printf("Failed to get roll call entries: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to retrieve roll call.")
+	}
+
+	floors, err := getFloors(db)
+	if err != nil {
+		log.Printf("Failed to get floors: %v", err)
+	}
+
+	return c.Render(http.StatusOK, "rollcall.html", map[string]interface{}{
+		"date":           date,
+		"curfewAt":       curfewOn(date, getCurfew(db)),
+		"groups":         groupByFloor(entries, rollCallEntryLocation),
+		"floors":         floors,
+		"filter":         filter,
+		"successMessage": popFlash(c, "rollcall_success"),
+	})
+}
+
+// errInvalidArrival は点呼の帰寮時刻の入力が正しくない場合のエラーです
+var errInvalidArrival = errors.New("invalid arrival time")
+
+// saveRollCalls は date の夜の点呼結果と、門限後に帰寮した寮生の帰寮時刻をフォームから保存します
+// 寮生 (date の夜の居住者) でない学籍番号が含まれる場合は何も保存せず、その学籍番号を返します
+func saveRollCalls(db *sql.DB, form url.Values, date time.Time, updatedBy string) ([]string, error) {
+	studentIDs := form["students"]
+	_, unknown, err := resolveBulkStudents(db, studentIDs, 0, 0, date)
+	if err != nil {
+		return nil, err
+	}
+	if len(unknown) > 0 {
+		return unknown, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, studentID := range studentIDs {
+		rollCall := form.Get("rollcall-"+studentID) == "on"
+		// 帰寮時刻の欄がない (外泊者は無効にしている) 場合は、受付端末などで記録した帰寮時刻をそのまま残す
+		// 欄を空にして送った場合のみ帰寮時刻を消す
+		_, arrivalPosted := form["arrival-"+studentID]
+		var actualArrival sql.NullTime
+		if arrival := form.Get("arrival-" + studentID); arrival != "" {
+			t, err := clockOn(date, arrival)
+			if err != nil {
+				return nil, errInvalidArrival
+			}
+			actualArrival = sql.NullTime{Time: t, Valid: true}
+		}
+		if err := saveRollCall(tx, studentID, date, rollCall, actualArrival, arrivalPosted, updatedBy); err != nil {
+			return nil, err
+		}
+	}
+	return nil, tx.Commit()
+}
+
+// rollCallUpdateHandler は今夜の点呼結果と、門限後に帰寮した寮生の帰寮時刻を保存します
+// 日付が変わった後 (正午まで) は前日の夜の点呼として保存します
+// 寮生 (有効な居住者) でない学籍番号が含まれる場合は何も保存しません
+func rollCallUpdateHandler(c echo.Context) error {
+	formValues, err := c.FormParams()
+	if err != nil {
+		log.Printf("Failed to parse form data for roll call: %v", err)
+		return c.String(http.StatusBadRequest, "Invalid form data.")
+	}
+
+	date := nightOf(time.Now())
+	user := currentUser(c)
+	unknown, err := saveRollCalls(db, formValues, date, user.Username)
+	if errors.Is(err, errInvalidArrival) {
+		return c.String(http.StatusBadRequest, "Invalid arrival time.")
+	}
+	if err != nil {
+		log.Printf("Failed to save roll call: %v", err)
+		return c.String(http.StatusInternalServerError, "Failed to save roll call.")
+	}
+	if len(unknown) > 0 {
+		log.Printf("Rejected roll call with unknown students %v", unknown)
+		return c.String(http.StatusBadRequest, "Unknown student.")
+	}
+	log.Printf("Roll call for %s saved by %s", date.Format("2006-01-02"), user.Username)
+
+	return redirectWithFlash(c, "/rollcall", time.Now().Format("[15:04]")+" 点呼結果を保存しました。", true, "rollcall_success", "rollcall_error")
+}
+
+// overnightStatusHandler は今夜の外泊状況を閲覧専用で表示します
+// 全寮生の記録を閲覧できないユーザー (寮長・階長) には、自分のフロアのみを表示します
+func overnightStatusHandler(c echo.Context) error {
+	today := time.Now()
+	user := currentUser(c)
+	filter := parseLocationFilter(c)
+
+	var ownFloor RoomLocation
+	if !user.Can(PermRecordsReadAll) {
+		loc, err := getCurrentLocation(db, user.Username, today)
+		if err != nil {
+			log.Printf("Failed to get location of %s: %v", user.Username, err)
+			return c.String(http.StatusInternalServerError, "Failed to retrieve overnight status.")
+		}
+		ownFloor = loc
+		filter = LocationFilter{FloorID: loc.FloorID}
+	}
+
+	var entries []RollCallEntry
+	if user.Can(PermRecordsReadAll) || filter.FloorID > 0 {
+		var err error
+		entries, err = getRollCallEntries(db, today, filter)
+		if err != nil {
+			log.Printf("Failed to get overnight status: %v", err)
+			return c.String(http.StatusInternalServerError, "Failed to retrieve overnight status.")
+		}
+	}
+
+	var floors []Floor
+	if user.Can(PermRecordsReadAll) {
+		var err error
+		floors, err = getFloors(db)
+		if err != nil {
+			log.Printf("Failed to get floors: %v", err)
+		}
+	}
+
+	return c.Render(http.StatusOK, "overnight.html", map[string]interface{}{
+		"date":     today,
+		"curfewAt": curfewOn(today, getCurfew(db)),
+		"groups":   groupByFloor(entries, rollCallEntryLocation),
+		"floors":   floors,
+		"filter":   filter,
+		"ownFloor": ownFloor,
+	})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// serveAs は user としてログインした状態で handler にリクエストを送ります (フラッシュ用のセッションはメモリ上に保存します)
+func serveAs(t *testing.T, handler echo.HandlerFunc, user *User, method, target string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	prev := sessionStore
+	sessionStore = NewServerSessionStore(newMemorySessionBackend(), []byte("test-secret"), time.Hour, 24*time.Hour)
+	t.Cleanup(func() { sessionStore = prev })
+
+	var body *strings.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+	req := httptest.NewRequest(method, target, body)
+	if form != nil {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	}
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.Set(contextUserKey, user)
+	if err := session.Middleware(sessionStore)(handler)(c); err != nil {
+		t.Fatalf("%s %s: %v", method, target, err)
+	}
+	return rec
+}
+
+func TestRollCallUpdateKeepsResidentsUnregistered(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, `INSERT INTO users (username, password, role, active) VALUES
+		('s1', 'x', 'user', TRUE), ('s2', 'x', 'user', TRUE), ('gone', 'x', 'user', FALSE), ('k1', 'x', 'kitchen', TRUE)`)
+	staff := &User{Username: "n1", Role: RoleNightDuty, Active: true}
+
+	form := url.Values{"students": {"s1", "s2"}, "rollcall-s1": {"on"}}
+	if rec := serveAs(t, rollCallUpdateHandler, staff, http.MethodPost, "/rollcall", form); rec.Code != http.StatusSeeOther {
+		t.Fatalf("roll call: status %d, body %q", rec.Code, rec.Body.String())
+	}
+
+	var rollCalls, records int
+	db.QueryRow(`SELECT COUNT(*) FILTER (WHERE roll_call) FROM roll_calls`).Scan(&rollCalls)
+	db.QueryRow(`SELECT COUNT(*) FROM gaihaku_kesshoku_records`).Scan(&records)
+	if rollCalls != 1 || records != 0 {
+		t.Errorf("after roll call: %d roll calls, %d meal records; want 1 and 0", rollCalls, records)
+	}
+
+	// 点呼をとっても、記録のない寮生として数える
+	overviews, err := getDayOverviews(db, time.Now(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o := overviews[0]; o.Unregistered != 2 || o.RollCalled != 1 {
+		t.Errorf("overview: unregistered=%d roll called=%d, want 2 and 1", o.Unregistered, o.RollCalled)
+	}
+}
+
+func TestRollCallUpdateRejectsNonResidents(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, `INSERT INTO users (username, password, role, active) VALUES
+		('s1', 'x', 'user', TRUE), ('gone', 'x', 'user', FALSE), ('k1', 'x', 'kitchen', TRUE)`)
+	staff := &User{Username: "n1", Role: RoleNightDuty, Active: true}
+
+	for _, id := range []string{"gone", "k1", "nobody"} {
+		form := url.Values{"students": {"s1", id}, "rollcall-s1": {"on"}, "rollcall-" + id: {"on"}}
+		if rec := serveAs(t, rollCallUpdateHandler, staff, http.MethodPost, "/rollcall", form); rec.Code != http.StatusBadRequest {
+			t.Errorf("roll call with %s: status %d, want %d", id, rec.Code, http.StatusBadRequest)
+		}
+	}
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM roll_calls`).Scan(&n)
+	if n != 0 {
+		t.Errorf("rejected roll calls saved %d rows, want 0", n)
+	}
+}
+
+func TestRollCallUpdateArrivalField(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, `INSERT INTO users (username, password, role, active) VALUES ('s1', 'x', 'user', TRUE)`)
+	staff := &User{Username: "n1", Role: RoleNightDuty, Active: true}
+	now := nightOf(time.Now())
+	arrival := func() sql.NullTime {
+		t.Helper()
+		var at sql.NullTime
+		if err := db.QueryRow(`SELECT actual_arrival FROM roll_calls WHERE student_id = 's1'`).Scan(&at); err != nil {
+			t.Fatal(err)
+		}
+		return at
+	}
+
+	// 受付端末で記録した帰寮時刻は、帰寮時刻の欄のない送信では消さない
+	kiosk := time.Date(now.Year(), now.Month(), now.Day(), 23, 10, 0, 0, time.Local)
+	if err := recordArrival(db, "s1", now, kiosk, "kiosk"); err != nil {
+		t.Fatal(err)
+	}
+	serveAs(t, rollCallUpdateHandler, staff, http.MethodPost, "/rollcall", url.Values{"students": {"s1"}, "rollcall-s1": {"on"}})
+	if at := arrival(); !at.Valid || !at.Time.Equal(kiosk) {
+		t.Errorf("arrival after roll call without the field = %v, want %v", at, kiosk)
+	}
+
+	// 当直が入力した時刻で上書きし、空欄で送ると消す
+	serveAs(t, rollCallUpdateHandler, staff, http.MethodPost, "/rollcall", url.Values{"students": {"s1"}, "arrival-s1": {"23:45"}})
+	want, _ := clockOn(now, "23:45")
+	if at := arrival(); !at.Valid || !at.Time.Equal(want) {
+		t.Errorf("arrival after entering 23:45 = %v, want %v", at, want)
+	}
+	serveAs(t, rollCallUpdateHandler, staff, http.MethodPost, "/rollcall", url.Values{"students": {"s1"}, "arrival-s1": {""}})
+	if at := arrival(); at.Valid {
+		t.Errorf("arrival after clearing the field = %v, want none", at.Time)
+	}
+
+	// 当直が記録した帰寮時刻は、受付端末の記録で変更しない
+	serveAs(t, rollCallUpdateHandler, staff, http.MethodPost, "/rollcall", url.Values{"students": {"s1"}, "arrival-s1": {"23:45"}})
+	if err := recordArrival(db, "s1", now, kiosk, "kiosk"); err != nil {
+		t.Fatal(err)
+	}
+	if at := arrival(); !at.Valid || !at.Time.Equal(want) {
+		t.Errorf("arrival after a later kiosk scan = %v, want %v", at, want)
+	}
+}
+
+func TestSaveRollCallsAfterMidnight(t *testing.T) {
+	db := openTestDB(t)
+	createTestRooms(t)
+	mustExec(t, db, `INSERT INTO users (username, password, role, active) VALUES
+		('s1', 'x', 'user', TRUE), ('s2', 'x', 'user', TRUE), ('moved', 'x', 'user', TRUE)`)
+	// 4/11 に退寮した寮生も、4/10 の夜の点呼の対象
+	mustExec(t, db, `INSERT INTO room_assignments (student_id, room_id, start_date, end_date) VALUES ('moved', 1, '2024-04-01', '2024-04-11')`)
+
+	// 日付が変わった後の点呼は、前日の夜の点呼として保存する
+	date := nightOf(time.Date(2024, 4, 11, 1, 30, 0, 0, time.Local))
+	form := url.Values{"students": {"s1", "s2", "moved"}, "rollcall-s1": {"on"}, "rollcall-moved": {"on"}, "arrival-s2": {"00:20"}}
+	unknown, err := saveRollCalls(db, form, date, "n1")
+	if err != nil || len(unknown) > 0 {
+		t.Fatalf("save roll calls: unknown = %v, err = %v", unknown, err)
+	}
+
+	var days []string
+	rows, err := db.Query(`SELECT DISTINCT to_char(roll_date, 'YYYY-MM-DD') FROM roll_calls`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var d string
+		rows.Scan(&d)
+		days = append(days, d)
+	}
+	rows.Close()
+	if len(days) != 1 || days[0] != "2024-04-10" {
+		t.Errorf("roll call dates = %v, want [2024-04-10]", days)
+	}
+
+	entries, err := getRollCallEntries(db, date, LocationFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byID := make(map[string]RollCallEntry)
+	for _, e := range entries {
+		byID[e.StudentID] = e
+	}
+	if !byID["s1"].RollCall || !byID["moved"].RollCall {
+		t.Errorf("roll call list of the night = %+v, want s1 and moved roll called", entries)
+	}
+	want := time.Date(2024, 4, 11, 0, 20, 0, 0, time.Local)
+	if at := byID["s2"].ActualArrival; at == nil || !at.Equal(want) {
+		t.Errorf("arrival of s2 = %v, want %v", at, want)
+	}
+
+	if _, err := saveRollCalls(db, url.Values{"students": {"s1"}, "arrival-s1": {"25:00"}}, date, "n1"); !errors.Is(err, errInvalidArrival) {
+		t.Errorf("invalid arrival: err = %v, want errInvalidArrival", err)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// isPastDate は date が now の日付より前の日かを返します
+func isPastDate(date, now time.Time) bool {
+	return date.Format("2006-01-02") < now.Format("2006-01-02")
+}
+
+// getStudentMonth は寮生の month の月の記録を、点呼・帰寮時刻とその日の変更履歴とともに1日ずつ取得します
+func getStudentMonth(db *sql.DB, studentID string, month time.Time) ([]StudentDay, error) {
+	from := month
+	to := month.AddDate(0, 1, -1)
+	rows, err := db.Query(`
+	SELECT record_date, breakfast, lunch, dinner, overnight, COALESCE(note, ''), destination, stay_phone, expected_return,
+		guardian_status, staff_status, staff_comment, late_return, expected_arrival
+	FROM gaihaku_kesshoku_records
+	WHERE student_id = $1 AND record_date BETWEEN $2 AND $3`, studentID, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query records of month: %w", err)
+	}
+	defer rows.Close()
+
+	registered := make(map[string]StudentDay)
+	for rows.Next() {
+		d := StudentDay{Registered: true}
+		r := &d.Record
+		var expectedReturn, expectedArrival sql.NullTime
+		if err := rows.Scan(&r.RecordDate, &r.Breakfast, &r.Lunch, &r.Dinner, &r.Overnight, &r.Note,
+			&r.Destination, &r.StayPhone, &expectedReturn, &r.GuardianStatus, &r.StaffStatus, &r.StaffComment,
+			&r.LateReturn, &expectedArrival); err != nil {
+			log.Printf("Failed to scan gaihaku record: %v", err)
+			continue
+		}
+		if expectedReturn.Valid {
+			r.ExpectedReturn = &expectedReturn.Time
+		}
+		if expectedArrival.Valid {
+			r.ExpectedArrival = &expectedArrival.Time
+		}
+		registered[r.RecordDate.Format("2006-01-02")] = d
+	}
+
+	calendar, err := getDormCalendar(db, from, to)
+	if err != nil {
+		log.Printf("Failed to get dorm calendar: %v", err)
+	}
+	history, err := getRecordHistoryByDate(db, studentID, from, to)
+	if err != nil {
+		log.Printf("Failed to get record history for %s: %v", studentID, err)
+	}
+	rollCalls, err := getRollCalls(db, studentID, from, to)
+	if err != nil {
+		log.Printf("Failed to get roll calls for %s: %v", studentID, err)
+	}
+
+	now := time.Now()
+	var days []StudentDay
+	for date := from; !date.After(to); date = date.AddDate(0, 0, 1) {
+		key := date.Format("2006-01-02")
+		d, ok := registered[key]
+		if !ok {
+			d.Record = GaihakuKesshokuRecord{Breakfast: true, Lunch: true, Dinner: true}
+			calendar[key].apply(&d.Record)
+		}
+		d.Date = date
+		d.Record.StudentID, d.Record.RecordDate = studentID, date
+		d.Day = calendar[key]
+		d.History = history[key]
+		d.RollCall, d.ActualArrival = rollCalls[key].RollCall, rollCalls[key].ActualArrival
+		d.Past = isPastDate(date, now)
+		days = append(days, d)
+	}
+	return days, nil
+}
+
+// calendarWeeks は1か月分の日を日曜始まりの週に分けます。月の前後の空いた日はゼロ値で埋めます
+func calendarWeeks(days []StudentDay) [][]StudentDay {
+	if len(days) == 0 {
+		return nil
+	}
+	week := make([]StudentDay, int(days[0].Date.Weekday()), 7)
+	var weeks [][]StudentDay
+	for _, d := range days {
+		week = append(week, d)
+		if len(week) == 7 {
+			weeks = append(weeks, week)
+			week = make([]StudentDay, 0, 7)
+		}
+	}
+	if len(week) > 0 {
+		weeks = append(weeks, append(week, make([]StudentDay, 7-len(week))...))
+	}
+	return weeks
+}
+
+// studentCalendarPath は寮生の月のカレンダーで日 date を選んだページのパスです
+func studentCalendarPath(studentID string, date time.Time, unlock bool) string {
+	v := url.Values{}
+	v.Set("month", date.Format(monthLayout))
+	v.Set("date", date.Format("2006-01-02"))
+	if unlock {
+		v.Set("unlock", "1")
+	}
+	return "/admin/user/" + studentID + "/calendar?" + v.Encode()
+}
+
+// adminUserCalendarHandler は寮生の記録を月のカレンダーで表示します
+// 日を選ぶと、その日の記録と変更履歴を表示します。今日以降の日は編集でき、過去の日は編集のロックを解除した場合のみ編集できます
+func adminUserCalendarHandler(c echo.Context) error {
+	studentID := c.Param("student_id")
+	user, err := getUserByUsername(db, studentID)
+	if err != nil {
+		log.Printf("Failed to get user %s by admin: %v", studentID, err)
+		return c.String(http.StatusNotFound, "User not found.")
+	}
+
+	month := parseBillingMonth(c)
+	days, err := getStudentMonth(db, studentID, month)
+	if err != nil {
+		log.Printf("Failed to get records of %s for %s: %v", studentID, month.Format(monthLayout), err)
+		return c.String(http.StatusInternalServerError, "Failed to retrieve records.")
+	}
+
+	canEdit := currentUser(c).Can(PermRecordsWriteAll)
+	unlocked := canEdit && c.QueryParam("unlock") == "1"
+	var selected *StudentDay
+	if date, err := time.ParseInLocation("2006-01-02", c.QueryParam("date"), time.Local); err == nil {
+		for i := range days {
+			if days[i].Date.Equal(date) {
+				selected = &days[i]
+			}
+		}
+	}
+	if selected != nil && selected.Past && unlocked {
+		log.Printf("Past record of %s on %s unlocked by %s", studentID, selected.Date.Format("2006-01-02"), currentUser(c).Username)
+	}
+
+	return c.Render(http.StatusOK, "admin_user_calendar.html", map[string]interface{}{
+		"studentID":      studentID,
+		"user":           user,
+		"month":          month,
+		"prevMonth":      month.AddDate(0, -1, 0),
+		"nextMonth":      month.AddDate(0, 1, 0),
+		"weeks":          calendarWeeks(days),
+		"selected":       selected,
+		"canEdit":        canEdit,
+		"unlocked":       unlocked,
+		"editable":       selected != nil && canEdit && (!selected.Past || unlocked),
+		"curfew":         getCurfew(db),
+		"today":          time.Now(),
+		"successMessage": popFlash(c, "calendar_record_success"),
+		"errorMessage":   popFlash(c, "calendar_record_error"),
+	})
+}
+
+// adminSaveUserCalendarDayHandler は寮生の月のカレンダーで選んだ日の記録を保存します
+// 過去の日の記録は、編集のロックを解除して変更を確認した場合のみ保存し、変更履歴に過去の記録の修正として残します
+func adminSaveUserCalendarDayHandler(c echo.Context) error {
+	studentID := c.Param("student_id")
+	date, err := time.ParseInLocation("2006-01-02", c.FormValue("date"), time.Local)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid date.")
+	}
+	if _, err := getUserByUsername(db, studentID); err != nil {
+		log.Printf("Failed to get user %s by admin: %v", studentID, err)
+		return c.String(http.StatusNotFound, "User not found.")
+	}
+
+	past := isPastDate(date, time.Now())
+	path := studentCalendarPath(studentID, date, past)
+	action := HistoryAdmin
+	if past {
+		if c.FormValue("unlock") != "1" || c.FormValue("confirm_past") != "on" {
+			return redirectWithFlash(c, path, "過去の日の記録を変更するには、編集のロックを解除して変更の確認にチェックしてください。", false, "calendar_record_success", "calendar_record_error")
+		}
+		action = HistoryAdminPast
+	}
+
+	form, err := c.FormParams()
+	if err != nil {
+		log.Printf("Failed to parse form data for calendar update: %v", err)
+		return c.String(http.StatusBadRequest, "Invalid form data.")
+	}
+	rules := loadRecordRules(db, date, 1)
+	// カレンダーの食事の欄は、チェックが喫食を表す
+	r := readRecordForm(form, studentID, date, true)
+	rules.Calendar[date.Format("2006-01-02")].apply(&r)
+	if message := validateRecord(&r, rules.Curfew); message != "" {
+		return redirectWithFlash(c, path, message, false, "calendar_record_success", "calendar_record_error")
+	}
+	if _, err := saveRecords(db, []GaihakuKesshokuRecord{r}, action, currentUser(c).Username, false, nil); err != nil {
+		log.Printf("Failed to save record of %s on %s by admin: %v", studentID, date.Format("2006-01-02"), err)
+		return c.String(http.StatusInternalServerError, "Failed to submit record.")
+	}
+	if past {
+		log.Printf("Past record of %s on %s changed by %s", studentID, date.Format("2006-01-02"), currentUser(c).Username)
+	}
+
+	return redirectWithFlash(c, studentCalendarPath(studentID, date, false), date.Format("01/02")+" の記録を保存しました。", true, "calendar_record_success", "calendar_record_error")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestIsPastDate(t *testing.T) {
+	now := time.Date(2024, 4, 10, 0, 30, 0, 0, time.Local)
+	if !isPastDate(time.Date(2024, 4, 9, 23, 59, 0, 0, time.Local), now) {
+		t.Error("yesterday should be past")
+	}
+	if isPastDate(time.Date(2024, 4, 10, 0, 0, 0, 0, time.Local), now) {
+		t.Error("today should not be past")
+	}
+}
+
+func TestAdminSaveUserCalendarDayRequiresUnlockForPastDates(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, `INSERT INTO users (username, password, role, active) VALUES ('s1', 'x', 'user', TRUE)`)
+	admin := &User{Username: "admin", Role: RoleAdmin, Active: true}
+	save := func(c echo.Context) error {
+		c.SetParamNames("student_id")
+		c.SetParamValues("s1")
+		return adminSaveUserCalendarDayHandler(c)
+	}
+	history := func(date time.Time) []string {
+		t.Helper()
+		rows, err := db.Query(`SELECT action FROM record_history WHERE student_id = 's1' AND record_date = $1 ORDER BY id`, date.Format("2006-01-02"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var actions []string
+		for rows.Next() {
+			var a string
+			rows.Scan(&a)
+			actions = append(actions, a)
+		}
+		return actions
+	}
+
+	// 食事の欄にチェックがない送信は欠食の登録になる
+	yesterday := time.Now().AddDate(0, 0, -1)
+	date := yesterday.Format("2006-01-02")
+	for _, form := range []url.Values{
+		{"date": {date}},
+		{"date": {date}, "unlock": {"1"}},
+		{"date": {date}, "confirm_past": {"on"}},
+	} {
+		rec := serveAs(t, save, admin, http.MethodPost, "/admin/user/s1/calendar", form)
+		if rec.Code != http.StatusSeeOther || !strings.Contains(rec.Header().Get("Location"), "unlock=1") {
+			t.Errorf("past save %v: status %d, location %q; want a redirect back to the unlocked day", form, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+	if actions := history(yesterday); len(actions) != 0 {
+		t.Fatalf("locked past saves changed the record: %v", actions)
+	}
+
+	serveAs(t, save, admin, http.MethodPost, "/admin/user/s1/calendar", url.Values{"date": {date}, "unlock": {"1"}, "confirm_past": {"on"}})
+	if actions := history(yesterday); len(actions) != 1 || actions[0] != HistoryAdminPast {
+		t.Errorf("unlocked past save history = %v, want [%s]", actions, HistoryAdminPast)
+	}
+
+	// 今日以降はロックの解除なしで保存する
+	today := time.Now()
+	serveAs(t, save, admin, http.MethodPost, "/admin/user/s1/calendar", url.Values{"date": {today.Format("2006-01-02")}})
+	if actions := history(today); len(actions) != 1 || actions[0] != HistoryAdmin {
+		t.Errorf("today's save history = %v, want [%s]", actions, HistoryAdmin)
+	}
+}
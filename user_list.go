@@ -0,0 +1,258 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// userListPageSize はユーザー一覧の1ページの件数です
+const userListPageSize = 50
+
+// userSearchSQL はユーザー一覧の検索対象 (学籍番号・氏名・ふりがな) です
+// createUserSearchIndexes の索引と同じ式にしておく必要があります
+const userSearchSQL = `(u.username || ' ' || u.display_name || ' ' || u.furigana)`
+
+// userListSorts はユーザー一覧の並べ替えに使う列です (room は棟・フロアごとに見出しを付けて表示します)
+var userListSorts = map[string][]string{
+	"room":     {"b.name", "f.sort_order", "f.name", "rm.number"},
+	"id":       {"u.id"},
+	"username": {"u.username"},
+	"name":     {"NULLIF(u.furigana, '')", userNameSQL},
+	"grade":    {"NULLIF(u.grade, 0)"},
+	"role":     {"u.role"},
+	"status":   {"u.active"},
+}
+
+// createUserSearchIndexes はユーザー一覧の検索・絞り込みに使う索引を作成します
+// 部分一致の検索には pg_trgm 拡張を使います。拡張を作成できない場合は、索引なしで検索します
+func createUserSearchIndexes(db *sql.DB) error {
+	const createIndexSQL = `
+	CREATE INDEX IF NOT EXISTS users_role_active_idx ON users (role, active);
+	CREATE INDEX IF NOT EXISTS records_date_overnight_idx ON gaihaku_kesshoku_records (record_date) WHERE overnight;`
+	if _, err := db.Exec(createIndexSQL); err != nil {
+		return fmt.Errorf("failed to execute SQL: %w", err)
+	}
+
+	if _, err := db.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm"); err != nil {
+		log.Printf("pg_trgm is not available, user search runs without an index: %v", err)
+		return nil
+	}
+	_, err := db.Exec(`CREATE INDEX IF NOT EXISTS users_search_trgm_idx ON users
+	USING gin ((username || ' ' || display_name || ' ' || furigana) gin_trgm_ops)`)
+	if err != nil {
+		return fmt.Errorf("failed to create user search index: %w", err)
+	}
+	return nil
+}
+
+// UserQuery はユーザー一覧の検索・絞り込み・並べ替えの条件です
+type UserQuery struct {
+	Search       string // 学籍番号・氏名・ふりがなの部分一致、または部屋番号の前方一致
+	Role         string
+	Status       string // "" / "active" / "inactive"
+	Filter       LocationFilter
+	AwayTonight  bool // 今夜外泊する寮生のみ
+	Unregistered bool // 今日の記録がない寮生のみ
+	Sort         string
+	Desc         bool
+	Page         int // 1 から
+}
+
+// parseUserQuery はクエリパラメータからユーザー一覧の条件を読み込みます
+func parseUserQuery(c echo.Context) UserQuery {
+	q := UserQuery{
+		Search:       strings.TrimSpace(c.QueryParam("q")),
+		Role:         c.QueryParam("role"),
+		Status:       c.QueryParam("status"),
+		Filter:       parseLocationFilter(c),
+		AwayTonight:  c.QueryParam("away") == "1",
+		Unregistered: c.QueryParam("unregistered") == "1",
+		Sort:         c.QueryParam("sort"),
+		Desc:         c.QueryParam("desc") == "1",
+	}
+	if _, ok := userListSorts[q.Sort]; !ok {
+		q.Sort = "room"
+	}
+	q.Page, _ = strconv.Atoi(c.QueryParam("page"))
+	if q.Page < 1 {
+		q.Page = 1
+	}
+	return q
+}
+
+// values は条件をクエリパラメータに変換します (既定値は省略します)
+func (q UserQuery) values() url.Values {
+	v := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			v.Set(key, value)
+		}
+	}
+	set("q", q.Search)
+	set("role", q.Role)
+	set("status", q.Status)
+	if q.Filter.BuildingID > 0 {
+		v.Set("building", strconv.Itoa(q.Filter.BuildingID))
+	}
+	if q.Filter.FloorID > 0 {
+		v.Set("floor", strconv.Itoa(q.Filter.FloorID))
+	}
+	if q.AwayTonight {
+		v.Set("away", "1")
+	}
+	if q.Unregistered {
+		v.Set("unregistered", "1")
+	}
+	if q.Sort != "room" {
+		v.Set("sort", q.Sort)
+	}
+	if q.Desc {
+		v.Set("desc", "1")
+	}
+	if q.Page > 1 {
+		v.Set("page", strconv.Itoa(q.Page))
+	}
+	return v
+}
+
+// PageURL は同じ条件で指定ページを表示するURLです
+func (q UserQuery) PageURL(page int) string {
+	q.Page = page
+	return "/admin?" + q.values().Encode()
+}
+
+// SortURL は指定の列で並べ替えるURLです。同じ列を選び直すと昇順・降順を切り替えます
+func (q UserQuery) SortURL(sort string) string {
+	q.Desc = q.Sort == sort && !q.Desc
+	q.Sort, q.Page = sort, 1
+	return "/admin?" + q.values().Encode()
+}
+
+// SortMark は並べ替えに使っている列の見出しに付ける記号を返します
+func (q UserQuery) SortMark(sort string) string {
+	switch {
+	case q.Sort != sort:
+		return ""
+	case q.Desc:
+		return "▼"
+	default:
+		return "▲"
+	}
+}
+
+// Grouped は棟・フロアごとに見出しを付けて表示するか (部屋順で並べているとき) を返します
+func (q UserQuery) Grouped() bool {
+	return q.Sort == "room"
+}
+
+// UserPage はユーザー一覧の1ページ分の結果です
+type UserPage struct {
+	Users []User
+	Total int
+	Page  int
+	Pages int
+}
+
+// HasPrev と HasNext は前後のページがあるかを返します
+func (p UserPage) HasPrev() bool { return p.Page > 1 }
+func (p UserPage) HasNext() bool { return p.Page < p.Pages }
+
+// Prev と Next は前後のページ番号を返します
+func (p UserPage) Prev() int { return max(1, p.Page-1) }
+func (p UserPage) Next() int { return min(p.Pages, p.Page+1) }
+
+// PageNumbers はページ送りに表示するページ番号 (現在のページの前後) を返します
+func (p UserPage) PageNumbers() []int {
+	var pages []int
+	for i := max(1, p.Page-3); i <= min(p.Pages, p.Page+3); i++ {
+		pages = append(pages, i)
+	}
+	return pages
+}
+
+// searchUsers は条件に合うユーザーを現在の部屋・今夜の外泊とともに1ページ分取得します（パスワードを除く）
+// 最後のページより後のページを指定された場合は、最後のページを返します
+func searchUsers(db *sql.DB, q UserQuery, date time.Time) (UserPage, error) {
+	args := []interface{}{date.Format("2006-01-02")}
+	where := q.Filter.where(&args)
+	if q.Search != "" {
+		pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q.Search)
+		args = append(args, "%"+pattern+"%", pattern+"%")
+		where += fmt.Sprintf(" AND (%s ILIKE $%d OR rm.number ILIKE $%d)", userSearchSQL, len(args)-1, len(args))
+	}
+	if q.Role != "" {
+		args = append(args, q.Role)
+		where += fmt.Sprintf(" AND u.role = $%d", len(args))
+	}
+	switch q.Status {
+	case "active":
+		where += " AND u.active"
+	case "inactive":
+		where += " AND NOT u.active"
+	}
+	if q.AwayTonight {
+		where += " AND " + countedOvernightSQL
+	}
+	if q.Unregistered {
+		where += " AND " + residentOnDaySQL("$1::date") + " AND r.student_id IS NULL"
+	}
+
+	dir := " ASC"
+	if q.Desc {
+		dir = " DESC"
+	}
+	var order []string
+	for _, col := range userListSorts[q.Sort] {
+		// 部屋未割り当てや未登録の値は、昇順・降順どちらでも最後に並べる
+		order = append(order, col+dir+" NULLS LAST")
+	}
+	fromWhere := `
+	FROM users u ` + locationJoinSQL("$1::date") + `
+	LEFT JOIN gaihaku_kesshoku_records r ON r.student_id = u.username AND r.record_date = $1::date
+	WHERE TRUE` + where
+	filterArgs := args
+	args = append(args, userListPageSize, (q.Page-1)*userListPageSize)
+	query := `
+	SELECT u.id, u.username, u.role, u.active, ` + profileColumnsSQL + `, ` + locationColumnsSQL + `,
+		COALESCE(` + countedOvernightSQL + `, FALSE), COUNT(*) OVER ()` + fromWhere + `
+	ORDER BY ` + strings.Join(order, ", ") + `, u.id ASC
+	LIMIT $` + strconv.Itoa(len(args)-1) + ` OFFSET $` + strconv.Itoa(len(args))
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return UserPage{}, fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+
+	p := UserPage{Page: q.Page}
+	for rows.Next() {
+		var u User
+		dest := append([]interface{}{&u.ID, &u.Username, &u.Role, &u.Active}, profileScanDest(&u)...)
+		dest = append(dest, locationScanDest(&u.Location)...)
+		dest = append(dest, &u.AwayTonight, &p.Total)
+		if err := rows.Scan(dest...); err != nil {
+			log.Printf("Failed to scan user: %v", err)
+			continue
+		}
+		p.Users = append(p.Users, u)
+	}
+
+	// 最後のページより後のページでは件数が分からないため、数え直して最後のページを表示する
+	if len(p.Users) == 0 && q.Page > 1 {
+		if err := db.QueryRow("SELECT COUNT(*)"+fromWhere, filterArgs...).Scan(&p.Total); err != nil {
+			return UserPage{}, fmt.Errorf("failed to count users: %w", err)
+		}
+		if last := max(1, (p.Total+userListPageSize-1)/userListPageSize); last < q.Page {
+			q.Page = last
+			return searchUsers(db, q, date)
+		}
+	}
+	p.Pages = max(1, (p.Total+userListPageSize-1)/userListPageSize)
+	return p, nil
+}
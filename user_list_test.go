@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestParseUserQueryDefaults(t *testing.T) {
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/admin?sort=password&page=-3&away=1&q=+101+", nil), httptest.NewRecorder())
+	q := parseUserQuery(c)
+	if q.Sort != "room" || q.Page != 1 || !q.AwayTonight || q.Search != "101" {
+		t.Errorf("parsed query = %+v", q)
+	}
+	// 既定値は URL に含めない
+	if got := q.PageURL(2); got != "/admin?away=1&page=2&q=101" {
+		t.Errorf("page URL = %q", got)
+	}
+	if got := q.SortURL("name"); got != "/admin?away=1&q=101&sort=name" {
+		t.Errorf("sort URL = %q", got)
+	}
+}
+
+func TestSearchUsersFilters(t *testing.T) {
+	db := openTestDB(t)
+	createTestRooms(t)
+	mustExec(t, db, `INSERT INTO floors (building_id, name) VALUES (1, '2F')`)
+	mustExec(t, db, `INSERT INTO rooms (floor_id, number, capacity) VALUES (2, '201', 2)`)
+	mustExec(t, db, `INSERT INTO users (username, password, role, active, display_name, furigana) VALUES
+		('s1', 'x', 'user', TRUE, '山田 太郎', 'やまだ たろう'),
+		('s2', 'x', 'user', TRUE, '佐藤 花子', 'さとう はなこ'),
+		('s3', 'x', 'floor_leader', TRUE, '山本 100%', 'やまもと'),
+		('old', 'x', 'user', FALSE, '田中 一郎', 'たなか いちろう'),
+		('k1', 'x', 'kitchen', TRUE, '厨房', 'ちゅうぼう')`)
+	mustExec(t, db, `INSERT INTO room_assignments (student_id, room_id, start_date) VALUES
+		('s1', 1, CURRENT_DATE - 1), ('s2', 2, CURRENT_DATE - 1), ('s3', 3, CURRENT_DATE - 1)`)
+	mustExec(t, db, `INSERT INTO gaihaku_kesshoku_records (student_id, record_date, overnight, staff_status) VALUES
+		('s1', CURRENT_DATE, TRUE, 'approved'),
+		('s2', CURRENT_DATE, TRUE, 'pending')`)
+
+	tests := []struct {
+		name  string
+		query UserQuery
+		want  []string
+	}{
+		{"all", UserQuery{}, []string{"k1", "old", "s1", "s2", "s3"}},
+		{"name", UserQuery{Search: "山"}, []string{"s1", "s3"}},
+		{"furigana", UserQuery{Search: "はなこ"}, []string{"s2"}},
+		{"username", UserQuery{Search: "OLD"}, []string{"old"}},
+		{"literal percent", UserQuery{Search: "%"}, []string{"s3"}},
+		{"room prefix", UserQuery{Search: "10"}, []string{"s1", "s2", "s3"}},
+		{"room number", UserQuery{Search: "201"}, []string{"s3"}},
+		{"role", UserQuery{Role: RoleFloorLeader}, []string{"s3"}},
+		{"active", UserQuery{Status: "active"}, []string{"k1", "s1", "s2", "s3"}},
+		{"inactive", UserQuery{Status: "inactive"}, []string{"old"}},
+		{"floor", UserQuery{Filter: LocationFilter{FloorID: 1}}, []string{"s1", "s2"}},
+		{"away tonight", UserQuery{AwayTonight: true}, []string{"s1"}},
+		{"unregistered", UserQuery{Unregistered: true}, []string{"s3"}},
+		{"combined", UserQuery{Search: "山", Filter: LocationFilter{FloorID: 1}}, []string{"s1"}},
+	}
+	for _, tt := range tests {
+		tt.query.Sort, tt.query.Page = "username", 1
+		p, err := searchUsers(db, tt.query, time.Now())
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var got []string
+		for _, u := range p.Users {
+			got = append(got, u.Username)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) || p.Total != len(tt.want) {
+			t.Errorf("%s: users = %v (total %d), want %v", tt.name, got, p.Total, tt.want)
+		}
+	}
+}
+
+func TestSearchUsersClampsPage(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, `INSERT INTO users (username, password, role, active)
+		SELECT 's' || lpad(i::text, 3, '0'), 'x', 'user', TRUE FROM generate_series(1, $1::int + 5) i`, userListPageSize)
+
+	p, err := searchUsers(db, UserQuery{Sort: "username", Page: 2}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Page != 2 || p.Pages != 2 || len(p.Users) != 5 || p.Total != userListPageSize+5 {
+		t.Errorf("page 2: page=%d pages=%d users=%d total=%d", p.Page, p.Pages, len(p.Users), p.Total)
+	}
+
+	// 最後のページより後のページは、最後のページを返す
+	p, err = searchUsers(db, UserQuery{Sort: "username", Page: 9}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Page != 2 || p.Pages != 2 || len(p.Users) != 5 || p.Users[0].Username != "s051" {
+		t.Errorf("page 9: page=%d pages=%d users=%d", p.Page, p.Pages, len(p.Users))
+	}
+
+	// 結果がない場合は1ページ目 (空) を返す
+	p, err = searchUsers(db, UserQuery{Sort: "username", Search: "nobody", Page: 3}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Page != 1 || p.Pages != 1 || len(p.Users) != 0 {
+		t.Errorf("empty result page 3: page=%d pages=%d users=%d", p.Page, p.Pages, len(p.Users))
+	}
+}